@@ -0,0 +1,238 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle creates ProofBundles for releases which have been logged.
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/mod/sumdb/note"
+)
+
+type options struct {
+	initialDelay time.Duration
+	pollInterval time.Duration
+	deviceSize   uint64
+	proofs       bool
+	stateFile    string
+}
+
+// Option configures how a ProofBundle is built.
+type Option func(*options)
+
+// WithInitialDelay sets how long to wait before first checking whether the release
+// has been integrated into the log. The default is not to wait.
+func WithInitialDelay(d time.Duration) Option {
+	return func(o *options) {
+		o.initialDelay = d
+	}
+}
+
+// WithPollInterval sets the interval at which the log is polled while waiting for
+// the release to be integrated. The default is 5 seconds.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// WithDeviceCheckpointSize builds the bundle for a device which already holds a
+// checkpoint of the given size. The leaf hashes covered by that checkpoint are
+// replaced in the bundle by their compact range, making it much smaller.
+func WithDeviceCheckpointSize(size uint64) Option {
+	return func(o *options) {
+		o.deviceSize = size
+	}
+}
+
+// WithProofs builds the bundle for the device checkpoint set by
+// WithDeviceCheckpointSize with an inclusion proof for the release and a
+// consistency proof from the device's checkpoint, rather than with leaf hashes.
+// Such a bundle is smaller still, and cheaper for the device to verify, but can only
+// be verified by a device holding a checkpoint of exactly that size.
+func WithProofs() Option {
+	return func(o *options) {
+		o.proofs = true
+	}
+}
+
+// WithStateFile persists the progress of waiting for the release to be integrated
+// to the named file, so that if the wait is interrupted it can be resumed by a later
+// call rather than starting again. The latest verified checkpoint is stored, and is
+// trusted by later calls in place of the first checkpoint received from the log, as
+// is the index of the release once it has been sequenced.
+// The file is created if it does not exist, and is left in place once the bundle
+// has been built.
+func WithStateFile(name string) Option {
+	return func(o *options) {
+		o.stateFile = name
+	}
+}
+
+// BuildProofBundle waits for the signed release to be integrated into the log
+// accessed via f, and then returns a ProofBundle for it. The first checkpoint
+// received from the log, which must be signed by logSigV and have the given
+// origin, is trusted.
+//
+// The wait is bounded only by ctx, so callers should set a deadline if the release
+// may never be integrated.
+func BuildProofBundle(ctx context.Context, f client.Fetcher, release []byte, logSigV note.Verifier, origin string, opts ...Option) (*api.ProofBundle, error) {
+	o := options{
+		pollInterval: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.proofs && o.deviceSize == 0 {
+		return nil, errors.New("a bundle with proofs requires a device checkpoint size")
+	}
+
+	h := verify.Hasher()
+	leafHash := h.HashLeaf(release)
+	var s waitState
+	if o.stateFile != "" {
+		var err error
+		if s, err = loadState(o.stateFile); err != nil {
+			return nil, err
+		}
+		// The checkpoint is still a valid starting point when waiting for another
+		// release, but the index is not.
+		if !bytes.Equal(s.LeafHash, leafHash) {
+			s.LeafHash, s.LeafIndex = leafHash, nil
+		}
+		if len(s.Checkpoint) > 0 {
+			logging.Info("Resuming from state file", "state_file", o.stateFile)
+		}
+	}
+
+	st, err := client.NewLogStateTracker(ctx, f, h, s.Checkpoint, logSigV, origin, client.UnilateralConsensus(f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new LogStateTracker: %v", err)
+	}
+
+	// Wait for inclusion
+	var idx uint64
+	var ip [][]byte
+	var pb *client.ProofBuilder
+	timer := time.NewTimer(o.initialDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(o.pollInterval)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if _, _, _, err := st.Update(ctx); err != nil {
+			return nil, fmt.Errorf("failed to update LogState: %v", err)
+		}
+		cp := st.LatestConsistent
+		s.Checkpoint = st.LatestConsistentRaw
+
+		if s.LeafIndex == nil {
+			idx, err := client.LookupIndex(ctx, f, leafHash)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("failed to look up leaf index: %v", err)
+			}
+			if err == nil {
+				s.LeafIndex = &idx
+			}
+		}
+		if o.stateFile != "" {
+			if err := saveState(o.stateFile, s); err != nil {
+				return nil, err
+			}
+		}
+		if s.LeafIndex == nil {
+			logging.Info("Leaf not [yet] sequenced, retrying")
+			continue
+		}
+		idx = *s.LeafIndex
+		if idx >= cp.Size {
+			logging.Info("Leaf sequenced but not [yet] integrated, retrying", "index", idx, "tree_size", cp.Size)
+			continue
+		}
+
+		pb, err = client.NewProofBuilder(ctx, cp, h.HashChildren, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new ProofBuilder: %v", err)
+		}
+
+		ip, err = pb.InclusionProof(ctx, idx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create inclusion proof for leaf %d: %v", idx, err)
+		}
+		if err := proof.VerifyInclusion(h, idx, cp.Size, leafHash, ip, cp.Hash); err != nil {
+			return nil, fmt.Errorf("failed to verify inclusion proof: %q", err)
+		}
+		logging.Info("Found leaf", "index", idx)
+		if idx < o.deviceSize {
+			return nil, fmt.Errorf("release at index %d is already covered by device checkpoint of size %d", idx, o.deviceSize)
+		}
+		break
+	}
+
+	if o.proofs {
+		cp := st.LatestConsistent
+		cProof, err := pb.ConsistencyProof(ctx, o.deviceSize, cp.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create consistency proof from size %d to %d: %v", o.deviceSize, cp.Size, err)
+		}
+		return &api.ProofBundle{
+			NewCheckpoint:    st.LatestConsistentRaw,
+			FirmwareRelease:  release,
+			ConsistencyFrom:  o.deviceSize,
+			ConsistencyProof: cProof,
+			LeafIndex:        idx,
+			InclusionProof:   ip,
+		}, nil
+	}
+
+	allLeafHashes, err := client.FetchLeafHashes(ctx, f, 0, st.LatestConsistent.Size, st.LatestConsistent.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch leaf hashes [0, %d): %v", st.LatestConsistent.Size, err)
+	}
+
+	var prefix [][]byte
+	if o.deviceSize > 0 {
+		r := (&compact.RangeFactory{Hash: h.HashChildren}).NewEmptyRange(0)
+		for _, lh := range allLeafHashes[:o.deviceSize] {
+			if err := r.Append(lh, nil); err != nil {
+				return nil, fmt.Errorf("failed to build prefix range: %v", err)
+			}
+		}
+		prefix = r.Hashes()
+	}
+
+	return &api.ProofBundle{
+		NewCheckpoint:   st.LatestConsistentRaw,
+		FirmwareRelease: release,
+		LeafHashesStart: o.deviceSize,
+		PrefixRange:     prefix,
+		LeafHashes:      allLeafHashes[o.deviceSize:],
+	}, nil
+}
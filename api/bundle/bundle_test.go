@@ -0,0 +1,309 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/release"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestBuildProofBundle(t *testing.T) {
+	logDir, err := filepath.Abs("../../log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fetcher.New(&url.URL{Scheme: "file", Path: logDir + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lSigV, err := note.NewVerifier(keys.ArmoryDriveLogPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf1, err := os.ReadFile(filepath.Join(logDir, "seq/00/00/00/00/01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		release []byte
+		wantErr bool
+	}{
+		{
+			desc:    "logged",
+			release: leaf1,
+		}, {
+			desc:    "never logged",
+			release: []byte("not in the log\n"),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			pb, err := BuildProofBundle(ctx, f, test.release, lSigV, "Armory Drive Prod 2", WithPollInterval(10*time.Millisecond))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("BuildProofBundle() = %v, want err %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := len(pb.LeafHashes), 2; got != want {
+				t.Errorf("got %d leaf hashes, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildProofBundleDeviceCheckpoint(t *testing.T) {
+	logDir, err := filepath.Abs("../../log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fetcher.New(&url.URL{Scheme: "file", Path: logDir + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lSigV, err := note.NewVerifier(keys.ArmoryDriveLogPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frSigV, err := note.NewVerifier(keys.ArmoryDrivePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf0, err := os.ReadFile(filepath.Join(logDir, "seq/00/00/00/00/00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf1, err := os.ReadFile(filepath.Join(logDir, "seq/00/00/00/00/01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCP := api.Checkpoint{Size: 1, Hash: verify.Hasher().HashLeaf(leaf0)}
+
+	pb, err := BuildProofBundle(context.Background(), f, leaf1, lSigV, "Armory Drive Prod 2", WithDeviceCheckpointSize(deviceCP.Size))
+	if err != nil {
+		t.Fatalf("BuildProofBundle(): %v", err)
+	}
+	if got, want := len(pb.LeafHashes), 1; got != want {
+		t.Errorf("got %d leaf hashes, want %d", got, want)
+	}
+	if err := verify.Bundle(*pb, deviceCP, lSigV, frSigV, nil, "Armory Drive Prod 2"); err != nil {
+		t.Errorf("verify.Bundle(): %v", err)
+	}
+
+	if _, err := BuildProofBundle(context.Background(), f, leaf0, lSigV, "Armory Drive Prod 2", WithDeviceCheckpointSize(deviceCP.Size)); err == nil {
+		t.Error("BuildProofBundle() for release covered by device checkpoint succeeded, want error")
+	}
+}
+
+func TestBuildProofBundleProofs(t *testing.T) {
+	ctx := context.Background()
+	l := testutil.New(t)
+	deviceCPRaw := l.AddReleases("v1", "v2", "v3")
+	release := l.SignRelease(api.FirmwareRelease{Revision: "v4"})
+	l.Add(release)
+	l.AddReleases("v5")
+
+	n, err := note.Open(deviceCPRaw, note.VerifierList(l.LogVerifier))
+	if err != nil {
+		t.Fatalf("Failed to open device checkpoint: %v", err)
+	}
+	var deviceCP api.Checkpoint
+	if err := deviceCP.Unmarshal([]byte(n.Text)); err != nil {
+		t.Fatalf("Failed to unmarshal device checkpoint: %v", err)
+	}
+
+	pb, err := BuildProofBundle(ctx, l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithDeviceCheckpointSize(deviceCP.Size), WithProofs())
+	if err != nil {
+		t.Fatalf("BuildProofBundle(): %v", err)
+	}
+	if !pb.HasProofs() || len(pb.LeafHashes) > 0 {
+		t.Errorf("got bundle with %d leaf hashes and ConsistencyFrom %d, want proofs only", len(pb.LeafHashes), pb.ConsistencyFrom)
+	}
+	if err := pb.Validate(); err != nil {
+		t.Errorf("Validate(): %v", err)
+	}
+	if err := verify.Bundle(*pb, deviceCP, l.LogVerifier, l.ReleaseVerifier, nil, testutil.Origin); err != nil {
+		t.Errorf("verify.Bundle(): %v", err)
+	}
+	if err := verify.Bundle(*pb, api.Checkpoint{}, l.LogVerifier, l.ReleaseVerifier, nil, testutil.Origin); err == nil {
+		t.Error("verify.Bundle() without device checkpoint succeeded, want error")
+	}
+
+	if _, err := BuildProofBundle(ctx, l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithProofs()); err == nil {
+		t.Error("BuildProofBundle() with proofs but no device checkpoint succeeded, want error")
+	}
+}
+
+// TestReleasePipeline exercises the whole life of a release: it's created and
+// signed as create_release does, added to a log, bundled for a device which last
+// saw an earlier checkpoint, and verified as the device would.
+func TestReleasePipeline(t *testing.T) {
+	ctx := context.Background()
+	l := testutil.New(t)
+	deviceCPRaw := l.AddReleases("v1", "v2")
+
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/example/repo/commits/v3":
+			_, _ = w.Write([]byte("abc123def456"))
+		case "/src.tar.gz":
+			_, _ = w.Write([]byte("source"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(gh.Close)
+	dir := t.TempDir()
+	fw := []byte("firmware image")
+	if err := os.WriteFile(filepath.Join(dir, api.FirmwareArtifactName), fw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := release.BuildRelease(release.ReleaseConfig{
+		Repo:        "example/repo",
+		Description: "A release",
+		PlatformID:  "armory-drive",
+		CommitHash:  "abc123",
+		ToolChain:   "tama1.17.1",
+		RevisionTag: "v3",
+		Artifacts:   []string{filepath.Join(dir, "armory-drive.*")},
+		SourceURL:   gh.URL + "/src.tar.gz",
+		CreatedAt:   time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		GitHubAPI:   gh.URL,
+	})
+	if err != nil {
+		t.Fatalf("BuildRelease(): %v", err)
+	}
+	signed, err := release.SignRelease(fr, l.ReleaseSigner)
+	if err != nil {
+		t.Fatalf("SignRelease(): %v", err)
+	}
+	l.Add(signed)
+	l.AddReleases("v4")
+	fwHash := sha256.Sum256(fw)
+	artifacts := map[string][]byte{api.FirmwareArtifactName: fwHash[:]}
+
+	n, err := note.Open(deviceCPRaw, note.VerifierList(l.LogVerifier))
+	if err != nil {
+		t.Fatalf("Failed to open device checkpoint: %v", err)
+	}
+	var deviceCP api.Checkpoint
+	if err := deviceCP.Unmarshal([]byte(n.Text)); err != nil {
+		t.Fatalf("Failed to unmarshal device checkpoint: %v", err)
+	}
+
+	pb, err := BuildProofBundle(ctx, l.Fetcher(), signed, l.LogVerifier, testutil.Origin, WithDeviceCheckpointSize(deviceCP.Size))
+	if err != nil {
+		t.Fatalf("BuildProofBundle(): %v", err)
+	}
+	if err := verify.Bundle(*pb, deviceCP, l.LogVerifier, l.ReleaseVerifier, artifacts, testutil.Origin); err != nil {
+		t.Errorf("verify.Bundle(): %v", err)
+	}
+	pbRaw, err := json.Marshal(pb)
+	if err != nil {
+		t.Fatalf("Failed to marshal ProofBundle: %v", err)
+	}
+	if err := verify.BundleReader(bytes.NewReader(pbRaw), deviceCP, l.LogVerifier, l.ReleaseVerifier, artifacts, testutil.Origin); err != nil {
+		t.Errorf("verify.BundleReader(): %v", err)
+	}
+
+	otherHash := sha256.Sum256([]byte("some other image"))
+	if err := verify.Bundle(*pb, deviceCP, l.LogVerifier, l.ReleaseVerifier, map[string][]byte{api.FirmwareArtifactName: otherHash[:]}, testutil.Origin); err == nil {
+		t.Error("verify.Bundle() with wrong firmware hash succeeded, want error")
+	}
+}
+
+func TestBuildProofBundleStateFile(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1")
+	release := l.SignRelease(api.FirmwareRelease{Revision: "v2"})
+	stateFile := filepath.Join(t.TempDir(), "state")
+	readState := func() waitState {
+		t.Helper()
+		s, err := loadState(stateFile)
+		if err != nil {
+			t.Fatalf("loadState: %v", err)
+		}
+		return s
+	}
+
+	// The release isn't in the log, so the wait times out having saved the
+	// checkpoint it saw.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := BuildProofBundle(ctx, l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithPollInterval(10*time.Millisecond), WithStateFile(stateFile)); err == nil {
+		t.Fatal("BuildProofBundle() for unlogged release succeeded, want error")
+	}
+	if s := readState(); !bytes.Equal(s.Checkpoint, l.Checkpoint()) || s.LeafIndex != nil {
+		t.Errorf("Got state %+v, want checkpoint %q and no leaf index", s, l.Checkpoint())
+	}
+
+	// Once the release is logged, a resumed wait finds it.
+	l.Add(release)
+	pb, err := BuildProofBundle(context.Background(), l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithStateFile(stateFile))
+	if err != nil {
+		t.Fatalf("BuildProofBundle(): %v", err)
+	}
+	if !bytes.Equal(pb.NewCheckpoint, l.Checkpoint()) {
+		t.Errorf("Got checkpoint %q, want %q", pb.NewCheckpoint, l.Checkpoint())
+	}
+	if s := readState(); s.LeafIndex == nil || *s.LeafIndex != 1 {
+		t.Errorf("Got state %+v, want leaf index 1", s)
+	}
+
+	// State saved from another log must not be trusted.
+	if err := os.WriteFile(stateFile, mustMarshal(t, waitState{Checkpoint: testutil.New(t).AddReleases("v1")}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildProofBundle(context.Background(), l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithStateFile(stateFile)); err == nil {
+		t.Error("BuildProofBundle() with state from another log succeeded, want error")
+	}
+
+	if err := os.WriteFile(stateFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildProofBundle(context.Background(), l.Fetcher(), release, l.LogVerifier, testutil.Origin, WithStateFile(stateFile)); err == nil {
+		t.Error("BuildProofBundle() with corrupt state file succeeded, want error")
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return b
+}
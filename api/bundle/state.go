@@ -0,0 +1,78 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// waitState is the progress of waiting for a release to be integrated, which is
+// persisted so that the wait can be resumed by a later run.
+type waitState struct {
+	// Checkpoint is the latest checkpoint from the log which was verified to be
+	// consistent with those seen before it.
+	Checkpoint []byte `json:"checkpoint,omitempty"`
+	// LeafHash is the hash of the release being waited for.
+	LeafHash []byte `json:"leaf_hash,omitempty"`
+	// LeafIndex is the index at which the release was sequenced, if it has been.
+	LeafIndex *uint64 `json:"leaf_index,omitempty"`
+}
+
+// loadState reads the state from the named file. A missing file is not an error,
+// and returns an empty state.
+func loadState(name string) (waitState, error) {
+	var s waitState
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return s, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("failed to parse state file %q: %v", name, err)
+	}
+	return s, nil
+}
+
+// saveState writes the state to the named file, via a temporary file which is
+// renamed over it so that the file is never left partially written.
+func saveState(name string, s waitState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	// Once renamed, the temporary file no longer exists and this is a no-op.
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return nil
+}
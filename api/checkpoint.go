@@ -20,8 +20,15 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// TimestampExtension is the prefix of the optional checkpoint extension line which
+// records when the checkpoint was issued, as a decimal number of seconds since
+// the Unix epoch.
+const TimestampExtension = "Timestamp: "
+
 // Checkpoint represents a minimal log checkpoint.
 type Checkpoint struct {
 	// Origin is the unique identifier for the log issuing this checkpoint.
@@ -30,6 +37,16 @@ type Checkpoint struct {
 	Size uint64
 	// Hash is the hash which commits to the contents of the entire log.
 	Hash []byte
+	// Timestamp is when the checkpoint was issued, if it carries the timestamp
+	// extension, and the zero time otherwise.
+	Timestamp time.Time
+}
+
+// Equal reports whether c and other commit to the same log state, having the same
+// origin, size and root hash. The timestamps of the checkpoints, and any signatures
+// on them, are ignored, as checkpoints for the same state may be issued more than once.
+func (c Checkpoint) Equal(other Checkpoint) bool {
+	return c.Origin == other.Origin && c.Size == other.Size && bytes.Equal(c.Hash, other.Hash)
 }
 
 // Unmarshal parses the common formatted checkpoint data and stores the result
@@ -41,7 +58,10 @@ type Checkpoint struct {
 //  - <decimal representation of log size>
 //  - <base64 representation of root hash>
 //
-// There must be no extraneous trailing data.
+// These may be followed by a single timestamp extension line:
+//  - <TimestampExtension><decimal seconds since the Unix epoch>
+//
+// There must be no other extraneous trailing data.
 func (c *Checkpoint) Unmarshal(data []byte) error {
 	l := bytes.SplitN(data, []byte("\n"), 4)
 	if len(l) < 4 {
@@ -59,13 +79,34 @@ func (c *Checkpoint) Unmarshal(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("invalid checkpoint - invalid hash: %w", err)
 	}
-	if xl := len(l[3]); xl > 0 {
+	ts, rest, err := parseTimestamp(l[3])
+	if err != nil {
+		return err
+	}
+	if xl := len(rest); xl > 0 {
 		return fmt.Errorf("invalid checkpoint - %d bytes of unexpected trailing data", xl)
 	}
 	*c = Checkpoint{
-		Origin: origin,
-		Size:   size,
-		Hash:   h,
+		Origin:    origin,
+		Size:      size,
+		Hash:      h,
+		Timestamp: ts,
 	}
 	return nil
 }
+
+// parseTimestamp parses the timestamp extension line from the start of the
+// checkpoint data following the root hash, if it is present, and returns the
+// remaining data.
+func parseTimestamp(ext []byte) (time.Time, []byte, error) {
+	line, rest, found := bytes.Cut(ext, []byte("\n"))
+	v, ok := strings.CutPrefix(string(line), TimestampExtension)
+	if !found || !ok {
+		return time.Time{}, ext, nil
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}, nil, fmt.Errorf("invalid checkpoint - invalid timestamp %q", v)
+	}
+	return time.Unix(secs, 0).UTC(), rest, nil
+}
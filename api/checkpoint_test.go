@@ -16,6 +16,7 @@ package api
 
 import (
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -47,6 +48,35 @@ func TestUnmarshalCheckpoint(t *testing.T) {
 			desc:    "valid with trailing newlines",
 			m:       "ArmoryDrive Log v0\n9944\ndGhlIHZpZXcgZnJvbSB0aGUgdHJlZSB0b3BzIGlzIGdyZWF0IQ==\n\n\n\n",
 			wantErr: true,
+		}, {
+			desc: "valid with timestamp",
+			m:    "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: 1656000000\n",
+			want: Checkpoint{
+				Origin:    "ArmoryDrive Log v0",
+				Size:      123,
+				Hash:      []byte("bananas"),
+				Timestamp: time.Unix(1656000000, 0).UTC(),
+			},
+		}, {
+			desc:    "timestamp followed by trailing data",
+			m:       "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: 1656000000\nmore\n",
+			wantErr: true,
+		}, {
+			desc:    "two timestamps",
+			m:       "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: 1656000000\nTimestamp: 1656000001\n",
+			wantErr: true,
+		}, {
+			desc:    "invalid timestamp",
+			m:       "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: yesterday\n",
+			wantErr: true,
+		}, {
+			desc:    "negative timestamp",
+			m:       "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: -1\n",
+			wantErr: true,
+		}, {
+			desc:    "timestamp missing newline",
+			m:       "ArmoryDrive Log v0\n123\nYmFuYW5hcw==\nTimestamp: 1656000000",
+			wantErr: true,
 		}, {
 			desc:    "invalid - insufficient lines",
 			m:       "Head\n9944\n",
@@ -85,6 +115,52 @@ func TestUnmarshalCheckpoint(t *testing.T) {
 			if diff := cmp.Diff(test.want, got); len(diff) != 0 {
 				t.Fatalf("Unmarshalled Checkpoint with diff %s", diff)
 			}
+			// cmp uses Checkpoint.Equal, which ignores the timestamp.
+			if !got.Timestamp.Equal(test.want.Timestamp) {
+				t.Fatalf("Unmarshalled Checkpoint with timestamp %v, want %v", got.Timestamp, test.want.Timestamp)
+			}
+		})
+	}
+}
+
+func TestCheckpointEqual(t *testing.T) {
+	cp := Checkpoint{
+		Origin:    "ArmoryDrive Log v0",
+		Size:      123,
+		Hash:      []byte("bananas"),
+		Timestamp: time.Unix(1656000000, 0).UTC(),
+	}
+	for _, test := range []struct {
+		desc  string
+		other Checkpoint
+		want  bool
+	}{
+		{
+			desc:  "identical",
+			other: cp,
+			want:  true,
+		}, {
+			desc:  "different timestamp",
+			other: Checkpoint{Origin: cp.Origin, Size: cp.Size, Hash: []byte("bananas")},
+			want:  true,
+		}, {
+			desc:  "different origin",
+			other: Checkpoint{Origin: "Other Log", Size: cp.Size, Hash: cp.Hash, Timestamp: cp.Timestamp},
+		}, {
+			desc:  "different size",
+			other: Checkpoint{Origin: cp.Origin, Size: 124, Hash: cp.Hash, Timestamp: cp.Timestamp},
+		}, {
+			desc:  "same size, different hash",
+			other: Checkpoint{Origin: cp.Origin, Size: cp.Size, Hash: []byte("apples"), Timestamp: cp.Timestamp},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := cp.Equal(test.other); got != test.want {
+				t.Errorf("Equal = %t, want %t", got, test.want)
+			}
+			if got := test.other.Equal(cp); got != test.want {
+				t.Errorf("Equal (reversed) = %t, want %t", got, test.want)
+			}
 		})
 	}
 }
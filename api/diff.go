@@ -0,0 +1,99 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FieldChange describes a field which differs between two FirmwareReleases.
+type FieldChange struct {
+	// Field is the JSON name of the changed field. For changes to entries in
+	// ArtifactSHA256 or BuildArgs, the map key is appended after a dot, e.g.
+	// "artifact_sha256.armory-drive.imx".
+	Field string
+
+	// Old and New are human readable forms of the field's values, with hashes hex
+	// encoded. They are empty if the field, or map entry, is absent.
+	Old, New string
+}
+
+func (c FieldChange) String() string {
+	return fmt.Sprintf("%s changed %q→%q", c.Field, c.Old, c.New)
+}
+
+// DiffFirmwareRelease returns the fields which differ between the releases a and
+// b, in the order in which they are declared in FirmwareRelease. Changes to map
+// fields are reported per entry, in ascending order of key.
+func DiffFirmwareRelease(a, b FirmwareRelease) []FieldChange {
+	var r []FieldChange
+	diff := func(field, old, new string) {
+		if old != new {
+			r = append(r, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	diffMap := func(field string, old, new map[string]string) {
+		keys := make([]string, 0, len(old)+len(new))
+		for k := range old {
+			keys = append(keys, k)
+		}
+		for k := range new {
+			if _, ok := old[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diff(field+"."+k, old[k], new[k])
+		}
+	}
+	hashes := func(m map[string][]byte) map[string]string {
+		r := make(map[string]string, len(m))
+		for k, v := range m {
+			r[k] = hex.EncodeToString(v)
+		}
+		return r
+	}
+	size := func(n uint64) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.FormatUint(n, 10)
+	}
+	createdAt := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	diff("description", a.Description, b.Description)
+	diff("platform_id", a.PlatformID, b.PlatformID)
+	diff("revision", a.Revision, b.Revision)
+	diffMap("artifact_sha256", hashes(a.ArtifactSHA256), hashes(b.ArtifactSHA256))
+	diff("image_size", size(a.ImageSize), size(b.ImageSize))
+	diff("source_url", a.SourceURL, b.SourceURL)
+	diff("source_sha256", hex.EncodeToString(a.SourceSHA256), hex.EncodeToString(b.SourceSHA256))
+	diff("source_git_tree", a.SourceGitTree, b.SourceGitTree)
+	diff("tool_chain", a.ToolChain, b.ToolChain)
+	diffMap("build_args", a.BuildArgs, b.BuildArgs)
+	diff("created_at", createdAt(a.CreatedAt), createdAt(b.CreatedAt))
+	diff("schema_version", strconv.Itoa(a.Schema()), strconv.Itoa(b.Schema()))
+	return r
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffFirmwareRelease(t *testing.T) {
+	base := func() FirmwareRelease {
+		return FirmwareRelease{
+			Description: "armory-drive v2021.09.22",
+			PlatformID:  "UA-MKII-ULZ",
+			Revision:    "v2021.09.22",
+			ArtifactSHA256: map[string][]byte{
+				"armory-drive.csf": {0x01},
+				"armory-drive.imx": {0x02},
+			},
+			SourceURL:    "https://github.com/usbarmory/armory-drive/tarball/v2021.09.22",
+			SourceSHA256: []byte{0x03},
+			ToolChain:    "tamago version go1.17.1 linux/amd64",
+			BuildArgs: map[string]string{
+				"REV": "efeb733",
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		desc   string
+		modify func(fr *FirmwareRelease)
+		want   []FieldChange
+	}{
+		{
+			desc:   "identical",
+			modify: func(fr *FirmwareRelease) {},
+		}, {
+			desc: "scalar fields",
+			modify: func(fr *FirmwareRelease) {
+				fr.Revision = "v2021.10.08"
+				fr.ToolChain = "tamago version go1.17.2 linux/amd64"
+			},
+			want: []FieldChange{
+				{Field: "revision", Old: "v2021.09.22", New: "v2021.10.08"},
+				{Field: "tool_chain", Old: "tamago version go1.17.1 linux/amd64", New: "tamago version go1.17.2 linux/amd64"},
+			},
+		}, {
+			desc: "artifacts",
+			modify: func(fr *FirmwareRelease) {
+				fr.ArtifactSHA256["armory-drive.imx"] = []byte{0x12}
+				fr.ArtifactSHA256["armory-drive.sdp"] = []byte{0x04}
+				delete(fr.ArtifactSHA256, "armory-drive.csf")
+			},
+			want: []FieldChange{
+				{Field: "artifact_sha256.armory-drive.csf", Old: "01"},
+				{Field: "artifact_sha256.armory-drive.imx", Old: "02", New: "12"},
+				{Field: "artifact_sha256.armory-drive.sdp", New: "04"},
+			},
+		}, {
+			desc: "image size added",
+			modify: func(fr *FirmwareRelease) {
+				fr.ImageSize = 4096
+			},
+			want: []FieldChange{
+				{Field: "image_size", New: "4096"},
+			},
+		}, {
+			desc: "build args",
+			modify: func(fr *FirmwareRelease) {
+				fr.BuildArgs["REV"] = "b90e2d9"
+				fr.BuildArgs["OTHER"] = "thing"
+			},
+			want: []FieldChange{
+				{Field: "build_args.OTHER", New: "thing"},
+				{Field: "build_args.REV", Old: "efeb733", New: "b90e2d9"},
+			},
+		}, {
+			desc: "explicit schema version 1",
+			modify: func(fr *FirmwareRelease) {
+				fr.SchemaVersion = 1
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			b := base()
+			test.modify(&b)
+			got := DiffFirmwareRelease(base(), b)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("DiffFirmwareRelease() diff: %s", diff)
+			}
+		})
+	}
+}
@@ -15,10 +15,28 @@
 // Package api contains public structures related to the log contents.
 package api
 
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
 const (
 	// FirmwareArtifactName is the name of the firmware image which is expected
-	// to be present in the ArtifactSHA256 map of valid FirmwareRelease instances.
+	// to be present in the ArtifactSHA256 map of valid FirmwareRelease instances
+	// which build a single image for all platforms. Releases which build an image
+	// per platform name it as returned by PlatformArtifactName instead.
 	FirmwareArtifactName = "armory-drive.imx"
+
+	// CurrentSchemaVersion is the newest FirmwareRelease schema version understood
+	// by this package.
+	CurrentSchemaVersion = 1
 )
 
 // FirmwareRelease represents a firmware release, and contains all of the
@@ -37,6 +55,11 @@ type FirmwareRelease struct {
 	// ArtifactSHA256 contains the SHA256 hashes of the named release artifacts.
 	ArtifactSHA256 map[string][]byte `json:"artifact_sha256"`
 
+	// ImageSize is the size in bytes of the image named by FirmwareArtifact, so that a
+	// device can check that the update fits before installing it.
+	// This is not present in manifests created before the field was introduced.
+	ImageSize uint64 `json:"image_size,omitempty"`
+
 	// SourceURL is the location from which an archive of the source code used to
 	// produce this release can be downloaded.
 	SourceURL string `json:"source_url"`
@@ -45,9 +68,206 @@ type FirmwareRelease struct {
 	// pointed to by SourceURL.
 	SourceSHA256 []byte `json:"source_sha256"`
 
+	// SourceGitTree is the hex encoded hash of the git tree object of the commit
+	// which this release was built from. Unlike the archive served from SourceURL,
+	// which may be regenerated with different bytes over time, this is determined
+	// by the source alone, so remains verifiable from a checkout of the commit.
+	// This is not present in manifests which only commit to SourceSHA256.
+	SourceGitTree string `json:"source_git_tree,omitempty"`
+
 	// ToolChain identifies the toolchain used to build the release from the source.
 	ToolChain string `json:"tool_chain"`
 
 	// BuildArgs identifies the set of build arguments used to build the firmware from the source.
 	BuildArgs map[string]string `json:"build_args"`
+
+	// CreatedAt is the time at which this release manifest was created.
+	// This is not present in manifests created before the field was introduced.
+	CreatedAt time.Time `json:"created_at,omitzero"`
+
+	// SchemaVersion identifies the version of the schema this release manifest
+	// follows. Manifests without this field are schema version 1.
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// ErrUnsupportedSchemaVersion is returned when a FirmwareRelease follows a schema
+// version which is not understood by this package.
+type ErrUnsupportedSchemaVersion struct {
+	// Version is the schema version claimed by the FirmwareRelease.
+	Version int
+}
+
+func (e ErrUnsupportedSchemaVersion) Error() string {
+	return fmt.Sprintf("unsupported FirmwareRelease schema version %d (newest supported is %d)", e.Version, CurrentSchemaVersion)
+}
+
+// PlatformArtifactName returns the name of the firmware image built for the given
+// platform by releases which build an image per platform, e.g.
+// "armory-drive-UA-MKII-ULZ.imx".
+func PlatformArtifactName(platformID string) string {
+	return fmt.Sprintf("armory-drive-%s.imx", platformID)
+}
+
+// FirmwareArtifact returns the name of the release's firmware image in its
+// ArtifactSHA256 map: FirmwareArtifactName if the release claims it, and otherwise
+// the per-platform name for its PlatformID.
+func (fr FirmwareRelease) FirmwareArtifact() string {
+	if _, ok := fr.ArtifactSHA256[FirmwareArtifactName]; ok {
+		return FirmwareArtifactName
+	}
+	return PlatformArtifactName(fr.PlatformID)
+}
+
+// ParseSHA256 parses a SHA256 hash written either as hex, as it is usually quoted
+// by people and in release notes, or as standard base64, as it appears in the JSON
+// encoding of ArtifactSHA256.
+func ParseSHA256(s string) ([]byte, error) {
+	if len(s) == 2*sha256.Size {
+		if h, err := hex.DecodeString(s); err == nil {
+			return h, nil
+		}
+	}
+	h, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(h) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a hex or base64 encoded SHA256 hash", s)
+	}
+	return h, nil
+}
+
+// Schema returns the schema version of the FirmwareRelease, taking into account
+// that manifests without a SchemaVersion are version 1.
+func (fr FirmwareRelease) Schema() int {
+	if fr.SchemaVersion == 0 {
+		return 1
+	}
+	return fr.SchemaVersion
+}
+
+// CheckSchema returns an ErrUnsupportedSchemaVersion if the FirmwareRelease follows
+// a schema version which is not understood by this package.
+func (fr FirmwareRelease) CheckSchema() error {
+	if v := fr.Schema(); v < 1 || v > CurrentSchemaVersion {
+		return ErrUnsupportedSchemaVersion{Version: v}
+	}
+	return nil
+}
+
+// CanonicalJSON returns the canonical JSON encoding of the FirmwareRelease, which is
+// the form in which it is signed and committed to the log.
+//
+// The encoding is an object with one field per line, indented by two spaces, with
+// the fields in the order they are declared in the FirmwareRelease struct and named
+// by their JSON tags. The values are encoded as follows:
+//   - strings as JSON strings, escaped as by Go's encoding/json package
+//   - byte slices as standard base64 encoded strings, or null if nil
+//   - maps as nested objects indented by a further two spaces, with the keys in
+//     ascending byte order, or null if nil; empty maps are encoded as {}
+//   - image_size as a JSON number, omitted entirely if ImageSize is zero
+//   - source_git_tree omitted entirely if SourceGitTree is empty
+//   - created_at as an RFC3339 timestamp with fractional seconds only if non-zero,
+//     and omitted entirely if CreatedAt is the zero time
+//   - schema_version as a JSON number, omitted entirely if SchemaVersion is zero
+//
+// There is no trailing newline. This is the same encoding produced by
+// json.MarshalIndent(fr, "", "  "), which earlier releases were signed with.
+func (fr FirmwareRelease) CanonicalJSON() ([]byte, error) {
+	b := &bytes.Buffer{}
+	first := true
+	field := func(name string) {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		b.WriteString("\n  ")
+		writeJSONString(b, name)
+		b.WriteString(": ")
+	}
+	bytesValue := func(v []byte) {
+		if v == nil {
+			b.WriteString("null")
+			return
+		}
+		writeJSONString(b, base64.StdEncoding.EncodeToString(v))
+	}
+	mapValue := func(keys []string, value func(k string)) {
+		if len(keys) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		sort.Strings(keys)
+		b.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n    ")
+			writeJSONString(b, k)
+			b.WriteString(": ")
+			value(k)
+		}
+		b.WriteString("\n  }")
+	}
+
+	b.WriteString("{")
+	field("description")
+	writeJSONString(b, fr.Description)
+	field("platform_id")
+	writeJSONString(b, fr.PlatformID)
+	field("revision")
+	writeJSONString(b, fr.Revision)
+	field("artifact_sha256")
+	if fr.ArtifactSHA256 == nil {
+		b.WriteString("null")
+	} else {
+		keys := make([]string, 0, len(fr.ArtifactSHA256))
+		for k := range fr.ArtifactSHA256 {
+			keys = append(keys, k)
+		}
+		mapValue(keys, func(k string) { bytesValue(fr.ArtifactSHA256[k]) })
+	}
+	if fr.ImageSize != 0 {
+		field("image_size")
+		b.WriteString(strconv.FormatUint(fr.ImageSize, 10))
+	}
+	field("source_url")
+	writeJSONString(b, fr.SourceURL)
+	field("source_sha256")
+	bytesValue(fr.SourceSHA256)
+	if fr.SourceGitTree != "" {
+		field("source_git_tree")
+		writeJSONString(b, fr.SourceGitTree)
+	}
+	field("tool_chain")
+	writeJSONString(b, fr.ToolChain)
+	field("build_args")
+	if fr.BuildArgs == nil {
+		b.WriteString("null")
+	} else {
+		keys := make([]string, 0, len(fr.BuildArgs))
+		for k := range fr.BuildArgs {
+			keys = append(keys, k)
+		}
+		mapValue(keys, func(k string) { writeJSONString(b, fr.BuildArgs[k]) })
+	}
+	if !fr.CreatedAt.IsZero() {
+		t, err := fr.CreatedAt.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		field("created_at")
+		b.Write(t)
+	}
+	if fr.SchemaVersion != 0 {
+		field("schema_version")
+		b.WriteString(strconv.Itoa(fr.SchemaVersion))
+	}
+	b.WriteString("\n}")
+	return b.Bytes(), nil
+}
+
+// writeJSONString writes s to b as a JSON string.
+func writeJSONString(b *bytes.Buffer, s string) {
+	// Marshalling a string cannot fail.
+	j, _ := json.Marshal(s)
+	b.Write(j)
 }
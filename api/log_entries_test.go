@@ -0,0 +1,221 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		fr   FirmwareRelease
+	}{
+		{
+			desc: "full",
+			fr: FirmwareRelease{
+				Description: "AD release <with> \"escapes\" & unicode ½",
+				PlatformID:  "UA-DRV-0",
+				Revision:    "v2021.06.25",
+				ArtifactSHA256: map[string][]byte{
+					"armory-drive.sig": []byte("sig"),
+					"armory-drive.imx": []byte("imx"),
+					"armory-drive.csf": []byte("csf"),
+				},
+				ImageSize:    1 << 20,
+				SourceURL:    "https://github.com/usbarmory/armory-drive/tarball/v2021.06.25",
+				SourceSHA256: []byte("source"),
+				ToolChain:    "tamago1.16.3",
+				BuildArgs: map[string]string{
+					"REV":   "acd1c56",
+					"OTHER": "thing",
+				},
+				CreatedAt:     time.Date(2021, 6, 25, 11, 41, 25, 0, time.UTC),
+				SchemaVersion: 1,
+			},
+		}, {
+			desc: "source git tree",
+			fr: FirmwareRelease{
+				Revision:      "v2022.01.01",
+				SourceURL:     "https://github.com/usbarmory/armory-drive/tarball/v2022.01.01",
+				SourceGitTree: "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+			},
+		}, {
+			desc: "empty",
+			fr:   FirmwareRelease{},
+		}, {
+			desc: "empty maps",
+			fr: FirmwareRelease{
+				ArtifactSHA256: map[string][]byte{},
+				BuildArgs:      map[string]string{},
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := test.fr.CanonicalJSON()
+			if err != nil {
+				t.Fatalf("CanonicalJSON: %v", err)
+			}
+			want, err := json.MarshalIndent(test.fr, "", "  ")
+			if err != nil {
+				t.Fatalf("MarshalIndent: %v", err)
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Errorf("CanonicalJSON differs from MarshalIndent, diff: %s", diff)
+			}
+
+			var rt FirmwareRelease
+			if err := json.Unmarshal(got, &rt); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if diff := cmp.Diff(test.fr, rt); diff != "" {
+				t.Errorf("Round trip through CanonicalJSON changed release, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		manifest string
+		want     int
+		wantErr  bool
+	}{
+		{
+			desc:     "absent",
+			manifest: `{"revision": "v2021.06.25"}`,
+			want:     1,
+		}, {
+			desc:     "current",
+			manifest: `{"revision": "v2021.06.25", "schema_version": 1}`,
+			want:     1,
+		}, {
+			desc:     "future",
+			manifest: `{"revision": "v2021.06.25", "schema_version": 2}`,
+			want:     2,
+			wantErr:  true,
+		}, {
+			desc:     "negative",
+			manifest: `{"revision": "v2021.06.25", "schema_version": -1}`,
+			want:     -1,
+			wantErr:  true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var fr FirmwareRelease
+			if err := json.Unmarshal([]byte(test.manifest), &fr); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got := fr.Schema(); got != test.want {
+				t.Errorf("Schema() = %d, want %d", got, test.want)
+			}
+			err := fr.CheckSchema()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("CheckSchema() = %v, want err %t", err, test.wantErr)
+			}
+			var e ErrUnsupportedSchemaVersion
+			if test.wantErr && !errors.As(err, &e) {
+				t.Errorf("CheckSchema() = %T, want ErrUnsupportedSchemaVersion", err)
+			}
+		})
+	}
+}
+
+func TestFirmwareArtifact(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		fr   FirmwareRelease
+		want string
+	}{
+		{
+			desc: "single image",
+			fr: FirmwareRelease{
+				PlatformID:     "UA-MKII-ULZ",
+				ArtifactSHA256: map[string][]byte{FirmwareArtifactName: []byte("imx"), "armory-drive.csf": []byte("csf")},
+			},
+			want: FirmwareArtifactName,
+		}, {
+			desc: "image per platform",
+			fr: FirmwareRelease{
+				PlatformID:     "mk2",
+				ArtifactSHA256: map[string][]byte{"armory-drive-mk2.imx": []byte("imx"), "armory-drive-usbarmory.imx": []byte("imx")},
+			},
+			want: "armory-drive-mk2.imx",
+		}, {
+			desc: "no artifacts",
+			fr:   FirmwareRelease{PlatformID: "mk2"},
+			want: "armory-drive-mk2.imx",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := test.fr.FirmwareArtifact(); got != test.want {
+				t.Errorf("FirmwareArtifact() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSHA256(t *testing.T) {
+	want := sha256.Sum256([]byte("firmware image"))
+	for _, test := range []struct {
+		desc    string
+		s       string
+		wantErr bool
+	}{
+		{
+			desc: "hex",
+			s:    hex.EncodeToString(want[:]),
+		}, {
+			desc: "upper case hex",
+			s:    strings.ToUpper(hex.EncodeToString(want[:])),
+		}, {
+			desc: "base64",
+			s:    base64.StdEncoding.EncodeToString(want[:]),
+		}, {
+			desc:    "short hex",
+			s:       hex.EncodeToString(want[:16]),
+			wantErr: true,
+		}, {
+			desc:    "short base64",
+			s:       base64.StdEncoding.EncodeToString(want[:16]),
+			wantErr: true,
+		}, {
+			desc:    "neither",
+			s:       "not a hash",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := ParseSHA256(test.s)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ParseSHA256(%q) = %v, want err %t", test.s, err, test.wantErr)
+			}
+			if !test.wantErr && !bytes.Equal(got, want[:]) {
+				t.Errorf("ParseSHA256(%q) = %x, want %x", test.s, got, want)
+			}
+		})
+	}
+}
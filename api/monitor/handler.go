@@ -0,0 +1,48 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+)
+
+// LeafHandler acts on each release found in the log, once the leaf containing it
+// has been verified.
+type LeafHandler interface {
+	// Handle is called with the verified leaf, which holds its index in the log
+	// and the release it contains. Returning an error stops the monitor.
+	Handle(ctx context.Context, l Leaf) error
+}
+
+// LeafHandlerFunc adapts a function to a LeafHandler.
+type LeafHandlerFunc func(ctx context.Context, l Leaf) error
+
+// Handle calls f.
+func (f LeafHandlerFunc) Handle(ctx context.Context, l Leaf) error {
+	return f(ctx, l)
+}
+
+// Chain returns a LeafHandler which passes each leaf to the handlers in turn,
+// stopping at the first which returns an error.
+func Chain(handlers ...LeafHandler) LeafHandler {
+	return LeafHandlerFunc(func(ctx context.Context, l Leaf) error {
+		for _, h := range handlers {
+			if err := h.Handle(ctx, l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+)
+
+func TestChain(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, test := range []struct {
+		desc     string
+		failAt   int
+		wantCall string
+		wantErr  error
+	}{
+		{
+			desc:     "all succeed",
+			failAt:   -1,
+			wantCall: "[a b c]",
+		}, {
+			desc:     "stops at first error",
+			failAt:   1,
+			wantCall: "[a b]",
+			wantErr:  errFailed,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var calls []string
+			var handlers []LeafHandler
+			for i, name := range []string{"a", "b", "c"} {
+				handlers = append(handlers, LeafHandlerFunc(func(_ context.Context, l Leaf) error {
+					if l.Index != 7 || l.Release.Revision != "v1" {
+						t.Errorf("Handler %s got leaf %d with revision %q, want 7 and v1", name, l.Index, l.Release.Revision)
+					}
+					calls = append(calls, name)
+					if i == test.failAt {
+						return errFailed
+					}
+					return nil
+				}))
+			}
+			err := Chain(handlers...).Handle(context.Background(), Leaf{Index: 7, Release: api.FirmwareRelease{Revision: "v1"}})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Handle: got %v, want %v", err, test.wantErr)
+			}
+			if got := fmt.Sprint(calls); got != test.wantCall {
+				t.Errorf("Called handlers %s, want %s", got, test.wantCall)
+			}
+		})
+	}
+}
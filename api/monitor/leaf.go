@@ -0,0 +1,142 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package monitor provides the Monitor which follows the log, and the checks it
+// performs on each leaf, so that other tools can verify leaves without running the
+// whole monitor.
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"golang.org/x/mod/sumdb/note"
+)
+
+type options struct {
+	maxSignatures    int
+	writeCheckpoint  func(cpRaw []byte) error
+	consistencyProof func(oldSize, newSize uint64, p ConsistencyProof) error
+	maxCheckpointAge time.Duration
+}
+
+// Option configures the checks performed on leaves, and the behaviour of a Monitor.
+type Option func(*options)
+
+// WithMaxSignatures sets the maximum number of signature lines which a leaf may
+// carry. Leaves with more signatures are rejected before any attempt is made to
+// verify them. The default is verify.DefaultMaxSignatures.
+func WithMaxSignatures(n int) Option {
+	return func(o *options) {
+		o.maxSignatures = n
+	}
+}
+
+// LeafVerifier verifies leaves against the latest consistent checkpoint of a state
+// tracker at the time it was created.
+type LeafVerifier struct {
+	st               client.LogStateTracker
+	pb               *client.ProofBuilder
+	releaseVerifiers note.Verifiers
+	opts             options
+}
+
+// NewLeafVerifier returns a LeafVerifier which checks that leaves are committed
+// to by the latest consistent checkpoint of st, and are releases signed by one of
+// releaseVerifiers.
+func NewLeafVerifier(ctx context.Context, st client.LogStateTracker, releaseVerifiers note.Verifiers, opts ...Option) (*LeafVerifier, error) {
+	o := options{
+		maxSignatures: verify.DefaultMaxSignatures,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	pb, err := client.NewProofBuilder(ctx, st.LatestConsistent, st.Hasher.HashChildren, st.Fetcher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct proof builder: %v", err)
+	}
+	return &LeafVerifier{
+		st:               st,
+		pb:               pb,
+		releaseVerifiers: releaseVerifiers,
+		opts:             o,
+	}, nil
+}
+
+// Leaf is a leaf which has been verified by a LeafVerifier.
+type Leaf struct {
+	// Index is the position of the leaf in the log.
+	Index uint64
+	// Hash is the leaf hash committed to by the log.
+	Hash []byte
+	// Release is the FirmwareRelease contained in the leaf.
+	Release api.FirmwareRelease
+	// Signatures are the verified signatures on the release.
+	Signatures []note.Signature
+	// Raw is the signed release note, exactly as it was logged.
+	Raw []byte
+}
+
+// Verify fetches the leaf at index i, checks its inclusion under the checkpoint and
+// the signature on it, and returns the FirmwareRelease it contains.
+func (v *LeafVerifier) Verify(ctx context.Context, i uint64) (Leaf, error) {
+	cp := v.st.LatestConsistent
+	if i >= cp.Size {
+		return Leaf{}, fmt.Errorf("index %d is not covered by checkpoint of size %d", i, cp.Size)
+	}
+	rawLeaf, err := client.GetLeaf(ctx, v.st.Fetcher, i)
+	if err != nil {
+		return Leaf{}, fmt.Errorf("failed to get leaf at index %d: %v", i, err)
+	}
+	hash := v.st.Hasher.HashLeaf(rawLeaf)
+	ip, err := v.pb.InclusionProof(ctx, i)
+	if err != nil {
+		return Leaf{}, fmt.Errorf("failed to get inclusion proof for index %d: %v", i, err)
+	}
+
+	if err := verify.VerifyLeafInclusion(rawLeaf, i, cp.Size, ip, cp.Hash); err != nil {
+		return Leaf{}, fmt.Errorf("VerifyInclusionProof() %d: %v", i, err)
+	}
+
+	if err := verify.CheckNoteSignatures(rawLeaf, v.opts.maxSignatures); err != nil {
+		return Leaf{}, fmt.Errorf("invalid leaf note at index %d: %v", i, err)
+	}
+	releaseNote, err := verify.OpenNote(rawLeaf, v.releaseVerifiers)
+	if err != nil {
+		return Leaf{}, fmt.Errorf("failed to open leaf note at index %d: %w", i, err)
+	}
+
+	var release api.FirmwareRelease
+	if err := json.Unmarshal([]byte(releaseNote.Text), &release); err != nil {
+		return Leaf{}, fmt.Errorf("failed to unmarshal release at index %d: %w", i, err)
+	}
+	return Leaf{Index: i, Hash: hash, Release: release, Signatures: releaseNote.Sigs, Raw: rawLeaf}, nil
+}
+
+// VerifyLeaf verifies the single leaf at index i against the latest consistent
+// checkpoint of st, as described on LeafVerifier.Verify. When verifying many leaves,
+// it's more efficient to create a LeafVerifier and use it for all of them.
+func VerifyLeaf(ctx context.Context, st client.LogStateTracker, i uint64, releaseVerifiers note.Verifiers, opts ...Option) (api.FirmwareRelease, error) {
+	v, err := NewLeafVerifier(ctx, st, releaseVerifiers, opts...)
+	if err != nil {
+		return api.FirmwareRelease{}, err
+	}
+	l, err := v.Verify(ctx, i)
+	return l.Release, err
+}
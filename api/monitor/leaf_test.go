@@ -0,0 +1,108 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"crypto/rand"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestVerifyLeaf(t *testing.T) {
+	ctx := context.Background()
+	logDir, err := filepath.Abs("../../log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fetcher.New(&url.URL{Scheme: "file", Path: logDir + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lSigV, err := note.NewVerifier(keys.ArmoryDriveLogPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), nil, lSigV, "Armory Drive Prod 2", client.UnilateralConsensus(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frSigV, err := note.NewVerifier(keys.ArmoryDrivePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPub, err := note.GenerateKey(rand.Reader, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigV, err := note.NewVerifier(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc         string
+		index        uint64
+		verifier     note.Verifier
+		opts         []Option
+		wantRevision string
+		wantErr      bool
+	}{
+		{
+			desc:         "first",
+			index:        0,
+			verifier:     frSigV,
+			wantRevision: "v2021.09.22",
+		}, {
+			desc:         "last",
+			index:        1,
+			verifier:     frSigV,
+			wantRevision: "v2021.10.08",
+		}, {
+			desc:     "beyond checkpoint",
+			index:    2,
+			verifier: frSigV,
+			wantErr:  true,
+		}, {
+			desc:     "wrong release key",
+			index:    1,
+			verifier: otherSigV,
+			wantErr:  true,
+		}, {
+			desc:     "too many signatures",
+			index:    1,
+			verifier: frSigV,
+			opts:     []Option{WithMaxSignatures(0)},
+			wantErr:  true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			fr, err := VerifyLeaf(ctx, st, test.index, note.VerifierList(test.verifier), test.opts...)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("VerifyLeaf() = %v, want err %t", err, test.wantErr)
+			}
+			if fr.Revision != test.wantRevision {
+				t.Errorf("VerifyLeaf() revision = %q, want %q", fr.Revision, test.wantRevision)
+			}
+		})
+	}
+}
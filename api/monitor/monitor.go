@@ -0,0 +1,290 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// WithCheckpointWriter sets a function which From calls with the signed checkpoint
+// once all of the leaves it commits to have been checked, so that it can be
+// persisted as the starting point for the next run.
+func WithCheckpointWriter(f func(cpRaw []byte) error) Option {
+	return func(o *options) {
+		o.writeCheckpoint = f
+	}
+}
+
+// WithConsistencyProofHandler sets a function which Update calls with each
+// consistency proof it verifies, and the sizes of the trees it relates.
+func WithConsistencyProofHandler(f func(oldSize, newSize uint64, p ConsistencyProof) error) Option {
+	return func(o *options) {
+		o.consistencyProof = f
+	}
+}
+
+// WithMaxCheckpointAge sets how old the log's latest checkpoint may be before
+// Update logs an error and reports the log as stale, as it may have stopped issuing
+// checkpoints. Checkpoints which carry a timestamp are aged from when they were
+// issued, and others from when the monitor first saw the log reach their size.
+func WithMaxCheckpointAge(d time.Duration) Option {
+	return func(o *options) {
+		o.maxCheckpointAge = d
+	}
+}
+
+// ConsistencyProof records a verified consistency proof between two checkpoints.
+type ConsistencyProof struct {
+	// OldCheckpoint is the signed checkpoint previously held by the monitor.
+	OldCheckpoint []byte
+	// NewCheckpoint is the signed checkpoint which the monitor updated to.
+	NewCheckpoint []byte
+	// Proof is the consistency proof between the two checkpoints.
+	Proof [][]byte
+}
+
+// Monitor verifiably checks inclusion of all leaves in a range, and then passes
+// each verified leaf to a handler. Several handlers can be combined with Chain.
+type Monitor struct {
+	st               client.LogStateTracker
+	releaseVerifiers note.Verifiers
+	handler          LeafHandler
+	opts             options
+	// lastGrowth is when the log was last seen to grow, or when the monitor started.
+	lastGrowth time.Time
+	// stale is true while the log's latest checkpoint is older than the maximum
+	// checkpoint age.
+	stale bool
+	// verified is the number of leaves checked since the monitor started.
+	verified uint64
+}
+
+// New returns a Monitor which follows the log tracked by st, from its latest
+// consistent checkpoint. Leaves must be releases signed by one of
+// releaseVerifiers, and are passed to handler once they have been verified.
+func New(st client.LogStateTracker, releaseVerifiers note.Verifiers, handler LeafHandler, opts ...Option) *Monitor {
+	o := options{
+		maxSignatures: verify.DefaultMaxSignatures,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Monitor{
+		st:               st,
+		releaseVerifiers: releaseVerifiers,
+		handler:          handler,
+		opts:             o,
+		lastGrowth:       time.Now(),
+	}
+}
+
+// Checkpoint returns the latest checkpoint which the monitor has verified to be
+// consistent with those before it, and its signed form.
+func (m *Monitor) Checkpoint() (log.Checkpoint, []byte) {
+	return m.st.LatestConsistent, m.st.LatestConsistentRaw
+}
+
+// Stale returns true if the log's latest checkpoint was older than the maximum
+// checkpoint age when Update last fetched it, as described on WithMaxCheckpointAge.
+func (m *Monitor) Stale() bool {
+	return m.stale
+}
+
+// Verified returns the number of leaves checked since the monitor was created.
+func (m *Monitor) Verified() uint64 {
+	return m.verified
+}
+
+// Update fetches the latest checkpoint from the log and, if the log has grown,
+// verifies its consistency with the previous checkpoint and checks the new leaves.
+//
+// If the log serves a checkpoint smaller than the previous one, it has been rolled
+// back, and if it serves one of the same size but with a different root hash, it
+// has forked. Either is an error.
+func (m *Monitor) Update(ctx context.Context) error {
+	oldCP, oldCPRaw := m.st.LatestConsistent, m.st.LatestConsistentRaw
+	lastHead := oldCP.Size
+	// The state tracker silently ignores checkpoints which are no larger than the
+	// one it holds, so check the latest checkpoint against it before updating.
+	cp, cpRaw, n, err := m.st.ConsensusCheckpoint(ctx, m.st.CpSigVerifier, m.st.Origin)
+	if err != nil {
+		return fmt.Errorf("failed to fetch checkpoint: %v", err)
+	}
+	if err := checkNotRewound(oldCP, oldCPRaw, *cp, cpRaw); err != nil {
+		return err
+	}
+	if cp.Size == lastHead {
+		// Nothing has changed, so there's no need for the state tracker to fetch
+		// the tiles for the checkpoint again.
+		m.checkAge(time.Now(), false, issuedAt(n))
+		logging.V(2).Info("Polling: no new data found", "tree_size", lastHead)
+		return nil
+	}
+	oldRaw, p, newRaw, err := m.st.Update(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update checkpoint: %v", err)
+	}
+	// The state tracker fetches the checkpoint again, so it must not have gone
+	// back from the one checked above either.
+	if err := checkNotRewound(*cp, cpRaw, m.st.LatestConsistent, m.st.LatestConsistentRaw); err != nil {
+		return err
+	}
+	m.checkAge(time.Now(), true, issuedAt(m.st.CheckpointNote))
+	if err := m.checkConsistency(oldCP, oldRaw, newRaw, p); err != nil {
+		return err
+	}
+	logging.V(1).Info("Found new checkpoint, fetching new leaves", "tree_size", m.st.LatestConsistent.Size)
+	if err := m.From(ctx, lastHead); err != nil {
+		return fmt.Errorf("monitor.From(%d): %v", lastHead, err)
+	}
+	return nil
+}
+
+// checkNotRewound returns an error if the checkpoint got, which the log has served
+// since the checkpoint seen, is smaller than it, or is the same size but has a
+// different root hash.
+func checkNotRewound(seen log.Checkpoint, seenRaw []byte, got log.Checkpoint, gotRaw []byte) error {
+	switch {
+	case got.Size < seen.Size:
+		logging.Error("Log has been rolled back: it served a checkpoint smaller than one it served before", "tree_size", got.Size, "checkpoint", string(gotRaw), "previous_tree_size", seen.Size, "previous_checkpoint", string(seenRaw))
+		return fmt.Errorf("log rolled back from tree size %d to %d", seen.Size, got.Size)
+	case got.Size == seen.Size && seen.Size > 0 && !asCheckpoint(got).Equal(asCheckpoint(seen)):
+		logging.Error("Log has forked: it served a checkpoint of the same size as one it served before, but with a different root hash", "tree_size", got.Size, "checkpoint", string(gotRaw), "previous_checkpoint", string(seenRaw))
+		return fmt.Errorf("log forked at tree size %d: got root hash %x, but previously root hash %x", got.Size, got.Hash, seen.Hash)
+	}
+	return nil
+}
+
+// asCheckpoint returns the origin, size and root hash of cp, ignoring any extension
+// lines, so that checkpoints can be compared regardless of how they were signed.
+func asCheckpoint(cp log.Checkpoint) api.Checkpoint {
+	return api.Checkpoint{Origin: cp.Origin, Size: cp.Size, Hash: cp.Hash}
+}
+
+// checkAge records whether the log grew at the given time, and logs an error if
+// its latest checkpoint is now older than the maximum checkpoint age. The age of
+// a checkpoint is measured from the time at which it was issued, if it carries a
+// timestamp, and otherwise from when the monitor first saw the log reach its size.
+// The error is only logged once each time the log becomes stale.
+func (m *Monitor) checkAge(now time.Time, grew bool, issued time.Time) {
+	if grew {
+		m.lastGrowth = now
+	}
+	since := m.lastGrowth
+	if !issued.IsZero() {
+		since = issued
+	}
+	maxAge := m.opts.maxCheckpointAge
+	stale := maxAge > 0 && now.Sub(since) > maxAge
+	switch {
+	case stale && !m.stale:
+		logging.Error("Log's latest checkpoint is older than the maximum checkpoint age, it may have stopped issuing checkpoints", "tree_size", m.st.LatestConsistent.Size, "since", since.Format(time.RFC3339), "max_checkpoint_age", maxAge.String())
+	case !stale && m.stale:
+		logging.Info("Log's latest checkpoint is fresh again", "tree_size", m.st.LatestConsistent.Size, "since", since.Format(time.RFC3339))
+	}
+	m.stale = stale
+}
+
+// issuedAt returns the time at which the checkpoint in n was issued, or the zero
+// time if it doesn't carry a timestamp.
+func issuedAt(n *note.Note) time.Time {
+	var cp api.Checkpoint
+	if n == nil || cp.Unmarshal([]byte(n.Text)) != nil {
+		return time.Time{}
+	}
+	return cp.Timestamp
+}
+
+// checkConsistency verifies the proof that the log has only grown, and not been
+// rewritten, between the old checkpoint and the new one held by the state tracker.
+// The proof is passed to the consistency proof handler, if one was configured.
+func (m *Monitor) checkConsistency(oldCP log.Checkpoint, oldRaw, newRaw []byte, p [][]byte) error {
+	newCP := m.st.LatestConsistent
+	if oldCP.Size == 0 {
+		// Every tree is consistent with the empty tree.
+		return nil
+	}
+	if err := proof.VerifyConsistency(m.st.Hasher, oldCP.Size, newCP.Size, p, oldCP.Hash, newCP.Hash); err != nil {
+		return fmt.Errorf("invalid consistency proof from tree size %d to %d: %v", oldCP.Size, newCP.Size, err)
+	}
+	logging.Info("Verified consistency proof", "old_tree_size", oldCP.Size, "tree_size", newCP.Size)
+	if m.opts.consistencyProof == nil {
+		return nil
+	}
+	return m.opts.consistencyProof(oldCP.Size, newCP.Size, ConsistencyProof{
+		OldCheckpoint: oldRaw,
+		NewCheckpoint: newRaw,
+		Proof:         p,
+	})
+}
+
+// From checks the leaves from `start` up to the checkpoint from the state tracker.
+// Upon reaching the end of the leaves, the checkpoint is passed to the checkpoint
+// writer, if one was configured. If ctx is cancelled first, it is not.
+func (m *Monitor) From(ctx context.Context, start uint64) error {
+	if err := m.checkLeaves(ctx, start, m.st.LatestConsistent.Size); err != nil {
+		return err
+	}
+	if m.opts.writeCheckpoint == nil {
+		return nil
+	}
+	return m.opts.writeCheckpoint(m.st.LatestConsistentRaw)
+}
+
+// Range updates the state tracker to the latest checkpoint from the log, and then
+// checks the leaves in the range [start, end) against it.
+// Unlike From, this does not pass the checkpoint to the checkpoint writer.
+func (m *Monitor) Range(ctx context.Context, start, end uint64) error {
+	if _, _, _, err := m.st.Update(ctx); err != nil {
+		return fmt.Errorf("failed to update checkpoint: %v", err)
+	}
+	if size := m.st.LatestConsistent.Size; end > size || start > end {
+		return fmt.Errorf("invalid range [%d, %d) for tree size %d", start, end, size)
+	}
+	return m.checkLeaves(ctx, start, end)
+}
+
+// checkLeaves checks the leaves in the range [start, end), which must be within the
+// checkpoint from the state tracker, and passes each of them to the handler.
+func (m *Monitor) checkLeaves(ctx context.Context, start, end uint64) error {
+	lv, err := NewLeafVerifier(ctx, m.st, m.releaseVerifiers, WithMaxSignatures(m.opts.maxSignatures))
+	if err != nil {
+		return err
+	}
+	for i := start; i < end; i++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before leaf %d: %w", i, err)
+		}
+		l, err := lv.Verify(ctx, i)
+		if err != nil {
+			return err
+		}
+		if err := m.handler.Handle(ctx, l); err != nil {
+			return fmt.Errorf("handler(): %w", err)
+		}
+		m.verified++
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// newTestMonitor returns a Monitor for the test log which records the revisions
+// it sees.
+func newTestMonitor(l *testutil.Log, seen *[]string, opts ...Option) *Monitor {
+	return New(l.StateTracker(), note.VerifierList(l.ReleaseVerifier), LeafHandlerFunc(func(_ context.Context, l Leaf) error {
+		*seen = append(*seen, l.Release.Revision)
+		return nil
+	}), opts...)
+}
+
+func TestMonitorUpdateConsistencyProof(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1", "v2", "v3")
+	var seen []string
+	var gotSizes []uint64
+	var got ConsistencyProof
+	m := newTestMonitor(l, &seen, WithConsistencyProofHandler(func(oldSize, newSize uint64, p ConsistencyProof) error {
+		gotSizes, got = []uint64{oldSize, newSize}, p
+		return nil
+	}))
+	if err := m.From(context.Background(), 0); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+
+	l.AddReleases("v4", "v5")
+	if err := m.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got, want := fmt.Sprint(seen), "[v1 v2 v3 v4 v5]"; got != want {
+		t.Errorf("Saw revisions %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(gotSizes), "[3 5]"; got != want {
+		t.Fatalf("Got consistency proof for sizes %s, want %s", got, want)
+	}
+
+	open := func(cpRaw []byte) api.Checkpoint {
+		t.Helper()
+		n, err := note.Open(cpRaw, note.VerifierList(l.LogVerifier))
+		if err != nil {
+			t.Fatalf("Failed to open checkpoint: %v", err)
+		}
+		var cp api.Checkpoint
+		if err := cp.Unmarshal([]byte(n.Text)); err != nil {
+			t.Fatalf("Failed to unmarshal checkpoint: %v", err)
+		}
+		return cp
+	}
+	oldCP, newCP := open(got.OldCheckpoint), open(got.NewCheckpoint)
+	if err := proof.VerifyConsistency(verify.Hasher(), oldCP.Size, newCP.Size, got.Proof, oldCP.Hash, newCP.Hash); err != nil {
+		t.Errorf("Consistency proof does not verify: %v", err)
+	}
+}
+
+func TestMonitorUpdateRewound(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		// served returns the checkpoints served by the log for each fetch, the last
+		// of which is repeated.
+		served  func(cp1, cp2, cp3, forked []byte) [][]byte
+		wantErr bool
+	}{
+		{
+			desc:   "same checkpoint",
+			served: func(_, cp2, _, _ []byte) [][]byte { return [][]byte{cp2} },
+		}, {
+			desc:   "grown",
+			served: func(_, _, cp3, _ []byte) [][]byte { return [][]byte{cp3} },
+		}, {
+			desc:    "same size, different hash",
+			served:  func(_, _, _, forked []byte) [][]byte { return [][]byte{forked} },
+			wantErr: true,
+		}, {
+			desc:    "rolled back",
+			served:  func(cp1, _, _, _ []byte) [][]byte { return [][]byte{cp1} },
+			wantErr: true,
+		}, {
+			desc:    "rolled back between fetches",
+			served:  func(_, cp2, cp3, _ []byte) [][]byte { return [][]byte{cp3, cp2} },
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx := context.Background()
+			l := testutil.New(t)
+			cp1 := l.AddReleases("v1")
+			cp2 := l.AddReleases("v2")
+			var seen []string
+			m := newTestMonitor(l, &seen)
+			if err := m.From(ctx, 0); err != nil {
+				t.Fatalf("From: %v", err)
+			}
+			cp3 := l.AddReleases("v3")
+
+			fork := api.Checkpoint{Origin: testutil.Origin, Size: 2, Hash: bytes.Repeat([]byte{0x42}, 32)}
+			forked, err := note.Sign(&note.Note{Text: fmt.Sprintf("%s\n%d\n%s\n", fork.Origin, fork.Size, base64.StdEncoding.EncodeToString(fork.Hash))}, l.LogSigner)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			served := test.served(cp1, cp2, cp3, forked)
+			f := l.Fetcher()
+			m.st.ConsensusCheckpoint = client.UnilateralConsensus(func(ctx context.Context, p string) ([]byte, error) {
+				if p == layout.CheckpointPath {
+					cpRaw := served[0]
+					if len(served) > 1 {
+						served = served[1:]
+					}
+					return cpRaw, nil
+				}
+				return f(ctx, p)
+			})
+			err = m.Update(ctx)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Update: %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMonitorUpdateUnchanged(t *testing.T) {
+	ctx := context.Background()
+	l := testutil.New(t)
+	l.AddReleases("v1", "v2", "v3")
+	var seen []string
+	m := newTestMonitor(l, &seen)
+	if err := m.From(ctx, 0); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+
+	var fetched []string
+	f := m.st.Fetcher
+	m.st.Fetcher = func(ctx context.Context, p string) ([]byte, error) {
+		fetched = append(fetched, p)
+		return f(ctx, p)
+	}
+	m.st.ConsensusCheckpoint = client.UnilateralConsensus(m.st.Fetcher)
+	if err := m.Update(ctx); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got, want := fmt.Sprint(fetched), fmt.Sprint([]string{layout.CheckpointPath}); got != want {
+		t.Errorf("Update of unchanged log fetched %s, want %s", got, want)
+	}
+}
+
+func TestMonitorUpdateStale(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		issued    time.Time
+		wantStale bool
+	}{
+		{
+			desc: "no timestamp",
+		}, {
+			desc:   "recent timestamp",
+			issued: time.Now().Add(-time.Minute),
+		}, {
+			desc:      "old timestamp",
+			issued:    time.Now().Add(-2 * time.Hour),
+			wantStale: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctx := context.Background()
+			l := testutil.New(t)
+			l.AddReleases("v1", "v2")
+			var seen []string
+			m := newTestMonitor(l, &seen, WithMaxCheckpointAge(time.Hour))
+			if err := m.From(ctx, 0); err != nil {
+				t.Fatalf("From: %v", err)
+			}
+
+			cp := m.st.LatestConsistent
+			text := fmt.Sprintf("%s\n%d\n%s\n", cp.Origin, cp.Size, base64.StdEncoding.EncodeToString(cp.Hash))
+			if !test.issued.IsZero() {
+				text += fmt.Sprintf("%s%d\n", api.TimestampExtension, test.issued.Unix())
+			}
+			cpRaw, err := note.Sign(&note.Note{Text: text}, l.LogSigner)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			f := l.Fetcher()
+			m.st.ConsensusCheckpoint = client.UnilateralConsensus(func(ctx context.Context, p string) ([]byte, error) {
+				if p == layout.CheckpointPath {
+					return cpRaw, nil
+				}
+				return f(ctx, p)
+			})
+			if err := m.Update(ctx); err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			if got := m.Stale(); got != test.wantStale {
+				t.Errorf("Stale() = %t, want %t", got, test.wantStale)
+			}
+		})
+	}
+}
+
+func TestMonitorFromCancelled(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1", "v2", "v3")
+	var seen []string
+	var written []byte
+	m := newTestMonitor(l, &seen, WithCheckpointWriter(func(cpRaw []byte) error {
+		written = cpRaw
+		return nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := m.handler
+	m.handler = LeafHandlerFunc(func(ctx context.Context, l Leaf) error {
+		// Simulate a signal arriving while the second leaf is being checked.
+		if l.Index == 1 {
+			cancel()
+		}
+		return handler.Handle(ctx, l)
+	})
+
+	if err := m.From(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("From: got %v, want %v", err, context.Canceled)
+	}
+	if got, want := fmt.Sprint(seen), "[v1 v2]"; got != want {
+		t.Errorf("Saw revisions %s, want %s", got, want)
+	}
+	if written != nil {
+		t.Errorf("Checkpoint written after cancellation: %s", written)
+	}
+
+	if err := m.From(context.Background(), 2); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+	if !bytes.Equal(written, l.Checkpoint()) {
+		t.Errorf("Wrote checkpoint %q, want %q", written, l.Checkpoint())
+	}
+}
+
+func TestMonitorCheckAge(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1")
+	var seen []string
+	m := newTestMonitor(l, &seen, WithMaxCheckpointAge(time.Hour))
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.lastGrowth = start
+
+	for _, step := range []struct {
+		after time.Duration
+		grew  bool
+		// issued, if non-zero, is when the checkpoint says it was issued, relative
+		// to the start.
+		issued    time.Duration
+		wantStale bool
+	}{
+		{after: 30 * time.Minute},
+		{after: 61 * time.Minute, wantStale: true},
+		{after: 2 * time.Hour, wantStale: true},
+		{after: 3 * time.Hour, grew: true},
+		{after: 3*time.Hour + 59*time.Minute},
+		{after: 4*time.Hour + time.Minute, wantStale: true},
+		// The timestamp takes precedence over when the log last grew.
+		{after: 4*time.Hour + 2*time.Minute, issued: 4 * time.Hour},
+		{after: 5*time.Hour + time.Minute, issued: 4 * time.Hour, wantStale: true},
+		{after: 5*time.Hour + 2*time.Minute, grew: true, issued: 2 * time.Hour, wantStale: true},
+	} {
+		var issued time.Time
+		if step.issued > 0 {
+			issued = start.Add(step.issued)
+		}
+		m.checkAge(start.Add(step.after), step.grew, issued)
+		if m.Stale() != step.wantStale {
+			t.Errorf("After %v (grew %t, issued %v): stale = %t, want %t", step.after, step.grew, step.issued, m.Stale(), step.wantStale)
+		}
+	}
+
+	m.opts.maxCheckpointAge = 0
+	m.checkAge(start.Add(100*time.Hour), false, time.Time{})
+	if m.stale {
+		t.Error("Log reported stale with no maximum checkpoint age")
+	}
+}
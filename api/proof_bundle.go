@@ -14,6 +14,18 @@
 
 package api
 
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
 // ProofBundle is written to the armory at update time so that the running
 // firmware can convince itself of the discoverability of the update before
 // installing it.
@@ -29,9 +41,380 @@ type ProofBundle struct {
 	// FirmwareRelease struct.
 	FirmwareRelease []byte
 
-	// LeafHashes contains all leaf hashes committed to by NewCheckpoint.
+	// LeafHashesStart is the index of the first leaf hash in LeafHashes.
+	//
+	// This is zero unless the bundle was created for a device which already holds a
+	// checkpoint of at least this size, in which case PrefixRange stands in for the
+	// leaf hashes which have been omitted.
+	LeafHashesStart uint64 `json:",omitempty"`
+
+	// PrefixRange contains the hashes of the compact range covering the leaves
+	// [0, LeafHashesStart), from which the device is able to recompute the roots of
+	// the tree without the omitted leaf hashes.
+	PrefixRange [][]byte `json:",omitempty"`
+
+	// ConsistencyFrom is zero unless the bundle was created for a device which
+	// already holds a checkpoint of this size, and carries ConsistencyProof and
+	// InclusionProof in place of leaf hashes. See HasProofs.
+	ConsistencyFrom uint64 `json:",omitempty"`
+
+	// ConsistencyProof proves that NewCheckpoint is consistent with the device's
+	// checkpoint of size ConsistencyFrom.
+	ConsistencyProof [][]byte `json:",omitempty"`
+
+	// LeafIndex is the index in the log at which FirmwareRelease was logged. It is
+	// only present along with ConsistencyFrom.
+	LeafIndex uint64 `json:",omitempty"`
+
+	// InclusionProof proves that FirmwareRelease is committed to by NewCheckpoint at
+	// LeafIndex.
+	InclusionProof [][]byte `json:",omitempty"`
+
+	// LeafHashes contains the leaf hashes committed to by NewCheckpoint, starting
+	// at LeafHashesStart.
 	//
 	// This is to allow users who don't/cannot use a tool to install the firmware to verify
 	// consistency with any possible Checkpoint they may have on their device currently.
 	LeafHashes [][]byte
 }
+
+// HasProofs returns true if the bundle proves the inclusion of FirmwareRelease and
+// the consistency of NewCheckpoint with the device's checkpoint using
+// InclusionProof and ConsistencyProof, rather than LeafHashes. Such bundles are much
+// smaller, but can only be verified by a device holding a checkpoint of size
+// ConsistencyFrom.
+func (pb ProofBundle) HasProofs() bool {
+	return pb.ConsistencyFrom > 0
+}
+
+// BundleDigest returns a SHA256 digest which uniquely identifies the contents of
+// the provided ProofBundle.
+//
+// The digest is calculated over a canonical serialisation of the bundle in which
+// each field is prefixed by its length as a big-endian uint64, so it does not
+// depend on how the bundle happened to be encoded when it was transported:
+//  - NewCheckpoint
+//  - FirmwareRelease
+//  - the number of LeafHashes, followed by each of the LeafHashes in order
+//  - if LeafHashesStart is non-zero or PrefixRange is non-empty: LeafHashesStart
+//    as a big-endian uint64, followed by the number of PrefixRange hashes and each
+//    of them in order
+//  - if the bundle HasProofs: ConsistencyFrom as a big-endian uint64, followed by
+//    the number of ConsistencyProof hashes and each of them in order, and then
+//    LeafIndex, the number of InclusionProof hashes and each of them in order
+//
+// The last two items are omitted for bundles containing all leaf hashes, so their
+// digests are unchanged from before the fields were introduced.
+func BundleDigest(pb ProofBundle) ([]byte, error) {
+	h := sha256.New()
+	writeField := func(b []byte) error {
+		if err := binary.Write(h, binary.BigEndian, uint64(len(b))); err != nil {
+			return err
+		}
+		_, err := h.Write(b)
+		return err
+	}
+	if err := writeField(pb.NewCheckpoint); err != nil {
+		return nil, fmt.Errorf("failed to hash NewCheckpoint: %v", err)
+	}
+	if err := writeField(pb.FirmwareRelease); err != nil {
+		return nil, fmt.Errorf("failed to hash FirmwareRelease: %v", err)
+	}
+	if err := binary.Write(h, binary.BigEndian, uint64(len(pb.LeafHashes))); err != nil {
+		return nil, fmt.Errorf("failed to hash LeafHashes count: %v", err)
+	}
+	for i, lh := range pb.LeafHashes {
+		if err := writeField(lh); err != nil {
+			return nil, fmt.Errorf("failed to hash leaf hash %d: %v", i, err)
+		}
+	}
+	writeHashes := func(name string, start uint64, hs [][]byte) error {
+		if err := binary.Write(h, binary.BigEndian, start); err != nil {
+			return fmt.Errorf("failed to hash %s start: %v", name, err)
+		}
+		if err := binary.Write(h, binary.BigEndian, uint64(len(hs))); err != nil {
+			return fmt.Errorf("failed to hash %s count: %v", name, err)
+		}
+		for i, ph := range hs {
+			if err := writeField(ph); err != nil {
+				return fmt.Errorf("failed to hash %s hash %d: %v", name, i, err)
+			}
+		}
+		return nil
+	}
+	if pb.LeafHashesStart != 0 || len(pb.PrefixRange) != 0 {
+		if err := writeHashes("prefix range", pb.LeafHashesStart, pb.PrefixRange); err != nil {
+			return nil, err
+		}
+	}
+	if pb.HasProofs() {
+		if err := writeHashes("consistency proof", pb.ConsistencyFrom, pb.ConsistencyProof); err != nil {
+			return nil, err
+		}
+		if err := writeHashes("inclusion proof", pb.LeafIndex, pb.InclusionProof); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// Validate performs cheap structural checks on the ProofBundle, so that obviously
+// malformed bundles can be rejected with a clear reason before any signatures or
+// proofs are verified:
+//  - NewCheckpoint and FirmwareRelease must be non-empty
+//  - every hash in LeafHashes and PrefixRange must be a SHA256 hash
+//  - PrefixRange must hold one hash for each bit set in LeafHashesStart, which
+//    is the size of the compact range covering [0, LeafHashesStart)
+//  - LeafHashesStart plus the number of LeafHashes must equal the size claimed
+//    by NewCheckpoint, unless the bundle HasProofs
+//  - if the bundle HasProofs, it must carry no leaf hashes or prefix range, and
+//    ConsistencyFrom and LeafIndex must both be less than the size claimed by
+//    NewCheckpoint, with LeafIndex not less than ConsistencyFrom
+//  - every hash in ConsistencyProof and InclusionProof must be a SHA256 hash, and
+//    they must be empty unless the bundle HasProofs
+//
+// A bundle which passes these checks may still be invalid, so it must be verified
+// before it is trusted. In particular, the signature on NewCheckpoint is not checked.
+func (pb ProofBundle) Validate() error {
+	if len(pb.NewCheckpoint) == 0 {
+		return errors.New("invalid ProofBundle - empty NewCheckpoint")
+	}
+	if len(pb.FirmwareRelease) == 0 {
+		return errors.New("invalid ProofBundle - empty FirmwareRelease")
+	}
+	for i, h := range pb.LeafHashes {
+		if len(h) != sha256.Size {
+			return fmt.Errorf("invalid ProofBundle - leaf hash %d is %d bytes, want %d", i, len(h), sha256.Size)
+		}
+	}
+	for i, h := range pb.PrefixRange {
+		if len(h) != sha256.Size {
+			return fmt.Errorf("invalid ProofBundle - prefix range hash %d is %d bytes, want %d", i, len(h), sha256.Size)
+		}
+	}
+	for i, h := range pb.ConsistencyProof {
+		if len(h) != sha256.Size {
+			return fmt.Errorf("invalid ProofBundle - consistency proof hash %d is %d bytes, want %d", i, len(h), sha256.Size)
+		}
+	}
+	for i, h := range pb.InclusionProof {
+		if len(h) != sha256.Size {
+			return fmt.Errorf("invalid ProofBundle - inclusion proof hash %d is %d bytes, want %d", i, len(h), sha256.Size)
+		}
+	}
+	if !pb.HasProofs() && (len(pb.ConsistencyProof) > 0 || len(pb.InclusionProof) > 0 || pb.LeafIndex > 0) {
+		return errors.New("invalid ProofBundle - proofs without ConsistencyFrom")
+	}
+	if got, want := len(pb.PrefixRange), bits.OnesCount64(pb.LeafHashesStart); got != want {
+		return fmt.Errorf("invalid ProofBundle - %d prefix range hashes for LeafHashesStart %d, want %d", got, pb.LeafHashesStart, want)
+	}
+
+	// The checkpoint text is everything up to the blank line separating it from
+	// the note's signatures.
+	i := bytes.Index(pb.NewCheckpoint, []byte("\n\n"))
+	if i < 0 {
+		return errors.New("invalid ProofBundle - NewCheckpoint is not a signed note")
+	}
+	var cp Checkpoint
+	if err := cp.Unmarshal(pb.NewCheckpoint[:i+1]); err != nil {
+		return fmt.Errorf("invalid ProofBundle - %v", err)
+	}
+	if pb.HasProofs() {
+		if pb.LeafHashesStart > 0 || len(pb.LeafHashes) > 0 {
+			return errors.New("invalid ProofBundle - leaf hashes and proofs are mutually exclusive")
+		}
+		if pb.ConsistencyFrom >= cp.Size {
+			return fmt.Errorf("invalid ProofBundle - ConsistencyFrom %d for Checkpoint of size %d", pb.ConsistencyFrom, cp.Size)
+		}
+		if pb.LeafIndex < pb.ConsistencyFrom || pb.LeafIndex >= cp.Size {
+			return fmt.Errorf("invalid ProofBundle - LeafIndex %d outside [%d, %d)", pb.LeafIndex, pb.ConsistencyFrom, cp.Size)
+		}
+		return nil
+	}
+	if l := pb.LeafHashesStart + uint64(len(pb.LeafHashes)); l != cp.Size {
+		return fmt.Errorf("invalid ProofBundle - %d leafhashes for Checkpoint of size %d", l, cp.Size)
+	}
+	return nil
+}
+
+// MaxProofBundleSize is the largest decompressed size of a gzip compressed bundle
+// accepted by ParseProofBundle, so that a small malicious bundle can't expand to
+// exhaust memory. It is enough for the JSON encoding of a bundle with over a
+// million leaf hashes.
+const MaxProofBundleSize = 64 << 20
+
+// gzipMagic is the header which begins every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// BinaryMagic is the header which begins every ProofBundle in the binary encoding
+// produced by MarshalBinary. It includes the version of the encoding.
+var BinaryMagic = []byte("ADPB\x01")
+
+// ParseProofBundle parses a ProofBundle serialised as JSON, or in the binary
+// encoding of MarshalBinary, as written by the create_proofbundle tool. Either may
+// be gzip compressed, in which case it must decompress to no more than
+// MaxProofBundleSize bytes. The encoding is detected from the bundle's header, so
+// callers needn't know how the bundle was written.
+func ParseProofBundle(b []byte) (ProofBundle, error) {
+	if bytes.HasPrefix(b, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return ProofBundle{}, fmt.Errorf("failed to decompress ProofBundle: %v", err)
+		}
+		if b, err = io.ReadAll(io.LimitReader(r, MaxProofBundleSize+1)); err != nil {
+			return ProofBundle{}, fmt.Errorf("failed to decompress ProofBundle: %v", err)
+		}
+		if len(b) > MaxProofBundleSize {
+			return ProofBundle{}, fmt.Errorf("decompressed ProofBundle is larger than %d bytes", MaxProofBundleSize)
+		}
+	}
+	var pb ProofBundle
+	if bytes.HasPrefix(b, BinaryMagic) {
+		if err := pb.UnmarshalBinary(b); err != nil {
+			return ProofBundle{}, err
+		}
+		return pb, nil
+	}
+	if err := json.Unmarshal(b, &pb); err != nil {
+		return ProofBundle{}, fmt.Errorf("failed to unmarshal ProofBundle: %v", err)
+	}
+	return pb, nil
+}
+
+// MarshalBinary returns the compact binary encoding of the ProofBundle, which is
+// about half the size of the JSON encoding as hashes are not base64 encoded, and
+// is simpler to parse on the device.
+//
+// The encoding is BinaryMagic followed by these fields, in which every integer is
+// a big-endian uint64:
+//  - the length of NewCheckpoint, followed by NewCheckpoint
+//  - the length of FirmwareRelease, followed by FirmwareRelease
+//  - LeafHashesStart
+//  - the number of PrefixRange hashes, followed by each of them in order
+//  - the number of LeafHashes, followed by each of them in order
+//  - if the bundle HasProofs: ConsistencyFrom, the number of ConsistencyProof
+//    hashes followed by each of them in order, and then LeafIndex, the number of
+//    InclusionProof hashes followed by each of them in order
+//
+// Every hash must be a SHA256 hash, so the hashes are not length prefixed. A bundle
+// with proofs or a LeafIndex but no ConsistencyFrom is rejected, as Validate does,
+// since they wouldn't be encoded.
+func (pb ProofBundle) MarshalBinary() ([]byte, error) {
+	if !pb.HasProofs() && (len(pb.ConsistencyProof) > 0 || len(pb.InclusionProof) > 0 || pb.LeafIndex > 0) {
+		return nil, errors.New("invalid ProofBundle - proofs without ConsistencyFrom")
+	}
+	b := &bytes.Buffer{}
+	b.Write(BinaryMagic)
+	putUint := func(v uint64) {
+		_ = binary.Write(b, binary.BigEndian, v)
+	}
+	putHashes := func(name string, hs [][]byte) error {
+		putUint(uint64(len(hs)))
+		for i, h := range hs {
+			if len(h) != sha256.Size {
+				return fmt.Errorf("%s hash %d is %d bytes, want %d", name, i, len(h), sha256.Size)
+			}
+			b.Write(h)
+		}
+		return nil
+	}
+	putUint(uint64(len(pb.NewCheckpoint)))
+	b.Write(pb.NewCheckpoint)
+	putUint(uint64(len(pb.FirmwareRelease)))
+	b.Write(pb.FirmwareRelease)
+	putUint(pb.LeafHashesStart)
+	if err := putHashes("prefix range", pb.PrefixRange); err != nil {
+		return nil, err
+	}
+	if err := putHashes("leaf", pb.LeafHashes); err != nil {
+		return nil, err
+	}
+	if pb.HasProofs() {
+		putUint(pb.ConsistencyFrom)
+		if err := putHashes("consistency proof", pb.ConsistencyProof); err != nil {
+			return nil, err
+		}
+		putUint(pb.LeafIndex)
+		if err := putHashes("inclusion proof", pb.InclusionProof); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary parses the binary encoding produced by MarshalBinary into the
+// ProofBundle. It is an error for there to be any data after the encoded bundle.
+func (pb *ProofBundle) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, BinaryMagic) {
+		return errors.New("invalid binary ProofBundle - bad header")
+	}
+	data = data[len(BinaryMagic):]
+	var err error
+	getUint := func(name string) uint64 {
+		if err != nil {
+			return 0
+		}
+		if len(data) < 8 {
+			err = fmt.Errorf("invalid binary ProofBundle - truncated %s", name)
+			return 0
+		}
+		v := binary.BigEndian.Uint64(data)
+		data = data[8:]
+		return v
+	}
+	getBytes := func(name string, n uint64) []byte {
+		if err != nil {
+			return nil
+		}
+		if uint64(len(data)) < n {
+			err = fmt.Errorf("invalid binary ProofBundle - truncated %s", name)
+			return nil
+		}
+		v := append([]byte(nil), data[:n]...)
+		data = data[n:]
+		return v
+	}
+	getHashes := func(name string) [][]byte {
+		n := getUint(name + " count")
+		if err != nil {
+			return nil
+		}
+		// Check the count against the remaining data before allocating for it.
+		if n > uint64(len(data))/sha256.Size {
+			err = fmt.Errorf("invalid binary ProofBundle - %d %s hashes in %d bytes", n, name, len(data))
+			return nil
+		}
+		var hs [][]byte
+		if n > 0 {
+			hs = make([][]byte, 0, n)
+		}
+		for i := uint64(0); i < n; i++ {
+			hs = append(hs, getBytes(name+" hash", sha256.Size))
+		}
+		return hs
+	}
+
+	var r ProofBundle
+	r.NewCheckpoint = getBytes("NewCheckpoint", getUint("NewCheckpoint length"))
+	r.FirmwareRelease = getBytes("FirmwareRelease", getUint("FirmwareRelease length"))
+	r.LeafHashesStart = getUint("LeafHashesStart")
+	r.PrefixRange = getHashes("prefix range")
+	r.LeafHashes = getHashes("leaf")
+	if err == nil && len(data) > 0 {
+		r.ConsistencyFrom = getUint("ConsistencyFrom")
+		r.ConsistencyProof = getHashes("consistency proof")
+		r.LeafIndex = getUint("LeafIndex")
+		r.InclusionProof = getHashes("inclusion proof")
+		if err == nil && r.ConsistencyFrom == 0 {
+			err = errors.New("invalid binary ProofBundle - proofs with zero ConsistencyFrom")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("invalid binary ProofBundle - %d bytes of unexpected trailing data", len(data))
+	}
+	*pb = r
+	return nil
+}
@@ -0,0 +1,448 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testBundle() ProofBundle {
+	return ProofBundle{
+		NewCheckpoint:   []byte("ArmoryDrive Log v0\n2\nYmFuYW5hcw==\n"),
+		FirmwareRelease: []byte("{\"revision\": \"v1\"}\n"),
+		LeafHashes: [][]byte{
+			[]byte("Many"),
+			[]byte("Leaves"),
+		},
+	}
+}
+
+func TestBundleDigestDeterministic(t *testing.T) {
+	a, err := BundleDigest(testBundle())
+	if err != nil {
+		t.Fatalf("BundleDigest: %v", err)
+	}
+	b, err := BundleDigest(testBundle())
+	if err != nil {
+		t.Fatalf("BundleDigest: %v", err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatalf("BundleDigest of identical bundles differs: %x != %x", a, b)
+	}
+}
+
+func TestBundleDigestChanges(t *testing.T) {
+	want, err := BundleDigest(testBundle())
+	if err != nil {
+		t.Fatalf("BundleDigest: %v", err)
+	}
+	for _, test := range []struct {
+		desc   string
+		modify func(pb *ProofBundle)
+	}{
+		{
+			desc:   "checkpoint",
+			modify: func(pb *ProofBundle) { pb.NewCheckpoint = []byte("ArmoryDrive Log v0\n3\nYmFuYW5hcw==\n") },
+		}, {
+			desc:   "firmware release",
+			modify: func(pb *ProofBundle) { pb.FirmwareRelease = []byte("{\"revision\": \"v2\"}\n") },
+		}, {
+			desc:   "leaf hash",
+			modify: func(pb *ProofBundle) { pb.LeafHashes[1] = []byte("Trees") },
+		}, {
+			desc:   "extra leaf hash",
+			modify: func(pb *ProofBundle) { pb.LeafHashes = append(pb.LeafHashes, []byte("Golden")) },
+		}, {
+			desc: "leaf hash boundaries",
+			modify: func(pb *ProofBundle) {
+				pb.LeafHashes = [][]byte{[]byte("ManyLeaves")}
+			},
+		}, {
+			desc: "field boundaries",
+			modify: func(pb *ProofBundle) {
+				pb.NewCheckpoint = append(append([]byte{}, pb.NewCheckpoint...), pb.FirmwareRelease[0])
+				pb.FirmwareRelease = pb.FirmwareRelease[1:]
+			},
+		}, {
+			desc:   "leaf hashes start",
+			modify: func(pb *ProofBundle) { pb.LeafHashesStart = 1 },
+		}, {
+			desc:   "prefix range",
+			modify: func(pb *ProofBundle) { pb.PrefixRange = [][]byte{[]byte("Roots")} },
+		}, {
+			desc:   "consistency from",
+			modify: func(pb *ProofBundle) { pb.ConsistencyFrom = 1 },
+		}, {
+			desc: "consistency proof",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.ConsistencyProof = 1, [][]byte{[]byte("Branches")}
+			},
+		}, {
+			desc: "inclusion proof",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.LeafIndex, pb.InclusionProof = 1, 1, [][]byte{[]byte("Twigs")}
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pb := testBundle()
+			test.modify(&pb)
+			got, err := BundleDigest(pb)
+			if err != nil {
+				t.Fatalf("BundleDigest: %v", err)
+			}
+			if bytes.Equal(got, want) {
+				t.Fatalf("BundleDigest did not change for modified bundle")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	hash := bytes.Repeat([]byte{1}, 32)
+	validBundle := func() ProofBundle {
+		return ProofBundle{
+			NewCheckpoint:   []byte("ArmoryDrive Log v0\n3\nYmFuYW5hcw==\n\n— log sig\n"),
+			FirmwareRelease: []byte("{\"revision\": \"v1\"}\n\n— release sig\n"),
+			LeafHashes:      [][]byte{hash, hash, hash},
+		}
+	}
+	for _, test := range []struct {
+		desc    string
+		modify  func(pb *ProofBundle)
+		wantErr bool
+	}{
+		{
+			desc:   "valid",
+			modify: func(pb *ProofBundle) {},
+		}, {
+			desc: "valid with prefix range",
+			modify: func(pb *ProofBundle) {
+				pb.LeafHashesStart, pb.PrefixRange, pb.LeafHashes = 2, [][]byte{hash}, pb.LeafHashes[2:]
+			},
+		}, {
+			desc: "valid with proofs",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.ConsistencyProof, pb.LeafIndex, pb.InclusionProof, pb.LeafHashes = 1, [][]byte{hash}, 2, [][]byte{hash, hash}, nil
+			},
+		}, {
+			desc: "proofs and leaf hashes",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.ConsistencyProof, pb.LeafIndex, pb.InclusionProof = 1, [][]byte{hash}, 2, [][]byte{hash, hash}
+			},
+			wantErr: true,
+		}, {
+			desc: "proofs without consistency from",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyProof, pb.LeafIndex, pb.InclusionProof, pb.LeafHashes = [][]byte{hash}, 2, [][]byte{hash, hash}, nil
+			},
+			wantErr: true,
+		}, {
+			desc: "consistency from checkpoint size",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.LeafIndex, pb.LeafHashes = 3, 2, nil
+			},
+			wantErr: true,
+		}, {
+			desc: "leaf index before consistency from",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.LeafIndex, pb.LeafHashes = 2, 1, nil
+			},
+			wantErr: true,
+		}, {
+			desc: "short inclusion proof hash",
+			modify: func(pb *ProofBundle) {
+				pb.ConsistencyFrom, pb.LeafIndex, pb.InclusionProof, pb.LeafHashes = 1, 2, [][]byte{hash[1:]}, nil
+			},
+			wantErr: true,
+		}, {
+			desc:    "empty checkpoint",
+			modify:  func(pb *ProofBundle) { pb.NewCheckpoint = nil },
+			wantErr: true,
+		}, {
+			desc:    "empty release",
+			modify:  func(pb *ProofBundle) { pb.FirmwareRelease = nil },
+			wantErr: true,
+		}, {
+			desc:    "short leaf hash",
+			modify:  func(pb *ProofBundle) { pb.LeafHashes[1] = hash[1:] },
+			wantErr: true,
+		}, {
+			desc: "short prefix range hash",
+			modify: func(pb *ProofBundle) {
+				pb.LeafHashesStart, pb.PrefixRange, pb.LeafHashes = 2, [][]byte{hash[1:]}, pb.LeafHashes[2:]
+			},
+			wantErr: true,
+		}, {
+			desc: "missing prefix range",
+			modify: func(pb *ProofBundle) {
+				pb.LeafHashesStart, pb.LeafHashes = 2, pb.LeafHashes[2:]
+			},
+			wantErr: true,
+		}, {
+			desc:    "too few leaf hashes",
+			modify:  func(pb *ProofBundle) { pb.LeafHashes = pb.LeafHashes[1:] },
+			wantErr: true,
+		}, {
+			desc:    "too many leaf hashes",
+			modify:  func(pb *ProofBundle) { pb.LeafHashes = append(pb.LeafHashes, hash) },
+			wantErr: true,
+		}, {
+			desc:    "unsigned checkpoint",
+			modify:  func(pb *ProofBundle) { pb.NewCheckpoint = []byte("ArmoryDrive Log v0\n3\nYmFuYW5hcw==\n") },
+			wantErr: true,
+		}, {
+			desc: "malformed checkpoint",
+			modify: func(pb *ProofBundle) {
+				pb.NewCheckpoint = []byte("ArmoryDrive Log v0\nthree\nYmFuYW5hcw==\n\n— log sig\n")
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pb := validBundle()
+			test.modify(&pb)
+			if err := pb.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate: %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseProofBundle(t *testing.T) {
+	want := testBundle()
+	plain, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	compressed := gzipped(t, plain)
+	// Whitespace around the JSON compresses to almost nothing, however much of it
+	// there is.
+	bomb := gzipped(t, append(plain, bytes.Repeat([]byte(" "), MaxProofBundleSize)...))
+	bin, err := binaryBundle().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		raw     []byte
+		want    ProofBundle
+		wantErr bool
+	}{
+		{
+			desc: "plain",
+			raw:  plain,
+		}, {
+			desc: "gzip",
+			raw:  compressed,
+		}, {
+			desc:    "truncated gzip",
+			raw:     compressed[:len(compressed)/2],
+			wantErr: true,
+		}, {
+			desc:    "gzip too large",
+			raw:     bomb,
+			wantErr: true,
+		}, {
+			desc: "binary",
+			raw:  bin,
+			want: binaryBundle(),
+		}, {
+			desc:    "not JSON",
+			raw:     []byte("not a bundle"),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := ParseProofBundle(test.raw)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ParseProofBundle: %v, wantErr %t", err, test.wantErr)
+			}
+			if test.want.NewCheckpoint == nil {
+				test.want = want
+			}
+			if err == nil {
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("Got unexpected ProofBundle, diff: %s", diff)
+				}
+			}
+		})
+	}
+}
+
+// gzipped returns b compressed with gzip.
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// binaryBundle returns a bundle which can be encoded by MarshalBinary, as all of
+// its hashes are SHA256 hashes.
+func binaryBundle() ProofBundle {
+	pb := ProofBundle{
+		NewCheckpoint:   []byte("ArmoryDrive Log v0\n5\nYmFuYW5hcw==\n"),
+		FirmwareRelease: []byte("{\"revision\": \"v1\"}\n"),
+		LeafHashesStart: 2,
+	}
+	for i := 0; i < 3; i++ {
+		h := sha256.Sum256([]byte{byte(i)})
+		pb.LeafHashes = append(pb.LeafHashes, h[:])
+	}
+	h := sha256.Sum256([]byte("prefix"))
+	pb.PrefixRange = [][]byte{h[:]}
+	return pb
+}
+
+// binaryProofsBundle returns a bundle with proofs which can be encoded by
+// MarshalBinary.
+func binaryProofsBundle() ProofBundle {
+	pb := ProofBundle{
+		NewCheckpoint:   []byte("ArmoryDrive Log v0\n5\nYmFuYW5hcw==\n"),
+		FirmwareRelease: []byte("{\"revision\": \"v1\"}\n"),
+		ConsistencyFrom: 2,
+		LeafIndex:       3,
+	}
+	for i := 0; i < 3; i++ {
+		h := sha256.Sum256([]byte{byte(i)})
+		pb.ConsistencyProof = append(pb.ConsistencyProof, h[:])
+		h = sha256.Sum256([]byte{byte(i), byte(i)})
+		pb.InclusionProof = append(pb.InclusionProof, h[:])
+	}
+	return pb
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	// Proofs are only encoded if the bundle HasProofs, so these wouldn't round trip.
+	withoutConsistencyFrom := func(edit func(*ProofBundle)) ProofBundle {
+		pb := binaryBundle()
+		edit(&pb)
+		return pb
+	}
+	for _, test := range []struct {
+		desc    string
+		pb      ProofBundle
+		wantErr bool
+	}{
+		{
+			desc: "full",
+			pb:   binaryBundle(),
+		}, {
+			desc: "proofs",
+			pb:   binaryProofsBundle(),
+		}, {
+			desc: "empty",
+			pb:   ProofBundle{},
+		}, {
+			desc:    "consistency proof without ConsistencyFrom",
+			pb:      withoutConsistencyFrom(func(pb *ProofBundle) { pb.ConsistencyProof = [][]byte{make([]byte, sha256.Size)} }),
+			wantErr: true,
+		}, {
+			desc:    "inclusion proof without ConsistencyFrom",
+			pb:      withoutConsistencyFrom(func(pb *ProofBundle) { pb.InclusionProof = [][]byte{make([]byte, sha256.Size)} }),
+			wantErr: true,
+		}, {
+			desc:    "leaf index without ConsistencyFrom",
+			pb:      withoutConsistencyFrom(func(pb *ProofBundle) { pb.LeafIndex = 1 }),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			b, err := test.pb.MarshalBinary()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("MarshalBinary: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got ProofBundle
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if diff := cmp.Diff(test.pb, got); diff != "" {
+				t.Errorf("Round trip changed ProofBundle, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMarshalBinaryBadHash(t *testing.T) {
+	if _, err := testBundle().MarshalBinary(); err == nil {
+		t.Error("MarshalBinary with short leaf hashes: got no error")
+	}
+}
+
+func TestUnmarshalBinary(t *testing.T) {
+	b, err := binaryBundle().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	hugeCount := append([]byte{}, b[:len(b)-8-3*sha256.Size]...)
+	hugeCount = binary.BigEndian.AppendUint64(hugeCount, 1<<60)
+
+	for _, test := range []struct {
+		desc    string
+		raw     []byte
+		wantErr bool
+	}{
+		{
+			desc: "valid",
+			raw:  b,
+		}, {
+			desc:    "bad header",
+			raw:     append([]byte("ADPB\x02"), b[len(BinaryMagic):]...),
+			wantErr: true,
+		}, {
+			desc:    "truncated",
+			raw:     b[:len(b)-1],
+			wantErr: true,
+		}, {
+			desc:    "trailing data",
+			raw:     append(append([]byte{}, b...), 0),
+			wantErr: true,
+		}, {
+			desc:    "huge hash count",
+			raw:     hugeCount,
+			wantErr: true,
+		}, {
+			desc:    "proofs with zero consistency from",
+			raw:     append(append([]byte{}, b...), make([]byte, 4*8)...),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var pb ProofBundle
+			err := pb.UnmarshalBinary(test.raw)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("UnmarshalBinary: %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package release creates and signs FirmwareRelease manifests.
+package release
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// DefaultGitHubAPI is the base URL of the GitHub API.
+const DefaultGitHubAPI = "https://api.github.com"
+
+// ReleaseConfig describes the firmware release to build.
+type ReleaseConfig struct {
+	// Repo is the GitHub repo, in owner/name form, which the release is built from.
+	Repo string
+	// Description is a human readable description of the release.
+	Description string
+	// PlatformID identifies the platform which the release is targetting.
+	PlatformID string
+	// CommitHash is the git commit hash which the release was built from.
+	CommitHash string
+	// ToolChain is the toolchain used to build the release.
+	ToolChain string
+	// RevisionTag is the git tag name which identifies the firmware revision.
+	RevisionTag string
+
+	// Artifacts is a list of globs or http(s) URLs specifying the release artifacts
+	// to include. Entries prefixed with ! are exclusions: any artifact whose path,
+	// or base name, matches one of them is skipped regardless of where it appears
+	// in the list.
+	Artifacts []string
+
+	// SourceURL is the URL of the source tarball for the release. If empty, the
+	// GitHub tarball of RevisionTag in Repo is used.
+	SourceURL string
+	// SourceGitTree causes the git tree hash of CommitHash, as reported by the
+	// GitHub API, to be recorded in place of the SHA256 of the source tarball.
+	// GitHub's tarballs are not byte-for-byte stable over time, whereas the tree
+	// hash can always be recomputed from a checkout of the commit.
+	SourceGitTree bool
+	// CreatedAt is recorded as the release creation time. If zero, the current
+	// time truncated to the second is used.
+	CreatedAt time.Time
+
+	// AllowTagMismatch causes a failure to confirm that RevisionTag resolves to
+	// CommitHash to be logged as a warning, rather than returned as an error.
+	AllowTagMismatch bool
+	// CheckAncestor additionally requires CommitHash to be in the history of
+	// RevisionTag, as reported by the GitHub compare API.
+	CheckAncestor bool
+
+	// HTTPClient is used for all HTTP requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// GitHubAPI is the base URL of the GitHub API. If empty, DefaultGitHubAPI is
+	// used.
+	GitHubAPI string
+}
+
+// ErrTagMismatch is returned when the revision tag does not resolve to the
+// commit which the release claims to be built from.
+type ErrTagMismatch struct {
+	// Tag is the revision tag.
+	Tag string
+	// Got is the commit hash which Tag resolves to.
+	Got string
+	// Want is the commit hash which the release claims.
+	Want string
+}
+
+func (e ErrTagMismatch) Error() string {
+	return fmt.Sprintf("tag %q resolves to commit %s, not %s", e.Tag, e.Got, e.Want)
+}
+
+// ErrNotAncestor is returned when the commit which the release claims to be built
+// from is not in the history of the revision tag.
+type ErrNotAncestor struct {
+	// Commit is the commit hash which the release claims.
+	Commit string
+	// Tag is the revision tag.
+	Tag string
+	// Status describes Tag relative to Commit, as reported by the GitHub compare API.
+	Status string
+}
+
+func (e ErrNotAncestor) Error() string {
+	return fmt.Sprintf("commit %s is not in the history of tag %q (tag is %s)", e.Commit, e.Tag, e.Status)
+}
+
+// ErrDuplicateArtifact is returned when two different files or URLs would be
+// recorded under the same artifact name.
+type ErrDuplicateArtifact struct {
+	// Name is the artifact name.
+	Name string
+	// First and Second are the paths or URLs of the two artifacts.
+	First, Second string
+}
+
+func (e ErrDuplicateArtifact) Error() string {
+	return fmt.Sprintf("artifact %q matched by both %q and %q", e.Name, e.First, e.Second)
+}
+
+// BuildRelease returns the FirmwareRelease described by cfg, after checking with
+// GitHub that its revision tag resolves to its commit hash, and hashing its source
+// tarball, or looking up its git tree, and artifacts.
+func BuildRelease(cfg ReleaseConfig) (api.FirmwareRelease, error) {
+	if err := cfg.validate(); err != nil {
+		return api.FirmwareRelease{}, err
+	}
+	b := builder{
+		c:         cfg.HTTPClient,
+		githubAPI: cfg.GitHubAPI,
+	}
+	if b.c == nil {
+		b.c = http.DefaultClient
+	}
+	if b.githubAPI == "" {
+		b.githubAPI = DefaultGitHubAPI
+	}
+
+	sourceURL := cfg.SourceURL
+	if sourceURL == "" {
+		sourceURL = fmt.Sprintf("https://github.com/%s/archive/refs/tags/%s.tar.gz", cfg.Repo, cfg.RevisionTag)
+	}
+	var sourceHash []byte
+	var sourceTree string
+	if cfg.SourceGitTree {
+		t, err := b.commitTree(cfg.Repo, cfg.CommitHash)
+		if err != nil {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to look up source git tree: %v", err)
+		}
+		sourceTree = t
+	} else {
+		h, _, err := b.hashRemote(sourceURL)
+		if err != nil {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to hash source tarball (%s): %v", sourceURL, err)
+		}
+		sourceHash = h
+	}
+
+	created := cfg.CreatedAt
+	if created.IsZero() {
+		created = time.Now().UTC().Truncate(time.Second)
+	}
+
+	fr := api.FirmwareRelease{
+		Description:   cfg.Description,
+		PlatformID:    cfg.PlatformID,
+		Revision:      cfg.RevisionTag,
+		SourceURL:     sourceURL,
+		SourceSHA256:  sourceHash,
+		SourceGitTree: sourceTree,
+		ToolChain:     cfg.ToolChain,
+		BuildArgs: map[string]string{
+			"REV": cfg.CommitHash,
+		},
+		CreatedAt: created,
+	}
+
+	if err := b.checkTagCommit(cfg.Repo, cfg.RevisionTag, cfg.CommitHash); err != nil {
+		if !cfg.AllowTagMismatch {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to confirm revision tag: %w", err)
+		}
+		logging.Warning("Failed to confirm revision tag", "error", err)
+	}
+	if cfg.CheckAncestor {
+		if err := b.checkCommitAncestor(cfg.Repo, cfg.RevisionTag, cfg.CommitHash); err != nil {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to confirm commit is in the history of the revision tag: %w", err)
+		}
+	}
+
+	logging.Info("Hashing release artifacts")
+	artifacts, sizes, err := b.hashArtifacts(cfg.Artifacts)
+	if err != nil {
+		return api.FirmwareRelease{}, fmt.Errorf("failed to hash artifacts: %w", err)
+	}
+	if len(artifacts) == 0 {
+		return api.FirmwareRelease{}, errors.New("artifacts matched ZERO files")
+	}
+	fr.ArtifactSHA256 = artifacts
+	fr.ImageSize = sizes[fr.FirmwareArtifact()]
+	return fr, nil
+}
+
+// SignRelease returns the canonical JSON encoding of fr as a note signed by each
+// of the signers. Signing with more than one key allows a manifest to be verified
+// by either the old or new key during key rotation.
+func SignRelease(fr api.FirmwareRelease, signers ...note.Signer) ([]byte, error) {
+	if len(signers) == 0 {
+		return nil, errors.New("no signers provided")
+	}
+	pp, err := fr.CanonicalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal FirmwareRelease: %v", err)
+	}
+	// Note body must end in a trailing new line.
+	return note.Sign(&note.Note{Text: string(pp) + "\n"}, signers...)
+}
+
+func (cfg ReleaseConfig) validate() error {
+	errs := make([]string, 0)
+	checkEmpty := func(n, s string) {
+		if s == "" {
+			errs = append(errs, fmt.Sprintf("%s can't be empty", n))
+		}
+	}
+	checkEmpty("Repo", cfg.Repo)
+	checkEmpty("Description", cfg.Description)
+	checkEmpty("PlatformID", cfg.PlatformID)
+	checkEmpty("CommitHash", cfg.CommitHash)
+	checkEmpty("ToolChain", cfg.ToolChain)
+	checkEmpty("RevisionTag", cfg.RevisionTag)
+	if len(cfg.Artifacts) == 0 {
+		errs = append(errs, "Artifacts can't be empty")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid ReleaseConfig: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// builder makes the HTTP requests needed to build a release.
+type builder struct {
+	c         *http.Client
+	githubAPI string
+}
+
+// hashArtifacts returns the SHA256 hashes and sizes of the artifacts specified by
+// the globs, keyed by their base names; see ReleaseConfig.Artifacts.
+// It is an error for two different files or URLs to share a base name, as only
+// one of them could be recorded in the release; a file matched by more than one
+// glob is only hashed once.
+func (b builder) hashArtifacts(globs []string) (map[string][]byte, map[string]uint64, error) {
+	var includes, excludes []string
+	for _, glob := range globs {
+		if ex, ok := strings.CutPrefix(glob, "!"); ok {
+			if _, err := filepath.Match(ex, ""); err != nil {
+				return nil, nil, fmt.Errorf("invalid exclusion %q: %v", glob, err)
+			}
+			excludes = append(excludes, ex)
+			continue
+		}
+		includes = append(includes, glob)
+	}
+	excluded := func(p, name string) bool {
+		for _, ex := range excludes {
+			// Errors were checked above.
+			if m, _ := filepath.Match(ex, p); m {
+				return true
+			}
+			if m, _ := filepath.Match(ex, name); m {
+				return true
+			}
+		}
+		return false
+	}
+
+	r := make(map[string][]byte)
+	sizes := make(map[string]uint64)
+	// sources records where each artifact was found, so that two different files
+	// which would be recorded under the same name can be detected.
+	sources := make(map[string]string)
+	add := func(name, src string, hashFn func(string) ([]byte, uint64, error)) error {
+		if prev, ok := sources[name]; ok {
+			if prev == src {
+				return nil
+			}
+			return ErrDuplicateArtifact{Name: name, First: prev, Second: src}
+		}
+		h, size, err := hashFn(src)
+		if err != nil {
+			return err
+		}
+		sources[name], r[name], sizes[name] = src, h, size
+		return nil
+	}
+	for _, glob := range includes {
+		if u, err := url.Parse(glob); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			if excluded(glob, path.Base(u.Path)) {
+				continue
+			}
+			if err := add(path.Base(u.Path), glob, b.hashRemote); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		match, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range match {
+			_, name := filepath.Split(f)
+			if excluded(f, name) {
+				logging.V(1).Info("Excluding file", "path", f)
+				continue
+			}
+			if err := add(name, filepath.Clean(f), hashFile); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return r, sizes, nil
+}
+
+// checkTagCommit uses the GitHub API to check that the tag in the given repo
+// resolves to a commit whose hash begins with commitHash.
+func (b builder) checkTagCommit(repo, tag, commitHash string) error {
+	u := fmt.Sprintf("%s/repos/%s/commits/%s", b.githubAPI, repo, url.PathEscape(tag))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// Ask for just the commit SHA rather than the full commit object.
+	req.Header.Set("Accept", "application/vnd.github.sha")
+	resp, err := b.c.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %q: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got non-200 HTTP status when fetching %q: %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response from %q: %v", u, err)
+	}
+	sha := strings.TrimSpace(string(body))
+	if len(commitHash) == 0 || !strings.HasPrefix(sha, strings.ToLower(commitHash)) {
+		return ErrTagMismatch{Tag: tag, Got: sha, Want: commitHash}
+	}
+	return nil
+}
+
+// checkCommitAncestor uses the GitHub compare API to check that commitHash is reachable
+// from the tag in the given repo, i.e. that the tag is at or after the commit.
+func (b builder) checkCommitAncestor(repo, tag, commitHash string) error {
+	u := fmt.Sprintf("%s/repos/%s/compare/%s...%s", b.githubAPI, repo, url.PathEscape(commitHash), url.PathEscape(tag))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := b.c.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %q: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got non-200 HTTP status when fetching %q: %s", u, resp.Status)
+	}
+	var cmp struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&cmp); err != nil {
+		return fmt.Errorf("failed to parse response from %q: %v", u, err)
+	}
+	// The status describes the tag relative to the commit.
+	switch cmp.Status {
+	case "ahead", "identical":
+		return nil
+	case "behind", "diverged":
+		return ErrNotAncestor{Commit: commitHash, Tag: tag, Status: cmp.Status}
+	default:
+		return fmt.Errorf("unexpected comparison status %q for commit %s and tag %q", cmp.Status, commitHash, tag)
+	}
+}
+
+// commitTree uses the GitHub API to look up the hash of the git tree object of the
+// commit in the given repo.
+func (b builder) commitTree(repo, commitHash string) (string, error) {
+	u := fmt.Sprintf("%s/repos/%s/commits/%s", b.githubAPI, repo, url.PathEscape(commitHash))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := b.c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %q: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("got non-200 HTTP status when fetching %q: %s", u, resp.Status)
+	}
+	var c struct {
+		Commit struct {
+			Tree struct {
+				SHA string `json:"sha"`
+			} `json:"tree"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return "", fmt.Errorf("failed to parse response from %q: %v", u, err)
+	}
+	t := c.Commit.Tree.SHA
+	if _, err := hex.DecodeString(t); err != nil || len(t) == 0 {
+		return "", fmt.Errorf("invalid tree hash %q for commit %s", t, commitHash)
+	}
+	return t, nil
+}
+
+// hashRemote returns the SHA256 and size of the contents of the resource pointed
+// to by url.
+func (b builder) hashRemote(url string) ([]byte, uint64, error) {
+	resp, err := b.c.Get(url)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch %q: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, 0, fmt.Errorf("got non-200 HTTP status when fetching %q: %s", url, resp.Status)
+	}
+	return hash(resp.Body)
+}
+
+func hashFile(path string) ([]byte, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return hash(f)
+}
+
+func hash(r io.Reader) ([]byte, uint64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to hash content: %v", err)
+	}
+	return h.Sum(nil), uint64(n), nil
+}
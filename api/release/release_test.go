@@ -0,0 +1,466 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package release
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestCheckTagCommit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/usbarmory/armory-drive/commits/v2021.06.25" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("acd1c56f3a32e3ab3aac6866a3bd8b70a6575d87"))
+	}))
+	defer s.Close()
+
+	for _, test := range []struct {
+		desc       string
+		tag        string
+		commitHash string
+		wantErr    bool
+	}{
+		{
+			desc:       "short hash matches",
+			tag:        "v2021.06.25",
+			commitHash: "acd1c56",
+		}, {
+			desc:       "full hash matches",
+			tag:        "v2021.06.25",
+			commitHash: "acd1c56f3a32e3ab3aac6866a3bd8b70a6575d87",
+		}, {
+			desc:       "mismatch",
+			tag:        "v2021.06.25",
+			commitHash: "f3a32e3",
+			wantErr:    true,
+		}, {
+			desc:       "unknown tag",
+			tag:        "v1999.01.01",
+			commitHash: "acd1c56",
+			wantErr:    true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := builder{c: http.DefaultClient, githubAPI: s.URL}.checkTagCommit("usbarmory/armory-drive", test.tag, test.commitHash)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckCommitAncestor(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := map[string]string{
+			"/repos/usbarmory/armory-drive/compare/acd1c56...v2021.06.25": "identical",
+			"/repos/usbarmory/armory-drive/compare/1234567...v2021.06.25": "ahead",
+			"/repos/usbarmory/armory-drive/compare/f3a32e3...v2021.06.25": "diverged",
+			"/repos/usbarmory/armory-drive/compare/b90e2d9...v2021.06.25": "behind",
+		}[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"status": %q, "ahead_by": 1}`, status)
+	}))
+	defer s.Close()
+
+	for _, test := range []struct {
+		desc       string
+		commitHash string
+		wantErr    bool
+	}{
+		{
+			desc:       "tagged commit",
+			commitHash: "acd1c56",
+		}, {
+			desc:       "earlier commit",
+			commitHash: "1234567",
+		}, {
+			desc:       "commit on another branch",
+			commitHash: "f3a32e3",
+			wantErr:    true,
+		}, {
+			desc:       "later commit",
+			commitHash: "b90e2d9",
+			wantErr:    true,
+		}, {
+			desc:       "unknown commit",
+			commitHash: "0000000",
+			wantErr:    true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := builder{c: http.DefaultClient, githubAPI: s.URL}.checkCommitAncestor("usbarmory/armory-drive", "v2021.06.25", test.commitHash)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHashArtifacts(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("remote"))
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "armory-drive.imx"), []byte("local"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	globs := []string{filepath.Join(dir, "armory-drive.*"), s.URL + "/releases/v1/armory-drive.sig"}
+
+	got, gotSizes, err := builder{c: http.DefaultClient}.hashArtifacts(globs)
+	if err != nil {
+		t.Fatalf("hashArtifacts: %v", err)
+	}
+	local, remote := sha256.Sum256([]byte("local")), sha256.Sum256([]byte("remote"))
+	want := map[string][]byte{
+		"armory-drive.imx": local[:],
+		"armory-drive.sig": remote[:],
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Got unexpected artifact hashes, diff: %s", diff)
+	}
+	wantSizes := map[string]uint64{
+		"armory-drive.imx": uint64(len("local")),
+		"armory-drive.sig": uint64(len("remote")),
+	}
+	if diff := cmp.Diff(wantSizes, gotSizes); diff != "" {
+		t.Errorf("Got unexpected artifact sizes, diff: %s", diff)
+	}
+}
+
+func TestHashArtifactsDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, d, "armory-drive.imx"), []byte(d), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		desc    string
+		globs   []string
+		wantErr bool
+	}{
+		{
+			desc:  "same file matched twice",
+			globs: []string{filepath.Join(dir, "a", "armory-drive.*"), filepath.Join(dir, "a", "armory-drive.imx")},
+		}, {
+			desc:    "same name in different dirs",
+			globs:   []string{filepath.Join(dir, "*", "armory-drive.imx")},
+			wantErr: true,
+		}, {
+			desc:    "file and URL with same name",
+			globs:   []string{filepath.Join(dir, "a", "armory-drive.imx"), "https://example.com/armory-drive.imx"},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, _, err := builder{c: http.DefaultClient}.hashArtifacts(test.globs)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("hashArtifacts: %v, wantErr %t", err, test.wantErr)
+			}
+			if err == nil && len(got) != 1 {
+				t.Errorf("Got %d artifacts, want 1", len(got))
+			}
+		})
+	}
+}
+
+func TestHashArtifactsExclusions(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"armory-drive.imx", "armory-drive.csf", "armory-drive.elf", "armory-drive.o"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	all := filepath.Join(dir, "armory-drive.*")
+
+	for _, test := range []struct {
+		desc    string
+		globs   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			desc:  "no exclusions",
+			globs: []string{all},
+			want:  []string{"armory-drive.csf", "armory-drive.elf", "armory-drive.imx", "armory-drive.o"},
+		}, {
+			desc:  "exclude base names",
+			globs: []string{all, "!*.elf", "!*.o"},
+			want:  []string{"armory-drive.csf", "armory-drive.imx"},
+		}, {
+			desc:  "exclusion before include",
+			globs: []string{"!armory-drive.elf", all},
+			want:  []string{"armory-drive.csf", "armory-drive.imx", "armory-drive.o"},
+		}, {
+			desc:  "exclude full path",
+			globs: []string{all, "!" + filepath.Join(dir, "armory-drive.[eo]*")},
+			want:  []string{"armory-drive.csf", "armory-drive.imx"},
+		}, {
+			desc:  "exclude remote",
+			globs: []string{all, "https://example.com/armory-drive.sig", "!*.sig", "!*.elf", "!*.o"},
+			want:  []string{"armory-drive.csf", "armory-drive.imx"},
+		}, {
+			desc:    "invalid exclusion",
+			globs:   []string{all, "!["},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, _, err := builder{c: http.DefaultClient}.hashArtifacts(test.globs)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("hashArtifacts: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var names []string
+			for n := range got {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			if diff := cmp.Diff(test.want, names); diff != "" {
+				t.Errorf("Got unexpected artifacts, diff: %s", diff)
+			}
+		})
+	}
+}
+
+// fakeGitHub returns a server which serves the GitHub API and source tarball
+// requests made by BuildRelease for a v1.0.0 tag of example/repo at commit abc123.
+func fakeGitHub(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/example/repo/commits/v1.0.0":
+			_, _ = w.Write([]byte("abc123def456"))
+		case "/repos/example/repo/commits/abc123":
+			_, _ = w.Write([]byte(`{"sha": "abc123def456", "commit": {"tree": {"sha": "4b825dc642cb6eb9a060e54bf8d69288fbee4904"}}}`))
+		case "/repos/example/repo/compare/abc123...v1.0.0":
+			_, _ = w.Write([]byte(`{"status": "identical"}`))
+		case "/src.tar.gz":
+			_, _ = w.Write([]byte("source"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestBuildRelease(t *testing.T) {
+	s := fakeGitHub(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "armory-drive.imx"), []byte("imx"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	created := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	cfg := func(f func(*ReleaseConfig)) ReleaseConfig {
+		c := ReleaseConfig{
+			Repo:          "example/repo",
+			Description:   "release",
+			PlatformID:    "armory-drive",
+			CommitHash:    "abc123",
+			ToolChain:     "tamago1.17.1",
+			RevisionTag:   "v1.0.0",
+			Artifacts:     []string{filepath.Join(dir, "armory-drive.*")},
+			SourceURL:     s.URL + "/src.tar.gz",
+			CreatedAt:     created,
+			CheckAncestor: true,
+			GitHubAPI:     s.URL,
+		}
+		if f != nil {
+			f(&c)
+		}
+		return c
+	}
+	source, imx := sha256.Sum256([]byte("source")), sha256.Sum256([]byte("imx"))
+	want := api.FirmwareRelease{
+		Description:    "release",
+		PlatformID:     "armory-drive",
+		Revision:       "v1.0.0",
+		ArtifactSHA256: map[string][]byte{"armory-drive.imx": imx[:]},
+		ImageSize:      uint64(len("imx")),
+		SourceURL:      s.URL + "/src.tar.gz",
+		SourceSHA256:   source[:],
+		ToolChain:      "tamago1.17.1",
+		BuildArgs:      map[string]string{"REV": "abc123"},
+		CreatedAt:      created,
+	}
+
+	for _, test := range []struct {
+		desc    string
+		cfg     ReleaseConfig
+		wantErr bool
+		// wantAs, if set, is a pointer to the typed error which the error
+		// returned must wrap.
+		wantAs any
+		// modifyWant, if set, is applied to the expected release.
+		modifyWant func(*api.FirmwareRelease)
+	}{
+		{
+			desc: "valid",
+			cfg:  cfg(nil),
+		}, {
+			desc: "tag mismatch allowed",
+			cfg: cfg(func(c *ReleaseConfig) {
+				c.RevisionTag = "v0.0.1"
+				c.CheckAncestor = false
+				c.AllowTagMismatch = true
+			}),
+		}, {
+			desc:    "tag mismatch",
+			cfg:     cfg(func(c *ReleaseConfig) { c.CommitHash = "def456" }),
+			wantErr: true,
+			wantAs:  &ErrTagMismatch{},
+		}, {
+			desc: "duplicate artifact",
+			cfg: cfg(func(c *ReleaseConfig) {
+				c.Artifacts = append(c.Artifacts, s.URL+"/armory-drive.imx")
+			}),
+			wantErr: true,
+			wantAs:  &ErrDuplicateArtifact{},
+		}, {
+			desc:    "no artifacts matched",
+			cfg:     cfg(func(c *ReleaseConfig) { c.Artifacts = []string{filepath.Join(dir, "*.sig")} }),
+			wantErr: true,
+		}, {
+			desc:    "missing field",
+			cfg:     cfg(func(c *ReleaseConfig) { c.PlatformID = "" }),
+			wantErr: true,
+		}, {
+			desc: "source git tree",
+			cfg: cfg(func(c *ReleaseConfig) {
+				c.SourceGitTree = true
+				// The tarball isn't fetched when recording the git tree.
+				c.SourceURL = s.URL + "/missing.tar.gz"
+			}),
+			modifyWant: func(fr *api.FirmwareRelease) {
+				fr.SourceURL = s.URL + "/missing.tar.gz"
+				fr.SourceSHA256 = nil
+				fr.SourceGitTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+			},
+		}, {
+			desc: "source git tree of unknown commit",
+			cfg: cfg(func(c *ReleaseConfig) {
+				c.SourceGitTree = true
+				c.CommitHash = "def456"
+				c.CheckAncestor = false
+				c.AllowTagMismatch = true
+			}),
+			wantErr: true,
+		}, {
+			desc:    "missing source",
+			cfg:     cfg(func(c *ReleaseConfig) { c.SourceURL = s.URL + "/missing.tar.gz" }),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := BuildRelease(test.cfg)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("BuildRelease: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				if test.wantAs != nil && !errors.As(err, test.wantAs) {
+					t.Errorf("BuildRelease: got error %v, want %T", err, test.wantAs)
+				}
+				return
+			}
+			w := want
+			w.Revision = test.cfg.RevisionTag
+			if test.modifyWant != nil {
+				test.modifyWant(&w)
+			}
+			if diff := cmp.Diff(w, got); diff != "" {
+				t.Errorf("Got unexpected FirmwareRelease, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSignRelease(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "test-key")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	fr := api.FirmwareRelease{
+		Description:    "release",
+		PlatformID:     "armory-drive",
+		Revision:       "v1.0.0",
+		ArtifactSHA256: map[string][]byte{"armory-drive.imx": []byte("hash")},
+		ToolChain:      "tamago1.17.1",
+		BuildArgs:      map[string]string{"REV": "abc123"},
+	}
+
+	if _, err := SignRelease(fr); err == nil {
+		t.Error("SignRelease with no signers: got no error")
+	}
+
+	signed, err := SignRelease(fr, s)
+	if err != nil {
+		t.Fatalf("SignRelease: %v", err)
+	}
+	n, err := note.Open(signed, note.VerifierList(v))
+	if err != nil {
+		t.Fatalf("note.Open: %v", err)
+	}
+	pp, err := fr.CanonicalJSON()
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	if got, want := n.Text, string(pp)+"\n"; got != want {
+		t.Errorf("Got note text %q, want %q", got, want)
+	}
+	var got api.FirmwareRelease
+	if err := json.Unmarshal([]byte(n.Text), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(fr, got); diff != "" {
+		t.Errorf("Got unexpected FirmwareRelease, diff: %s", diff)
+	}
+}
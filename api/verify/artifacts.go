@@ -0,0 +1,49 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// BundleArtifacts is like Bundle, but takes the contents of the artifacts rather
+// than their hashes. The artifacts are hashed with SHA256, which is the hash used
+// by FirmwareRelease manifests to commit to artifacts.
+func BundleArtifacts(pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifacts map[string]io.Reader, origin string, opts ...Option) error {
+	artifactHashes, err := HashArtifacts(artifacts)
+	if err != nil {
+		return err
+	}
+	return Bundle(pb, oldCP, logSigV, frSigV, artifactHashes, origin, opts...)
+}
+
+// HashArtifacts reads each of the artifacts to the end, and returns their hashes
+// in the form expected by Bundle.
+func HashArtifacts(artifacts map[string]io.Reader) (map[string][]byte, error) {
+	r := make(map[string][]byte, len(artifacts))
+	for name, a := range artifacts {
+		h := sha256.New()
+		if _, err := io.Copy(h, a); err != nil {
+			return nil, fmt.Errorf("failed to hash artifact %q: %v", name, err)
+		}
+		r[name] = h.Sum(nil)
+	}
+	return r, nil
+}
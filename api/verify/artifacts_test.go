@@ -0,0 +1,79 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+)
+
+// errReader is an io.Reader which always fails.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestBundleArtifacts(t *testing.T) {
+	logSig := mustMakeSigner(t, testLogSignerPrivate)
+	fwSig := mustMakeSigner(t, testFirmwarePrivate)
+	logSigV := mustMakeVerifier(t, testLogSignerPublic)
+	fwSigV := mustMakeVerifier(t, testFirmwarePublic)
+
+	imageHash := sha256.Sum256([]byte("firmware image"))
+	fw := makeFirmwareRelease(t, map[string][]byte{api.FirmwareArtifactName: imageHash[:]}, fwSig)
+	leafHashes := append(append([][]byte{}, testLeafHashes...), Hasher().HashLeaf(fw))
+	roots := buildLog(t, leafHashes)
+	pb := api.ProofBundle{
+		FirmwareRelease: fw,
+		NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+		LeafHashes:      leafHashes,
+	}
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	for _, test := range []struct {
+		desc    string
+		image   io.Reader
+		wantErr bool
+	}{
+		{
+			desc:  "valid",
+			image: strings.NewReader("firmware image"),
+		}, {
+			desc:    "wrong image",
+			image:   strings.NewReader("evil image"),
+			wantErr: true,
+		}, {
+			desc:    "read error",
+			image:   errReader{},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := BundleArtifacts(pb, oldCP, logSigV, fwSigV, map[string]io.Reader{api.FirmwareArtifactName: test.image}, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("BundleArtifacts() = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import "github.com/transparency-dev/merkle/proof"
+
+// VerifyLeafInclusion checks that the raw leaf is committed to at index by a log
+// of the given size with the given root hash, using the inclusion proof provided.
+// The leaf is hashed in the same way as the log hashes its entries.
+func VerifyLeafInclusion(leaf []byte, index, size uint64, p [][]byte, root []byte) error {
+	h := Hasher()
+	return proof.VerifyInclusion(h, index, size, h.HashLeaf(leaf), p, root)
+}
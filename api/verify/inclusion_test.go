@@ -0,0 +1,73 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/transparency-dev/merkle/testonly"
+)
+
+func TestVerifyLeafInclusion(t *testing.T) {
+	tree := testonly.New(Hasher())
+	for i := 0; i < 7; i++ {
+		tree.AppendData([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	p, err := tree.InclusionProof(3, tree.Size())
+	if err != nil {
+		t.Fatalf("InclusionProof: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		leaf    []byte
+		index   uint64
+		root    []byte
+		wantErr bool
+	}{
+		{
+			desc:  "included",
+			leaf:  []byte("leaf 3"),
+			index: 3,
+			root:  tree.Hash(),
+		}, {
+			desc:    "wrong leaf",
+			leaf:    []byte("leaf 4"),
+			index:   3,
+			root:    tree.Hash(),
+			wantErr: true,
+		}, {
+			desc:    "wrong index",
+			leaf:    []byte("leaf 3"),
+			index:   2,
+			root:    tree.Hash(),
+			wantErr: true,
+		}, {
+			desc:    "wrong root",
+			leaf:    []byte("leaf 3"),
+			index:   3,
+			root:    tree.HashAt(6),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := VerifyLeafInclusion(test.leaf, test.index, tree.Size(), p, test.root)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("VerifyLeafInclusion() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
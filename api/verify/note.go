@@ -0,0 +1,83 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+// ErrUnknownSigners is returned by OpenNote when none of the signatures on a note
+// were made by a known key. It wraps the *note.UnverifiedNoteError returned by
+// note.Open, so callers which check for that error continue to work.
+type ErrUnknownSigners struct {
+	// Signers are the signatures on the note, none of which could be verified.
+	Signers []note.Signature
+
+	err *note.UnverifiedNoteError
+}
+
+func (e ErrUnknownSigners) Error() string {
+	if len(e.Signers) == 0 {
+		return "note has no signatures"
+	}
+	ids := make([]string, 0, len(e.Signers))
+	for _, s := range e.Signers {
+		ids = append(ids, fmt.Sprintf("%s+%08x", s.Name, s.Hash))
+	}
+	return fmt.Sprintf("note has no verifiable signatures, it is signed by unknown key(s) %s", strings.Join(ids, ", "))
+}
+
+// Unwrap returns the *note.UnverifiedNoteError returned by note.Open.
+func (e ErrUnknownSigners) Unwrap() error {
+	if e.err == nil {
+		return nil
+	}
+	return e.err
+}
+
+// OpenNote is like note.Open, but if none of the signatures on the note can be
+// verified, the ErrUnknownSigners returned lists the name and key hash of every
+// signer, so that a mismatch with the expected keys can be diagnosed.
+func OpenNote(msg []byte, known note.Verifiers) (*note.Note, error) {
+	n, err := note.Open(msg, known)
+	var uErr *note.UnverifiedNoteError
+	if errors.As(err, &uErr) {
+		return nil, ErrUnknownSigners{Signers: uErr.Note.UnverifiedSigs, err: uErr}
+	}
+	return n, err
+}
+
+// CheckNoteSignatures returns an error if the signed note msg carries more than
+// maxSigs signature lines.
+//
+// This is a cheap check which can be used to reject maliciously padded notes before
+// passing them to note.Open.
+func CheckNoteSignatures(msg []byte, maxSigs int) error {
+	// As with note.Open, the signatures follow the last blank line in the note.
+	i := bytes.LastIndex(msg, []byte("\n\n"))
+	if i < 0 {
+		// This isn't a valid note, but that's for note.Open to report.
+		return nil
+	}
+	if n := bytes.Count(msg[i+2:], []byte("\n")); n > maxSigs {
+		return fmt.Errorf("note has %d signatures, more than the maximum of %d", n, maxSigs)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestOpenNote(t *testing.T) {
+	var signers []note.Signer
+	var verifiers []note.Verifier
+	for _, name := range []string{"alpha", "beta"} {
+		skey, vkey, err := note.GenerateKey(rand.Reader, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, mustMakeSigner(t, skey))
+		verifiers = append(verifiers, mustMakeVerifier(t, vkey))
+	}
+	msg, err := note.Sign(&note.Note{Text: "body\n"}, signers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc        string
+		known       []note.Verifier
+		wantSigners []string
+		wantErr     bool
+	}{
+		{
+			desc:  "one known",
+			known: verifiers[1:],
+		}, {
+			desc:        "all unknown",
+			known:       []note.Verifier{mustMakeVerifier(t, testLogSignerPublic)},
+			wantSigners: []string{"alpha", "beta"},
+			wantErr:     true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			n, err := OpenNote(msg, note.VerifierList(test.known...))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("OpenNote: %v, wantErr %t", err, test.wantErr)
+			}
+			if !test.wantErr {
+				if n.Text != "body\n" {
+					t.Errorf("got text %q, want %q", n.Text, "body\n")
+				}
+				return
+			}
+			var uErr ErrUnknownSigners
+			if !errors.As(err, &uErr) {
+				t.Fatalf("got error %v, want ErrUnknownSigners", err)
+			}
+			var nErr *note.UnverifiedNoteError
+			if !errors.As(err, &nErr) {
+				t.Errorf("got error %v, want it to wrap *note.UnverifiedNoteError", err)
+			}
+			if got, want := len(uErr.Signers), len(test.wantSigners); got != want {
+				t.Fatalf("got %d signers, want %d", got, want)
+			}
+			for i, name := range test.wantSigners {
+				v := verifiers[i]
+				if got := uErr.Signers[i].Name; got != name {
+					t.Errorf("signer %d: got name %q, want %q", i, got, name)
+				}
+				if id := fmt.Sprintf("%s+%08x", v.Name(), v.KeyHash()); !strings.Contains(err.Error(), id) {
+					t.Errorf("error %q doesn't mention signer %s", err, id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import "golang.org/x/mod/sumdb/note"
+
+// DefaultMaxSignatures is the default maximum number of signature lines a note may
+// carry before it is rejected without attempting to verify it.
+const DefaultMaxSignatures = 32
+
+// DefaultMaxLeaves is the default maximum number of leaf hashes a ProofBundle may
+// need to reach its checkpoint.
+const DefaultMaxLeaves = 1 << 20
+
+type options struct {
+	maxSignatures    int
+	maxLeaves        uint64
+	releaseVerifiers []note.Verifier
+	releaseThreshold int
+	releaseSigners   *[]note.Signature
+	bundleDigest     *[]byte
+	maxImageSize     uint64
+}
+
+// Option configures the checks performed when verifying a ProofBundle.
+type Option func(*options)
+
+// WithMaxSignatures sets the maximum number of signature lines which the notes in a
+// ProofBundle may carry. Notes with more signatures are rejected before any attempt
+// is made to verify them.
+func WithMaxSignatures(n int) Option {
+	return func(o *options) {
+		o.maxSignatures = n
+	}
+}
+
+// WithMaxLeaves sets the maximum number of leaf hashes which a ProofBundle may need
+// to reach its checkpoint. Bundles needing more are rejected before any of their
+// leaf hashes are replayed, bounding the work which an untrusted bundle can cause.
+// Bundles with proofs instead of leaf hashes are not limited, as the size of their
+// proofs grows only with the logarithm of the checkpoint size.
+func WithMaxLeaves(n uint64) Option {
+	return func(o *options) {
+		o.maxLeaves = n
+	}
+}
+
+// WithReleaseVerifiers authorises further keys, in addition to the firmware release
+// verifier passed to Bundle, to sign the FirmwareRelease manifest. This allows a
+// manifest signed by either the old or new key to be accepted while release signing
+// keys are being rotated. If these are the only keys authorised, the verifier passed
+// to Bundle may be nil. Keys given both ways are only counted once.
+func WithReleaseVerifiers(vs ...note.Verifier) Option {
+	return func(o *options) {
+		o.releaseVerifiers = append(o.releaseVerifiers, vs...)
+	}
+}
+
+// WithReleaseThreshold sets the number of distinct authorised keys which must have
+// signed the FirmwareRelease manifest for it to be accepted. The default is 1.
+func WithReleaseThreshold(n int) Option {
+	return func(o *options) {
+		o.releaseThreshold = n
+	}
+}
+
+// WithVerifiedReleaseSigners records the verified signatures on the FirmwareRelease
+// manifest into *sigs if the bundle is verified successfully, allowing the caller
+// to tell which of the authorised keys signed it, e.g. to confirm that a release
+// was signed by the current key rather than an older one which is still accepted.
+func WithVerifiedReleaseSigners(sigs *[]note.Signature) Option {
+	return func(o *options) {
+		o.releaseSigners = sigs
+	}
+}
+
+// WithBundleDigest records the api.BundleDigest of the ProofBundle into *d if the
+// bundle is verified successfully, so that the caller can identify exactly which
+// bundle was accepted, e.g. in logs or to avoid verifying it again. It is not
+// supported by BundleReader, which doesn't keep the leaf hashes it has verified.
+func WithBundleDigest(d *[]byte) Option {
+	return func(o *options) {
+		o.bundleDigest = d
+	}
+}
+
+// WithMaxImageSize sets the largest firmware image, in bytes, which the device is
+// able to install. Bundles whose FirmwareRelease declares a larger ImageSize are
+// rejected with an ErrImageTooLarge. Releases which don't declare their image size
+// are not checked. By default, the image size is not checked.
+func WithMaxImageSize(n uint64) Option {
+	return func(o *options) {
+		o.maxImageSize = n
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		maxSignatures:    DefaultMaxSignatures,
+		maxLeaves:        DefaultMaxLeaves,
+		releaseThreshold: 1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// BundleReader performs the same checks as Bundle on a JSON serialised ProofBundle
+// read from r.
+//
+// Unlike decoding the bundle and calling Bundle, the leaf hashes are verified as
+// they are read rather than being held in memory, so the memory required does not
+// grow with the size of the log. For this to be possible, the LeafHashes field must
+// come after all of the other fields in the serialised bundle, as it does when
+// marshalled with encoding/json.
+func BundleReader(r io.Reader, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][]byte, origin string, opts ...Option) error {
+	o := newOptions(opts)
+	if o.bundleDigest != nil {
+		return errors.New("WithBundleDigest is not supported by BundleReader")
+	}
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	var newCPRaw, frRaw []byte
+	var start, from, index uint64
+	var prefix, consistency, inclusion [][]byte
+	var bv *bundleVerifier
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read ProofBundle: %v", err)
+		}
+		key, _ := t.(string)
+		switch {
+		case strings.EqualFold(key, "NewCheckpoint"):
+			if newCPRaw, err = decodeBytes(dec); err != nil {
+				return fmt.Errorf("failed to read NewCheckpoint: %v", err)
+			}
+		case strings.EqualFold(key, "FirmwareRelease"):
+			if frRaw, err = decodeBytes(dec); err != nil {
+				return fmt.Errorf("failed to read FirmwareRelease: %v", err)
+			}
+		case strings.EqualFold(key, "LeafHashesStart"):
+			if bv != nil {
+				return errors.New("invalid ProofBundle - LeafHashesStart must precede LeafHashes")
+			}
+			if err := dec.Decode(&start); err != nil {
+				return fmt.Errorf("failed to read LeafHashesStart: %v", err)
+			}
+		case strings.EqualFold(key, "PrefixRange"):
+			if bv != nil {
+				return errors.New("invalid ProofBundle - PrefixRange must precede LeafHashes")
+			}
+			// The prefix range has at most one hash per level of the tree, so is
+			// small enough to hold in memory.
+			if err := dec.Decode(&prefix); err != nil {
+				return fmt.Errorf("failed to read PrefixRange: %v", err)
+			}
+		case strings.EqualFold(key, "ConsistencyFrom"):
+			if err := dec.Decode(&from); err != nil {
+				return fmt.Errorf("failed to read ConsistencyFrom: %v", err)
+			}
+		case strings.EqualFold(key, "ConsistencyProof"):
+			// Proofs hold at most two hashes per level of the tree, so are small
+			// enough to hold in memory.
+			if err := dec.Decode(&consistency); err != nil {
+				return fmt.Errorf("failed to read ConsistencyProof: %v", err)
+			}
+		case strings.EqualFold(key, "LeafIndex"):
+			if err := dec.Decode(&index); err != nil {
+				return fmt.Errorf("failed to read LeafIndex: %v", err)
+			}
+		case strings.EqualFold(key, "InclusionProof"):
+			if err := dec.Decode(&inclusion); err != nil {
+				return fmt.Errorf("failed to read InclusionProof: %v", err)
+			}
+		case strings.EqualFold(key, "LeafHashes"):
+			if bv != nil {
+				return errors.New("invalid ProofBundle - duplicate LeafHashes")
+			}
+			if newCPRaw == nil || frRaw == nil {
+				return errors.New("invalid ProofBundle - LeafHashes must follow NewCheckpoint and FirmwareRelease")
+			}
+			if bv, err = newBundleVerifier(newCPRaw, frRaw, start, prefix, oldCP, logSigV, origin, o); err != nil {
+				return err
+			}
+			if err := streamLeafHashes(dec, bv); err != nil {
+				return err
+			}
+		default:
+			// Ignore unknown fields, as encoding/json would.
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("failed to read ProofBundle: %v", err)
+			}
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	if from > 0 {
+		pb := api.ProofBundle{
+			NewCheckpoint:    newCPRaw,
+			FirmwareRelease:  frRaw,
+			LeafHashesStart:  start,
+			PrefixRange:      prefix,
+			ConsistencyFrom:  from,
+			ConsistencyProof: consistency,
+			LeafIndex:        index,
+			InclusionProof:   inclusion,
+		}
+		// encoding/json writes a null LeafHashes for bundles with proofs.
+		if bv != nil && bv.tree.End() > start {
+			return errors.New("invalid ProofBundle - leaf hashes and proofs are mutually exclusive")
+		}
+		return Bundle(pb, oldCP, logSigV, frSigV, artifactHashes, origin, opts...)
+	}
+	if bv == nil {
+		// There were no leaf hashes, which is only valid for an empty checkpoint.
+		var err error
+		if bv, err = newBundleVerifier(newCPRaw, frRaw, start, prefix, oldCP, logSigV, origin, o); err != nil {
+			return err
+		}
+	}
+	return bv.finish(frSigV, anyOf(artifactHashes))
+}
+
+// streamLeafHashes reads a JSON array of base64 encoded leaf hashes from dec,
+// appending each to bv as it is read.
+func streamLeafHashes(dec *json.Decoder, bv *bundleVerifier) error {
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read LeafHashes: %v", err)
+	}
+	if t == nil {
+		return nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("invalid ProofBundle - LeafHashes is not an array")
+	}
+	if err := bv.checkMaxLeaves(); err != nil {
+		return err
+	}
+	for dec.More() {
+		lh, err := decodeBytes(dec)
+		if err != nil {
+			return fmt.Errorf("failed to read leaf hash %d: %v", bv.tree.End(), err)
+		}
+		if err := bv.appendLeafHash(lh); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// decodeBytes reads a base64 encoded JSON string, or null, from dec.
+func decodeBytes(dec *json.Decoder) ([]byte, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := t.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return base64.StdEncoding.DecodeString(v)
+	default:
+		return nil, fmt.Errorf("unexpected %v, want base64 string", t)
+	}
+}
+
+// expectDelim reads the next token from dec and checks that it is the delimiter d.
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read ProofBundle: %v", err)
+	}
+	if got, ok := t.(json.Delim); !ok || got != d {
+		return fmt.Errorf("invalid ProofBundle - got %v, want %v", t, d)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/usbarmory/armory-drive-log/api"
+)
+
+func TestBundleReader(t *testing.T) {
+	logSig := mustMakeSigner(t, testLogSignerPrivate)
+	fwSig := mustMakeSigner(t, testFirmwarePrivate)
+	logSigV := mustMakeVerifier(t, testLogSignerPublic)
+	fwSigV := mustMakeVerifier(t, testFirmwarePublic)
+
+	h := Hasher()
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, fwSig)
+	leafHashes := append(append([][]byte{}, testLeafHashes...), h.HashLeaf(fw))
+	roots := buildLog(t, leafHashes)
+	goodCP := makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig)
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	for _, test := range []struct {
+		desc          string
+		pb            api.ProofBundle
+		oldCP         api.Checkpoint
+		wantArtifacts map[string][]byte
+	}{
+		{
+			desc:          "works",
+			pb:            api.ProofBundle{NewCheckpoint: goodCP, FirmwareRelease: fw, LeafHashes: leafHashes},
+			oldCP:         oldCP,
+			wantArtifacts: artifacts,
+		}, {
+			desc:          "wrong firmware",
+			pb:            api.ProofBundle{NewCheckpoint: goodCP, FirmwareRelease: fw, LeafHashes: leafHashes},
+			oldCP:         oldCP,
+			wantArtifacts: map[string][]byte{"FirmwareImage": []byte("Have a banana")},
+		}, {
+			desc:          "bad old checkpoint",
+			pb:            api.ProofBundle{NewCheckpoint: goodCP, FirmwareRelease: fw, LeafHashes: leafHashes},
+			oldCP:         api.Checkpoint{Size: 1, Hash: []byte("This hash is not reconstructible")},
+			wantArtifacts: artifacts,
+		}, {
+			desc:          "bad new checkpoint",
+			pb:            api.ProofBundle{NewCheckpoint: makeCheckpoint(t, len(leafHashes), []byte("Not present"), logSig), FirmwareRelease: fw, LeafHashes: leafHashes},
+			oldCP:         oldCP,
+			wantArtifacts: artifacts,
+		}, {
+			desc:          "too few leaf hashes",
+			pb:            api.ProofBundle{NewCheckpoint: goodCP, FirmwareRelease: fw, LeafHashes: leafHashes[1:]},
+			oldCP:         oldCP,
+			wantArtifacts: artifacts,
+		}, {
+			desc:          "too many leaf hashes",
+			pb:            api.ProofBundle{NewCheckpoint: goodCP, FirmwareRelease: fw, LeafHashes: append(append([][]byte{}, leafHashes...), []byte("extra"))},
+			oldCP:         oldCP,
+			wantArtifacts: artifacts,
+		}, {
+			desc:          "manifest not logged",
+			pb:            api.ProofBundle{NewCheckpoint: makeCheckpoint(t, len(testLeafHashes), roots[len(testLeafHashes)-1], logSig), FirmwareRelease: fw, LeafHashes: testLeafHashes},
+			oldCP:         oldCP,
+			wantArtifacts: artifacts,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pbRaw, err := json.Marshal(test.pb)
+			if err != nil {
+				t.Fatalf("Failed to marshal ProofBundle: %v", err)
+			}
+			want := Bundle(test.pb, test.oldCP, logSigV, fwSigV, test.wantArtifacts, testLogOrigin)
+			got := BundleReader(bytes.NewReader(pbRaw), test.oldCP, logSigV, fwSigV, test.wantArtifacts, testLogOrigin)
+			if (got != nil) != (want != nil) {
+				t.Fatalf("BundleReader: %v, but Bundle: %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBundleReaderLeafHashesFirst(t *testing.T) {
+	logSigV := mustMakeVerifier(t, testLogSignerPublic)
+	fwSigV := mustMakeVerifier(t, testFirmwarePublic)
+	r := bytes.NewReader([]byte(`{"LeafHashes": [], "NewCheckpoint": null, "FirmwareRelease": null}`))
+	if err := BundleReader(r, api.Checkpoint{}, logSigV, fwSigV, nil, testLogOrigin); err == nil {
+		t.Fatal("BundleReader succeeded with LeafHashes before NewCheckpoint, want error")
+	}
+}
+
+// streamingBundle is an io.Reader which generates a serialised ProofBundle with a
+// large number of leaves on the fly, sampling the live heap size as it goes.
+type streamingBundle struct {
+	header  []byte
+	n       uint64
+	last    []byte
+	next    uint64
+	buf     bytes.Buffer
+	maxHeap uint64
+}
+
+func leafHashAt(i uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], i)
+	h := sha256.Sum256(b[:])
+	return h[:]
+}
+
+func (s *streamingBundle) Read(p []byte) (int, error) {
+	for s.buf.Len() < len(p) && s.next <= s.n {
+		if s.next%8192 == 0 {
+			runtime.GC()
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > s.maxHeap {
+				s.maxHeap = m.HeapAlloc
+			}
+		}
+		switch {
+		case s.next == 0:
+			s.buf.Write(s.header)
+		case s.next == s.n:
+			fmt.Fprintf(&s.buf, "%q]}", base64.StdEncoding.EncodeToString(s.last))
+		default:
+			fmt.Fprintf(&s.buf, "%q,", base64.StdEncoding.EncodeToString(leafHashAt(s.next-1)))
+		}
+		s.next++
+	}
+	return s.buf.Read(p)
+}
+
+func TestBundleReaderBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large bundle test in short mode")
+	}
+	logSig := mustMakeSigner(t, testLogSignerPrivate)
+	fwSig := mustMakeSigner(t, testFirmwarePrivate)
+	logSigV := mustMakeVerifier(t, testLogSignerPublic)
+	fwSigV := mustMakeVerifier(t, testFirmwarePublic)
+
+	const n = 1 << 16
+	h := Hasher()
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, fwSig)
+	manifestHash := h.HashLeaf(fw)
+	tree := (&compact.RangeFactory{Hash: h.HashChildren}).NewEmptyRange(0)
+	for i := uint64(0); i < n-1; i++ {
+		if err := tree.Append(leafHashAt(i), nil); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := tree.Append(manifestHash, nil); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	root, err := tree.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash: %v", err)
+	}
+
+	header, err := json.Marshal(api.ProofBundle{
+		NewCheckpoint:   makeCheckpoint(t, n, root, logSig),
+		FirmwareRelease: fw,
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	// Replace the trailing `null}` with the opening of the leaf hash array.
+	header = append(bytes.TrimSuffix(header, []byte("null}")), '[')
+
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	sb := &streamingBundle{header: header, n: n, last: manifestHash}
+	if err := BundleReader(sb, api.Checkpoint{}, logSigV, fwSigV, artifacts, testLogOrigin); err != nil {
+		t.Fatalf("BundleReader: %v", err)
+	}
+
+	// The leaf hashes alone would take 2MiB if they were all held in memory.
+	const bound = 512 << 10
+	if sb.maxHeap > base && sb.maxHeap-base > bound {
+		t.Errorf("Live heap grew by %d bytes while verifying, want < %d", sb.maxHeap-base, bound)
+	}
+}
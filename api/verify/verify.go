@@ -17,114 +17,517 @@ package verify
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/usbarmory/armory-drive-log/api"
 	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
 	"github.com/transparency-dev/merkle/rfc6962"
 	"golang.org/x/mod/sumdb/note"
 )
 
+// Hasher returns the hasher used by the log to compute its leaf and node hashes.
+// Code which hashes log entries or verifies proofs from the log should use it, so
+// that it can't disagree with the log about how the tree is built.
+func Hasher() *rfc6962.Hasher {
+	return rfc6962.New(crypto.SHA256)
+}
+
+// ErrManifestNotLogged is returned when the FirmwareRelease in a ProofBundle is not
+// among the leaves committed to by the bundle's checkpoint.
+type ErrManifestNotLogged struct {
+	// ManifestHash is the leaf hash of the FirmwareRelease.
+	ManifestHash []byte
+	// CheckpointSize is the size of the bundle's checkpoint.
+	CheckpointSize uint64
+}
+
+func (e ErrManifestNotLogged) Error() string {
+	return fmt.Sprintf("unable to prove inclusion - failed to locate manifest hash %x in checkpoint of size %d", e.ManifestHash, e.CheckpointSize)
+}
+
+// ErrOldRootMismatch is returned when the leaf hashes in a ProofBundle do not
+// reproduce the root hash of the device's checkpoint, so the bundle's checkpoint
+// cannot be shown to be consistent with it.
+type ErrOldRootMismatch struct {
+	// CheckpointSize is the size of the device's checkpoint.
+	CheckpointSize uint64
+	// RootHash is the root hash of the device's checkpoint.
+	RootHash []byte
+}
+
+func (e ErrOldRootMismatch) Error() string {
+	return fmt.Sprintf("unable to prove consistency - failed to recreate old checkpoint root %x", e.RootHash)
+}
+
+// ErrNewRootMismatch is returned when the leaf hashes in a ProofBundle do not
+// reproduce the root hash of the bundle's checkpoint.
+type ErrNewRootMismatch struct {
+	// CheckpointSize is the size of the bundle's checkpoint.
+	CheckpointSize uint64
+	// RootHash is the root hash of the bundle's checkpoint.
+	RootHash []byte
+}
+
+func (e ErrNewRootMismatch) Error() string {
+	return fmt.Sprintf("unable to prove consistency - failed to locate new checkpoint hash %x", e.RootHash)
+}
+
+// ErrManifestBeforeCheckpoint is returned when the FirmwareRelease in a ProofBundle
+// was logged at an index which is already covered by the device's checkpoint, which
+// means it cannot be a release the device hasn't already seen.
+type ErrManifestBeforeCheckpoint struct {
+	// Index is the index in the log at which the manifest was found.
+	Index uint64
+	// CheckpointSize is the size of the device's checkpoint.
+	CheckpointSize uint64
+}
+
+func (e ErrManifestBeforeCheckpoint) Error() string {
+	return fmt.Sprintf("manifest at index %d is already covered by checkpoint of size %d", e.Index, e.CheckpointSize)
+}
+
+// ErrCheckpointNotNewer is returned when the checkpoint in a ProofBundle is no larger
+// than the device's checkpoint, as happens when a device is offered an older update
+// than it already has. Such a bundle cannot contain a release which the device
+// hasn't already seen.
+type ErrCheckpointNotNewer struct {
+	// Size is the size of the bundle's checkpoint.
+	Size uint64
+	// CheckpointSize is the size of the device's checkpoint.
+	CheckpointSize uint64
+}
+
+func (e ErrCheckpointNotNewer) Error() string {
+	if e.Size < e.CheckpointSize {
+		return fmt.Sprintf("bundle checkpoint of size %d is older than device checkpoint of size %d", e.Size, e.CheckpointSize)
+	}
+	return fmt.Sprintf("bundle checkpoint of size %d is no newer than device checkpoint of size %d", e.Size, e.CheckpointSize)
+}
+
+// ErrImageTooLarge is returned when the FirmwareRelease in a ProofBundle declares
+// a firmware image which is larger than the device can install; see
+// WithMaxImageSize.
+type ErrImageTooLarge struct {
+	// ImageSize is the size of the image declared by the FirmwareRelease.
+	ImageSize uint64
+	// MaxImageSize is the largest image which the device can install.
+	MaxImageSize uint64
+}
+
+func (e ErrImageTooLarge) Error() string {
+	return fmt.Sprintf("firmware image of %d bytes exceeds maximum of %d bytes", e.ImageSize, e.MaxImageSize)
+}
+
 // Bundle verifies that the Bundle is self-consistent, and consistent with the provided
 // smaller checkpoint from the device.
 //
 // For a ProofBundle to be considered good, we need to:
-//  1. check the signature on the new Checkpoint contained within
-//  2. verify that the first oldCP.Size leaf hashes provided can reconstruct oldCP.Hash
+//  1. check the signature on the new Checkpoint contained within, and that its origin
+//     line is the expected origin, so that checkpoints from other logs are rejected.
+//     If oldCP is not empty, the new Checkpoint must also be larger than it
+//  2. verify that the first oldCP.Size leaf hashes provided can reconstruct oldCP.Hash, with
+//     pb.PrefixRange standing in for any leaf hashes before pb.LeafHashesStart
 //  3. verify that the first newCP.Size leaf hashes provided can reconstruct pb.NewCheckpoint.Hash
-//  4. verify that the hash of pb.FirmwareRelease is among the list of leaf hashes provided
-//  5. check that the signature on the FirmwareRelease manifest is valid
+//  4. verify that the hash of pb.FirmwareRelease is among the list of leaf hashes provided,
+//     at an index which is not already covered by oldCP
+//  5. check that the signature on the FirmwareRelease manifest is valid, and that its
+//     schema version is supported. See WithReleaseVerifiers and WithReleaseThreshold
+//     for accepting manifests signed by more than one key, and WithMaxImageSize for
+//     rejecting images which the device cannot install
 //  6. check that all provided artifact hashes are present in the FirmwareRelease manifist, and are
 //     identical to the values the manifest claims they should be.
 //
 // If all of these checks hold, then we are sufficiently convinced that the firmware update is discoverable by others.
 //
+// A bundle which HasProofs carries no leaf hashes, so steps 2 to 4 are instead:
+//  2. verify pb.ConsistencyProof from oldCP, which must be of size pb.ConsistencyFrom,
+//     to the new Checkpoint
+//  3. verify pb.InclusionProof for the hash of pb.FirmwareRelease at pb.LeafIndex
+//     under the new Checkpoint, where pb.LeafIndex is not already covered by oldCP
+//
+// Such bundles are only accepted by a device which already holds a checkpoint;
+// devices without one must be given the leaf hashes.
+//
 // TODO(al): Extend to support witnesses.
-func Bundle(pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][]byte, origin string) error {
-	// First, check the signature on the new CP.
-	newCP := &api.Checkpoint{}
-	{
-		newCPRaw, err := note.Open(pb.NewCheckpoint, note.VerifierList(logSigV))
+func Bundle(pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][]byte, origin string, opts ...Option) error {
+	return BundleAnyOf(pb, oldCP, logSigV, frSigV, anyOf(artifactHashes), origin, opts...)
+}
+
+// BundleContext is like Bundle, but stops verifying and returns ctx.Err() if ctx is
+// cancelled or its deadline passes while the bundle's leaf hashes are being replayed.
+// This bounds the time a caller can be tied up by a very large bundle.
+func BundleContext(ctx context.Context, pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][]byte, origin string, opts ...Option) error {
+	return bundleAnyOf(ctx, pb, oldCP, logSigV, frSigV, anyOf(artifactHashes), origin, opts...)
+}
+
+// BundleAnyOf is like Bundle, but allows a set of acceptable hashes to be provided
+// for each artifact. The check in step 6 passes for an artifact if the hash claimed
+// by the FirmwareRelease manifest matches any of the acceptable hashes for it.
+func BundleAnyOf(pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][][]byte, origin string, opts ...Option) error {
+	return bundleAnyOf(context.Background(), pb, oldCP, logSigV, frSigV, artifactHashes, origin, opts...)
+}
+
+// ctxCheckInterval is the number of leaf hashes replayed between checks for
+// cancellation of the context passed to BundleContext.
+const ctxCheckInterval = 1024
+
+func bundleAnyOf(ctx context.Context, pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][][]byte, origin string, opts ...Option) error {
+	o := newOptions(opts)
+	if err := verifyBundle(ctx, pb, oldCP, logSigV, frSigV, artifactHashes, origin, o); err != nil {
+		return err
+	}
+	if o.bundleDigest != nil {
+		d, err := api.BundleDigest(pb)
 		if err != nil {
-			return fmt.Errorf("failed to verify signature on NewCheckpoint: %v", err)
+			return fmt.Errorf("failed to compute digest of verified ProofBundle: %v", err)
 		}
-		if err := newCP.Unmarshal([]byte(newCPRaw.Text)); err != nil {
-			return fmt.Errorf("failed to unmarshal NewCheckpoint: %v", err)
+		*o.bundleDigest = d
+	}
+	return nil
+}
+
+// verifyBundle performs the checks described on Bundle.
+func verifyBundle(ctx context.Context, pb api.ProofBundle, oldCP api.Checkpoint, logSigV note.Verifier, frSigV note.Verifier, artifactHashes map[string][][]byte, origin string, opts options) error {
+	// First, check the signature on the new CP.
+	bv, err := newBundleVerifier(pb.NewCheckpoint, pb.FirmwareRelease, pb.LeafHashesStart, pb.PrefixRange, oldCP, logSigV, origin, opts)
+	if err != nil {
+		return err
+	}
+
+	if pb.HasProofs() {
+		if pb.LeafHashesStart > 0 || len(pb.LeafHashes) > 0 {
+			return errors.New("invalid ProofBundle - leaf hashes and proofs are mutually exclusive")
 		}
-		if newCP.Origin != origin  {
-			return fmt.Errorf("invalid checkpoint - incorrect origin: %q", newCP.Origin)
+		if err := bv.checkProofs(pb.ConsistencyFrom, pb.ConsistencyProof, pb.LeafIndex, pb.InclusionProof); err != nil {
+			return err
 		}
+		return bv.checkRelease(frSigV, artifactHashes)
 	}
 
-	if l := uint64(len(pb.LeafHashes)); l != newCP.Size {
-		return fmt.Errorf("invalid ProofBundle - %d leafhashes for Checkpoint of size %d", l, newCP.Size)
+	if err := bv.checkMaxLeaves(); err != nil {
+		return err
+	}
+	if l := pb.LeafHashesStart + uint64(len(pb.LeafHashes)); l != bv.newCP.Size {
+		return fmt.Errorf("invalid ProofBundle - %d leafhashes for Checkpoint of size %d", l, bv.newCP.Size)
 	}
 
 	// Next, ensure firmware manifest is discoverable:
 	//  - prove its inclusion under the new checkpoint, and
 	//  - prove that the new checkpoint is consistent with the device's old checkpoint
-	h := rfc6962.DefaultHasher
-	manifestHash := h.HashLeaf(pb.FirmwareRelease)
-	tree := (&compact.RangeFactory{Hash: h.HashChildren}).NewEmptyRange(0)
+	for i, leafHash := range pb.LeafHashes {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if err := bv.appendLeafHash(leafHash); err != nil {
+			return err
+		}
+	}
 
-	manifestFound := false
-	oldCPFound := false
-	newCPFound := false
+	return bv.finish(frSigV, artifactHashes)
+}
 
-	for i, leafHash := range pb.LeafHashes {
-		if err := tree.Append(leafHash, nil); err != nil {
-			return fmt.Errorf("error while appending leaf %d", i)
+// VerifyLeafHashes performs steps 2 to 4 of the checks described on Bundle, for
+// callers which already have the leaf hashes of a log and checkpoints which they
+// trust, but not a full ProofBundle. leafHashes must be the hashes of all of the
+// leaves committed to by newCP, in order, and target is the leaf hash whose
+// inclusion is to be proven.
+//
+// The leaf hashes are replayed into a compact range, which must reproduce the root
+// hashes of both checkpoints, and target must be among them at an index which is
+// not covered by oldCP. An empty oldCP is consistent with every checkpoint.
+// Failure of these checks is reported as an ErrOldRootMismatch, ErrNewRootMismatch,
+// ErrManifestNotLogged or ErrManifestBeforeCheckpoint respectively.
+//
+// The signatures on the checkpoints are not checked.
+func VerifyLeafHashes(leafHashes [][]byte, oldCP, newCP api.Checkpoint, target []byte) error {
+	if oldCP.Size > newCP.Size {
+		return ErrCheckpointNotNewer{Size: newCP.Size, CheckpointSize: oldCP.Size}
+	}
+	if l := uint64(len(leafHashes)); l != newCP.Size {
+		return fmt.Errorf("%d leafhashes for Checkpoint of size %d", l, newCP.Size)
+	}
+	v := &bundleVerifier{
+		oldCP:        oldCP,
+		newCP:        newCP,
+		manifestHash: target,
+		tree:         (&compact.RangeFactory{Hash: Hasher().HashChildren}).NewEmptyRange(0),
+	}
+	for _, leafHash := range leafHashes {
+		if err := v.appendLeafHash(leafHash); err != nil {
+			return err
 		}
-		r, err := tree.GetRootHash(nil)
+	}
+	return v.checkReplay()
+}
+
+// anyOf converts a map of single artifact hashes into the form accepted by BundleAnyOf.
+func anyOf(artifactHashes map[string][]byte) map[string][][]byte {
+	r := make(map[string][][]byte, len(artifactHashes))
+	for artifact, h := range artifactHashes {
+		r[artifact] = [][]byte{h}
+	}
+	return r
+}
+
+// bundleVerifier performs the checks described on Bundle, but allows the leaf
+// hashes of the bundle to be provided one at a time.
+type bundleVerifier struct {
+	opts            options
+	oldCP           api.Checkpoint
+	newCP           api.Checkpoint
+	firmwareRelease []byte
+	manifestHash    []byte
+	tree            *compact.Range
+
+	manifestFound bool
+	manifestIndex uint64
+	oldCPFound    bool
+	newCPFound    bool
+}
+
+// newBundleVerifier checks the signature on the bundle's new checkpoint, and returns
+// a bundleVerifier ready to accept the bundle's leaf hashes from index start onwards.
+// The prefix hashes are the compact range covering the leaves before start.
+func newBundleVerifier(newCPRaw, firmwareRelease []byte, start uint64, prefix [][]byte, oldCP api.Checkpoint, logSigV note.Verifier, origin string, opts options) (*bundleVerifier, error) {
+	newCP := api.Checkpoint{}
+	{
+		if err := CheckNoteSignatures(newCPRaw, opts.maxSignatures); err != nil {
+			return nil, fmt.Errorf("invalid NewCheckpoint: %v", err)
+		}
+		n, err := OpenNote(newCPRaw, note.VerifierList(logSigV))
 		if err != nil {
-			return fmt.Errorf("failed to get root from compact tree: %v", err)
+			return nil, fmt.Errorf("failed to verify signature on NewCheckpoint: %v", err)
+		}
+		if err := newCP.Unmarshal([]byte(n.Text)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal NewCheckpoint: %v", err)
 		}
-		if !manifestFound {
-			manifestFound = bytes.Equal(leafHash, manifestHash)
+		if newCP.Origin != origin {
+			return nil, fmt.Errorf("invalid checkpoint - incorrect origin %q, want %q", newCP.Origin, origin)
 		}
-		if tree.End() == oldCP.Size {
-			oldCPFound = bytes.Equal(r, oldCP.Hash)
+		if oldCP.Size > 0 && newCP.Size <= oldCP.Size {
+			return nil, ErrCheckpointNotNewer{Size: newCP.Size, CheckpointSize: oldCP.Size}
 		}
-		if tree.End() == newCP.Size {
-			newCPFound = bytes.Equal(r, newCP.Hash)
+	}
+
+	// Leaf hashes may only be omitted if they're covered by the device's checkpoint,
+	// as the prefix range is only trustworthy once it has reproduced oldCP.Hash.
+	if start > oldCP.Size {
+		return nil, fmt.Errorf("invalid ProofBundle - leaf hashes start at %d, after old checkpoint of size %d", start, oldCP.Size)
+	}
+	h := Hasher()
+	// The range modifies its hashes as leaves are appended, so give it a copy.
+	tree, err := (&compact.RangeFactory{Hash: h.HashChildren}).NewRange(0, start, append([][]byte{}, prefix...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ProofBundle - bad prefix range: %v", err)
+	}
+	v := &bundleVerifier{
+		opts:            opts,
+		oldCP:           oldCP,
+		newCP:           newCP,
+		firmwareRelease: firmwareRelease,
+		manifestHash:    h.HashLeaf(firmwareRelease),
+		tree:            tree,
+	}
+	if start > 0 {
+		if err := v.checkRoots(); err != nil {
+			return nil, err
 		}
 	}
+	return v, nil
+}
 
+// checkMaxLeaves checks, before any leaf hashes are appended, that the number of
+// leaf hashes needed to reach the new checkpoint is within the configured maximum.
+func (v *bundleVerifier) checkMaxLeaves() error {
+	if n := v.newCP.Size - v.tree.End(); n > v.opts.maxLeaves {
+		return fmt.Errorf("invalid ProofBundle - %d leaf hashes for Checkpoint of size %d exceeds maximum of %d", n, v.newCP.Size, v.opts.maxLeaves)
+	}
+	return nil
+}
+
+// appendLeafHash adds the next leaf hash from the bundle to the tree.
+func (v *bundleVerifier) appendLeafHash(leafHash []byte) error {
+	i := v.tree.End()
+	if i >= v.newCP.Size {
+		return fmt.Errorf("invalid ProofBundle - more than %d leafhashes for Checkpoint of size %d", i, v.newCP.Size)
+	}
+	if err := v.tree.Append(leafHash, nil); err != nil {
+		return fmt.Errorf("error while appending leaf %d", i)
+	}
+	// Prefer an occurrence of the manifest which is newer than oldCP, should
+	// it have been logged more than once.
+	if (!v.manifestFound || v.manifestIndex < v.oldCP.Size) && bytes.Equal(leafHash, v.manifestHash) {
+		v.manifestFound = true
+		v.manifestIndex = i
+	}
+	return v.checkRoots()
+}
+
+// checkRoots compares the root of the tree built so far against the old and new
+// checkpoints, if it is the same size as either of them.
+func (v *bundleVerifier) checkRoots() error {
+	if v.tree.End() != v.oldCP.Size && v.tree.End() != v.newCP.Size {
+		return nil
+	}
+	r, err := v.tree.GetRootHash(nil)
+	if err != nil {
+		return fmt.Errorf("failed to get root from compact tree: %v", err)
+	}
+	if v.tree.End() == v.oldCP.Size {
+		v.oldCPFound = bytes.Equal(r, v.oldCP.Hash)
+	}
+	if v.tree.End() == v.newCP.Size {
+		v.newCPFound = bytes.Equal(r, v.newCP.Hash)
+	}
+	return nil
+}
+
+// checkReplay checks, once all leaf hashes have been appended, that they reproduced
+// the roots of both checkpoints and included the manifest.
+func (v *bundleVerifier) checkReplay() error {
+	if l := v.tree.End(); l != v.newCP.Size {
+		return fmt.Errorf("invalid ProofBundle - %d leafhashes for Checkpoint of size %d", l, v.newCP.Size)
+	}
 	// If we don't have an oldCP (or oldCP is genuinely zero sized), then all future CPs are consistent with it.
-	if !oldCPFound && oldCP.Size > 0 {
-		return fmt.Errorf("unable to prove consistency - failed to recreate old checkpoint root %x", oldCP.Hash)
+	if !v.oldCPFound && v.oldCP.Size > 0 {
+		return ErrOldRootMismatch{CheckpointSize: v.oldCP.Size, RootHash: v.oldCP.Hash}
 	}
-	if !newCPFound {
-		return fmt.Errorf("unable to prove consistency - failed to locate new checkpoint hash %x", newCP.Hash)
+	if !v.newCPFound {
+		return ErrNewRootMismatch{CheckpointSize: v.newCP.Size, RootHash: v.newCP.Hash}
 	}
-	if !manifestFound {
-		return fmt.Errorf("unable to prove inclusion - failed to locate manifest hash %x", manifestHash)
+	if !v.manifestFound {
+		return ErrManifestNotLogged{ManifestHash: v.manifestHash, CheckpointSize: v.newCP.Size}
 	}
+	if v.manifestIndex < v.oldCP.Size {
+		return ErrManifestBeforeCheckpoint{Index: v.manifestIndex, CheckpointSize: v.oldCP.Size}
+	}
+	return nil
+}
+
+// checkProofs checks, in place of replaying leaf hashes, that the consistency proof
+// from a checkpoint of size from to the new checkpoint, and the inclusion proof for
+// the manifest at index, are valid. The device's checkpoint must be of size from.
+func (v *bundleVerifier) checkProofs(from uint64, consistency [][]byte, index uint64, inclusion [][]byte) error {
+	if v.oldCP.Size == 0 {
+		return errors.New("invalid ProofBundle - bundle with proofs requires a device checkpoint, leaf hashes are needed without one")
+	}
+	if from != v.oldCP.Size {
+		return fmt.Errorf("invalid ProofBundle - consistency proof is from size %d, but device checkpoint is size %d", from, v.oldCP.Size)
+	}
+	h := Hasher()
+	if err := proof.VerifyConsistency(h, v.oldCP.Size, v.newCP.Size, consistency, v.oldCP.Hash, v.newCP.Hash); err != nil {
+		return fmt.Errorf("unable to prove consistency - invalid consistency proof from size %d to %d: %v", v.oldCP.Size, v.newCP.Size, err)
+	}
+	if index < v.oldCP.Size {
+		return ErrManifestBeforeCheckpoint{Index: index, CheckpointSize: v.oldCP.Size}
+	}
+	if err := proof.VerifyInclusion(h, index, v.newCP.Size, v.manifestHash, inclusion, v.newCP.Hash); err != nil {
+		return ErrManifestNotLogged{ManifestHash: v.manifestHash, CheckpointSize: v.newCP.Size}
+	}
+	return nil
+}
+
+// finish completes the verification once all leaf hashes have been appended.
+func (v *bundleVerifier) finish(frSigV note.Verifier, artifactHashes map[string][][]byte) error {
+	if err := v.checkReplay(); err != nil {
+		return err
+	}
+	return v.checkRelease(frSigV, artifactHashes)
+}
+
+// releaseVerifiers returns the keys authorised to sign the FirmwareRelease: frSigV
+// and those passed WithReleaseVerifiers. Nil verifiers are skipped, so that callers
+// may rely on WithReleaseVerifiers alone, and a key passed more than once is only
+// included once, as note rejects the same key appearing twice as ambiguous.
+func (v *bundleVerifier) releaseVerifiers(frSigV note.Verifier) note.Verifiers {
+	type keyID struct {
+		name string
+		hash uint32
+	}
+	seen := make(map[keyID]bool)
+	vs := make([]note.Verifier, 0, 1+len(v.opts.releaseVerifiers))
+	for _, rv := range append([]note.Verifier{frSigV}, v.opts.releaseVerifiers...) {
+		if rv == nil {
+			continue
+		}
+		id := keyID{name: rv.Name(), hash: rv.KeyHash()}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		vs = append(vs, rv)
+	}
+	return note.VerifierList(vs...)
+}
 
+// checkRelease completes the verification once the manifest has been shown to be
+// included in the log, by checking its signatures and the artifact hashes it
+// claims.
+func (v *bundleVerifier) checkRelease(frSigV note.Verifier, artifactHashes map[string][][]byte) error {
 	// Check the signature on the FirmwareRelease as we unmarshal it
 	fr := &api.FirmwareRelease{}
+	var sigs []note.Signature
 	{
-		frRaw, err := note.Open(pb.FirmwareRelease, note.VerifierList(frSigV))
+		if err := CheckNoteSignatures(v.firmwareRelease, v.opts.maxSignatures); err != nil {
+			return fmt.Errorf("invalid FirmwareRelease: %v", err)
+		}
+		frRaw, err := OpenNote(v.firmwareRelease, v.releaseVerifiers(frSigV))
 		if err != nil {
 			return fmt.Errorf("invalid signature on FirmwareRelease: %v", err)
 		}
+		if got, want := len(frRaw.Sigs), v.opts.releaseThreshold; got < want {
+			return fmt.Errorf("FirmwareRelease is signed by %d authorised key(s), but %d are required", got, want)
+		}
+		sigs = frRaw.Sigs
 		if err := json.Unmarshal([]byte(frRaw.Text), fr); err != nil {
 			return fmt.Errorf("failed to unmarshal FirmwareRelease: %v", err)
 		}
+		if err := fr.CheckSchema(); err != nil {
+			return err
+		}
+		if maxSize := v.opts.maxImageSize; maxSize > 0 && fr.ImageSize > maxSize {
+			return ErrImageTooLarge{ImageSize: fr.ImageSize, MaxImageSize: maxSize}
+		}
 	}
 
 	// Lastly, check that the provided artifact hashes are the same as the ones
-	// claimed by the FirmwareRelease manifest.
+	// claimed by the FirmwareRelease manifest. FirmwareArtifactName stands for the
+	// release's firmware image, which may be named for its platform.
 	for artifact, expected := range artifactHashes {
+		if artifact == api.FirmwareArtifactName {
+			artifact = fr.FirmwareArtifact()
+		}
 		h, ok := fr.ArtifactSHA256[artifact]
 		if !ok {
 			return fmt.Errorf("FirmwareRelease does not commit to artifact hash for %q", artifact)
 		}
-		if !bytes.Equal(expected, h) {
-			return fmt.Errorf("expected artifact hash for %q is %x, but FirmwareRelease claims %x", artifact, expected, h)
+		if !containsHash(expected, h) {
+			if len(expected) == 1 {
+				return fmt.Errorf("expected artifact hash for %q is %x, but FirmwareRelease claims %x", artifact, expected[0], h)
+			}
+			return fmt.Errorf("expected artifact hash for %q is one of %x, but FirmwareRelease claims %x", artifact, expected, h)
 		}
 	}
 
+	if v.opts.releaseSigners != nil {
+		*v.opts.releaseSigners = sigs
+	}
 	return nil
 }
+
+// containsHash returns true if h is present in hashes.
+func containsHash(hashes [][]byte, h []byte) bool {
+	for _, c := range hashes {
+		if bytes.Equal(c, h) {
+			return true
+		}
+	}
+	return false
+}
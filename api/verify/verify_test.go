@@ -15,14 +15,20 @@
 package verify
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/usbarmory/armory-drive-log/api"
 	"github.com/transparency-dev/merkle/compact"
-	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/merkle/testonly"
 	"golang.org/x/mod/sumdb/note"
 )
 
@@ -49,7 +55,7 @@ var (
 // buildLog calculates a set of incremental root hashes for a growing log by adding leafHahses one at a time.
 func buildLog(t *testing.T, leafHashes [][]byte) [][]byte {
 	roots := make([][]byte, 0)
-	h := rfc6962.DefaultHasher
+	h := Hasher()
 	tree := (&compact.RangeFactory{Hash: h.HashChildren}).NewEmptyRange(0)
 	for _, lh := range leafHashes {
 		if err := tree.Append(lh, nil); err != nil {
@@ -65,22 +71,61 @@ func buildLog(t *testing.T, leafHashes [][]byte) [][]byte {
 	return roots
 }
 
-func TestBundle(t *testing.T) {
-	logSig := mustMakeSigner(t, testLogSignerPrivate)
-	fwSig := mustMakeSigner(t, testFirmwarePrivate)
-	logSigV := mustMakeVerifier(t, testLogSignerPublic)
-	fwSigV := mustMakeVerifier(t, testFirmwarePublic)
+// prefixRange returns the hashes of the compact range covering leafHashes.
+func prefixRange(t *testing.T, leafHashes [][]byte) [][]byte {
+	t.Helper()
+	tree := (&compact.RangeFactory{Hash: Hasher().HashChildren}).NewEmptyRange(0)
+	for _, lh := range leafHashes {
+		if err := tree.Append(lh, nil); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	return tree.Hashes()
+}
 
-	h := rfc6962.DefaultHasher
+// bundleFixture holds the keys used to sign the test checkpoints and releases.
+type bundleFixture struct {
+	logSig, fwSig   note.Signer
+	logSigV, fwSigV note.Verifier
+}
+
+func newBundleFixture(t *testing.T) bundleFixture {
+	t.Helper()
+	return bundleFixture{
+		logSig:  mustMakeSigner(t, testLogSignerPrivate),
+		fwSig:   mustMakeSigner(t, testFirmwarePrivate),
+		logSigV: mustMakeVerifier(t, testLogSignerPublic),
+		fwSigV:  mustMakeVerifier(t, testFirmwarePublic),
+	}
+}
+
+// bundle returns a ProofBundle for fw whose checkpoint commits to leafHashes,
+// along with the root hashes of the log at each size as returned by buildLog.
+func (f bundleFixture) bundle(t *testing.T, fw []byte, leafHashes [][]byte) (api.ProofBundle, [][]byte) {
+	t.Helper()
+	roots := buildLog(t, leafHashes)
+	return api.ProofBundle{
+		FirmwareRelease: fw,
+		NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
+		LeafHashes:      leafHashes,
+	}, roots
+}
+
+// withRelease returns testLeafHashes followed by the leaf hash of fw.
+func withRelease(fw []byte) [][]byte {
+	return append(append([][]byte{}, testLeafHashes...), Hasher().HashLeaf(fw))
+}
+
+func TestBundle(t *testing.T) {
+	f := newBundleFixture(t)
 	firmwareImageHash := []byte("Firmware Hash")
 	commitArtifacts := map[string][]byte{
 		"FirmwareImage": firmwareImageHash,
 		"Thingy":        []byte("Magig"),
 		"Art":           []byte("Fact"),
 	}
-	fw := makeFirmwareRelease(t, commitArtifacts, fwSig)
-	manifestHash := h.HashLeaf(fw)
-	leafHashes := append(testLeafHashes, manifestHash)
+	fw := makeFirmwareRelease(t, commitArtifacts, f.fwSig)
+	leafHashes := withRelease(fw)
 	roots := buildLog(t, leafHashes)
 
 	for _, test := range []struct {
@@ -94,7 +139,7 @@ func TestBundle(t *testing.T) {
 			desc: "works",
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 				LeafHashes:      leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -109,7 +154,7 @@ func TestBundle(t *testing.T) {
 			desc: "wrong firmware",
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 				LeafHashes:      leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -126,7 +171,7 @@ func TestBundle(t *testing.T) {
 			desc: "missing artifact",
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 				LeafHashes:      leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -142,7 +187,7 @@ func TestBundle(t *testing.T) {
 			desc: "bad consistency - can't prove old CP",
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 				LeafHashes:      leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -159,7 +204,7 @@ func TestBundle(t *testing.T) {
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
 				// Provide an inconsistent new CP root hash
-				NewCheckpoint: makeCheckpoint(t, len(leafHashes), []byte("This root not present"), logSig),
+				NewCheckpoint: makeCheckpoint(t, len(leafHashes), []byte("This root not present"), f.logSig),
 				LeafHashes:    leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -174,7 +219,7 @@ func TestBundle(t *testing.T) {
 			desc: "bad consistency - can't prove manifest",
 			pb: api.ProofBundle{
 				FirmwareRelease: fw,
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 				// Replace manifest hash with one which doesn't match
 				LeafHashes: append(append([][]byte{}, leafHashes[0:len(leafHashes)-1]...), []byte("wrong manifest hash")),
 			},
@@ -190,8 +235,8 @@ func TestBundle(t *testing.T) {
 			desc: "invalid firmware manifest signature",
 			pb: api.ProofBundle{
 				// Invalid - signed by log's key
-				FirmwareRelease: makeFirmwareRelease(t, commitArtifacts, logSig),
-				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], logSig),
+				FirmwareRelease: makeFirmwareRelease(t, commitArtifacts, f.logSig),
+				NewCheckpoint:   makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.logSig),
 			},
 			oldCP: api.Checkpoint{
 				Size: 1,
@@ -204,9 +249,9 @@ func TestBundle(t *testing.T) {
 		}, {
 			desc: "invalid log checkpoint signature",
 			pb: api.ProofBundle{
-				FirmwareRelease: makeFirmwareRelease(t, commitArtifacts, fwSig),
+				FirmwareRelease: makeFirmwareRelease(t, commitArtifacts, f.fwSig),
 				// Invalid - signed by firmware key
-				NewCheckpoint: makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], fwSig),
+				NewCheckpoint: makeCheckpoint(t, len(leafHashes), roots[len(roots)-1], f.fwSig),
 				LeafHashes:    leafHashes,
 			},
 			oldCP: api.Checkpoint{
@@ -220,7 +265,302 @@ func TestBundle(t *testing.T) {
 		},
 	} {
 		t.Run(test.desc, func(t *testing.T) {
-			err := Bundle(test.pb, test.oldCP, logSigV, fwSigV, test.wantArtifacts, testLogOrigin)
+			err := Bundle(test.pb, test.oldCP, f.logSigV, f.fwSigV, test.wantArtifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBundleMaxSignatures(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	// Pad the checkpoint with signatures from unknown signers.
+	for i := 0; i < 40; i++ {
+		pb.NewCheckpoint = append(pb.NewCheckpoint, []byte(fmt.Sprintf("\u2014 padding-%d %s\n", i, base64.StdEncoding.EncodeToString([]byte("hash and signature"))))...)
+	}
+
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin); err == nil {
+		t.Error("Bundle with 41 checkpoint signatures succeeded with default limit, want error")
+	}
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithMaxSignatures(50)); err != nil {
+		t.Errorf("Bundle with 41 checkpoint signatures failed with limit of 50: %v", err)
+	}
+}
+
+func TestBundleMaxLeaves(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	n := uint64(len(pb.LeafHashes))
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithMaxLeaves(n)); err != nil {
+		t.Errorf("Bundle with %d leaves failed with limit of %d: %v", n, n, err)
+	}
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithMaxLeaves(n-1)); err == nil {
+		t.Errorf("Bundle with %d leaves succeeded with limit of %d, want error", n, n-1)
+	}
+	pbRaw, err := json.Marshal(pb)
+	if err != nil {
+		t.Fatalf("Failed to marshal ProofBundle: %v", err)
+	}
+	if err := BundleReader(bytes.NewReader(pbRaw), oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithMaxLeaves(n-1)); err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Errorf("BundleReader with %d leaves and limit of %d = %v, want maximum leaves error", n, n-1, err)
+	}
+
+	// A huge checkpoint must be rejected without needing its leaf hashes.
+	pb = api.ProofBundle{
+		FirmwareRelease: fw,
+		NewCheckpoint:   makeCheckpoint(t, DefaultMaxLeaves+1, roots[len(roots)-1], f.logSig),
+	}
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin); err == nil || !strings.Contains(err.Error(), "exceeds maximum") {
+		t.Errorf("Bundle with huge checkpoint = %v, want maximum leaves error", err)
+	}
+
+	// Bundles with proofs carry no leaf hashes, so aren't limited.
+	tree := testonly.New(Hasher())
+	tree.Append(withRelease(fw)...)
+	consistency, err := tree.ConsistencyProof(oldCP.Size, tree.Size())
+	if err != nil {
+		t.Fatalf("ConsistencyProof: %v", err)
+	}
+	inclusion, err := tree.InclusionProof(tree.Size()-1, tree.Size())
+	if err != nil {
+		t.Fatalf("InclusionProof: %v", err)
+	}
+	pb = api.ProofBundle{
+		FirmwareRelease:  fw,
+		NewCheckpoint:    makeCheckpoint(t, int(tree.Size()), tree.Hash(), f.logSig),
+		ConsistencyFrom:  oldCP.Size,
+		ConsistencyProof: consistency,
+		LeafIndex:        tree.Size() - 1,
+		InclusionProof:   inclusion,
+	}
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithMaxLeaves(1)); err != nil {
+		t.Errorf("Bundle with proofs failed with limit of 1 leaf: %v", err)
+	}
+}
+
+func TestBundleManifestNotLogged(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, testLeafHashes)
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+	var nlErr ErrManifestNotLogged
+	if !errors.As(err, &nlErr) {
+		t.Fatalf("Got %v, want ErrManifestNotLogged", err)
+	}
+	if want := Hasher().HashLeaf(fw); !bytes.Equal(nlErr.ManifestHash, want) {
+		t.Errorf("Got ManifestHash %x, want %x", nlErr.ManifestHash, want)
+	}
+	if got, want := nlErr.CheckpointSize, uint64(len(testLeafHashes)); got != want {
+		t.Errorf("Got CheckpointSize %d, want %d", got, want)
+	}
+}
+
+func TestBundleOrigin(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	for _, test := range []struct {
+		desc    string
+		origin  string
+		wantErr bool
+	}{
+		{
+			desc:   "expected origin",
+			origin: testLogOrigin,
+		}, {
+			desc:    "other log",
+			origin:  "ArmoryDrive Log v1",
+			wantErr: true,
+		}, {
+			desc:    "empty origin",
+			origin:  "",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, test.origin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBundleContext(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	if err := BundleContext(context.Background(), pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin); err != nil {
+		t.Fatalf("BundleContext() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := BundleContext(ctx, pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin); !errors.Is(err, context.Canceled) {
+		t.Fatalf("BundleContext() with cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBundleManifestIndex(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	// The manifest is at index 3, followed by some more leaves.
+	leafHashes := append(append(append([][]byte{}, testLeafHashes[:3]...), Hasher().HashLeaf(fw)), testLeafHashes[3:]...)
+	pb, roots := f.bundle(t, fw, leafHashes)
+
+	for _, test := range []struct {
+		desc      string
+		oldSize   uint64
+		wantErr   bool
+		wantIndex bool
+	}{
+		{
+			desc:    "manifest after old checkpoint",
+			oldSize: 2,
+		}, {
+			desc:    "manifest first leaf after old checkpoint",
+			oldSize: 3,
+		}, {
+			desc:      "manifest within old checkpoint",
+			oldSize:   4,
+			wantErr:   true,
+			wantIndex: true,
+		}, {
+			desc:      "manifest well within old checkpoint",
+			oldSize:   6,
+			wantErr:   true,
+			wantIndex: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			oldCP := api.Checkpoint{
+				Size: test.oldSize,
+				Hash: roots[test.oldSize-1],
+			}
+			err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+			var iErr ErrManifestBeforeCheckpoint
+			if gotIndex := errors.As(err, &iErr); gotIndex != test.wantIndex {
+				t.Fatalf("want ErrManifestBeforeCheckpoint: %v, but got: %v", test.wantIndex, err)
+			}
+			if test.wantIndex && (iErr.Index != 3 || iErr.CheckpointSize != test.oldSize) {
+				t.Errorf("Got %+v, want index 3 and checkpoint size %d", iErr, test.oldSize)
+			}
+		})
+	}
+}
+
+func TestBundleCheckpointNotNewer(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, append(append([][]byte{}, testLeafHashes[:3]...), Hasher().HashLeaf(fw)))
+
+	for _, test := range []struct {
+		desc    string
+		oldCP   api.Checkpoint
+		wantErr bool
+	}{
+		{
+			desc:  "older",
+			oldCP: api.Checkpoint{Size: 3, Hash: roots[2]},
+		}, {
+			desc:    "same size",
+			oldCP:   api.Checkpoint{Size: 4, Hash: roots[3]},
+			wantErr: true,
+		}, {
+			desc:    "newer",
+			oldCP:   api.Checkpoint{Size: 5, Hash: []byte("a newer root")},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := Bundle(pb, test.oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			var nErr ErrCheckpointNotNewer
+			if gotErr := errors.As(err, &nErr); gotErr != test.wantErr {
+				t.Fatalf("want ErrCheckpointNotNewer: %v, but got: %v", test.wantErr, err)
+			}
+			if test.wantErr && (nErr.Size != 4 || nErr.CheckpointSize != test.oldCP.Size) {
+				t.Errorf("Got %+v, want size 4 and checkpoint size %d", nErr, test.oldCP.Size)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("Bundle() = %v", err)
+			}
+		})
+	}
+}
+
+func TestBundleAnyOf(t *testing.T) {
+	f := newBundleFixture(t)
+	fw := makeFirmwareRelease(t, map[string][]byte{"FirmwareImage": []byte("Variant B")}, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+
+	for _, test := range []struct {
+		desc          string
+		wantArtifacts map[string][][]byte
+		wantErr       bool
+	}{
+		{
+			desc: "matches second",
+			wantArtifacts: map[string][][]byte{
+				"FirmwareImage": {[]byte("Variant A"), []byte("Variant B")},
+			},
+		}, {
+			desc: "matches none",
+			wantArtifacts: map[string][][]byte{
+				"FirmwareImage": {[]byte("Variant A"), []byte("Variant C")},
+			},
+			wantErr: true,
+		}, {
+			desc: "no acceptable hashes",
+			wantArtifacts: map[string][][]byte{
+				"FirmwareImage": {},
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := BundleAnyOf(pb, oldCP, f.logSigV, f.fwSigV, test.wantArtifacts, testLogOrigin)
 			if gotErr := err != nil; gotErr != test.wantErr {
 				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
 			}
@@ -246,7 +586,7 @@ func mustMakeVerifier(t *testing.T, pubK string) note.Verifier {
 	return v
 }
 
-func makeFirmwareRelease(t *testing.T, artifacts map[string][]byte, sig note.Signer) []byte {
+func makeFirmwareRelease(t *testing.T, artifacts map[string][]byte, sigs ...note.Signer) []byte {
 	fr := api.FirmwareRelease{
 		Description:    "A release",
 		PlatformID:     "7½",
@@ -263,7 +603,7 @@ func makeFirmwareRelease(t *testing.T, artifacts map[string][]byte, sig note.Sig
 	if err != nil {
 		t.Fatalf("Failed to marshal FirmwareRelease: %v", err)
 	}
-	n, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, sig)
+	n, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, sigs...)
 	if err != nil {
 		t.Fatalf("Failed to sign FirmwareRelease: %v", err)
 	}
@@ -279,3 +619,566 @@ func makeCheckpoint(t *testing.T, size int, hash []byte, sig note.Signer) []byte
 	}
 	return n
 }
+
+func TestBundleSchemaVersion(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	for _, test := range []struct {
+		desc    string
+		version int
+		wantErr bool
+	}{
+		{
+			desc:    "absent",
+			version: 0,
+		}, {
+			desc:    "current",
+			version: api.CurrentSchemaVersion,
+		}, {
+			desc:    "future",
+			version: api.CurrentSchemaVersion + 1,
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			frRaw, err := json.MarshalIndent(api.FirmwareRelease{ArtifactSHA256: artifacts, SchemaVersion: test.version}, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to marshal FirmwareRelease: %v", err)
+			}
+			fw, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, f.fwSig)
+			if err != nil {
+				t.Fatalf("Failed to sign FirmwareRelease: %v", err)
+			}
+			pb, roots := f.bundle(t, fw, withRelease(fw))
+			oldCP := api.Checkpoint{
+				Size: 1,
+				Hash: roots[0],
+			}
+
+			err = Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+			var svErr api.ErrUnsupportedSchemaVersion
+			if test.wantErr && !errors.As(err, &svErr) {
+				t.Errorf("Got %v, want ErrUnsupportedSchemaVersion", err)
+			}
+		})
+	}
+}
+
+func TestBundleMaxImageSize(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	for _, test := range []struct {
+		desc      string
+		imageSize uint64
+		opts      []Option
+		wantErr   bool
+	}{
+		{
+			desc:      "unchecked",
+			imageSize: 2048,
+		}, {
+			desc:      "fits",
+			imageSize: 1024,
+			opts:      []Option{WithMaxImageSize(1024)},
+		}, {
+			desc: "size not declared",
+			opts: []Option{WithMaxImageSize(1024)},
+		}, {
+			desc:      "too large",
+			imageSize: 1025,
+			opts:      []Option{WithMaxImageSize(1024)},
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			frRaw, err := api.FirmwareRelease{ArtifactSHA256: artifacts, ImageSize: test.imageSize}.CanonicalJSON()
+			if err != nil {
+				t.Fatalf("Failed to marshal FirmwareRelease: %v", err)
+			}
+			fw, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, f.fwSig)
+			if err != nil {
+				t.Fatalf("Failed to sign FirmwareRelease: %v", err)
+			}
+			pb, _ := f.bundle(t, fw, withRelease(fw))
+
+			err = Bundle(pb, api.Checkpoint{}, f.logSigV, f.fwSigV, artifacts, testLogOrigin, test.opts...)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+			var sErr ErrImageTooLarge
+			if test.wantErr && !errors.As(err, &sErr) {
+				t.Errorf("Got %v, want ErrImageTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestBundlePlatformArtifact(t *testing.T) {
+	f := newBundleFixture(t)
+	platformImage := api.PlatformArtifactName("UA-MKII-ULZ")
+	for _, test := range []struct {
+		desc      string
+		claimed   map[string][]byte
+		artifacts map[string][]byte
+		wantErr   bool
+	}{
+		{
+			desc:      "firmware image named for platform",
+			claimed:   map[string][]byte{platformImage: []byte("Firmware Hash")},
+			artifacts: map[string][]byte{api.FirmwareArtifactName: []byte("Firmware Hash")},
+		}, {
+			desc:      "platform image by name",
+			claimed:   map[string][]byte{platformImage: []byte("Firmware Hash")},
+			artifacts: map[string][]byte{platformImage: []byte("Firmware Hash")},
+		}, {
+			desc:      "single image preferred",
+			claimed:   map[string][]byte{api.FirmwareArtifactName: []byte("Firmware Hash"), platformImage: []byte("Other Hash")},
+			artifacts: map[string][]byte{api.FirmwareArtifactName: []byte("Firmware Hash")},
+		}, {
+			desc:      "platform image mismatch",
+			claimed:   map[string][]byte{platformImage: []byte("Firmware Hash")},
+			artifacts: map[string][]byte{api.FirmwareArtifactName: []byte("Evil Hash")},
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			frRaw, err := api.FirmwareRelease{PlatformID: "UA-MKII-ULZ", ArtifactSHA256: test.claimed}.CanonicalJSON()
+			if err != nil {
+				t.Fatalf("Failed to marshal FirmwareRelease: %v", err)
+			}
+			fw, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, f.fwSig)
+			if err != nil {
+				t.Fatalf("Failed to sign FirmwareRelease: %v", err)
+			}
+			pb, _ := f.bundle(t, fw, withRelease(fw))
+
+			err = Bundle(pb, api.Checkpoint{}, f.logSigV, f.fwSigV, test.artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBundleDigest(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	pb, roots := f.bundle(t, fw, withRelease(fw))
+	oldCP := api.Checkpoint{
+		Size: 1,
+		Hash: roots[0],
+	}
+	want, err := api.BundleDigest(pb)
+	if err != nil {
+		t.Fatalf("BundleDigest: %v", err)
+	}
+
+	var got []byte
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithBundleDigest(&got)); err != nil {
+		t.Fatalf("Bundle() = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got digest %x, want %x", got, want)
+	}
+
+	got = nil
+	bad := map[string][]byte{"FirmwareImage": []byte("Evil Hash")}
+	if err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, bad, testLogOrigin, WithBundleDigest(&got)); err == nil {
+		t.Fatal("Bundle() with wrong artifact hash succeeded, want error")
+	}
+	if got != nil {
+		t.Errorf("Got digest %x for bundle which failed verification, want none", got)
+	}
+
+	pbRaw, err := json.Marshal(pb)
+	if err != nil {
+		t.Fatalf("Failed to marshal ProofBundle: %v", err)
+	}
+	if err := BundleReader(bytes.NewReader(pbRaw), oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin, WithBundleDigest(&got)); err == nil {
+		t.Error("BundleReader() with WithBundleDigest succeeded, want error")
+	}
+}
+
+func TestBundleReleaseVerifiers(t *testing.T) {
+	f := newBundleFixture(t)
+	oldSig, oldSigV := f.fwSig, f.fwSigV
+	newPriv, newPub, err := note.GenerateKey(rand.Reader, "new-firmware")
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	newSig := mustMakeSigner(t, newPriv)
+	newSigV := mustMakeVerifier(t, newPub)
+
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	for _, test := range []struct {
+		desc        string
+		sigs        []note.Signer
+		frSigV      note.Verifier
+		opts        []Option
+		wantSigners []string
+		wantErr     bool
+	}{
+		{
+			desc:        "old key only",
+			sigs:        []note.Signer{oldSig},
+			frSigV:      oldSigV,
+			opts:        []Option{WithReleaseVerifiers(newSigV)},
+			wantSigners: []string{"test-firmware"},
+		}, {
+			desc:        "new key only",
+			sigs:        []note.Signer{newSig},
+			frSigV:      oldSigV,
+			opts:        []Option{WithReleaseVerifiers(newSigV)},
+			wantSigners: []string{"new-firmware"},
+		}, {
+			desc:    "new key not authorised",
+			sigs:    []note.Signer{newSig},
+			frSigV:  oldSigV,
+			wantErr: true,
+		}, {
+			desc:        "both keys",
+			sigs:        []note.Signer{oldSig, newSig},
+			frSigV:      oldSigV,
+			opts:        []Option{WithReleaseVerifiers(newSigV), WithReleaseThreshold(2)},
+			wantSigners: []string{"test-firmware", "new-firmware"},
+		}, {
+			desc:    "below threshold",
+			sigs:    []note.Signer{newSig},
+			frSigV:  oldSigV,
+			opts:    []Option{WithReleaseVerifiers(newSigV), WithReleaseThreshold(2)},
+			wantErr: true,
+		}, {
+			desc:    "threshold counts only authorised keys",
+			sigs:    []note.Signer{oldSig, newSig},
+			frSigV:  oldSigV,
+			opts:    []Option{WithReleaseThreshold(2)},
+			wantErr: true,
+		}, {
+			desc:        "only option keys",
+			sigs:        []note.Signer{newSig},
+			opts:        []Option{WithReleaseVerifiers(nil, newSigV)},
+			wantSigners: []string{"new-firmware"},
+		}, {
+			desc:        "key passed both ways",
+			sigs:        []note.Signer{oldSig},
+			frSigV:      oldSigV,
+			opts:        []Option{WithReleaseVerifiers(oldSigV, newSigV)},
+			wantSigners: []string{"test-firmware"},
+		}, {
+			desc:    "duplicate key counted once",
+			sigs:    []note.Signer{oldSig},
+			frSigV:  oldSigV,
+			opts:    []Option{WithReleaseVerifiers(oldSigV), WithReleaseThreshold(2)},
+			wantErr: true,
+		}, {
+			desc:    "no keys",
+			sigs:    []note.Signer{oldSig},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			fw := makeFirmwareRelease(t, artifacts, test.sigs...)
+			pb, roots := f.bundle(t, fw, withRelease(fw))
+			oldCP := api.Checkpoint{
+				Size: 1,
+				Hash: roots[0],
+			}
+
+			var sigs []note.Signature
+			opts := append([]Option{WithVerifiedReleaseSigners(&sigs)}, test.opts...)
+			err := Bundle(pb, oldCP, f.logSigV, test.frSigV, artifacts, testLogOrigin, opts...)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+			var got []string
+			for _, s := range sigs {
+				got = append(got, s.Name)
+			}
+			if diff := cmp.Diff(test.wantSigners, got); diff != "" {
+				t.Errorf("Verified signers diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestBundlePrefixRange(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	leafHashes := withRelease(fw)
+	full, roots := f.bundle(t, fw, leafHashes)
+	newCP := full.NewCheckpoint
+	oldSize := uint64(len(testLeafHashes))
+	oldCP := api.Checkpoint{
+		Size: oldSize,
+		Hash: roots[oldSize-1],
+	}
+
+	for _, test := range []struct {
+		desc    string
+		start   uint64
+		prefix  [][]byte
+		wantErr bool
+	}{
+		{
+			desc:   "start at old checkpoint",
+			start:  oldSize,
+			prefix: prefixRange(t, leafHashes[:oldSize]),
+		}, {
+			desc:   "start before old checkpoint",
+			start:  1,
+			prefix: prefixRange(t, leafHashes[:1]),
+		}, {
+			desc:    "start after old checkpoint",
+			start:   oldSize + 1,
+			prefix:  prefixRange(t, leafHashes[:oldSize+1]),
+			wantErr: true,
+		}, {
+			desc:    "wrong prefix range",
+			start:   oldSize,
+			prefix:  prefixRange(t, append([][]byte{[]byte("Not a leaf")}, leafHashes[1:oldSize]...)),
+			wantErr: true,
+		}, {
+			desc:    "prefix range for wrong size",
+			start:   oldSize,
+			prefix:  prefixRange(t, leafHashes[:oldSize-1]),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pb := api.ProofBundle{
+				NewCheckpoint:   newCP,
+				FirmwareRelease: fw,
+				LeafHashesStart: test.start,
+				PrefixRange:     test.prefix,
+				LeafHashes:      leafHashes[test.start:],
+			}
+			err := Bundle(pb, oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+
+			pbRaw, err := json.Marshal(pb)
+			if err != nil {
+				t.Fatalf("Failed to marshal ProofBundle: %v", err)
+			}
+			err = BundleReader(bytes.NewReader(pbRaw), oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("BundleReader() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyLeafHashes(t *testing.T) {
+	h := Hasher()
+	target := h.HashLeaf([]byte("manifest"))
+	leafHashes := append(append([][]byte{}, testLeafHashes...), target)
+	roots := buildLog(t, leafHashes)
+	oldSize := len(testLeafHashes) - 1
+	oldCP := api.Checkpoint{Size: uint64(oldSize), Hash: roots[oldSize-1]}
+	newCP := api.Checkpoint{Size: uint64(len(leafHashes)), Hash: roots[len(roots)-1]}
+
+	for _, test := range []struct {
+		desc       string
+		leafHashes [][]byte
+		oldCP      api.Checkpoint
+		newCP      api.Checkpoint
+		target     []byte
+		wantErr    bool
+		// wantAs, if set, is a pointer to the type of error which is expected.
+		wantAs any
+	}{
+		{
+			desc:       "valid",
+			leafHashes: leafHashes,
+			oldCP:      oldCP,
+			newCP:      newCP,
+			target:     target,
+		}, {
+			desc:       "no old checkpoint",
+			leafHashes: leafHashes,
+			newCP:      newCP,
+			target:     target,
+		}, {
+			desc:       "old root mismatch",
+			leafHashes: leafHashes,
+			oldCP:      api.Checkpoint{Size: oldCP.Size, Hash: roots[0]},
+			newCP:      newCP,
+			target:     target,
+			wantErr:    true,
+			wantAs:     &ErrOldRootMismatch{},
+		}, {
+			desc:       "new root mismatch",
+			leafHashes: leafHashes,
+			oldCP:      oldCP,
+			newCP:      api.Checkpoint{Size: newCP.Size, Hash: roots[0]},
+			target:     target,
+			wantErr:    true,
+			wantAs:     &ErrNewRootMismatch{},
+		}, {
+			desc:       "target not logged",
+			leafHashes: leafHashes,
+			oldCP:      oldCP,
+			newCP:      newCP,
+			target:     h.HashLeaf([]byte("other")),
+			wantErr:    true,
+			wantAs:     &ErrManifestNotLogged{},
+		}, {
+			desc:       "target before old checkpoint",
+			leafHashes: leafHashes,
+			oldCP:      oldCP,
+			newCP:      newCP,
+			target:     testLeafHashes[0],
+			wantErr:    true,
+			wantAs:     &ErrManifestBeforeCheckpoint{},
+		}, {
+			desc:       "old checkpoint larger",
+			leafHashes: leafHashes,
+			oldCP:      api.Checkpoint{Size: newCP.Size + 1},
+			newCP:      newCP,
+			target:     target,
+			wantErr:    true,
+			wantAs:     &ErrCheckpointNotNewer{},
+		}, {
+			desc:       "missing leaf hashes",
+			leafHashes: leafHashes[:len(leafHashes)-1],
+			oldCP:      oldCP,
+			newCP:      newCP,
+			target:     target,
+			wantErr:    true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := VerifyLeafHashes(test.leafHashes, test.oldCP, test.newCP, test.target)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("VerifyLeafHashes() = %v, want err %t", err, test.wantErr)
+			}
+			if test.wantAs != nil && !errors.As(err, test.wantAs) {
+				t.Errorf("VerifyLeafHashes() = %v, want %T", err, test.wantAs)
+			}
+		})
+	}
+}
+
+func TestBundleProofs(t *testing.T) {
+	f := newBundleFixture(t)
+	artifacts := map[string][]byte{"FirmwareImage": []byte("Firmware Hash")}
+	fw := makeFirmwareRelease(t, artifacts, f.fwSig)
+	leafHashes := append(withRelease(fw), []byte("Leaf after release"))
+	tree := testonly.New(Hasher())
+	tree.Append(leafHashes...)
+	size := tree.Size()
+	newCP := makeCheckpoint(t, int(size), tree.Hash(), f.logSig)
+	oldSize := uint64(len(testLeafHashes))
+	oldCP := api.Checkpoint{
+		Size: oldSize,
+		Hash: tree.HashAt(oldSize),
+	}
+	mustProof := func(p [][]byte, err error) [][]byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	consistency := mustProof(tree.ConsistencyProof(oldSize, size))
+	inclusion := mustProof(tree.InclusionProof(oldSize, size))
+
+	for _, test := range []struct {
+		desc        string
+		oldCP       api.Checkpoint
+		from        uint64
+		consistency [][]byte
+		index       uint64
+		inclusion   [][]byte
+		leafHashes  [][]byte
+		wantErr     bool
+	}{
+		{
+			desc:        "valid",
+			oldCP:       oldCP,
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize,
+			inclusion:   inclusion,
+		}, {
+			desc:        "no device checkpoint",
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize,
+			inclusion:   inclusion,
+			wantErr:     true,
+		}, {
+			desc:        "proof from other size",
+			oldCP:       api.Checkpoint{Size: oldSize - 1, Hash: tree.HashAt(oldSize - 1)},
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize,
+			inclusion:   inclusion,
+			wantErr:     true,
+		}, {
+			desc:        "inconsistent device checkpoint",
+			oldCP:       api.Checkpoint{Size: oldSize, Hash: tree.HashAt(oldSize - 1)},
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize,
+			inclusion:   inclusion,
+			wantErr:     true,
+		}, {
+			desc:        "wrong index",
+			oldCP:       oldCP,
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize + 1,
+			inclusion:   inclusion,
+			wantErr:     true,
+		}, {
+			desc:        "manifest covered by device checkpoint",
+			oldCP:       oldCP,
+			from:        oldSize,
+			consistency: consistency,
+			index:       0,
+			inclusion:   mustProof(tree.InclusionProof(0, size)),
+			wantErr:     true,
+		}, {
+			desc:        "leaf hashes and proofs",
+			oldCP:       oldCP,
+			from:        oldSize,
+			consistency: consistency,
+			index:       oldSize,
+			inclusion:   inclusion,
+			leafHashes:  leafHashes,
+			wantErr:     true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			pb := api.ProofBundle{
+				NewCheckpoint:    newCP,
+				FirmwareRelease:  fw,
+				ConsistencyFrom:  test.from,
+				ConsistencyProof: test.consistency,
+				LeafIndex:        test.index,
+				InclusionProof:   test.inclusion,
+				LeafHashes:       test.leafHashes,
+			}
+			err := Bundle(pb, test.oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Bundle() = %v, want err %t", err, test.wantErr)
+			}
+
+			pbRaw, err := json.Marshal(pb)
+			if err != nil {
+				t.Fatalf("Failed to marshal ProofBundle: %v", err)
+			}
+			err = BundleReader(bytes.NewReader(pbRaw), test.oldCP, f.logSigV, f.fwSigV, artifacts, testLogOrigin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("BundleReader() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cp_diff is a tool which lists the releases added to the log between two
+// checkpoints.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	logURL        = flag.String("log_url", "https://raw.githubusercontent.com/usbarmory/armory-drive-log/master/log/", "URL identifying the location of the log")
+	logPubKey     = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
+	logOrigin     = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
+	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
+	oldCPFile     = flag.String("old_checkpoint", "", "Path to the older of the two signed checkpoints")
+	newCPFile     = flag.String("new_checkpoint", "", "Path to the newer of the two signed checkpoints, leave unset to use the log's latest checkpoint")
+	httpProxy     = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests to the log through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	timeout       = flag.Duration("timeout", time.Minute, "Maximum duration to spend fetching from the log")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+
+	if len(*oldCPFile) == 0 {
+		logging.Exit("--old_checkpoint required")
+	}
+	oldRaw, err := os.ReadFile(*oldCPFile)
+	if err != nil {
+		logging.Exitf("Failed to read checkpoint file %q: %v", *oldCPFile, err)
+	}
+	var newRaw []byte
+	if len(*newCPFile) > 0 {
+		if newRaw, err = os.ReadFile(*newCPFile); err != nil {
+			logging.Exitf("Failed to read checkpoint file %q: %v", *newCPFile, err)
+		}
+	}
+
+	lSigV, err := note.NewVerifier(*logPubKey)
+	if err != nil {
+		logging.Exitf("Failed to construct log note verifier: %v", err)
+	}
+	rSigV, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		logging.Exitf("Failed to construct release note verifier: %v", err)
+	}
+	root, err := url.Parse(*logURL)
+	if err != nil {
+		logging.Exitf("Failed to parse log URL %q: %v", *logURL, err)
+	}
+	f, err := fetcher.New(root, fetcher.WithProxy(*httpProxy))
+	if err != nil {
+		logging.Exitf("Failed to create fetcher: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	leaves, err := diffCheckpoints(ctx, f, oldRaw, newRaw, lSigV, *logOrigin, note.VerifierList(rSigV))
+	if err != nil {
+		logging.Exit(err.Error())
+	}
+	for _, l := range leaves {
+		fmt.Printf("%d\t%s\t%s\n", l.Index, l.Release.Revision, l.Release.PlatformID)
+	}
+}
+
+// diffCheckpoints returns the leaves added to the log between the checkpoints
+// oldRaw and newRaw. If newRaw is nil, the log's latest checkpoint is used.
+//
+// The checkpoints are checked to be signed by the log and consistent with each
+// other, and each returned leaf is checked to be included under the newer one and
+// to be a release signed by one of releaseVerifiers.
+func diffCheckpoints(ctx context.Context, f client.Fetcher, oldRaw, newRaw []byte, lSigV note.Verifier, origin string, releaseVerifiers note.Verifiers) ([]monitor.Leaf, error) {
+	if newRaw == nil {
+		_, raw, _, err := client.FetchCheckpoint(ctx, f, lSigV, origin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch latest checkpoint: %v", err)
+		}
+		newRaw = raw
+	}
+	newCP, _, newNote, err := log.ParseCheckpoint(newRaw, origin, lSigV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid new checkpoint: %v", err)
+	}
+	consensus := func(context.Context, note.Verifier, string) (*log.Checkpoint, []byte, *note.Note, error) {
+		return newCP, newRaw, newNote, nil
+	}
+	st, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), oldRaw, lSigV, origin, consensus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid old checkpoint: %v", err)
+	}
+	oldSize := st.LatestConsistent.Size
+	if newCP.Size < oldSize {
+		return nil, fmt.Errorf("new checkpoint size %d is smaller than old checkpoint size %d", newCP.Size, oldSize)
+	}
+	if newCP.Size == oldSize && !bytes.Equal(newCP.Hash, st.LatestConsistent.Hash) {
+		return nil, fmt.Errorf("checkpoints of size %d have different hashes %x and %x", oldSize, st.LatestConsistent.Hash, newCP.Hash)
+	}
+	if _, _, _, err := st.Update(ctx); err != nil {
+		return nil, fmt.Errorf("failed to prove consistency between checkpoints: %v", err)
+	}
+
+	lv, err := monitor.NewLeafVerifier(ctx, st, releaseVerifiers)
+	if err != nil {
+		return nil, err
+	}
+	var leaves []monitor.Leaf
+	for i := oldSize; i < st.LatestConsistent.Size; i++ {
+		l, err := lv.Verify(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, l)
+	}
+	return leaves, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestDiffCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	l := testutil.New(t)
+	cp2 := l.AddReleases("v1", "v2")
+	cp4 := l.AddReleases("v3", "v4")
+	l.AddReleases("v5")
+
+	for _, test := range []struct {
+		desc    string
+		old     []byte
+		new     []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			desc: "two new releases",
+			old:  cp2,
+			new:  cp4,
+			want: "[2:v3 3:v4]",
+		}, {
+			desc: "latest checkpoint",
+			old:  cp2,
+			want: "[2:v3 3:v4 4:v5]",
+		}, {
+			desc: "same checkpoint",
+			old:  cp4,
+			new:  cp4,
+			want: "[]",
+		}, {
+			desc:    "new smaller than old",
+			old:     cp4,
+			new:     cp2,
+			wantErr: true,
+		}, {
+			desc:    "bad old signature",
+			old:     cp2[:len(cp2)-5],
+			new:     cp4,
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			leaves, err := diffCheckpoints(ctx, l.Fetcher(), test.old, test.new, l.LogVerifier, testutil.Origin, note.VerifierList(l.ReleaseVerifier))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("diffCheckpoints: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := []string{}
+			for _, l := range leaves {
+				got = append(got, fmt.Sprintf("%d:%s", l.Index, l.Release.Revision))
+			}
+			if gotStr := fmt.Sprint(got); gotStr != test.want {
+				t.Errorf("Got leaves %s, want %s", gotStr, test.want)
+			}
+		})
+	}
+}
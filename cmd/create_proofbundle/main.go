@@ -17,40 +17,54 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
-	"github.com/transparency-dev/merkle/proof"
-	"github.com/transparency-dev/merkle/rfc6962"
 	"github.com/transparency-dev/serverless-log/client"
 	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/bundle"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
 	"golang.org/x/mod/sumdb/note"
 )
 
 var (
 	release       = flag.String("release", "armory-drive.release", "Path to release metadata file")
+	revision      = flag.String("revision", "", "If set, the release is found by scanning the log for this revision or commit hash rather than read from --release")
 	logURL        = flag.String("log_url", "https://raw.githubusercontent.com/usbarmory/armory-drive-log/master/log/", "URL identifying the location of the log")
 	logPubKeyFile = flag.String("log_pubkey_file", "", "Path to file containing the log's public key")
 	logOrigin     = flag.String("log_origin", "", "The expected first line of checkpoints issued by the log")
 	outputFile    = flag.String("output", "", "Path to write output file to, leave unset to write to stdout")
 	timeout       = flag.Duration("timeout", 10*time.Second, "Maximum duration to wait for release to become integrated into the log")
+	initialDelay  = flag.Duration("initial_delay", 0, "Duration to wait before first checking whether the release has been integrated into the log")
+	pollInterval  = flag.Duration("poll_interval", 5*time.Second, "Interval at which the log is polled while waiting for the release to be integrated")
+	httpProxy     = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests to the log through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	deviceCPFile  = flag.String("device_checkpoint", "", "Path to the signed checkpoint held by the device being updated. If set, leaf hashes already covered by it are omitted from the bundle")
+	proofs        = flag.Bool("proofs", false, "Set to true to include an inclusion proof and a consistency proof from --device_checkpoint in the bundle in place of leaf hashes, making it smaller still. Such a bundle can only be verified by a device holding exactly that checkpoint")
+	stateFile     = flag.String("state_file", "", "If set, path to a file in which progress waiting for the release to be integrated is saved, so that a rerun after --timeout resumes the wait rather than starting again")
+	binaryFormat  = flag.Bool("binary", false, "Set to true to serialise the bundle in the compact binary encoding of api.ProofBundle.MarshalBinary rather than JSON")
+	compress      = flag.Bool("compress", false, "Set to true to gzip the serialised bundle, which api.ParseProofBundle and verify_ota decompress transparently")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
 )
 
 func main() {
 	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
 
 	if err := checkFlags(); err != nil {
-		glog.Exitf("Invalid flags:\n%s", err)
+		logging.Exitf("Invalid flags:\n%s", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
@@ -58,110 +72,211 @@ func main() {
 
 	pkRaw, err := os.ReadFile(*logPubKeyFile)
 	if err != nil {
-		glog.Exitf("Unable to read log's public key from %q: %v", *logPubKeyFile, err)
+		logging.Exitf("Unable to read log's public key from %q: %v", *logPubKeyFile, err)
 	}
 	lSigV, err := note.NewVerifier(string(pkRaw))
 	if err != nil {
-		glog.Exitf("Unable to create new log signature verifier: %v", err)
+		logging.Exitf("Unable to create new log signature verifier: %v", err)
+	}
+
+	if len(*logOrigin) == 0 {
+		logging.Exitf("Log origin cannot be empty.")
 	}
 
-	releaseRaw, err := os.ReadFile(*release)
+	f, err := newFetcher(*logURL, *httpProxy)
 	if err != nil {
-		glog.Exitf("Failed to read release file %q: %v", *release, err)
+		logging.Exit(err.Error())
 	}
 
-	if len(*logOrigin) == 0 {
-		glog.Exitf("Log origin cannot be empty.")
+	var releaseRaw []byte
+	if len(*revision) > 0 {
+		if releaseRaw, err = releaseByRevision(ctx, f, lSigV, *logOrigin, *revision); err != nil {
+			logging.Exitf("Failed to find release %q in log: %v", *revision, err)
+		}
+	} else if releaseRaw, err = os.ReadFile(*release); err != nil {
+		logging.Exitf("Failed to read release file %q: %v", *release, err)
 	}
 
-	bundle, err := createBundle(ctx, *logURL, releaseRaw, lSigV, *logOrigin)
+	var deviceSize uint64
+	if len(*deviceCPFile) > 0 {
+		cpRaw, err := os.ReadFile(*deviceCPFile)
+		if err != nil {
+			logging.Exitf("Failed to read device checkpoint file %q: %v", *deviceCPFile, err)
+		}
+		cp, err := openCheckpoint(cpRaw, lSigV, *logOrigin)
+		if err != nil {
+			logging.Exitf("Invalid device checkpoint: %v", err)
+		}
+		deviceSize = cp.Size
+	}
+
+	pb, err := createBundle(ctx, f, releaseRaw, lSigV, *logOrigin, *initialDelay, *pollInterval, deviceSize, *proofs, *stateFile)
 	if err != nil {
-		glog.Exitf("Failed to create ProofBundle: %v", err)
+		logging.Exitf("Failed to create ProofBundle: %v", err)
 	}
-	bundleRaw, err := json.MarshalIndent(bundle, "", "  ")
+	bundleRaw, err := marshalBundle(pb, *binaryFormat, *compress)
 	if err != nil {
-		glog.Exitf("Failed to marshal ProofBundle: %v", err)
+		logging.Exitf("Failed to marshal ProofBundle: %v", err)
 	}
 
 	if *outputFile == "" {
-		fmt.Println(string(bundleRaw))
+		if *binaryFormat || *compress {
+			_, err = os.Stdout.Write(bundleRaw)
+		} else {
+			_, err = fmt.Println(string(bundleRaw))
+		}
+		if err != nil {
+			logging.Exitf("Failed to write ProofBundle: %v", err)
+		}
 	} else {
 		if err := os.WriteFile(*outputFile, bundleRaw, 0644); err != nil {
-			glog.Exitf("Failed to write to output file %q: %v", *outputFile, err)
+			logging.Exitf("Failed to write to output file %q: %v", *outputFile, err)
 		}
-		glog.Infof("Wrote proof bundle to %q", *outputFile)
+		logging.Infof("Wrote proof bundle to %q", *outputFile)
+	}
+}
+
+// marshalBundle serialises the bundle as indented JSON, or in the binary encoding
+// if binaryFormat is set, which is gzipped if compress is set.
+func marshalBundle(pb *api.ProofBundle, binaryFormat, compress bool) ([]byte, error) {
+	var bundleRaw []byte
+	var err error
+	if binaryFormat {
+		bundleRaw, err = pb.MarshalBinary()
+	} else {
+		bundleRaw, err = json.MarshalIndent(pb, "", "  ")
+	}
+	if err != nil || !compress {
+		return bundleRaw, err
+	}
+	b := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(b, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bundleRaw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
 	}
+	return b.Bytes(), nil
 }
 
-func createBundle(ctx context.Context, logURL string, release []byte, lSigV note.Verifier, origin string) (*api.ProofBundle, error) {
+// newFetcher returns a fetcher for the log at logURL, which sends HTTP(S) requests
+// through proxy if it is set.
+func newFetcher(logURL, proxy string) (client.Fetcher, error) {
 	root, err := url.Parse(logURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse log URL %q: %v", logURL, err)
 	}
-	f, err := newFetcher(root)
+	f, err := fetcher.New(root, fetcher.WithProxy(proxy))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fetcher: %v", err)
 	}
+	return f, nil
+}
 
-	h := rfc6962.DefaultHasher
+// createBundle waits for the release to be integrated into the log accessed via f,
+// checking first after initialDelay and then every pollInterval, and returns a
+// ProofBundle for it.
+//
+// If deviceSize is non-zero, the bundle is for a device which already holds a checkpoint
+// of that size, and the leaf hashes it covers are replaced by their compact range. If
+// proofs is also set, all of the leaf hashes are replaced by inclusion and consistency
+// proofs.
+func createBundle(ctx context.Context, f client.Fetcher, release []byte, lSigV note.Verifier, origin string, initialDelay, pollInterval time.Duration, deviceSize uint64, proofs bool, stateFile string) (*api.ProofBundle, error) {
+	opts := []bundle.Option{
+		bundle.WithInitialDelay(initialDelay),
+		bundle.WithPollInterval(pollInterval),
+		bundle.WithDeviceCheckpointSize(deviceSize),
+	}
+	if proofs {
+		opts = append(opts, bundle.WithProofs())
+	}
+	if stateFile != "" {
+		opts = append(opts, bundle.WithStateFile(stateFile))
+	}
+	return bundle.BuildProofBundle(ctx, f, release, lSigV, origin, opts...)
+}
 
-	st, err := client.NewLogStateTracker(ctx, f, h, nil, lSigV, origin, client.UnilateralConsensus(f))
+// openCheckpoint verifies the signature on the checkpoint note, and that it is
+// from the log with the expected origin.
+func openCheckpoint(cpRaw []byte, lSigV note.Verifier, origin string) (api.Checkpoint, error) {
+	n, err := note.Open(cpRaw, note.VerifierList(lSigV))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new LogStateTracker: %v", err)
-	}
-
-	leafHash := h.HashLeaf(release)
-	// Wait for inclusion
-	ticker := time.NewTicker(time.Millisecond)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			ticker.Reset(5 * time.Second)
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+		return api.Checkpoint{}, fmt.Errorf("failed to verify signature on checkpoint: %v", err)
+	}
+	cp := api.Checkpoint{}
+	if err := cp.Unmarshal([]byte(n.Text)); err != nil {
+		return api.Checkpoint{}, fmt.Errorf("failed to unmarshal checkpoint: %v", err)
+	}
+	if cp.Origin != origin {
+		return api.Checkpoint{}, fmt.Errorf("incorrect checkpoint origin %q, want %q", cp.Origin, origin)
+	}
+	return cp, nil
+}
 
-		if _, _, _, err := st.Update(ctx); err != nil {
-			return nil, fmt.Errorf("failed to update LogState: %v", err)
-		}
-		cp := st.LatestConsistent
+// newStateTracker returns a state tracker for the log accessed via f, which trusts
+// the first checkpoint it receives from the log.
+func newStateTracker(ctx context.Context, f client.Fetcher, lSigV note.Verifier, origin string) (client.LogStateTracker, error) {
+	st, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), nil, lSigV, origin, client.UnilateralConsensus(f))
+	if err != nil {
+		return client.LogStateTracker{}, fmt.Errorf("failed to create new LogStateTracker: %v", err)
+	}
+	return st, nil
+}
 
-		idx, err := client.LookupIndex(ctx, f, leafHash)
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return nil, fmt.Errorf("failed to look up leaf index: %v", err)
-			}
-			glog.Infof("Leaf not [yet] sequenced, retrying")
-			continue
-		}
+// releaseByRevision scans the leaves in the log for a release whose Revision or
+// REV build argument matches rev, and returns the signed release as it was logged.
+// This allows a bundle to be recreated for a logged release whose original signed
+// file has been lost.
+//
+// The signatures on the release are not verified, as they will be checked by the
+// device when it verifies the bundle.
+func releaseByRevision(ctx context.Context, f client.Fetcher, lSigV note.Verifier, origin string, rev string) ([]byte, error) {
+	st, err := newStateTracker(ctx, f, lSigV, origin)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := st.Update(ctx); err != nil {
+		return nil, fmt.Errorf("failed to update LogState: %v", err)
+	}
 
-		pb, err := client.NewProofBuilder(ctx, cp, h.HashChildren, f)
+	var found []uint64
+	var release []byte
+	for i := uint64(0); i < st.LatestConsistent.Size; i++ {
+		leaf, err := client.GetLeaf(ctx, f, i)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create new ProofBuilder: %v", err)
+			return nil, fmt.Errorf("failed to get leaf at index %d: %v", i, err)
 		}
-
-		ip, err := pb.InclusionProof(ctx, idx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create inclusion proof for leaf %d: %v", idx, err)
+		// There are no verifiers, so opening the note always fails, but the error
+		// carries the unverified note text.
+		_, err = note.Open(leaf, note.VerifierList())
+		var e *note.UnverifiedNoteError
+		if !errors.As(err, &e) {
+			logging.Warning("Skipping leaf", "index", i, "error", err)
+			continue
+		}
+		var fr api.FirmwareRelease
+		if err := json.Unmarshal([]byte(e.Note.Text), &fr); err != nil {
+			logging.Warning("Skipping leaf: failed to unmarshal release", "index", i, "error", err)
+			continue
 		}
-		if err := proof.VerifyInclusion(h, idx, cp.Size, leafHash, ip, cp.Hash); err != nil {
-			return nil, fmt.Errorf("failed to verify inclusion proof: %q", err)
+		if fr.Revision == rev || fr.BuildArgs["REV"] == rev {
+			found = append(found, i)
+			release = leaf
 		}
-		glog.Infof("Found leaf at %d", idx)
-		break
 	}
-
-	allLeafHashes, err := client.FetchLeafHashes(ctx, f, 0, st.LatestConsistent.Size, st.LatestConsistent.Size)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch leaf hashes [0, %d): %v", st.LatestConsistent.Size, err)
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no release with revision %q in log of size %d", rev, st.LatestConsistent.Size)
+	case 1:
+		logging.Info("Found release", "revision", rev, "index", found[0])
+		return release, nil
+	default:
+		return nil, fmt.Errorf("revision %q matches multiple releases at indices %v", rev, found)
 	}
-
-	return &api.ProofBundle{
-		NewCheckpoint:   st.LatestConsistentRaw,
-		FirmwareRelease: release,
-		LeafHashes:      allLeafHashes,
-	}, nil
 }
 
 func checkFlags() error {
@@ -174,6 +289,12 @@ func checkFlags() error {
 	checkNotEmpty("release", *release)
 	checkNotEmpty("log_url", *logURL)
 	checkNotEmpty("log_pubkey_file", *logPubKeyFile)
+	if *pollInterval <= 0 {
+		errs = append(errs, "--poll_interval must be positive")
+	}
+	if *proofs && *deviceCPFile == "" {
+		errs = append(errs, "--proofs requires --device_checkpoint")
+	}
 
 	if !strings.HasSuffix(*logURL, "/") {
 		errs = append(errs, "--log_url must end with a '/'")
@@ -184,49 +305,3 @@ func checkFlags() error {
 	}
 	return nil
 }
-
-// newFetcher creates a Fetcher for the log at the given root location.
-func newFetcher(root *url.URL) (client.Fetcher, error) {
-	get := getByScheme[root.Scheme]
-	if get == nil {
-		return nil, fmt.Errorf("unsupported URL scheme %s", root.Scheme)
-	}
-
-	f := func(ctx context.Context, p string) ([]byte, error) {
-		u, err := root.Parse(p)
-		if err != nil {
-			return nil, err
-		}
-		return get(ctx, u)
-	}
-	return f, nil
-}
-
-var getByScheme = map[string]func(context.Context, *url.URL) ([]byte, error){
-	"http":  readHTTP,
-	"https": readHTTP,
-	"file": func(_ context.Context, u *url.URL) ([]byte, error) {
-		return os.ReadFile(u.Path)
-	},
-}
-
-func readHTTP(ctx context.Context, u *url.URL) ([]byte, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	switch resp.StatusCode {
-	case 200:
-		return io.ReadAll(resp.Body)
-	case 404:
-		return nil, os.ErrNotExist
-	default:
-		return nil, fmt.Errorf("failed to fetch url: %s", resp.Status)
-	}
-}
@@ -0,0 +1,121 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestReleaseByRevision(t *testing.T) {
+	logDir, err := filepath.Abs("../../log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFetcher((&url.URL{Scheme: "file", Path: logDir + "/"}).String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lSigV, err := note.NewVerifier(keys.ArmoryDriveLogPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf1, err := os.ReadFile(filepath.Join(logDir, "seq/00/00/00/00/01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		rev     string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			desc: "by revision",
+			rev:  "v2021.10.08",
+			want: leaf1,
+		}, {
+			desc: "by commit",
+			rev:  "b90e2d9",
+			want: leaf1,
+		}, {
+			desc:    "missing",
+			rev:     "v2000.01.01",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := releaseByRevision(context.Background(), f, lSigV, "Armory Drive Prod 2", test.rev)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("releaseByRevision() = %v, want err %t", err, test.wantErr)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("releaseByRevision() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMarshalBundle(t *testing.T) {
+	pb := &api.ProofBundle{
+		NewCheckpoint:   []byte("Test Log\n64\nYmFuYW5hcw==\n\n— log sig\n"),
+		FirmwareRelease: []byte("{}\n\n— release sig\n"),
+	}
+	for i := 0; i < 64; i++ {
+		pb.LeafHashes = append(pb.LeafHashes, bytes.Repeat([]byte{byte(i)}, 32))
+	}
+
+	plain, err := marshalBundle(pb, false, false)
+	if err != nil {
+		t.Fatalf("marshalBundle: %v", err)
+	}
+	compressed, err := marshalBundle(pb, false, true)
+	if err != nil {
+		t.Fatalf("marshalBundle compressed: %v", err)
+	}
+	if len(compressed) >= len(plain) {
+		t.Errorf("Compressed bundle is %d bytes, not smaller than %d", len(compressed), len(plain))
+	}
+	bin, err := marshalBundle(pb, true, false)
+	if err != nil {
+		t.Fatalf("marshalBundle binary: %v", err)
+	}
+	if len(bin) >= len(plain) {
+		t.Errorf("Binary bundle is %d bytes, not smaller than %d", len(bin), len(plain))
+	}
+	binCompressed, err := marshalBundle(pb, true, true)
+	if err != nil {
+		t.Fatalf("marshalBundle binary compressed: %v", err)
+	}
+	for _, raw := range [][]byte{plain, compressed, bin, binCompressed} {
+		got, err := api.ParseProofBundle(raw)
+		if err != nil {
+			t.Fatalf("ParseProofBundle: %v", err)
+		}
+		if diff := cmp.Diff(*pb, got); diff != "" {
+			t.Errorf("Round trip changed ProofBundle, diff: %s", diff)
+		}
+	}
+}
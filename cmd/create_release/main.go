@@ -16,19 +16,20 @@
 package main
 
 import (
-	"crypto/sha256"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/release"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
 	"golang.org/x/mod/sumdb/note"
 )
 
@@ -38,85 +39,187 @@ var (
 	platformID     = flag.String("platform_id", "", "Specifies the plaform ID that this release is targetting")
 	commitHash     = flag.String("commit_hash", "", "Speficies the github commit hash that the release was built from")
 	toolChain      = flag.String("tool_chain", "", "Specifies the toolchain used to build the release")
-	artifacts      = flag.String("artifacts", `armory-drive.*`, "Space separated list of globs specifying the release artifacts to include")
+	artifacts      = flag.String("artifacts", `armory-drive.*`, "Space separated list of globs or http(s) URLs specifying the release artifacts to include. Globs prefixed with ! exclude any matching artifacts, e.g. 'armory-drive.* !*.elf'")
 	revisionTag    = flag.String("revision_tag", "", "The git tag name which identifies the firmware revision")
-	privateKeyFile = flag.String("private_key", "", "Path to file containing the private key used to sign the manifest")
+	privateKeyFile = flag.String("private_key", "", "Comma separated list of paths to files containing the private keys used to sign the manifest. If unset, uses the keys in the ARMORY_SIGNING_KEY environment variable, one per line.")
 	output         = flag.String("output", "", "Path to write the output to, leave empty to write to stdout")
+	createdAt      = flag.String("created_at", "", "RFC3339 timestamp to record as the release creation time, defaults to now")
+	checkAncestor  = flag.Bool("check_ancestor", false, "Set to true to fail unless --commit_hash is in the history of --revision_tag, as reported by the GitHub compare API")
+	verifyOutput   = flag.Bool("verify", false, "Set to true to check that the signed output verifies against the public keys derived from the private keys, and contains the expected FirmwareRelease, before writing it")
+	httpProxy      = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	strict         = flag.Bool("strict", false, "Set to true to fail, rather than only warn, if --revision_tag does not resolve to --commit_hash")
+	sourceGitTree  = flag.Bool("source_git_tree", false, "Set to true to record the git tree hash of --commit_hash, which can always be recomputed from a checkout, instead of the SHA256 of GitHub's source tarball, which is not byte-for-byte stable over time")
+	logFormat      = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
 )
 
 func main() {
 	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
 	if err := validateFlags(); err != nil {
-		glog.Exitf("Invalid flag(s):\n%s", err)
+		logging.Exitf("Invalid flag(s):\n%s", err)
 	}
-
-	sourceURL := fmt.Sprintf("https://github.com/%s/archive/refs/tags/%s.tar.gz", *repo, *revisionTag)
-	sourceHash, err := hashRemote(sourceURL)
+	c, err := fetcher.HTTPClient(*httpProxy)
 	if err != nil {
-		glog.Exitf("Failed to hash source tarball (%s): %v", sourceURL, err)
+		logging.Exitf("Failed to create HTTP client: %v", err)
+	}
+
+	cfg := release.ReleaseConfig{
+		Repo:             *repo,
+		Description:      *description,
+		PlatformID:       *platformID,
+		CommitHash:       *commitHash,
+		ToolChain:        *toolChain,
+		RevisionTag:      *revisionTag,
+		Artifacts:        strings.Split(*artifacts, " "),
+		AllowTagMismatch: !*strict,
+		CheckAncestor:    *checkAncestor,
+		SourceGitTree:    *sourceGitTree,
+		HTTPClient:       c,
+	}
+	if len(*createdAt) > 0 {
+		if cfg.CreatedAt, err = time.Parse(time.RFC3339, *createdAt); err != nil {
+			logging.Exitf("Invalid --created_at: %v", err)
+		}
 	}
-
-	fr := api.FirmwareRelease{
-		Description:  *description,
-		PlatformID:   *platformID,
-		Revision:     *revisionTag,
-		SourceURL:    sourceURL,
-		SourceSHA256: sourceHash,
-		ToolChain:    *toolChain,
-		BuildArgs: map[string]string{
-			"REV": *commitHash,
-		},
+	fr, err := release.BuildRelease(cfg)
+	if err != nil {
+		logging.Exitf("Failed to build FirmwareRelease: %v", err)
 	}
 
-	// TODO(al): consider using the GH API to check that revisionTag resolves to commitHash and
-	// warn if that's not the case.
-
-	glog.Info("Hashing release artifacts...")
-	artifacts, err := hashArtifacts()
+	ks, err := privateKeys()
 	if err != nil {
-		glog.Exitf("Failed to hash artifacts: %v", err)
-	}
-	if len(artifacts) == 0 {
-		glog.Exit("--artifacts matched ZERO files")
+		logging.Exitf("Failed to read private keys: %v", err)
 	}
-	fr.ArtifactSHA256 = artifacts
-
-	pp, err := json.MarshalIndent(fr, "", "  ")
+	signers, err := newSigners(ks)
 	if err != nil {
-		glog.Exitf("Failed to marshal FirmwareRelease: %v", err)
+		logging.Exitf("Failed to read private keys: %v", err)
 	}
-	s, err := sign(string(pp))
+	s, err := release.SignRelease(fr, signers...)
 	if err != nil {
-		glog.Exitf("Failed to sign FirmwareRelease JSON: %v", err)
+		logging.Exitf("Failed to sign FirmwareRelease JSON: %v", err)
+	}
+	if *verifyOutput {
+		if err := verifyRelease(s, ks, fr); err != nil {
+			logging.Exitf("Failed to verify signed FirmwareRelease: %v", err)
+		}
+		logging.Info("Signed FirmwareRelease verified")
 	}
 	// Write struct to stdout in case we're being piped.
 	if *output == "" {
 		fmt.Println(string(s))
 	} else {
 		if err := os.WriteFile(*output, s, 0644); err != nil {
-			glog.Exitf("Failed to write output to %q: %v", *output, err)
+			logging.Exitf("Failed to write output to %q: %v", *output, err)
 		}
 
 	}
 }
 
-// sign signs the passed in body using the Go sumdb's note format.
-func sign(body string) ([]byte, error) {
-	// Note body must end in a trailing new line, so add one if necessary.
-	if !strings.HasSuffix(body, "\n") {
-		body = fmt.Sprintf("%s\n", body)
+// privateKeyEnv is the environment variable from which the private keys are read
+// if --private_key is not set.
+const privateKeyEnv = "ARMORY_SIGNING_KEY"
+
+// newSigners returns note signers for each of the private keys.
+func newSigners(ks []string) ([]note.Signer, error) {
+	signers := make([]note.Signer, 0, len(ks))
+	for _, k := range ks {
+		signer, err := note.NewSigner(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialise key: %v", err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// verifyRelease checks that the signed note carries a valid signature from each of
+// the private keys, and that its text is the canonical encoding of a valid
+// FirmwareRelease identical to want.
+func verifyRelease(signed []byte, ks []string, want api.FirmwareRelease) error {
+	vs := make([]note.Verifier, 0, len(ks))
+	for _, k := range ks {
+		vk, err := publicKey(k)
+		if err != nil {
+			return err
+		}
+		v, err := note.NewVerifier(vk)
+		if err != nil {
+			return fmt.Errorf("failed to create verifier for derived public key: %v", err)
+		}
+		vs = append(vs, v)
+	}
+	n, err := note.Open(signed, note.VerifierList(vs...))
+	if err != nil {
+		return fmt.Errorf("failed to open note: %v", err)
+	}
+	if got, want := len(n.Sigs), len(vs); got != want {
+		return fmt.Errorf("note has %d verified signature(s), want %d", got, want)
 	}
 
-	k, err := os.ReadFile(*privateKeyFile)
+	var fr api.FirmwareRelease
+	if err := json.Unmarshal([]byte(n.Text), &fr); err != nil {
+		return fmt.Errorf("failed to unmarshal FirmwareRelease: %v", err)
+	}
+	if err := fr.CheckSchema(); err != nil {
+		return err
+	}
+	if diff := api.DiffFirmwareRelease(want, fr); len(diff) > 0 {
+		return fmt.Errorf("signed FirmwareRelease differs from the one created: %v", diff)
+	}
+	c, err := fr.CanonicalJSON()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read private key file: %v", err)
+		return fmt.Errorf("failed to marshal FirmwareRelease: %v", err)
+	}
+	if got, want := n.Text, string(c)+"\n"; got != want {
+		return fmt.Errorf("signed text is not the canonical FirmwareRelease encoding")
+	}
+	return nil
+}
+
+// publicKey derives the note verifier key corresponding to the given note signer
+// key, which has the form PRIVATE+KEY+<name>+<hash>+<keydata>.
+func publicKey(skey string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(skey), "+", 5)
+	if len(parts) != 5 || parts[0] != "PRIVATE" || parts[1] != "KEY" {
+		return "", errors.New("malformed private key")
 	}
-	signer, err := note.NewSigner(string(k))
+	name, hash, enc := parts[2], parts[3], parts[4]
+	key, err := base64.StdEncoding.DecodeString(enc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialise key: %v", err)
+		return "", fmt.Errorf("malformed private key: %v", err)
+	}
+	if len(key) != 1+ed25519.SeedSize || key[0] != algEd25519 {
+		return "", errors.New("unsupported private key type")
 	}
+	pub := ed25519.NewKeyFromSeed(key[1:]).Public().(ed25519.PublicKey)
+	return fmt.Sprintf("%s+%s+%s", name, hash, base64.StdEncoding.EncodeToString(append([]byte{algEd25519}, pub...))), nil
+}
 
-	return note.Sign(&note.Note{Text: body}, signer)
+// algEd25519 is the note key algorithm identifier for Ed25519 keys.
+const algEd25519 = 1
+
+// privateKeys returns the signing keys from the files specified by --private_key, or
+// from the environment if the flag is unset. Signing with more than one key allows
+// a manifest to be verified by either the old or new key during key rotation.
+func privateKeys() ([]string, error) {
+	if len(*privateKeyFile) == 0 {
+		ks := strings.Fields(os.Getenv(privateKeyEnv))
+		if len(ks) == 0 {
+			return nil, fmt.Errorf("%s environment variable not found", privateKeyEnv)
+		}
+		return ks, nil
+	}
+	var ks []string
+	for _, f := range strings.Split(*privateKeyFile, ",") {
+		k, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key file: %v", err)
+		}
+		ks = append(ks, string(k))
+	}
+	return ks, nil
 }
 
 func validateFlags() error {
@@ -139,53 +242,3 @@ func validateFlags() error {
 	}
 	return nil
 }
-
-func hashArtifacts() (map[string][]byte, error) {
-	r := make(map[string][]byte)
-	for _, glob := range strings.Split(*artifacts, " ") {
-		match, err := filepath.Glob(glob)
-		if err != nil {
-			return nil, err
-		}
-		for _, f := range match {
-			h, err := hashFile(f)
-			if err != nil {
-				return nil, err
-			}
-
-			_, name := filepath.Split(f)
-			r[name] = h
-		}
-	}
-	return r, nil
-}
-
-// hashRemote returns the SHA256 of the contents of the resource pointed to by url.
-func hashRemote(url string) ([]byte, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch %q: %v", url, err)
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("got non-200 HTTP status when fetching %q: %s", url, resp.Status)
-	}
-	defer resp.Body.Close()
-	return hash(resp.Body)
-}
-
-func hashFile(path string) ([]byte, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	return hash(f)
-}
-
-func hash(r io.Reader) ([]byte, error) {
-	h := sha256.New()
-	if _, err := io.Copy(h, r); err != nil {
-		return nil, fmt.Errorf("failed to hash content: %v", err)
-	}
-	return h.Sum(nil), nil
-}
@@ -0,0 +1,147 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestPublicKey(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "test-key")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	got, err := publicKey(skey)
+	if err != nil {
+		t.Fatalf("publicKey: %v", err)
+	}
+	if got != vkey {
+		t.Errorf("publicKey: got %q, want %q", got, vkey)
+	}
+
+	for _, bad := range []string{"", vkey, "PRIVATE+KEY+test-key+01234567+!!!"} {
+		if _, err := publicKey(bad); err == nil {
+			t.Errorf("publicKey(%q): got no error", bad)
+		}
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	skey, _, err := note.GenerateKey(rand.Reader, "test-key")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	skey2, _, err := note.GenerateKey(rand.Reader, "test-key-2")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	fr := api.FirmwareRelease{
+		Description:    "release",
+		PlatformID:     "armory-drive",
+		Revision:       "v1.0.0",
+		ArtifactSHA256: map[string][]byte{"armory-drive.imx": []byte("hash")},
+		ToolChain:      "tamago1.17.1",
+		BuildArgs:      map[string]string{"REV": "abc123"},
+		CreatedAt:      time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	mustSign := func(body string, ks ...string) []byte {
+		t.Helper()
+		signers, err := newSigners(ks)
+		if err != nil {
+			t.Fatalf("newSigners: %v", err)
+		}
+		s, err := note.Sign(&note.Note{Text: body + "\n"}, signers...)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		return s
+	}
+	pp, err := fr.CanonicalJSON()
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	other := fr
+	other.Revision = "v1.0.1"
+	otherPP, err := other.CanonicalJSON()
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+	unsupported := fr
+	unsupported.SchemaVersion = api.CurrentSchemaVersion + 1
+	unsupportedPP, err := unsupported.CanonicalJSON()
+	if err != nil {
+		t.Fatalf("CanonicalJSON: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc    string
+		signed  []byte
+		keys    []string
+		wantErr bool
+	}{
+		{
+			desc:   "valid",
+			signed: mustSign(string(pp), skey),
+			keys:   []string{skey},
+		}, {
+			desc:   "valid two keys",
+			signed: mustSign(string(pp), skey, skey2),
+			keys:   []string{skey, skey2},
+		}, {
+			desc:    "missing signature",
+			signed:  mustSign(string(pp), skey),
+			keys:    []string{skey, skey2},
+			wantErr: true,
+		}, {
+			desc:    "wrong key",
+			signed:  mustSign(string(pp), skey2),
+			keys:    []string{skey},
+			wantErr: true,
+		}, {
+			desc:    "different release",
+			signed:  mustSign(string(otherPP), skey),
+			keys:    []string{skey},
+			wantErr: true,
+		}, {
+			desc:    "not canonical",
+			signed:  mustSign(strings.ReplaceAll(string(pp), "\n  ", "\n\t"), skey),
+			keys:    []string{skey},
+			wantErr: true,
+		}, {
+			desc:    "unsupported schema",
+			signed:  mustSign(string(unsupportedPP), skey),
+			keys:    []string{skey},
+			wantErr: true,
+		}, {
+			desc:    "not JSON",
+			signed:  mustSign("release", skey),
+			keys:    []string{skey},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := verifyRelease(test.signed, test.keys, fr)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("verifyRelease: %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// export_log is a tool which verifies every leaf committed to by the log's latest
+// checkpoint, and writes them to a directory as a self-contained snapshot of the
+// log which can be verified without access to the log itself.
+//
+// For the leaf at each index, the directory holds:
+//   - <index>.json: the FirmwareRelease, in its canonical JSON encoding
+//   - <index>.release: the signed release note, exactly as it was logged
+//
+// along with manifest.json, which holds the signed checkpoint and the hashes of
+// all of the leaves it commits to, in order. manifest.json is written last, so an
+// export which was interrupted can be recognised by its absence.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	logURL        = flag.String("log_url", "https://raw.githubusercontent.com/usbarmory/armory-drive-log/master/log/", "URL identifying the location of the log")
+	logPubKey     = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
+	logOrigin     = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
+	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
+	outputDir     = flag.String("output_dir", "", "Directory to write the snapshot to, which must be empty or not yet exist")
+	httpProxy     = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests to the log through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+// manifestFile is the name of the file in the snapshot which holds its manifest.
+const manifestFile = "manifest.json"
+
+// manifest describes the contents of the log at the time of the export.
+type manifest struct {
+	// Checkpoint is the signed checkpoint which the leaves were verified against.
+	Checkpoint []byte
+	// LeafHashes contains the hashes of every leaf committed to by Checkpoint, in
+	// order, from which the checkpoint's root hash can be recomputed.
+	LeafHashes [][]byte
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+	ctx := context.Background()
+
+	if len(*outputDir) == 0 {
+		logging.Exit("--output_dir required")
+	}
+	lSigV, err := note.NewVerifier(*logPubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new log signature verifier: %v", err)
+	}
+	frSigV, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new release signature verifier: %v", err)
+	}
+
+	root, err := url.Parse(*logURL)
+	if err != nil {
+		logging.Exitf("Failed to parse log URL %q: %v", *logURL, err)
+	}
+	f, err := fetcher.New(root, fetcher.WithProxy(*httpProxy))
+	if err != nil {
+		logging.Exitf("Failed to create fetcher: %v", err)
+	}
+	st, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), nil, lSigV, *logOrigin, client.UnilateralConsensus(f))
+	if err != nil {
+		logging.Exitf("Failed to create new LogStateTracker: %v", err)
+	}
+
+	if err := export(ctx, st, note.VerifierList(frSigV), *outputDir); err != nil {
+		logging.Exitf("Failed to export log: %v", err)
+	}
+	fmt.Printf("Exported %d releases to %q\n", st.LatestConsistent.Size, *outputDir)
+}
+
+// export verifies every leaf committed to by the latest consistent checkpoint of st,
+// and writes the snapshot described in the package comment to dir.
+func export(ctx context.Context, st client.LogStateTracker, releaseVerifiers note.Verifiers, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read output directory: %v", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("output directory %q is not empty", dir)
+	}
+
+	lv, err := monitor.NewLeafVerifier(ctx, st, releaseVerifiers)
+	if err != nil {
+		return err
+	}
+	m := manifest{
+		Checkpoint: st.LatestConsistentRaw,
+		LeafHashes: make([][]byte, 0, st.LatestConsistent.Size),
+	}
+	for i := uint64(0); i < st.LatestConsistent.Size; i++ {
+		l, err := lv.Verify(ctx, i)
+		if err != nil {
+			return err
+		}
+		frRaw, err := l.Release.CanonicalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal release at index %d: %v", i, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", i)), append(frRaw, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write release at index %d: %v", i, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.release", i)), l.Raw, 0644); err != nil {
+			return fmt.Errorf("failed to write signed release at index %d: %v", i, err)
+		}
+		m.LeafHashes = append(m.LeafHashes, l.Hash)
+		logging.V(1).Info("Exported release", "index", i, "revision", l.Release.Revision)
+	}
+
+	mRaw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), mRaw, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestExport(t *testing.T) {
+	l := testutil.New(t)
+	revs := []string{"v1", "v2", "v3"}
+	cp := l.AddReleases(revs...)
+	dir := filepath.Join(t.TempDir(), "snapshot")
+
+	if err := export(context.Background(), l.StateTracker(), note.VerifierList(l.ReleaseVerifier), dir); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	mRaw, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(mRaw, &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !bytes.Equal(m.Checkpoint, cp) {
+		t.Errorf("Got checkpoint %q, want %q", m.Checkpoint, cp)
+	}
+	if got, want := len(m.LeafHashes), len(revs); got != want {
+		t.Fatalf("Got %d leaf hashes, want %d", got, want)
+	}
+	for i, rev := range revs {
+		signed, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.release", i)))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if got, want := verify.Hasher().HashLeaf(signed), m.LeafHashes[i]; !bytes.Equal(got, want) {
+			t.Errorf("Leaf %d: got hash %x, want %x", i, got, want)
+		}
+		frRaw, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.json", i)))
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		var fr api.FirmwareRelease
+		if err := json.Unmarshal(frRaw, &fr); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if fr.Revision != rev {
+			t.Errorf("Leaf %d: got revision %q, want %q", i, fr.Revision, rev)
+		}
+	}
+
+	// A second export must not overwrite the first.
+	if err := export(context.Background(), l.StateTracker(), note.VerifierList(l.ReleaseVerifier), dir); err == nil {
+		t.Error("export to non-empty directory: got no error")
+	}
+}
+
+func TestExportWrongReleaseKey(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1")
+	_, otherV, _ := testutil.GenerateKey(t, "release")
+	dir := t.TempDir()
+
+	if err := export(context.Background(), l.StateTracker(), note.VerifierList(otherV), dir); err == nil {
+		t.Fatal("export: got no error for releases signed by unknown key")
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); err == nil {
+		t.Error("Manifest written for failed export")
+	}
+}
@@ -21,33 +21,37 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/golang/glog"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
 	"golang.org/x/mod/sumdb/note"
 )
 
 var (
-	keyName = flag.String("key_name", "", "Name for the key identity.")
-	outPriv = flag.String("out_priv", "", "Output file for private key.")
-	outPub  = flag.String("out_pub", "", "Output file for public key.")
-	print   = flag.Bool("print", false, "Print private key, then public key, over 2 lines, to stdout.")
+	keyName   = flag.String("key_name", "", "Name for the key identity.")
+	outPriv   = flag.String("out_priv", "", "Output file for private key.")
+	outPub    = flag.String("out_pub", "", "Output file for public key.")
+	print     = flag.Bool("print", false, "Print private key, then public key, over 2 lines, to stdout.")
+	logFormat = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
 )
 
 func main() {
 	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
 
 	if len(*keyName) == 0 {
-		glog.Exit("--key_name required")
+		logging.Exit("--key_name required")
 	}
 
 	if !(*print) {
 		if len(*outPriv) == 0 || len(*outPub) == 0 {
-			glog.Exit("--print and/or --out_priv and --out_pub required.")
+			logging.Exit("--print and/or --out_priv and --out_pub required.")
 		}
 	}
 
 	skey, vkey, err := note.GenerateKey(rand.Reader, *keyName)
 	if err != nil {
-		glog.Exitf("Unable to create key: %q", err)
+		logging.Exitf("Unable to create key: %q", err)
 	}
 
 	if *print {
@@ -57,10 +61,10 @@ func main() {
 
 	if len(*outPriv) > 0 && len(*outPub) > 0 {
 		if err := writeFileIfNotExists(*outPriv, skey); err != nil {
-			glog.Exit(err)
+			logging.Exit(err.Error())
 		}
 		if err := writeFileIfNotExists(*outPub, vkey); err != nil {
-			glog.Exit(err)
+			logging.Exit(err.Error())
 		}
 	}
 }
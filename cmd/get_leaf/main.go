@@ -0,0 +1,110 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// get_leaf is a tool which fetches a single leaf from the log, verifies its
+// inclusion under the log's latest checkpoint and the signature on the release it
+// contains, and prints the FirmwareRelease.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	index         = flag.Int64("index", -1, "The index of the leaf to fetch")
+	logURL        = flag.String("log_url", "https://raw.githubusercontent.com/usbarmory/armory-drive-log/master/log/", "URL identifying the location of the log")
+	logPubKey     = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
+	logOrigin     = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
+	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
+	raw           = flag.Bool("raw", false, "Set to true to print the signed release note exactly as it was logged, rather than the parsed FirmwareRelease")
+	httpProxy     = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests to the log through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+	ctx := context.Background()
+
+	if *index < 0 {
+		logging.Exit("--index required")
+	}
+	lSigV, err := note.NewVerifier(*logPubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new log signature verifier: %v", err)
+	}
+	frSigV, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new release signature verifier: %v", err)
+	}
+
+	root, err := url.Parse(*logURL)
+	if err != nil {
+		logging.Exitf("Failed to parse log URL %q: %v", *logURL, err)
+	}
+	f, err := fetcher.New(root, fetcher.WithProxy(*httpProxy))
+	if err != nil {
+		logging.Exitf("Failed to create fetcher: %v", err)
+	}
+	st, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), nil, lSigV, *logOrigin, client.UnilateralConsensus(f))
+	if err != nil {
+		logging.Exitf("Failed to create new LogStateTracker: %v", err)
+	}
+
+	if err := getLeaf(ctx, os.Stdout, st, note.VerifierList(frSigV), uint64(*index), *raw); err != nil {
+		logging.Exitf("Failed to get leaf %d: %v", *index, err)
+	}
+}
+
+// getLeaf verifies the leaf at index i against the latest consistent checkpoint of
+// st, and writes it to w: either the FirmwareRelease as indented JSON, or the
+// signed release note if raw is set.
+func getLeaf(ctx context.Context, w io.Writer, st client.LogStateTracker, releaseVerifiers note.Verifiers, i uint64, raw bool) error {
+	lv, err := monitor.NewLeafVerifier(ctx, st, releaseVerifiers)
+	if err != nil {
+		return err
+	}
+	l, err := lv.Verify(ctx, i)
+	if err != nil {
+		return err
+	}
+	logging.Info("Verified leaf", "index", i, "tree_size", st.LatestConsistent.Size, "leaf_hash", l.Hash)
+
+	if raw {
+		_, err = w.Write(l.Raw)
+		return err
+	}
+	frRaw, err := json.MarshalIndent(l.Release, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal release: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(frRaw))
+	return err
+}
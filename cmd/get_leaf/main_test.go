@@ -0,0 +1,92 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestGetLeaf(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1")
+	release := l.SignRelease(api.FirmwareRelease{Revision: "v2", PlatformID: "armory-drive"})
+	l.Add(release)
+	st := l.StateTracker()
+	releaseVerifiers := note.VerifierList(l.ReleaseVerifier)
+
+	for _, test := range []struct {
+		desc      string
+		index     uint64
+		raw       bool
+		verifiers note.Verifiers
+		want      []byte
+		wantRev   string
+		wantErr   bool
+	}{
+		{
+			desc:      "release",
+			index:     1,
+			verifiers: releaseVerifiers,
+			wantRev:   "v2",
+		}, {
+			desc:      "raw",
+			index:     1,
+			raw:       true,
+			verifiers: releaseVerifiers,
+			want:      release,
+		}, {
+			desc:      "beyond checkpoint",
+			index:     2,
+			verifiers: releaseVerifiers,
+			wantErr:   true,
+		}, {
+			desc:      "unknown release signer",
+			index:     1,
+			verifiers: note.VerifierList(testutil.New(t).ReleaseVerifier),
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			err := getLeaf(context.Background(), b, st, test.verifiers, test.index, test.raw)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("getLeaf: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if test.raw {
+				if !bytes.Equal(b.Bytes(), test.want) {
+					t.Errorf("getLeaf: got %q, want %q", b.Bytes(), test.want)
+				}
+				return
+			}
+			var fr api.FirmwareRelease
+			if err := json.Unmarshal(b.Bytes(), &fr); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if fr.Revision != test.wantRev {
+				t.Errorf("getLeaf: got revision %q, want %q", fr.Revision, test.wantRev)
+			}
+		})
+	}
+}
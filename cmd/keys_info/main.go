@@ -0,0 +1,43 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// keys_info is a tool which checks that the public keys embedded in the keys
+// package are valid, and prints the name and hash of each of them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+)
+
+func main() {
+	flag.Parse()
+
+	vs, err := keys.Verifiers()
+	if err != nil {
+		logging.Exitf("Invalid embedded keys: %v", err)
+	}
+	names := make([]string, 0, len(vs))
+	for n := range vs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Printf("%s\t%s\t%08x\n", n, vs[n].Name(), vs[n].KeyHash())
+	}
+}
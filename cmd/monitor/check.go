@@ -0,0 +1,118 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/internal/build"
+)
+
+// checkConfig performs the same setup as the monitor without entering the polling
+// loop: it fetches the latest checkpoint from the log, verifies the latest release
+// against the release key, and confirms that the build environment is able to
+// reproduce it. A line is written to w for each check, and an error is returned if
+// any of them failed.
+func checkConfig(ctx context.Context, w io.Writer) error {
+	failed := 0
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(w, "OK   %s: %s\n", name, detail)
+	}
+	skip := func(name, reason string) {
+		fmt.Fprintf(w, "SKIP %s: %s\n", name, reason)
+	}
+
+	policy, err := trustPolicyFromFlags()
+	if len(*policyFile) > 0 {
+		report("trust policy", err, *policyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("%d configuration check(s) failed", failed)
+	}
+
+	st, _, err := stateTrackerFromFlags(ctx, policy, nil)
+	if err == nil {
+		_, _, _, err = st.Update(ctx)
+	}
+	logOK := err == nil
+	report("log", err, fmt.Sprintf("checkpoint for %q at tree size %d", *logOrigin, st.LatestConsistent.Size))
+
+	releaseVerifiers, err := releaseVerifiersFromFlags(policy)
+	keyNames := []string{keyName(*releasePubKey)}
+	if policy != nil {
+		keyNames = keyNames[:0]
+		for _, k := range policy.ReleaseKeys {
+			keyNames = append(keyNames, keyName(k.Key))
+		}
+	}
+	report("release key", err, fmt.Sprintf("signer %q", strings.Join(keyNames, ", ")))
+
+	var latest *api.FirmwareRelease
+	switch {
+	case !logOK || err != nil:
+		skip("latest release", "log or release key unavailable")
+	case st.LatestConsistent.Size == 0:
+		skip("latest release", "log is empty")
+	default:
+		i := st.LatestConsistent.Size - 1
+		var l monitor.Leaf
+		lv, err := monitor.NewLeafVerifier(ctx, st, releaseVerifiers, monitor.WithMaxSignatures(*maxNoteSigs))
+		if err == nil {
+			l, err = lv.Verify(ctx, i)
+		}
+		if err == nil && policy != nil {
+			err = policy.checkRelease(l)
+		}
+		if err == nil {
+			latest = &l.Release
+		}
+		detail := ""
+		if latest != nil {
+			detail = fmt.Sprintf("leaf %d is revision %q built with %q", i, latest.Revision, latest.ToolChain)
+		}
+		report("latest release", err, detail)
+	}
+
+	if *skipBuild {
+		skip("build environment", "--skip_build is set")
+	} else {
+		tc, err := build.NewGitBuilder(true, buildOptionsFromFlags()...).CheckEnvironment(ctx)
+		if err == nil && latest != nil && tc != latest.ToolChain {
+			err = fmt.Errorf("toolchain %q does not match %q used by latest release %q", tc, latest.ToolChain, latest.Revision)
+		}
+		report("build environment", err, fmt.Sprintf("toolchain %q", tc))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d configuration check(s) failed", failed)
+	}
+	return nil
+}
+
+// keyName returns the name of the signer of a note verifier key.
+func keyName(key string) string {
+	name, _, _ := strings.Cut(key, "+")
+	return name
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestCheckConfig(t *testing.T) {
+	logDir, err := filepath.Abs("../../log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRoot := (&url.URL{Scheme: "file", Path: logDir + "/"}).String()
+	_, otherPub, err := note.GenerateKey(rand.Reader, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		origin   string
+		logKey   string
+		relKey   string
+		build    bool
+		wantFail string
+	}{
+		{
+			desc:   "good",
+			origin: "Armory Drive Prod 2",
+			logKey: keys.ArmoryDriveLogPub,
+			relKey: keys.ArmoryDrivePub,
+		}, {
+			desc:     "wrong origin",
+			origin:   "Armory Drive Prod 1",
+			logKey:   keys.ArmoryDriveLogPub,
+			relKey:   keys.ArmoryDrivePub,
+			wantFail: "FAIL log",
+		}, {
+			desc:     "wrong log key",
+			origin:   "Armory Drive Prod 2",
+			logKey:   otherPub,
+			relKey:   keys.ArmoryDrivePub,
+			wantFail: "FAIL log",
+		}, {
+			desc:     "wrong release key",
+			origin:   "Armory Drive Prod 2",
+			logKey:   keys.ArmoryDriveLogPub,
+			relKey:   otherPub,
+			wantFail: "FAIL latest release",
+		}, {
+			desc:     "malformed release key",
+			origin:   "Armory Drive Prod 2",
+			logKey:   keys.ArmoryDriveLogPub,
+			relKey:   "not a key",
+			wantFail: "FAIL release key",
+		}, {
+			desc:     "no tamago",
+			origin:   "Armory Drive Prod 2",
+			logKey:   keys.ArmoryDriveLogPub,
+			relKey:   keys.ArmoryDrivePub,
+			build:    true,
+			wantFail: "FAIL build environment",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			setFlag(t, logURL, logRoot)
+			setFlag(t, logOrigin, test.origin)
+			setFlag(t, logPubKey, test.logKey)
+			setFlag(t, releasePubKey, test.relKey)
+			setFlag(t, stateFile, filepath.Join(t.TempDir(), "state"))
+			setFlag(t, skipBuild, !test.build)
+			t.Setenv("TAMAGO", "")
+
+			var out bytes.Buffer
+			err := checkConfig(context.Background(), &out)
+			if gotErr, wantErr := err != nil, test.wantFail != ""; gotErr != wantErr {
+				t.Fatalf("checkConfig() = %v, want err %t\n%s", err, wantErr, out.String())
+			}
+			if test.wantFail != "" && !strings.Contains(out.String(), test.wantFail) {
+				t.Errorf("checkConfig() report missing %q:\n%s", test.wantFail, out.String())
+			}
+		})
+	}
+}
+
+// setFlag sets the flag pointed to by p to v for the duration of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
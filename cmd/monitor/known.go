@@ -0,0 +1,115 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+)
+
+// sigPrefix begins each signature line of a signed note.
+var sigPrefix = []byte("— ")
+
+// parseCheckpoints splits the contents of a known checkpoints file into the signed
+// checkpoints it contains. The checkpoints may simply be concatenated, or separated
+// by blank lines.
+func parseCheckpoints(b []byte) ([][]byte, error) {
+	var cps [][]byte
+	for len(bytes.TrimSpace(b)) > 0 {
+		b = bytes.TrimLeft(b, "\n")
+		// The checkpoint text ends at the first blank line, and is followed by
+		// its signature lines.
+		i := bytes.Index(b, []byte("\n\n"))
+		if i < 0 {
+			return nil, fmt.Errorf("checkpoint %d has no signatures", len(cps))
+		}
+		end := i + 2
+		for bytes.HasPrefix(b[end:], sigPrefix) {
+			nl := bytes.IndexByte(b[end:], '\n')
+			if nl < 0 {
+				return nil, fmt.Errorf("checkpoint %d is not terminated by a newline", len(cps))
+			}
+			end += nl + 1
+		}
+		if end == i+2 {
+			return nil, fmt.Errorf("checkpoint %d has no signatures", len(cps))
+		}
+		cps = append(cps, b[:end])
+		b = b[end:]
+	}
+	return cps, nil
+}
+
+// checkKnownCheckpoints verifies that each of the known checkpoints was signed by
+// the log, and that the log is consistent with it: that the state tracker's
+// checkpoint and the known one are both views of the same append-only history.
+// This detects a log which has been forked or rewound relative to checkpoints which
+// were obtained independently. If a trust policy is given, it is used to verify the
+// signatures in place of the state tracker's verifier.
+func checkKnownCheckpoints(ctx context.Context, st client.LogStateTracker, known [][]byte, p *trustPolicy) error {
+	for i, raw := range known {
+		var cp *log.Checkpoint
+		var err error
+		if p != nil {
+			cp, _, _, err = p.openCheckpoint(raw, st.Origin)
+		} else {
+			cp, _, _, err = log.ParseCheckpoint(raw, st.Origin, st.CpSigVerifier)
+		}
+		if err != nil {
+			return fmt.Errorf("known checkpoint %d is invalid: %v", i, err)
+		}
+		if err := checkConsistent(ctx, st, *cp, st.LatestConsistent); err != nil {
+			return fmt.Errorf("log is not consistent with known checkpoint %d of size %d: %v", i, cp.Size, err)
+		}
+		logging.Info("Verified consistency with known checkpoint", "known_tree_size", cp.Size, "tree_size", st.LatestConsistent.Size)
+	}
+	return nil
+}
+
+// checkConsistent fetches and verifies a consistency proof between the two
+// checkpoints, which may be of either size.
+func checkConsistent(ctx context.Context, st client.LogStateTracker, a, b log.Checkpoint) error {
+	if a.Size > b.Size {
+		a, b = b, a
+	}
+	if a.Size == b.Size {
+		if !bytes.Equal(a.Hash, b.Hash) {
+			return fmt.Errorf("different root hashes %x and %x for tree size %d", a.Hash, b.Hash, a.Size)
+		}
+		return nil
+	}
+	if a.Size == 0 {
+		// Every tree is consistent with the empty tree.
+		return nil
+	}
+	pb, err := client.NewProofBuilder(ctx, b, st.Hasher.HashChildren, st.Fetcher)
+	if err != nil {
+		return fmt.Errorf("failed to create proof builder for tree size %d: %v", b.Size, err)
+	}
+	cp, err := pb.ConsistencyProof(ctx, a.Size, b.Size)
+	if err != nil {
+		return fmt.Errorf("failed to build consistency proof from tree size %d to %d: %v", a.Size, b.Size, err)
+	}
+	if err := proof.VerifyConsistency(st.Hasher, a.Size, b.Size, cp, a.Hash, b.Hash); err != nil {
+		return fmt.Errorf("invalid consistency proof from tree size %d to %d: %v", a.Size, b.Size, err)
+	}
+	return nil
+}
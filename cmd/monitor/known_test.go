@@ -0,0 +1,115 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/transparency-dev/formats/log"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestParseCheckpoints(t *testing.T) {
+	l := testutil.New(t)
+	cp1 := l.AddReleases("v1")
+	cp2 := l.AddReleases("v2")
+
+	for _, test := range []struct {
+		desc    string
+		file    []byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{
+			desc: "concatenated",
+			file: append(append([]byte{}, cp1...), cp2...),
+			want: [][]byte{cp1, cp2},
+		}, {
+			desc: "blank lines",
+			file: bytes.Join([][]byte{cp1, cp2}, []byte("\n")),
+			want: [][]byte{cp1, cp2},
+		}, {
+			desc: "empty",
+			file: []byte("\n"),
+		}, {
+			desc:    "unsigned",
+			file:    []byte("Test Log\n1\nYmFuYW5hcw==\n"),
+			wantErr: true,
+		}, {
+			desc:    "truncated signature",
+			file:    cp1[:len(cp1)-1],
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := parseCheckpoints(test.file)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("parseCheckpoints: %v, wantErr %t", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("parseCheckpoints: got unexpected checkpoints, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckKnownCheckpoints(t *testing.T) {
+	l := testutil.New(t)
+	older := l.AddReleases("v1", "v2")
+	current := l.AddReleases("v3")
+	st := l.StateTracker()
+	newer := l.AddReleases("v4", "v5")
+
+	h := sha256.Sum256([]byte("fork"))
+	forked, err := note.Sign(&note.Note{Text: string(log.Checkpoint{Origin: testutil.Origin, Size: 2, Hash: h[:]}.Marshal())}, l.LogSigner)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	otherLog := testutil.New(t).AddReleases("v1")
+
+	for _, test := range []struct {
+		desc    string
+		known   [][]byte
+		wantErr bool
+	}{
+		{
+			desc:  "none",
+			known: nil,
+		}, {
+			desc:  "consistent",
+			known: [][]byte{older, current, newer},
+		}, {
+			desc:    "forked",
+			known:   [][]byte{older, forked},
+			wantErr: true,
+		}, {
+			desc:    "other log",
+			known:   [][]byte{otherLog},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := checkKnownCheckpoints(context.Background(), st, test.known, nil)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("checkKnownCheckpoints: %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
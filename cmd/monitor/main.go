@@ -22,152 +22,461 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
+	"math/rand/v2"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/golang/glog"
-	"github.com/transparency-dev/merkle/proof"
-	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/serverless-log/api/layout"
 	"github.com/transparency-dev/serverless-log/client"
 	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/build"
+	"github.com/usbarmory/armory-drive-log/internal/fetcher"
+	"github.com/usbarmory/armory-drive-log/internal/flagfile"
+	"github.com/usbarmory/armory-drive-log/internal/insecure"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/internal/releasedb"
 	"github.com/usbarmory/armory-drive-log/keys"
 	"golang.org/x/mod/sumdb/note"
 )
 
 var (
 	pollInterval  = flag.Duration("poll_interval", 1*time.Minute, "The interval at which the log will be polled for new data")
+	pollJitter    = flag.Float64("poll_jitter", 0, "If set, each poll interval is randomly lengthened or shortened by up to this fraction of --poll_interval, e.g. 0.1 for ±10%, so that many monitors don't poll the log in lockstep")
 	stateFile     = flag.String("state_file", "", "File path for where checkpoints should be stored")
 	logURL        = flag.String("log_url", "https://raw.githubusercontent.com/usbarmory/armory-drive-log/master/log/", "URL identifying the location of the log")
 	logPubKey     = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
 	logOrigin     = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
 	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
 	cleanup       = flag.Bool("cleanup", true, "Set to false to keep git checkouts and make artifacts around after verification")
+	fetchRetries  = flag.Int("fetch_retries", 5, "The number of times transient failures fetching from the log will be retried")
+	buildFromRev  = flag.String("build_from_revision", "", "If set, releases with revisions before this one are only checked for inclusion, and are not reproducibly built")
+	startIndex    = flag.Int64("start_index", -1, "If set, only the leaves from this index up to --end_index are verified, and the state file is not updated")
+	endIndex      = flag.Int64("end_index", -1, "The index after the last leaf to verify when --start_index is set, defaults to the log size")
+	artifacts     = flag.String("verify_artifacts", api.FirmwareArtifactName, "Comma separated list of the artifacts which are compared against each release after reproducing its build. If empty, all artifacts claimed by the release are compared. The default selects each release's firmware image, even if it is named for its platform")
+	makeTarget    = flag.String("make_target", build.DefaultMakeTarget, "The make target used to build releases which don't specify MAKE_TARGET in their build args")
+	crossCompile  = flag.String("cross_compile", build.DefaultCrossCompile, "The cross compiler prefix used to build releases which don't specify CROSS_COMPILE in their build args")
+	buildImage    = flag.String("build_container_image", "", "If set, releases are cloned and built inside this container image, which should be pinned by digest, rather than on the host. The image must provide git, make and the tamago toolchain pointed to by TAMAGO")
+	containerCmd  = flag.String("container_runtime", "docker", "The container runtime, such as docker or podman, used to run --build_container_image")
+	buildTimeout  = flag.Duration("build_timeout", 0, "If set, the reproducible build of each leaf is stopped if it takes longer than this: its git and make processes, everything they started, and its container if --build_container_image is set, are interrupted and then killed. Leaves whose builds time out are reported as failing to reproduce")
+	checkSource   = flag.Bool("check_source", false, "Set to true to also fetch each release's source tarball before building it and check it against the signed source_sha256. GitHub's tarballs aren't byte-for-byte stable, so this may fail for old releases")
+	skipBuild     = flag.Bool("skip_build", false, "Set to true to only check inclusion and signatures of leaves, without reproducing builds")
+	httpProxy     = flag.String("http_proxy", "", "If set, the URL of the proxy to send HTTP(S) requests to the log through, overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+	maxRPS        = flag.Float64("max_requests_per_second", 0, "If set, limits the rate of requests made to the log across the whole monitor")
+	maxRetryAfter = flag.Duration("max_retry_after", fetcher.DefaultMaxRetryAfter, "The longest the monitor waits when the log's server asks it to back off, such as when a rate limit has been hit. Requests which would be delayed for longer fail instead")
+	cacheDir      = flag.String("cache_dir", "", "If set, tiles and leaves fetched from the log are cached in this directory, so that restarts and repeated verifications don't fetch them again")
+	maxNoteSigs   = flag.Int("max_note_signatures", verify.DefaultMaxSignatures, "Checkpoints and leaves with more signatures than this are rejected without being verified")
+	once          = flag.Bool("once", false, "Set to true to verify the log up to its current checkpoint and then exit, rather than polling")
+	proofDir      = flag.String("consistency_proof_dir", "", "If set, the consistency proof verified for each new checkpoint is written to a file in this directory")
+	releaseDB     = flag.String("release_db", "", "If set, a record of each checked leaf is written to the database at this path")
+	policyFile    = flag.String("trust_policy", "", "If set, path to a JSON trust policy listing the log and release keys and the part of the log each is trusted for. Overrides --log_pubkey and --release_pubkey")
+	knownCPFile   = flag.String("known_checkpoints", "", "If set, path to a file of signed checkpoints obtained independently of the monitor, such as from a witness. At startup, the log is checked to be consistent with each of them")
+	maxCPAge      = flag.Duration("max_checkpoint_age", 0, "If set, an error is logged when the log's latest checkpoint is older than this, which may mean that it has stopped issuing checkpoints. Checkpoints are aged from their timestamp if they have one, and otherwise from when the log last grew. A --once run then exits with an error")
+	reportFile    = flag.String("report_file", "", "If set, a JSON summary of the run, including the verified checkpoint, is written to this file when a --once or --start_index run finishes")
+	reportKey     = flag.String("report_signing_key", "", "If set, path to a file containing a note private key with which the --report_file is signed, so that it is written as a signed note whose text is the JSON summary")
+	checkCfg      = flag.Bool("check_config", false, "Set to true to check the configuration and environment, print a report, and exit without monitoring")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+	configFile    = flag.String(flagfile.FlagName, "", flagfile.FlagUsage)
+	skipSig       = flag.Bool(insecure.SkipSignatureFlag, false, insecure.SkipSignatureUsage)
+	skipSigAck    = flag.Bool(insecure.AcknowledgeFlag, false, insecure.AcknowledgeUsage)
 )
 
 func main() {
 	flag.Parse()
-	ctx := context.Background()
+	if len(*configFile) > 0 {
+		if err := flagfile.Load(flag.CommandLine, *configFile); err != nil {
+			logging.Exit(err.Error())
+		}
+	}
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+	if err := insecure.Check(*skipSig, *skipSigAck); err != nil {
+		logging.Exit(err.Error())
+	}
+	if *pollJitter < 0 || *pollJitter >= 1 {
+		logging.Exitf("--poll_jitter must be at least 0 and less than 1, got %v", *pollJitter)
+	}
+	// SIGINT and SIGTERM cancel ctx, which stops the monitor after the leaf being
+	// checked. The state file is only written once all the leaves committed to by a
+	// checkpoint have been checked, so it always holds a fully verified checkpoint.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *checkCfg {
+		if err := checkConfig(ctx, os.Stdout); err != nil {
+			logging.Exit(err.Error())
+		}
+		return
+	}
 
-	st, isNew, err := stateTrackerFromFlags(ctx)
+	policy, err := trustPolicyFromFlags()
 	if err != nil {
-		glog.Exitf("Failed to create new LogStateTracker: %v", err)
+		logging.Exit(err.Error())
 	}
 
-	var releaseVerifiers note.Verifiers
-	if v, err := note.NewVerifier(*releasePubKey); err != nil {
-		glog.Exitf("Failed to construct release note verifier: %v", err)
-	} else {
-		releaseVerifiers = note.VerifierList(v)
+	reportSigner, err := reportSignerFromFlags()
+	if err != nil {
+		logging.Exit(err.Error())
+	}
+
+	cache, err := cacheFromFlags()
+	if err != nil {
+		logging.Exit(err.Error())
+	}
+	st, isNew, err := stateTrackerFromFlags(ctx, policy, cache)
+	if err != nil {
+		logging.Exitf("Failed to create new LogStateTracker: %v", err)
+	}
+
+	if len(*knownCPFile) > 0 {
+		if err := checkKnownCheckpointsFromFlags(ctx, st, policy); err != nil {
+			logging.Exit(err.Error())
+		}
+	}
+
+	releaseVerifiers, err := releaseVerifiersFromFlags(policy)
+	if err != nil {
+		logging.Exit(err.Error())
 	}
 
-	rbv, err := NewReproducibleBuildVerifier(*cleanup)
+	var artifactNames []string
+	if len(*artifacts) > 0 {
+		artifactNames = strings.Split(*artifacts, ",")
+	}
+	rbv, err := NewReproducibleBuildVerifier(*cleanup, *buildFromRev, artifactNames, *buildTimeout, buildOptionsFromFlags()...)
 	if err != nil {
-		glog.Exitf("Failed to create reproducible build verifier: %v", err)
+		logging.Exitf("Failed to create reproducible build verifier: %v", err)
+	}
+
+	// Each leaf is checked against the trust policy, then built, and then recorded.
+	var handlers []monitor.LeafHandler
+	if policy != nil {
+		handlers = append(handlers, policy)
+	}
+	buildFailed := rbv.HasFailed
+	if *skipBuild {
+		logging.Info("Reproducible builds disabled: only checking inclusion and signatures")
+		handlers, buildFailed = append(handlers, monitor.LeafHandlerFunc(logRelease)), nil
+	} else {
+		handlers = append(handlers, rbv)
+	}
+	if len(*releaseDB) > 0 {
+		db, err := releasedb.Open(*releaseDB)
+		if err != nil {
+			logging.Exitf("Failed to open release database: %v", err)
+		}
+		defer db.Close()
+		handlers = append(handlers, recordRelease(db, buildFailed))
+	}
+
+	opts := []monitor.Option{
+		monitor.WithMaxSignatures(*maxNoteSigs),
+		monitor.WithMaxCheckpointAge(*maxCPAge),
+		monitor.WithCheckpointWriter(func(cpRaw []byte) error {
+			return writeFileAtomic(*stateFile, cpRaw, 0644)
+		}),
+	}
+	if len(*proofDir) > 0 {
+		opts = append(opts, monitor.WithConsistencyProofHandler(writeConsistencyProof(*proofDir)))
 	}
+	m := monitor.New(st, releaseVerifiers, monitor.Chain(handlers...), opts...)
 
-	monitor := Monitor{
-		st:               st,
-		stateFile:        *stateFile,
-		releaseVerifiers: releaseVerifiers,
-		handler:          rbv.VerifyManifest,
+	if *startIndex >= 0 {
+		end := uint64(*endIndex)
+		if *endIndex < 0 {
+			if _, _, _, err := st.Update(ctx); err != nil {
+				logging.Exitf("Failed to update checkpoint: %v", err)
+			}
+			end = st.LatestConsistent.Size
+		}
+		if err := settleCache(cache, m.Range(ctx, uint64(*startIndex), end)); err != nil {
+			logging.Exitf("monitor.Range(%d, %d): %v", *startIndex, end, err)
+		}
+		writeReportFromFlags(m, rbv, reportSigner)
+		if failed := rbv.Failed(); len(failed) > 0 {
+			logging.Exitf("Failed to reproduce builds for leaves %v", failed)
+		}
+		return
 	}
 
 	if isNew {
 		// This monitor has no memory of running before, so let's catch up with the log.
-		if err := monitor.From(ctx, 0); err != nil {
-			glog.Exitf("monitor.From(%d): %v", 0, err)
+		if err := settleCache(cache, m.From(ctx, 0)); err != nil {
+			if shuttingDown(ctx) {
+				return
+			}
+			logging.Exitf("monitor.From(%d): %v", 0, err)
+		}
+	}
+
+	if *once {
+		if err := settleCache(cache, m.Update(ctx)); err != nil {
+			logging.Exit(err.Error())
+		}
+		writeReportFromFlags(m, rbv, reportSigner)
+		if failed := rbv.Failed(); len(failed) > 0 {
+			logging.Exitf("Failed to reproduce builds for leaves %v", failed)
+		}
+		if m.Stale() {
+			logging.Exitf("Log's latest checkpoint is older than --max_checkpoint_age of %v", *maxCPAge)
 		}
+		cp, _ := m.Checkpoint()
+		logging.Info("Verified log", "tree_size", cp.Size)
+		return
 	}
 
 	// We've processed all leaves committed to by the tracker's checkpoint, and now we enter polling mode.
-	ticker := time.NewTicker(*pollInterval)
-	defer ticker.Stop()
+	due := time.Now()
 	for {
-		lastHead := st.LatestConsistent.Size
-		if _, _, _, err := st.Update(ctx); err != nil {
-			glog.Exitf("Failed to update checkpoint: %q", err)
-		}
-		if st.LatestConsistent.Size > lastHead {
-			glog.V(1).Infof("Found new checkpoint for tree size %d, fetching new leaves", st.LatestConsistent.Size)
-			if err := monitor.From(ctx, lastHead); err != nil {
-				glog.Exitf("monitor.From(%d): %v", lastHead, err)
+		if err := settleCache(cache, m.Update(ctx)); err != nil {
+			if shuttingDown(ctx) {
+				return
 			}
-		} else {
-			glog.V(2).Infof("Polling: no new data found; tree size is still %d", st.LatestConsistent.Size)
+			logging.Exit(err.Error())
 		}
 
+		due = nextPoll(due, time.Now(), jitter(*pollInterval, *pollJitter, rand.Float64))
 		select {
 		case <-ctx.Done():
+			shuttingDown(ctx)
 			return
-		case <-ticker.C:
+		case <-time.After(time.Until(due)):
 			// Go around the loop again.
 		}
 	}
 }
 
-// Monitor verifiably checks inclusion of all leaves in a range, and then passes the
-// parsed FirmwareRelease to a handler.
-type Monitor struct {
-	st               client.LogStateTracker
-	stateFile        string
-	releaseVerifiers note.Verifiers
-	handler          func(context.Context, uint64, api.FirmwareRelease) error
+// nextPoll returns when the poll after the one which was due at the given time
+// should be made, an interval later. Scheduling polls from when they were due,
+// rather than from when the previous one finished, stops the time taken by each
+// update from making the poll period drift. If an update took longer than the
+// interval, the next poll is made immediately.
+func nextPoll(due, now time.Time, interval time.Duration) time.Time {
+	next := due.Add(interval)
+	if next.Before(now) {
+		return now
+	}
+	return next
 }
 
-// From checks the leaves from `start` up to the checkpoint from the state tracker.
-// Upon reaching the end of the leaves, the checkpoint is persisted in the state file.
-func (m *Monitor) From(ctx context.Context, start uint64) error {
-	fromCP := m.st.LatestConsistent
-	pb, err := client.NewProofBuilder(ctx, fromCP, m.st.Hasher.HashChildren, m.st.Fetcher)
+// cacheFromFlags returns the cache in --cache_dir for the log at --log_url, or nil
+// if --cache_dir isn't set.
+func cacheFromFlags() (*fetcher.Cache, error) {
+	if len(*cacheDir) == 0 {
+		return nil, nil
+	}
+	root, err := url.Parse(*logURL)
 	if err != nil {
-		return fmt.Errorf("failed to construct proof builder: %v", err)
+		return nil, fmt.Errorf("failed to parse log URL %q: %w", *logURL, err)
 	}
-	for i := start; i < fromCP.Size; i++ {
-		rawLeaf, err := client.GetLeaf(ctx, m.st.Fetcher, i)
-		if err != nil {
-			return fmt.Errorf("failed to get leaf at index %d: %v", i, err)
+	return fetcher.NewCache(*cacheDir, root)
+}
+
+// settleCache commits the resources fetched from the log to the cache if err is
+// nil, as they have then been verified against the log's checkpoint, and otherwise
+// discards them so that a bad response isn't persisted. It returns err.
+func settleCache(c *fetcher.Cache, err error) error {
+	if err != nil {
+		c.Discard()
+		return err
+	}
+	c.Commit()
+	return nil
+}
+
+// checkKnownCheckpointsFromFlags checks that the log tracked by st is consistent
+// with each of the checkpoints in --known_checkpoints.
+func checkKnownCheckpointsFromFlags(ctx context.Context, st client.LogStateTracker, p *trustPolicy) error {
+	b, err := os.ReadFile(*knownCPFile)
+	if err != nil {
+		return fmt.Errorf("failed to read known checkpoints: %v", err)
+	}
+	known, err := parseCheckpoints(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse known checkpoints file %q: %v", *knownCPFile, err)
+	}
+	return checkKnownCheckpoints(ctx, st, known, p)
+}
+
+// buildOptionsFromFlags returns the options for building releases set by flags.
+func buildOptionsFromFlags() []build.GitBuilderOption {
+	opts := []build.GitBuilderOption{build.WithMakeTarget(*makeTarget), build.WithCrossCompile(*crossCompile)}
+	if len(*buildImage) > 0 {
+		if !strings.Contains(*buildImage, "@sha256:") {
+			logging.Warning("--build_container_image is not pinned by digest, so builds may not be reproducible", "image", *buildImage)
 		}
-		hash := m.st.Hasher.HashLeaf(rawLeaf)
-		ip, err := pb.InclusionProof(ctx, i)
+		opts = append(opts, build.WithContainer(*containerCmd, *buildImage))
+	}
+	if *checkSource {
+		opts = append(opts, build.WithSourceCheck(nil))
+	}
+	return opts
+}
+
+// jitter returns d lengthened or shortened by up to the fraction f of d, using
+// random, which returns values in [0, 1), to choose by how much.
+func jitter(d time.Duration, f float64, random func() float64) time.Duration {
+	return d + time.Duration(float64(d)*f*(2*random()-1))
+}
+
+// shuttingDown returns true, after logging that the monitor is stopping, if ctx has
+// been cancelled by a signal. Errors from operations interrupted by the
+// cancellation are then expected, and the monitor should exit cleanly.
+func shuttingDown(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	logging.Info("Received signal, shutting down")
+	return true
+}
+
+// writeConsistencyProof returns a function which writes each consistency proof
+// verified by the monitor to a JSON file in dir, named for the tree sizes it relates.
+func writeConsistencyProof(dir string) func(uint64, uint64, monitor.ConsistencyProof) error {
+	return func(oldSize, newSize uint64, p monitor.ConsistencyProof) error {
+		evidence, err := json.MarshalIndent(p, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to get inclusion proof for index %d: %v", i, err)
+			return fmt.Errorf("failed to marshal consistency proof: %v", err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d-%d.json", oldSize, newSize))
+		if err := os.WriteFile(path, evidence, 0644); err != nil {
+			return fmt.Errorf("failed to write consistency proof: %v", err)
+		}
+		return nil
+	}
+}
+
+// recordRelease returns a handler which writes a record of each leaf to db. If
+// buildFailed is set, it reports whether the build of the release at the given
+// index could not be reproduced.
+func recordRelease(db *releasedb.DB, buildFailed func(uint64) bool) monitor.LeafHandler {
+	return monitor.LeafHandlerFunc(func(_ context.Context, l monitor.Leaf) error {
+		r := releasedb.Record{
+			Index:    l.Index,
+			LeafHash: l.Hash,
+			Release:  l.Release,
+			Verified: buildFailed == nil || !buildFailed(l.Index),
 		}
+		if err := db.Put(r); err != nil {
+			return fmt.Errorf("failed to record leaf %d: %v", l.Index, err)
+		}
+		return nil
+	})
+}
 
-		if err := proof.VerifyInclusion(m.st.Hasher, i, fromCP.Size, hash, ip, fromCP.Hash); err != nil {
-			return fmt.Errorf("VerifyInclusionProof() %d: %v", i, err)
+// openCheckpointFunc verifies and parses a signed checkpoint.
+type openCheckpointFunc func(cpRaw []byte, logSigV note.Verifier, origin string) (*log.Checkpoint, *note.Note, error)
+
+// fetchCheckpoint returns a function which fetches the latest checkpoint from the
+// log with f, and accepts it if open does. The fetcher returns the same checkpoint
+// again when the log reports that it hasn't changed, in which case it isn't opened
+// again.
+func fetchCheckpoint(f client.Fetcher, open openCheckpointFunc) client.ConsensusCheckpointFunc {
+	var lastRaw []byte
+	var lastCP *log.Checkpoint
+	var lastNote *note.Note
+	return func(ctx context.Context, logSigV note.Verifier, origin string) (*log.Checkpoint, []byte, *note.Note, error) {
+		cpRaw, err := f(ctx, layout.CheckpointPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if lastCP != nil && lastCP.Origin == origin && bytes.Equal(cpRaw, lastRaw) {
+			return lastCP, cpRaw, lastNote, nil
 		}
+		cp, n, err := open(cpRaw, logSigV, origin)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		lastRaw, lastCP, lastNote = cpRaw, cp, n
+		return cp, cpRaw, n, nil
+	}
+}
 
-		releaseNote, err := note.Open([]byte(rawLeaf), m.releaseVerifiers)
+// unilateralConsensus is like client.UnilateralConsensus, trusting the checkpoint
+// served by the log, but reports the signers of a checkpoint which the log's key
+// can't verify.
+func unilateralConsensus(f client.Fetcher) client.ConsensusCheckpointFunc {
+	return fetchCheckpoint(f, func(cpRaw []byte, logSigV note.Verifier, origin string) (*log.Checkpoint, *note.Note, error) {
+		if _, err := verify.OpenNote(cpRaw, note.VerifierList(logSigV)); err != nil {
+			return nil, nil, fmt.Errorf("failed to verify signatures on checkpoint: %w", err)
+		}
+		cp, _, n, err := log.ParseCheckpoint(cpRaw, origin, logSigV)
 		if err != nil {
-			if e, ok := err.(*note.UnverifiedNoteError); ok && len(e.Note.UnverifiedSigs) > 0 {
-				return fmt.Errorf("unknown signer %q for leaf at index %d: %v", e.Note.UnverifiedSigs[0].Name, i, err)
-			}
-			return fmt.Errorf("failed to open leaf note at index %d: %v", i, err)
+			return nil, nil, fmt.Errorf("failed to parse checkpoint: %v", err)
 		}
+		return cp, n, nil
+	})
+}
 
-		var release api.FirmwareRelease
-		if err := json.Unmarshal([]byte(releaseNote.Text), &release); err != nil {
-			return fmt.Errorf("failed to unmarshal release at index %d: %w", i, err)
+// limitCheckpointSignatures wraps the fetcher so that checkpoints carrying more than
+// maxSigs signatures are rejected before the state tracker attempts to open them.
+func limitCheckpointSignatures(f client.Fetcher, maxSigs int) client.Fetcher {
+	return func(ctx context.Context, p string) ([]byte, error) {
+		b, err := f(ctx, p)
+		if err != nil || p != layout.CheckpointPath {
+			return b, err
+		}
+		if err := verify.CheckNoteSignatures(b, maxSigs); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint: %v", err)
 		}
-		if err := m.handler(ctx, i, release); err != nil {
-			return fmt.Errorf("handler(): %w", err)
+		return b, nil
+	}
+}
+
+// logRelease is a handler which simply logs the verified FirmwareRelease.
+func logRelease(_ context.Context, l monitor.Leaf) error {
+	r := l.Release
+	logging.Info("Found release", "index", l.Index, "revision", r.Revision, "platform_id", r.PlatformID, "artifact", r.FirmwareArtifact(), "sha256", r.ArtifactSHA256[r.FirmwareArtifact()])
+	return nil
+}
+
+// trustPolicyFromFlags loads the trust policy provided to the main invocation, or
+// returns nil if there isn't one.
+func trustPolicyFromFlags() (*trustPolicy, error) {
+	if len(*policyFile) == 0 {
+		return nil, nil
+	}
+	return loadTrustPolicy(*policyFile)
+}
+
+// releaseVerifiersFromFlags constructs the verifiers for release notes from the flags
+// provided to the main invocation, or from the trust policy if there is one.
+func releaseVerifiersFromFlags(p *trustPolicy) (note.Verifiers, error) {
+	if *skipSig {
+		if p != nil {
+			return nil, fmt.Errorf("--%s cannot be used with --trust_policy", insecure.SkipSignatureFlag)
 		}
+		return insecure.Verifiers(), nil
+	}
+	if p != nil {
+		return p.releaseVerifiers, nil
 	}
-	return os.WriteFile(m.stateFile, m.st.LatestConsistentRaw, 0644)
+	v, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct release note verifier: %v", err)
+	}
+	return note.VerifierList(v), nil
 }
 
 // stateTrackerFromFlags constructs a state tracker based on the flags provided to the main invocation.
 // The checkpoint returned will be the checkpoint representing this monitor's view of the log history.
 // A boolean is returned that is true if the checkpoint was fetched from the log to initialize state.
-func stateTrackerFromFlags(ctx context.Context) (client.LogStateTracker, bool, error) {
+// If a trust policy is provided, it is used to verify checkpoints in place of --log_pubkey.
+func stateTrackerFromFlags(ctx context.Context, p *trustPolicy, cache *fetcher.Cache) (client.LogStateTracker, bool, error) {
 	if len(*stateFile) == 0 {
 		return client.LogStateTracker{}, false, errors.New("--state_file required")
 	}
@@ -177,43 +486,47 @@ func stateTrackerFromFlags(ctx context.Context) (client.LogStateTracker, bool, e
 		if !errors.Is(err, os.ErrNotExist) {
 			return client.LogStateTracker{}, false, fmt.Errorf("could not read state file %q: %w", *stateFile, err)
 		}
-		glog.Infof("State file %q missing. Will trust first checkpoint received from log.", *stateFile)
+		logging.Infof("State file %q missing. Will trust first checkpoint received from log.", *stateFile)
 	}
 
 	root, err := url.Parse(*logURL)
 	if err != nil {
 		return client.LogStateTracker{}, false, fmt.Errorf("failed to parse log URL %q: %w", *logURL, err)
 	}
-	f, err := newFetcher(root)
+	opts := []fetcher.Option{
+		fetcher.WithRetries(*fetchRetries, time.Second, time.Minute),
+		fetcher.WithProxy(*httpProxy),
+		fetcher.WithMaxRetryAfter(*maxRetryAfter),
+	}
+	if *maxRPS > 0 {
+		opts = append(opts, fetcher.WithRateLimit(*maxRPS))
+	}
+	if cache != nil {
+		opts = append(opts, fetcher.WithCache(cache))
+	}
+	f, err := fetcher.New(root, opts...)
 	if err != nil {
 		return client.LogStateTracker{}, false, fmt.Errorf("failed to create fetcher: %v", err)
 	}
+	f = limitCheckpointSignatures(f, *maxNoteSigs)
 
-	lSigV, err := note.NewVerifier(*logPubKey)
-	if err != nil {
+	var lSigV note.Verifier
+	cc := unilateralConsensus(f)
+	if p != nil {
+		// The tracker only uses its verifier to open the state checkpoint; newer
+		// checkpoints are checked against the policy.
+		lSigV, cc = p.LogKeys[0].v, p.consensus(f)
+	} else if lSigV, err = note.NewVerifier(*logPubKey); err != nil {
 		return client.LogStateTracker{}, false, fmt.Errorf("unable to create new log signature verifier: %w", err)
 	}
-
-	lst, err := client.NewLogStateTracker(ctx, f, rfc6962.DefaultHasher, state, lSigV, *logOrigin, client.UnilateralConsensus(f))
-	return lst, state == nil, err
-}
-
-// newFetcher creates a Fetcher for the log at the given root location.
-func newFetcher(root *url.URL) (client.Fetcher, error) {
-	if s := root.Scheme; s != "http" && s != "https" {
-		return nil, fmt.Errorf("unsupported URL scheme %s", s)
+	if state != nil {
+		// Catch a corrupt state file here, rather than leaving the state tracker to
+		// fail in a less obvious way.
+		if lSigV, err = checkStateCheckpoint(state, lSigV, *logOrigin, p); err != nil {
+			return client.LogStateTracker{}, false, fmt.Errorf("state file %q is corrupt or from a different log, delete it to trust the log's latest checkpoint: %w", *stateFile, err)
+		}
 	}
 
-	return func(ctx context.Context, p string) ([]byte, error) {
-		u, err := root.Parse(p)
-		if err != nil {
-			return nil, err
-		}
-		resp, err := http.Get(u.String())
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		return io.ReadAll(resp.Body)
-	}, nil
+	lst, err := client.NewLogStateTracker(ctx, f, verify.Hasher(), state, lSigV, *logOrigin, cc)
+	return lst, state == nil, err
 }
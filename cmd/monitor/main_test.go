@@ -0,0 +1,167 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/internal/releasedb"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestWriteConsistencyProof(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1", "v2", "v3")
+	dir := t.TempDir()
+	m := monitor.New(l.StateTracker(), note.VerifierList(l.ReleaseVerifier), monitor.LeafHandlerFunc(logRelease), monitor.WithConsistencyProofHandler(writeConsistencyProof(dir)))
+	if err := m.From(context.Background(), 0); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+
+	l.AddReleases("v4", "v5")
+	if err := m.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "3-5.json"))
+	if err != nil {
+		t.Fatalf("Failed to read consistency proof: %v", err)
+	}
+	var p monitor.ConsistencyProof
+	if err := json.Unmarshal(raw, &p); err != nil {
+		t.Fatalf("Failed to unmarshal consistency proof: %v", err)
+	}
+	if len(p.OldCheckpoint) == 0 || len(p.NewCheckpoint) == 0 || len(p.Proof) == 0 {
+		t.Errorf("Persisted consistency proof is incomplete: %s", raw)
+	}
+}
+
+func TestFetchCheckpoint(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1")
+	f := l.Fetcher()
+	opened := 0
+	cc := fetchCheckpoint(f, func(cpRaw []byte, v note.Verifier, origin string) (*log.Checkpoint, *note.Note, error) {
+		opened++
+		cp, _, n, err := log.ParseCheckpoint(cpRaw, origin, v)
+		return cp, n, err
+	})
+
+	for i, want := range []struct {
+		size   uint64
+		opened int
+	}{
+		{size: 1, opened: 1},
+		// The unchanged checkpoint isn't opened again.
+		{size: 1, opened: 1},
+		{size: 2, opened: 2},
+	} {
+		if i == 2 {
+			l.AddReleases("v2")
+		}
+		cp, _, _, err := cc(context.Background(), l.LogVerifier, testutil.Origin)
+		if err != nil {
+			t.Fatalf("Fetch %d: %v", i, err)
+		}
+		if cp.Size != want.size || opened != want.opened {
+			t.Errorf("Fetch %d: got size %d after opening %d checkpoints, want %d after %d", i, cp.Size, opened, want.size, want.opened)
+		}
+	}
+	if _, _, _, err := cc(context.Background(), l.LogVerifier, "other origin"); err == nil {
+		t.Error("Fetch with other origin succeeded, want error")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		f      float64
+		random float64
+		want   time.Duration
+	}{
+		{desc: "no jitter", f: 0, random: 0.9, want: time.Minute},
+		{desc: "shortest", f: 0.1, random: 0, want: 54 * time.Second},
+		{desc: "middle", f: 0.1, random: 0.5, want: time.Minute},
+		{desc: "longer", f: 0.1, random: 0.75, want: 63 * time.Second},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := jitter(time.Minute, test.f, func() float64 { return test.random }); got != test.want {
+				t.Errorf("jitter: got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNextPoll(t *testing.T) {
+	due := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc string
+		took time.Duration
+		want time.Duration
+	}{
+		{desc: "quick update", took: time.Second, want: time.Minute},
+		{desc: "slow update", took: 50 * time.Second, want: time.Minute},
+		{desc: "update overran", took: 90 * time.Second, want: 90 * time.Second},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := nextPoll(due, due.Add(test.took), time.Minute); !got.Equal(due.Add(test.want)) {
+				t.Errorf("nextPoll: got %v, want %v", got.Sub(due), test.want)
+			}
+		})
+	}
+}
+
+func TestMonitorReleaseDB(t *testing.T) {
+	l := testutil.New(t)
+	l.AddReleases("v1", "v2", "v3")
+	db, err := releasedb.Open(filepath.Join(t.TempDir(), "releases.db"))
+	if err != nil {
+		t.Fatalf("releasedb.Open: %v", err)
+	}
+	defer db.Close()
+	buildFailed := func(i uint64) bool { return i == 1 }
+	m := monitor.New(l.StateTracker(), note.VerifierList(l.ReleaseVerifier), recordRelease(db, buildFailed))
+
+	if err := m.From(context.Background(), 0); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+
+	for i, want := range []struct {
+		revision string
+		verified bool
+	}{
+		{revision: "v1", verified: true},
+		{revision: "v2", verified: false},
+		{revision: "v3", verified: true},
+	} {
+		r, found, err := db.Get(uint64(i))
+		if err != nil || !found {
+			t.Fatalf("Get(%d) = %v, %v", i, found, err)
+		}
+		if r.Release.Revision != want.revision || r.Verified != want.verified {
+			t.Errorf("Get(%d) = revision %q, verified %t, want %q, %t", i, r.Release.Revision, r.Verified, want.revision, want.verified)
+		}
+		if len(r.LeafHash) == 0 {
+			t.Errorf("Get(%d) has no leaf hash", i)
+		}
+	}
+}
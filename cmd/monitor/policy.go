@@ -0,0 +1,176 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// trustPolicy describes which keys are trusted to sign checkpoints and releases,
+// and for which part of the log's history each of them is trusted. This allows
+// the monitor to keep verifying the whole log after a signing key is rotated.
+//
+// Keys are trusted for windows of the log's indices rather than of time. A monitor
+// replaying the log can't tell when an old leaf was first logged, and the creation
+// time claimed by a release is chosen by whoever holds the release key.
+type trustPolicy struct {
+	// LogKeys are the keys trusted to sign checkpoints. The index window of a log
+	// key bounds the sizes of the checkpoints it may sign.
+	LogKeys []trustedKey `json:"log_keys"`
+	// ReleaseKeys are the keys trusted to sign releases. The index window of a
+	// release key bounds the indices of the leaves it may sign.
+	ReleaseKeys []trustedKey `json:"release_keys"`
+
+	logVerifiers     note.Verifiers
+	releaseVerifiers note.Verifiers
+}
+
+// trustedKey is a note verifier key and the window in which it is trusted.
+type trustedKey struct {
+	// Key is the note verifier key.
+	Key string `json:"key"`
+	// FromIndex is the first index for which the key is trusted.
+	FromIndex uint64 `json:"from_index,omitempty"`
+	// UntilIndex is the index from which the key is no longer trusted. If unset,
+	// the key is trusted for all indices from FromIndex onwards.
+	UntilIndex uint64 `json:"until_index,omitempty"`
+
+	v note.Verifier
+}
+
+// loadTrustPolicy reads and parses the trust policy file at path.
+func loadTrustPolicy(path string) (*trustPolicy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust policy: %v", err)
+	}
+	return parseTrustPolicy(raw)
+}
+
+// parseTrustPolicy parses a JSON trust policy, and constructs verifiers for the
+// keys it contains. Unknown fields are rejected, so that a key isn't trusted more
+// widely than intended because a limit on it was misspelt or isn't supported.
+func parseTrustPolicy(raw []byte) (*trustPolicy, error) {
+	p := &trustPolicy{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("failed to parse trust policy: %v", err)
+	}
+	if len(p.LogKeys) == 0 || len(p.ReleaseKeys) == 0 {
+		return nil, errors.New("trust policy must contain at least one log key and one release key")
+	}
+	var err error
+	if p.logVerifiers, err = initKeys(p.LogKeys); err != nil {
+		return nil, fmt.Errorf("invalid log key: %v", err)
+	}
+	if p.releaseVerifiers, err = initKeys(p.ReleaseKeys); err != nil {
+		return nil, fmt.Errorf("invalid release key: %v", err)
+	}
+	return p, nil
+}
+
+// initKeys constructs the verifier for each of the keys, and returns a list of them.
+func initKeys(keys []trustedKey) (note.Verifiers, error) {
+	vs := make([]note.Verifier, 0, len(keys))
+	for i := range keys {
+		k := &keys[i]
+		v, err := note.NewVerifier(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", k.Key, err)
+		}
+		if k.UntilIndex != 0 && k.UntilIndex <= k.FromIndex {
+			return nil, fmt.Errorf("%q: empty index window [%d, %d)", k.Key, k.FromIndex, k.UntilIndex)
+		}
+		k.v = v
+		vs = append(vs, v)
+	}
+	return note.VerifierList(vs...), nil
+}
+
+// trusts returns true if the key is trusted at index i.
+func (k trustedKey) trusts(i uint64) bool {
+	return i >= k.FromIndex && (k.UntilIndex == 0 || i < k.UntilIndex)
+}
+
+// trustedSigner returns the first key among keys which made one of the verified
+// signatures sigs, and which is trusted at index i.
+func trustedSigner(keys []trustedKey, sigs []note.Signature, i uint64) (trustedKey, error) {
+	for _, s := range sigs {
+		for _, k := range keys {
+			if s.Name == k.v.Name() && s.Hash == k.v.KeyHash() && k.trusts(i) {
+				return k, nil
+			}
+		}
+	}
+	return trustedKey{}, fmt.Errorf("no signature by a key trusted for index %d", i)
+}
+
+// openCheckpoint verifies that the checkpoint is signed by a log key which is
+// trusted for checkpoints of its size, and returns that key's verifier.
+func (p *trustPolicy) openCheckpoint(cpRaw []byte, origin string) (*log.Checkpoint, *note.Note, note.Verifier, error) {
+	n, err := verify.OpenNote(cpRaw, p.logVerifiers)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to verify signatures on checkpoint: %v", err)
+	}
+	cp := &log.Checkpoint{}
+	if _, err := cp.Unmarshal([]byte(n.Text)); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to unmarshal checkpoint: %v", err)
+	}
+	if cp.Origin != origin {
+		return nil, nil, nil, fmt.Errorf("got Origin %q but expected %q", cp.Origin, origin)
+	}
+	k, err := trustedSigner(p.LogKeys, n.Sigs, cp.Size)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("checkpoint of size %d: %v", cp.Size, err)
+	}
+	return cp, n, k.v, nil
+}
+
+// consensus returns a function which fetches the latest checkpoint from the log,
+// and accepts it if it is signed by a log key trusted for it. The state tracker's
+// log verifier is ignored in favour of the policy.
+func (p *trustPolicy) consensus(f client.Fetcher) client.ConsensusCheckpointFunc {
+	return fetchCheckpoint(f, func(cpRaw []byte, _ note.Verifier, origin string) (*log.Checkpoint, *note.Note, error) {
+		cp, n, _, err := p.openCheckpoint(cpRaw, origin)
+		return cp, n, err
+	})
+}
+
+// Handle implements monitor.LeafHandler by checking the release in the leaf
+// against the policy.
+func (p *trustPolicy) Handle(_ context.Context, l monitor.Leaf) error {
+	return p.checkRelease(l)
+}
+
+// checkRelease verifies that the leaf is signed by a release key which is trusted
+// for its index.
+func (p *trustPolicy) checkRelease(l monitor.Leaf) error {
+	if _, err := trustedSigner(p.ReleaseKeys, l.Signatures, l.Index); err != nil {
+		return fmt.Errorf("release %q at index %d: %v", l.Release.Revision, l.Index, err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestParseTrustPolicy(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			desc:   "works",
+			policy: fmt.Sprintf(`{"log_keys": [{"key": %q}], "release_keys": [{"key": %q, "until_index": 2}]}`, keys.ArmoryDriveLogPub, keys.ArmoryDrivePub),
+		}, {
+			desc:    "no release keys",
+			policy:  fmt.Sprintf(`{"log_keys": [{"key": %q}]}`, keys.ArmoryDriveLogPub),
+			wantErr: true,
+		}, {
+			desc:    "bad key",
+			policy:  fmt.Sprintf(`{"log_keys": [{"key": "armory-drive-log+1234+AAAA"}], "release_keys": [{"key": %q}]}`, keys.ArmoryDrivePub),
+			wantErr: true,
+		}, {
+			desc:    "empty window",
+			policy:  fmt.Sprintf(`{"log_keys": [{"key": %q}], "release_keys": [{"key": %q, "from_index": 3, "until_index": 3}]}`, keys.ArmoryDriveLogPub, keys.ArmoryDrivePub),
+			wantErr: true,
+		}, {
+			desc:    "log key time window",
+			policy:  fmt.Sprintf(`{"log_keys": [{"key": %q, "not_before": "2022-01-01T00:00:00Z"}], "release_keys": [{"key": %q}]}`, keys.ArmoryDriveLogPub, keys.ArmoryDrivePub),
+			wantErr: true,
+		}, {
+			desc:    "release key time window",
+			policy:  fmt.Sprintf(`{"log_keys": [{"key": %q}], "release_keys": [{"key": %q, "not_after": "2022-01-01T00:00:00Z"}]}`, keys.ArmoryDriveLogPub, keys.ArmoryDrivePub),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := parseTrustPolicy([]byte(test.policy))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("parseTrustPolicy() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedKeyTrusts(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		k    trustedKey
+		i    uint64
+		want bool
+	}{
+		{desc: "unbounded", k: trustedKey{}, i: 100, want: true},
+		{desc: "in index window", k: trustedKey{FromIndex: 2, UntilIndex: 4}, i: 3, want: true},
+		{desc: "at end of index window", k: trustedKey{FromIndex: 2, UntilIndex: 4}, i: 4},
+		{desc: "before index window", k: trustedKey{FromIndex: 2}, i: 1},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := test.k.trusts(test.i); got != test.want {
+				t.Errorf("trusts(%d) = %t, want %t", test.i, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrustPolicyCheckpoint(t *testing.T) {
+	// The checkpoint in the log directory is for tree size 2.
+	cpRaw, err := os.ReadFile("../../log/checkpoint")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, test := range []struct {
+		desc    string
+		window  string
+		wantErr bool
+	}{
+		{
+			desc: "no window",
+		}, {
+			desc:   "covers checkpoint",
+			window: `"from_index": 2, "until_index": 3,`,
+		}, {
+			desc:    "before window",
+			window:  `"from_index": 3,`,
+			wantErr: true,
+		}, {
+			desc:    "after window",
+			window:  `"until_index": 2,`,
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := parseTrustPolicy([]byte(fmt.Sprintf(`{"log_keys": [{%s "key": %q}], "release_keys": [{"key": %q}]}`, test.window, keys.ArmoryDriveLogPub, keys.ArmoryDrivePub)))
+			if err != nil {
+				t.Fatalf("parseTrustPolicy: %v", err)
+			}
+			_, _, _, err = p.openCheckpoint(cpRaw, "Armory Drive Prod 2")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("openCheckpoint() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMonitorTrustPolicy(t *testing.T) {
+	oldKey, _, oldPub := testutil.GenerateKey(t, "release-1")
+	newKey, _, newPub := testutil.GenerateKey(t, "release-2")
+
+	// Leaves 0 and 1 are signed by the old key, and leaf 2 by the new one. Each
+	// case replays the whole log with a fresh monitor after the rotation, so the
+	// old key's leaves are checked long after it was retired.
+	l := testutil.New(t)
+	l.ReleaseSigner = oldKey
+	l.AddReleases("v1", "v2")
+	l.ReleaseSigner = newKey
+	l.AddReleases("v3")
+
+	for _, test := range []struct {
+		desc    string
+		oldTo   uint64
+		newFrom uint64
+		wantErr bool
+	}{
+		{
+			desc:    "rotated at leaf 2",
+			oldTo:   2,
+			newFrom: 2,
+		}, {
+			desc:    "new key not yet trusted",
+			oldTo:   2,
+			newFrom: 3,
+			wantErr: true,
+		}, {
+			desc:    "old key retired early",
+			oldTo:   1,
+			newFrom: 2,
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := parseTrustPolicy([]byte(fmt.Sprintf(`{"log_keys": [{"key": %q}], "release_keys": [{"key": %q, "until_index": %d}, {"key": %q, "from_index": %d}]}`,
+				keys.ArmoryDriveLogPub, oldPub, test.oldTo, newPub, test.newFrom)))
+			if err != nil {
+				t.Fatalf("parseTrustPolicy: %v", err)
+			}
+			m := monitor.New(l.StateTracker(), p.releaseVerifiers, p)
+			err = m.From(context.Background(), 0)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("From() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustPolicyRelease(t *testing.T) {
+	_, oldV, oldPub := testutil.GenerateKey(t, "release-1")
+	_, newV, newPub := testutil.GenerateKey(t, "release-2")
+	p, err := parseTrustPolicy([]byte(fmt.Sprintf(`{"log_keys": [{"key": %q}], "release_keys": [{"key": %q, "until_index": 2}, {"key": %q, "from_index": 2}]}`,
+		keys.ArmoryDriveLogPub, oldPub, newPub)))
+	if err != nil {
+		t.Fatalf("parseTrustPolicy: %v", err)
+	}
+	oldSigs := []note.Signature{{Name: oldV.Name(), Hash: oldV.KeyHash()}}
+	newSigs := []note.Signature{{Name: newV.Name(), Hash: newV.KeyHash()}}
+	// Releases claiming to be created long after the rotation are still trusted
+	// or not by their index alone.
+	late := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc    string
+		index   uint64
+		sigs    []note.Signature
+		wantErr bool
+	}{
+		{
+			desc:  "old key before rotation",
+			index: 1,
+			sigs:  oldSigs,
+		}, {
+			desc:    "old key after rotation",
+			index:   2,
+			sigs:    oldSigs,
+			wantErr: true,
+		}, {
+			desc:  "new key after rotation",
+			index: 2,
+			sigs:  newSigs,
+		}, {
+			desc:    "new key before rotation",
+			index:   1,
+			sigs:    newSigs,
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			l := monitor.Leaf{
+				Index:      test.index,
+				Release:    api.FirmwareRelease{Revision: "v1", CreatedAt: late},
+				Signatures: test.sigs,
+			}
+			if err := p.checkRelease(l); (err != nil) != test.wantErr {
+				t.Errorf("checkRelease() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
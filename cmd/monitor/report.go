@@ -0,0 +1,123 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/internal/insecure"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// report is a machine readable summary of a run of the monitor, written when
+// it finishes so that automation needn't parse the logs.
+type report struct {
+	// Origin is the origin of the log's checkpoints.
+	Origin string `json:"origin"`
+	// TreeSize is the size of the verified checkpoint.
+	TreeSize uint64 `json:"tree_size"`
+	// LeavesVerified is the number of leaves checked during the run.
+	LeavesVerified uint64 `json:"leaves_verified"`
+	// BuildsMatched is the number of releases whose builds were reproduced.
+	BuildsMatched int `json:"builds_matched"`
+	// BuildsMismatched is the number of releases whose builds could not be reproduced.
+	BuildsMismatched int `json:"builds_mismatched"`
+	// Checkpoint is the verified signed checkpoint.
+	Checkpoint string `json:"checkpoint"`
+	// CheckpointStale is true if the checkpoint was older than --max_checkpoint_age.
+	CheckpointStale bool `json:"checkpoint_stale"`
+	// BuildsSkipped is true if releases were not built, with --skip_build, so
+	// that only their inclusion and signatures were checked.
+	BuildsSkipped bool `json:"builds_skipped"`
+	// SignaturesSkipped is true if signatures were not verified, with the
+	// insecure signature skipping flag, in which case the report can't be signed.
+	SignaturesSkipped bool `json:"signatures_skipped"`
+}
+
+// newReport summarises the run of the monitor, whose builds were reproduced by rbv.
+func newReport(m *monitor.Monitor, rbv *ReproducibleBuildVerifier) report {
+	cp, cpRaw := m.Checkpoint()
+	return report{
+		Origin:           cp.Origin,
+		TreeSize:         cp.Size,
+		LeavesVerified:   m.Verified(),
+		BuildsMatched:    rbv.Matched(),
+		BuildsMismatched: len(rbv.Failed()),
+		Checkpoint:       string(cpRaw),
+		CheckpointStale:  m.Stale(),
+	}
+}
+
+// writeReport writes the report as JSON to the named file. If signer is not nil,
+// the file is a note signed by signer, whose text is the JSON.
+func writeReport(name string, r report, signer note.Signer) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %v", err)
+	}
+	b = append(b, '\n')
+	if signer != nil {
+		if b, err = note.Sign(&note.Note{Text: string(b)}, signer); err != nil {
+			return fmt.Errorf("failed to sign report: %v", err)
+		}
+	}
+	if err := writeFileAtomic(name, b, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	return nil
+}
+
+// reportSignerFromFlags returns a signer for the key in --report_signing_key, or
+// nil if it isn't set. A signed report attests that the log was verified, so
+// signing is refused if signature checks are being skipped.
+func reportSignerFromFlags() (note.Signer, error) {
+	if *reportKey == "" {
+		return nil, nil
+	}
+	if *reportFile == "" {
+		return nil, fmt.Errorf("--report_signing_key requires --report_file")
+	}
+	if *skipSig {
+		return nil, fmt.Errorf("--report_signing_key can't be used with --%s", insecure.SkipSignatureFlag)
+	}
+	k, err := os.ReadFile(*reportKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report signing key: %v", err)
+	}
+	s, err := note.NewSigner(strings.TrimSpace(string(k)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid report signing key: %v", err)
+	}
+	return s, nil
+}
+
+// writeReportFromFlags writes the report for the run to --report_file, if it is set,
+// signed by signer if it is not nil.
+func writeReportFromFlags(m *monitor.Monitor, rbv *ReproducibleBuildVerifier, signer note.Signer) {
+	if *reportFile == "" {
+		return
+	}
+	r := newReport(m, rbv)
+	r.BuildsSkipped, r.SignaturesSkipped = *skipBuild, *skipSig
+	if err := writeReport(*reportFile, r, signer); err != nil {
+		logging.Exit(err.Error())
+	}
+	logging.Info("Wrote report", "report_file", *reportFile)
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestWriteReport(t *testing.T) {
+	l := testutil.New(t)
+	cp := l.AddReleases("v1", "v2", "v3")
+	m := monitor.New(l.StateTracker(), note.VerifierList(l.ReleaseVerifier), monitor.LeafHandlerFunc(logRelease))
+	if err := m.From(context.Background(), 0); err != nil {
+		t.Fatalf("From: %v", err)
+	}
+	rbv := &ReproducibleBuildVerifier{matched: 2, failed: []uint64{1}}
+
+	name := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(name, newReport(m, rbv), nil); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := map[string]any{
+		"origin":             testutil.Origin,
+		"tree_size":          3.0,
+		"leaves_verified":    3.0,
+		"builds_matched":     2.0,
+		"builds_mismatched":  1.0,
+		"checkpoint":         string(cp),
+		"builds_skipped":     false,
+		"signatures_skipped": false,
+		"checkpoint_stale":   false,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Got unexpected report, diff: %s", diff)
+	}
+
+	if err := writeReport(filepath.Join(t.TempDir(), "missing", "report.json"), report{}, nil); err == nil {
+		t.Error("writeReport to missing directory: got no error")
+	}
+}
+
+func TestWriteSignedReport(t *testing.T) {
+	signer, verifier, _ := testutil.GenerateKey(t, "monitor")
+	want := report{Origin: testutil.Origin, TreeSize: 3, LeavesVerified: 3, BuildsSkipped: true}
+
+	name := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(name, want, signer); err != nil {
+		t.Fatalf("writeReport: %v", err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	n, err := note.Open(b, note.VerifierList(verifier))
+	if err != nil {
+		t.Fatalf("Failed to open signed report: %v", err)
+	}
+	var got report
+	if err := json.Unmarshal([]byte(n.Text), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Got unexpected report, diff: %s", diff)
+	}
+}
+
+func TestReportSignerFromFlags(t *testing.T) {
+	priv, _, err := note.GenerateKey(rand.Reader, "monitor")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "monitor.key")
+	if err := os.WriteFile(keyFile, []byte(priv+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	setFlag(t, reportKey, keyFile)
+	setFlag(t, reportFile, filepath.Join(t.TempDir(), "report.json"))
+
+	if s, err := reportSignerFromFlags(); err != nil || s == nil {
+		t.Errorf("reportSignerFromFlags() = %v, %v, want signer", s, err)
+	}
+	// A signed report mustn't vouch for a run which didn't check signatures.
+	setFlag(t, skipSig, true)
+	if _, err := reportSignerFromFlags(); err == nil {
+		t.Error("reportSignerFromFlags() with signatures skipped succeeded, want error")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/transparency-dev/formats/log"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// checkStateCheckpoint checks that the contents of the state file are a checkpoint
+// with the given origin, signed by the log. If a trust policy is given, it is used
+// in place of lSigV, and the log verifier which signed the checkpoint is returned.
+func checkStateCheckpoint(state []byte, lSigV note.Verifier, origin string, p *trustPolicy) (note.Verifier, error) {
+	if len(state) == 0 {
+		return nil, errors.New("state file is empty")
+	}
+	if p != nil {
+		_, _, v, err := p.openCheckpoint(state, origin)
+		return v, err
+	}
+	// Opening the note first reports the signers of a checkpoint signed by an
+	// unexpected key, which ParseCheckpoint doesn't.
+	if _, err := verify.OpenNote(state, note.VerifierList(lSigV)); err != nil {
+		return nil, err
+	}
+	if _, _, _, err := log.ParseCheckpoint(state, origin, lSigV); err != nil {
+		return nil, err
+	}
+	return lSigV, nil
+}
+
+// writeFileAtomic writes data to the named file such that, even if the monitor
+// is killed part way through, the file holds either its old or new contents.
+// The data is written and synced to a temporary file in the same directory, which
+// is then renamed over the named file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmp := f.Name()
+	// Once renamed, tmp no longer exists and this is a no-op.
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %q: %v", tmp, err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to set permissions on %q: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %q: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %q: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %v", tmp, name, err)
+	}
+
+	// Sync the directory too, so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %q: %v", dir, err)
+	}
+	return nil
+}
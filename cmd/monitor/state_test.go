@@ -0,0 +1,116 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/testutil"
+)
+
+func TestCheckStateCheckpoint(t *testing.T) {
+	l := testutil.New(t)
+	cp := l.AddReleases("v1", "v2")
+	other := testutil.New(t)
+	otherCP := other.AddReleases("v1")
+
+	for _, test := range []struct {
+		desc    string
+		state   []byte
+		origin  string
+		wantErr bool
+	}{
+		{
+			desc:   "valid",
+			state:  cp,
+			origin: testutil.Origin,
+		}, {
+			desc:    "empty",
+			state:   []byte{},
+			origin:  testutil.Origin,
+			wantErr: true,
+		}, {
+			desc:    "truncated",
+			state:   cp[:len(cp)/2],
+			origin:  testutil.Origin,
+			wantErr: true,
+		}, {
+			desc:    "garbage",
+			state:   []byte("not a checkpoint"),
+			origin:  testutil.Origin,
+			wantErr: true,
+		}, {
+			desc:    "different log",
+			state:   otherCP,
+			origin:  testutil.Origin,
+			wantErr: true,
+		}, {
+			desc:    "wrong origin",
+			state:   cp,
+			origin:  "Armory Drive Prod 2",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			v, err := checkStateCheckpoint(test.state, l.LogVerifier, test.origin, nil)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("checkStateCheckpoint: %v, wantErr %t", err, test.wantErr)
+			}
+			if err == nil && v != l.LogVerifier {
+				t.Errorf("checkStateCheckpoint: got verifier %q, want %q", v.Name(), l.LogVerifier.Name())
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "state")
+
+	for _, want := range []string{"first checkpoint\n", "second\n"} {
+		if err := writeFileAtomic(name, []byte(want), 0644); err != nil {
+			t.Fatalf("writeFileAtomic: %v", err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Got contents %q, want %q", got, want)
+		}
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0644); got != want {
+		t.Errorf("Got permissions %v, want %v", got, want)
+	}
+	// No temporary files should be left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Got %d files in directory, want 1", len(entries))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "state"), nil, 0644); err == nil {
+		t.Error("writeFileAtomic to missing directory: got no error")
+	}
+}
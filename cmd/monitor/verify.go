@@ -14,122 +14,151 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"errors"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/usbarmory/armory-drive-log/api"
-	"github.com/usbarmory/armory-drive-log/keys"
-)
-
-const (
-	gitOwner = "usbarmory"
-	gitRepo  = "armory-drive"
+	"github.com/usbarmory/armory-drive-log/api/monitor"
+	"github.com/usbarmory/armory-drive-log/internal/build"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
 )
 
 // NewReproducibleBuildVerifier returns a ReproducibleBuildVerifier that will delete
 // any temporary git repositories after use if cleanup is true, or leave them around
 // for further investigation if false.
-func NewReproducibleBuildVerifier(cleanup bool) (*ReproducibleBuildVerifier, error) {
+//
+// If buildFrom is not empty, only releases with a revision at or after buildFrom
+// will be built; older releases are assumed to have been verified by inclusion alone.
+//
+// The named artifacts of each release are compared against those built, or all of
+// the artifacts claimed by the release if artifacts is empty. The options configure
+// how releases are built.
+//
+// If timeout is non-zero, the build of each release is stopped if it takes longer
+// than timeout, which interrupts and then kills every process it started.
+func NewReproducibleBuildVerifier(cleanup bool, buildFrom string, artifacts []string, timeout time.Duration, opts ...build.GitBuilderOption) (*ReproducibleBuildVerifier, error) {
 	return &ReproducibleBuildVerifier{
-		cleanup: cleanup,
+		builder:   build.NewGitBuilder(cleanup, opts...),
+		buildFrom: buildFrom,
+		artifacts: artifacts,
+		timeout:   timeout,
 	}, nil
 }
 
 // ReproducibleBuildVerifier checks out the source code referenced by a manifest and
 // determines whether it can reproduce the final build artifacts.
 type ReproducibleBuildVerifier struct {
-	cleanup bool
+	builder   build.Builder
+	buildFrom string
+	artifacts []string
+	// timeout, if non-zero, bounds the time spent building each release.
+	timeout time.Duration
+	// failed holds the indices of the leaves whose builds could not be reproduced.
+	failed []uint64
+	// matched is the number of leaves whose builds were reproduced.
+	matched int
 }
 
-// VerifyManifest attempts to reproduce the FirmwareRelease at index `i` in the log by
-// checking out the code and running the make file.
-func (v *ReproducibleBuildVerifier) VerifyManifest(ctx context.Context, i uint64, r api.FirmwareRelease) error {
-	glog.V(1).Infof("VerifyManifest %d: %q", i, r.Revision)
-	// Create temporary directory that will be cleaned up after this method returns
-	dir, err := os.MkdirTemp("", "armory-verify")
-	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %v", err)
-	}
-	if v.cleanup {
-		defer os.RemoveAll(dir)
-	} else {
-		glog.Infof("Cleanup disabled: %q will not be deleted after use", dir)
-	}
-
-	glog.V(1).Infof("Cloning repo into %q", dir)
-	// Clone the repository at the release tag
-	cmd := exec.Command("/usr/bin/git", "clone", fmt.Sprintf("https://github.com/%s/%s", gitOwner, gitRepo), "-b", r.Revision)
-	cmd.Dir = dir
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to clone: %v (%s)", err, out)
-	}
+// Matched returns the number of leaves whose builds this verifier reproduced.
+func (v *ReproducibleBuildVerifier) Matched() int {
+	return v.matched
+}
 
-	repoRoot := filepath.Join(dir, gitRepo)
-	// Confirm that the git revision matches the manifest
-	cmd = exec.Command("/usr/bin/git", "rev-parse", "--short", "HEAD")
-	cmd.Dir = repoRoot
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to get HEAD revision: %v (%s)", err, out)
-	}
-	if got, want := strings.TrimSpace(string(out)), r.BuildArgs["REV"]; got != want {
-		return fmt.Errorf("expected revision %q but got %q for tag %q", want, got, r.Revision)
-	}
+// Failed returns the indices of the leaves which this verifier was unable to reproduce.
+func (v *ReproducibleBuildVerifier) Failed() []uint64 {
+	return v.failed
+}
 
-	// TODO: support downloading other TAMAGO compiler builds.
-	// For now, this just uses the one version pointed to by the process env.
-	tamagoBin := ""
-	for _, e := range os.Environ() {
-		if strings.HasPrefix(e, "TAMAGO=") {
-			tamagoBin = e[len("TAMAGO="):]
+// HasFailed returns true if this verifier was unable to reproduce the leaf at index i.
+func (v *ReproducibleBuildVerifier) HasFailed(i uint64) bool {
+	for _, f := range v.failed {
+		if f == i {
+			return true
 		}
 	}
-	if len(tamagoBin) == 0 {
-		return fmt.Errorf("failed to find TAMAGO in env")
-	}
-	out, err = exec.Command(tamagoBin, "version").Output()
-	if err != nil {
-		return fmt.Errorf("failed to get tamago version: %v (%s)", err, out)
-	}
-	if got, want := fmt.Sprintf("tama%s", strings.TrimSpace(string(out))), r.ToolChain; got != want {
-		return fmt.Errorf("expected toolchain %q but got %q for tag %q", want, got, r.Revision)
-	}
+	return false
+}
+
+// Handle implements monitor.LeafHandler by reproducing the build of the release in
+// the leaf, as VerifyManifest does.
+func (v *ReproducibleBuildVerifier) Handle(ctx context.Context, l monitor.Leaf) error {
+	return v.VerifyManifest(ctx, l.Index, l.Release)
+}
 
-	// Copy the public keys into place
-	otaDir := filepath.Join(repoRoot, "internal", "ota")
-	if err := os.WriteFile(filepath.Join(otaDir, "armory-drive-log.pub"), []byte(keys.ArmoryDriveLogPub), 0666); err != nil {
-		return fmt.Errorf("failed to write key: %v", err)
+// VerifyManifest attempts to reproduce the FirmwareRelease at index `i` in the log by
+// checking out the code and running the make file.
+//
+// A build which takes longer than the verifier's timeout is reported as a failure
+// to reproduce the leaf, so that one wedged build doesn't block the monitor.
+func (v *ReproducibleBuildVerifier) VerifyManifest(ctx context.Context, i uint64, r api.FirmwareRelease) error {
+	logging.V(1).Info("VerifyManifest", "index", i, "revision", r.Revision)
+	if len(v.buildFrom) > 0 && compareRevisions(r.Revision, v.buildFrom) < 0 {
+		logging.Info("Revision is before build_from_revision, skipping reproducible build", "index", i, "revision", r.Revision, "build_from_revision", v.buildFrom)
+		return nil
 	}
-	if err := os.WriteFile(filepath.Join(otaDir, "armory-drive.pub"), []byte(keys.ArmoryDrivePub), 0666); err != nil {
-		return fmt.Errorf("failed to write key: %v", err)
+	bctx := ctx
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		bctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
 	}
-
-	// Make the imx file
-	glog.V(1).Infof("Running make in %s", repoRoot)
-	cmd = exec.Command("/usr/bin/make", "CROSS_COMPILE=arm-none-eabi-", "imx")
-	cmd.Dir = repoRoot
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to make: %v (%s)", err, out)
+	results, err := build.Verify(bctx, v.builder, r, v.artifacts...)
+	for _, a := range results {
+		if a.Matches() {
+			logging.V(1).Info("Artifact reproduced", "index", i, "artifact", a.Name, "sha256", a.Got)
+		}
 	}
-
-	// Hash the firmware artifact.
-	data, err := os.ReadFile(filepath.Join(repoRoot, api.FirmwareArtifactName))
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %v", api.FirmwareArtifactName, err)
-	}
-	if got, want := sha256.Sum256(data), r.ArtifactSHA256[api.FirmwareArtifactName]; !bytes.Equal(got[:], want) {
-		// TODO: report this in a more visible way than an error in the log.
-		glog.Errorf("Failed to verify leaf %d with revision %q: %s (got %x, wanted %x)", i, r.Revision, api.FirmwareArtifactName, got, want)
-		return nil
+		if ctx.Err() == nil && errors.Is(bctx.Err(), context.DeadlineExceeded) {
+			logging.Error("Build timed out", "index", i, "revision", r.Revision, "timeout", v.timeout, "error", err)
+			v.failed = append(v.failed, i)
+			return nil
+		}
+		var mErr build.ArtifactMismatchError
+		var sErr build.SourceMismatchError
+		var uErr build.UnclaimedArtifactError
+		if errors.As(err, &mErr) || errors.As(err, &sErr) || errors.As(err, &uErr) {
+			// TODO: report this in a more visible way than an error in the log.
+			logging.Error("Failed to verify leaf", "index", i, "revision", r.Revision, "error", err)
+			v.failed = append(v.failed, i)
+			return nil
+		}
+		return err
 	}
 
-	glog.Infof("Leaf %d for revision %q verified at git tag %q", i, r.Revision, r.BuildArgs["REV"])
+	v.matched++
+	logging.Info("Leaf verified", "index", i, "revision", r.Revision, "commit", r.BuildArgs["REV"])
 	return nil
 }
+
+// compareRevisions compares two release revisions of the form "v2021.05.03",
+// returning a negative number if a sorts before b, a positive number if it
+// sorts after b, and zero if they are equivalent.
+//
+// Dot-separated components are compared numerically where both are numbers,
+// and lexically otherwise.
+func compareRevisions(a, b string) int {
+	ap := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bp := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aErr := strconv.ParseUint(ap[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bp[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		default:
+			if c := strings.Compare(ap[i], bp[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(ap) - len(bp)
+}
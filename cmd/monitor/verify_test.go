@@ -0,0 +1,172 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+)
+
+// fakeBuilder records the revisions it is asked to build, and reproduces them perfectly.
+type fakeBuilder struct {
+	built []string
+}
+
+func (f *fakeBuilder) Build(_ context.Context, r api.FirmwareRelease) (map[string][]byte, error) {
+	f.built = append(f.built, r.Revision)
+	return r.ArtifactSHA256, nil
+}
+
+func TestVerifyManifestBuildFrom(t *testing.T) {
+	b := &fakeBuilder{}
+	v := &ReproducibleBuildVerifier{
+		builder:   b,
+		buildFrom: "v2021.06.25",
+	}
+	for i, rev := range []string{"v2021.05.03", "v2021.06.24", "v2021.06.25", "v2021.10.01", "v2022.01.10"} {
+		r := api.FirmwareRelease{
+			Revision:       rev,
+			ArtifactSHA256: map[string][]byte{api.FirmwareArtifactName: []byte("imx")},
+		}
+		if err := v.VerifyManifest(context.Background(), uint64(i), r); err != nil {
+			t.Fatalf("VerifyManifest(%d): %v", i, err)
+		}
+	}
+	if diff := cmp.Diff([]string{"v2021.06.25", "v2021.10.01", "v2022.01.10"}, b.built); diff != "" {
+		t.Errorf("Built unexpected revisions, diff: %s", diff)
+	}
+}
+
+// tamperingBuilder reproduces releases perfectly, except for the named artifact.
+type tamperingBuilder struct {
+	tampered string
+}
+
+func (f tamperingBuilder) Build(_ context.Context, r api.FirmwareRelease) (map[string][]byte, error) {
+	built := make(map[string][]byte)
+	for n, h := range r.ArtifactSHA256 {
+		built[n] = h
+	}
+	built[f.tampered] = []byte("tampered")
+	return built, nil
+}
+
+func TestVerifyManifestArtifacts(t *testing.T) {
+	r := api.FirmwareRelease{
+		Revision: "v2021.10.08",
+		ArtifactSHA256: map[string][]byte{
+			api.FirmwareArtifactName: []byte("imx"),
+			"armory-drive.csf":       []byte("csf"),
+		},
+	}
+	for _, test := range []struct {
+		desc       string
+		artifacts  []string
+		tampered   string
+		wantFailed bool
+	}{
+		{
+			desc:      "unchecked artifact tampered",
+			artifacts: []string{api.FirmwareArtifactName},
+			tampered:  "armory-drive.csf",
+		}, {
+			desc:       "checked artifact tampered",
+			artifacts:  []string{api.FirmwareArtifactName},
+			tampered:   api.FirmwareArtifactName,
+			wantFailed: true,
+		}, {
+			desc:       "all artifacts checked",
+			tampered:   "armory-drive.csf",
+			wantFailed: true,
+		}, {
+			desc:       "unclaimed artifact",
+			artifacts:  []string{api.FirmwareArtifactName, "armory-drive.sdp"},
+			tampered:   "armory-drive.csf",
+			wantFailed: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			v := &ReproducibleBuildVerifier{
+				builder:   tamperingBuilder{tampered: test.tampered},
+				artifacts: test.artifacts,
+			}
+			if err := v.VerifyManifest(context.Background(), 0, r); err != nil {
+				t.Fatalf("VerifyManifest: %v", err)
+			}
+			if got := v.HasFailed(0); got != test.wantFailed {
+				t.Errorf("HasFailed() = %t, want %t", got, test.wantFailed)
+			}
+			if got, want := v.Matched(), 1; test.wantFailed == (got == want) {
+				t.Errorf("Matched() = %d, with HasFailed() = %t", got, test.wantFailed)
+			}
+		})
+	}
+}
+
+// hangingBuilder is a Builder whose builds never finish before ctx is done.
+type hangingBuilder struct{}
+
+func (hangingBuilder) Build(ctx context.Context, _ api.FirmwareRelease) (map[string][]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestVerifyManifestTimeout(t *testing.T) {
+	r := api.FirmwareRelease{
+		Revision:       "v2021.10.08",
+		ArtifactSHA256: map[string][]byte{api.FirmwareArtifactName: []byte("imx")},
+	}
+	v := &ReproducibleBuildVerifier{
+		builder: hangingBuilder{},
+		timeout: 10 * time.Millisecond,
+	}
+	if err := v.VerifyManifest(context.Background(), 3, r); err != nil {
+		t.Fatalf("VerifyManifest: %v", err)
+	}
+	if !v.HasFailed(3) {
+		t.Error("HasFailed(3) = false after build timed out, want true")
+	}
+
+	// Cancelling the monitor isn't a failure to reproduce the leaf.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := v.VerifyManifest(ctx, 4, r); err == nil {
+		t.Error("VerifyManifest with cancelled context succeeded, want error")
+	}
+	if v.HasFailed(4) {
+		t.Error("HasFailed(4) = true after monitor was cancelled, want false")
+	}
+}
+
+func TestCompareRevisions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "v2021.05.03", b: "v2021.05.03", want: 0},
+		{a: "v2021.05.03", b: "v2021.06.25", want: -1},
+		{a: "v2022.01.01", b: "v2021.12.31", want: 1},
+		{a: "v2021.5.3", b: "v2021.05.10", want: -1},
+		{a: "v2021.05.03", b: "v2021.05", want: 1},
+	} {
+		got := compareRevisions(test.a, test.b)
+		if (got < 0 && test.want >= 0) || (got > 0 && test.want <= 0) || (got == 0 && test.want != 0) {
+			t.Errorf("compareRevisions(%q, %q) = %d, want sign of %d", test.a, test.b, got, test.want)
+		}
+	}
+}
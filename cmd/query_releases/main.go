@@ -0,0 +1,80 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// query_releases is a tool to look up the releases recorded by the monitor in its
+// release database.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/internal/releasedb"
+)
+
+var (
+	dbFile    = flag.String("db", "", "Path to the release database written by the monitor's --release_db flag")
+	index     = flag.Int64("index", -1, "If set, prints the record for the leaf at this index")
+	revision  = flag.String("revision", "", "If set, prints the records for all leaves with this revision")
+	logFormat = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+
+	if len(*dbFile) == 0 {
+		logging.Exit("--db required")
+	}
+	if (*index < 0) == (len(*revision) == 0) {
+		logging.Exit("Exactly one of --index or --revision required")
+	}
+
+	db, err := releasedb.OpenReadOnly(*dbFile)
+	if err != nil {
+		logging.Exit(err.Error())
+	}
+	defer db.Close()
+
+	var records []releasedb.Record
+	if *index >= 0 {
+		r, found, err := db.Get(uint64(*index))
+		if err != nil {
+			logging.Exitf("Failed to look up leaf %d: %v", *index, err)
+		}
+		if !found {
+			logging.Exitf("No record for leaf %d", *index)
+		}
+		records = append(records, r)
+	} else {
+		if records, err = db.ByRevision(*revision); err != nil {
+			logging.Exitf("Failed to look up revision %q: %v", *revision, err)
+		}
+		if len(records) == 0 {
+			logging.Exitf("No record for revision %q", *revision)
+		}
+	}
+
+	for _, r := range records {
+		j, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			logging.Exitf("Failed to marshal record: %v", err)
+		}
+		fmt.Println(string(j))
+	}
+}
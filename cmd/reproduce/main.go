@@ -0,0 +1,108 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// reproduce is a tool to check that a signed release manifest can be reproducibly
+// built from source, without reference to the log.
+// This tool has the same expectations of the environment as the monitor, such as a
+// working tamago installation, git, and other make tooling.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/internal/build"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	manifest      = flag.String("manifest", "", "Path to the signed manifest")
+	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
+	artifacts     = flag.String("artifacts", api.FirmwareArtifactName, "Comma separated list of the artifacts to compare against the manifest. If empty, all artifacts claimed by the manifest are compared. The default selects the release's firmware image, even if it is named for its platform")
+	makeTarget    = flag.String("make_target", build.DefaultMakeTarget, "The make target used to build releases which don't specify MAKE_TARGET in their build args")
+	crossCompile  = flag.String("cross_compile", build.DefaultCrossCompile, "The cross compiler prefix used to build releases which don't specify CROSS_COMPILE in their build args")
+	cleanup       = flag.Bool("cleanup", true, "Set to false to keep git checkouts and make artifacts around after verification")
+	checkSource   = flag.Bool("check_source", false, "Set to true to also fetch the release's source tarball and check it against the signed source_sha256. GitHub's tarballs aren't byte-for-byte stable, so this may fail for old releases")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+	ctx := context.Background()
+
+	if len(*manifest) == 0 {
+		logging.Exit("--manifest required")
+	}
+	msg, err := os.ReadFile(*manifest)
+	if err != nil {
+		logging.Exitf("Failed to read manifest file: %v", err)
+	}
+	v, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		logging.Exitf("Failed to construct release note verifier: %v", err)
+	}
+
+	var names []string
+	if len(*artifacts) > 0 {
+		names = strings.Split(*artifacts, ",")
+	}
+	opts := []build.GitBuilderOption{build.WithMakeTarget(*makeTarget), build.WithCrossCompile(*crossCompile)}
+	if *checkSource {
+		opts = append(opts, build.WithSourceCheck(nil))
+	}
+	r, results, err := reproduce(ctx, build.NewGitBuilder(*cleanup, opts...), msg, note.VerifierList(v), names)
+	var mErr build.ArtifactMismatchError
+	if err != nil && !errors.As(err, &mErr) {
+		logging.Exitf("Failed to reproduce release: %v", err)
+	}
+	for _, a := range results {
+		switch {
+		case a.Matches():
+			fmt.Printf("MATCH: revision %q reproduced %s\n", r.Revision, a.Name)
+		case a.Got == nil:
+			fmt.Printf("MISSING: revision %q: build did not produce %s\n", r.Revision, a.Name)
+		default:
+			fmt.Printf("MISMATCH: revision %q: %s hash mismatch (got %x, wanted %x)\n", r.Revision, a.Name, a.Got, a.Want)
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// reproduce verifies the signature on the manifest, and then uses the Builder to
+// check that the named artifacts of the release it describes can be reproduced.
+func reproduce(ctx context.Context, b build.Builder, manifest []byte, verifiers note.Verifiers, artifacts []string) (api.FirmwareRelease, []build.ArtifactResult, error) {
+	var r api.FirmwareRelease
+	n, err := note.Open(manifest, verifiers)
+	if err != nil {
+		return r, nil, fmt.Errorf("failed to verify manifest: %v", err)
+	}
+	if err := json.Unmarshal([]byte(n.Text), &r); err != nil {
+		return r, nil, fmt.Errorf("failed to unmarshal manifest: %v", err)
+	}
+	results, err := build.Verify(ctx, b, r, artifacts...)
+	return r, results, err
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/internal/build"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// fakeBuilder "builds" a release by returning a fixed set of artifact hashes.
+type fakeBuilder map[string][]byte
+
+func (f fakeBuilder) Build(_ context.Context, _ api.FirmwareRelease) (map[string][]byte, error) {
+	return f, nil
+}
+
+func TestReproduce(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "test-release")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	fr, err := json.Marshal(api.FirmwareRelease{
+		Revision:       "v1",
+		ArtifactSHA256: map[string][]byte{api.FirmwareArtifactName: []byte("good")},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	manifest, err := note.Sign(&note.Note{Text: string(fr) + "\n"}, s)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc         string
+		builder      fakeBuilder
+		wantMismatch bool
+		wantErr      bool
+	}{
+		{
+			desc:    "match",
+			builder: fakeBuilder{api.FirmwareArtifactName: []byte("good")},
+		}, {
+			desc:         "mismatch",
+			builder:      fakeBuilder{api.FirmwareArtifactName: []byte("bad")},
+			wantMismatch: true,
+			wantErr:      true,
+		}, {
+			desc:    "missing artifact",
+			builder: fakeBuilder{"something.else": []byte("good")},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, _, err := reproduce(context.Background(), test.builder, manifest, note.VerifierList(v), []string{api.FirmwareArtifactName})
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+			var mErr build.ArtifactMismatchError
+			if gotMismatch := errors.As(err, &mErr); gotMismatch != test.wantMismatch {
+				t.Fatalf("wantMismatch: %v, but got: %v", test.wantMismatch, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// verify_checkpoint is a tool which verifies the signature on a checkpoint issued
+// by the log, and prints the origin, size and root hash which it commits to.
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	checkpoint = flag.String("checkpoint", "", "Path to the signed checkpoint, or - to read it from stdin")
+	logPubKey  = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
+	logOrigin  = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
+	logFormat  = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+
+	if *checkpoint == "" {
+		logging.Exit("--checkpoint required")
+	}
+	lSigV, err := note.NewVerifier(*logPubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new log signature verifier: %v", err)
+	}
+	var cpRaw []byte
+	if *checkpoint == "-" {
+		cpRaw, err = io.ReadAll(os.Stdin)
+	} else {
+		cpRaw, err = os.ReadFile(*checkpoint)
+	}
+	if err != nil {
+		logging.Exitf("Failed to read checkpoint: %v", err)
+	}
+
+	cp, err := verifyCheckpoint(cpRaw, lSigV, *logOrigin)
+	if err != nil {
+		logging.Exitf("Failed to verify checkpoint: %v", err)
+	}
+	printCheckpoint(os.Stdout, cp)
+}
+
+// verifyCheckpoint verifies the signature on the checkpoint note, and that it is
+// from the log with the expected origin.
+func verifyCheckpoint(cpRaw []byte, lSigV note.Verifier, origin string) (api.Checkpoint, error) {
+	if err := verify.CheckNoteSignatures(cpRaw, verify.DefaultMaxSignatures); err != nil {
+		return api.Checkpoint{}, fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	n, err := verify.OpenNote(cpRaw, note.VerifierList(lSigV))
+	if err != nil {
+		return api.Checkpoint{}, fmt.Errorf("failed to verify signature on checkpoint: %v", err)
+	}
+	cp := api.Checkpoint{}
+	if err := cp.Unmarshal([]byte(n.Text)); err != nil {
+		return api.Checkpoint{}, fmt.Errorf("failed to unmarshal checkpoint: %v", err)
+	}
+	if cp.Origin != origin {
+		return api.Checkpoint{}, fmt.Errorf("incorrect checkpoint origin %q, want %q", cp.Origin, origin)
+	}
+	return cp, nil
+}
+
+// printCheckpoint writes the fields of the checkpoint to w, one per line.
+func printCheckpoint(w io.Writer, cp api.Checkpoint) {
+	fmt.Fprintf(w, "Origin: %s\n", cp.Origin)
+	fmt.Fprintf(w, "Size: %d\n", cp.Size)
+	fmt.Fprintf(w, "Hash: %s\n", base64.StdEncoding.EncodeToString(cp.Hash))
+	if !cp.Timestamp.IsZero() {
+		fmt.Fprintf(w, "Timestamp: %s\n", cp.Timestamp.Format(time.RFC3339))
+	}
+}
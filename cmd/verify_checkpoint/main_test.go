@@ -0,0 +1,87 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/testutil"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestVerifyCheckpoint(t *testing.T) {
+	l := testutil.New(t)
+	cpRaw := l.AddReleases("v1", "v2")
+	n, err := note.Open(cpRaw, note.VerifierList(l.LogVerifier))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	_, otherV, _ := testutil.GenerateKey(t, "other")
+
+	for _, test := range []struct {
+		desc     string
+		cpRaw    []byte
+		verifier note.Verifier
+		origin   string
+		wantErr  bool
+	}{
+		{
+			desc:     "valid",
+			cpRaw:    cpRaw,
+			verifier: l.LogVerifier,
+			origin:   testutil.Origin,
+		}, {
+			desc:     "wrong key",
+			cpRaw:    cpRaw,
+			verifier: otherV,
+			origin:   testutil.Origin,
+			wantErr:  true,
+		}, {
+			desc:     "wrong origin",
+			cpRaw:    cpRaw,
+			verifier: l.LogVerifier,
+			origin:   "Other Log",
+			wantErr:  true,
+		}, {
+			desc:     "tampered",
+			cpRaw:    bytes.Replace(cpRaw, []byte("\n2\n"), []byte("\n3\n"), 1),
+			verifier: l.LogVerifier,
+			origin:   testutil.Origin,
+			wantErr:  true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			cp, err := verifyCheckpoint(test.cpRaw, test.verifier, test.origin)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("verifyCheckpoint() = %v, want err %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			var b strings.Builder
+			printCheckpoint(&b, cp)
+			// Without a timestamp, the output is the checkpoint text with each
+			// field labelled.
+			lines := strings.Split(n.Text, "\n")
+			want := fmt.Sprintf("Origin: %s\nSize: %s\nHash: %s\n", lines[0], lines[1], lines[2])
+			if got := b.String(); got != want {
+				t.Errorf("Got output %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// verify_ota is a tool which checks an OTA zip in the same way as a device being
+// updated with it: the firmware image must be committed to by a signed release,
+// which the ProofBundle in the zip shows is included in the log.
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+	"golang.org/x/mod/sumdb/note"
+)
+
+var (
+	otaFile       = flag.String("ota", "armory-drive.ota", "Path to the OTA zip to verify")
+	deviceCPFile  = flag.String("device_checkpoint", "", "Path to the signed checkpoint held by the device being updated, leave unset to verify as a device with no checkpoint")
+	logPubKey     = flag.String("log_pubkey", keys.ArmoryDriveLogPub, "The log's public key")
+	logOrigin     = flag.String("log_origin", "Armory Drive Prod 2", "The expected first line of checkpoints issued by the log")
+	releasePubKey = flag.String("release_pubkey", keys.ArmoryDrivePub, "The release signer's public key")
+	firmwareName  = flag.String("firmware", api.FirmwareArtifactName, "Name of the firmware image in the OTA zip, which must be committed to by the release under the same name")
+	bundleName    = flag.String("proof_bundle", "armory-drive.log", "Name of the serialised ProofBundle in the OTA zip")
+	logFormat     = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+)
+
+func main() {
+	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
+
+	lSigV, err := note.NewVerifier(*logPubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new log signature verifier: %v", err)
+	}
+	frSigV, err := note.NewVerifier(*releasePubKey)
+	if err != nil {
+		logging.Exitf("Unable to create new release signature verifier: %v", err)
+	}
+	var deviceCP []byte
+	if len(*deviceCPFile) > 0 {
+		if deviceCP, err = os.ReadFile(*deviceCPFile); err != nil {
+			logging.Exitf("Failed to read device checkpoint file %q: %v", *deviceCPFile, err)
+		}
+	}
+
+	r, err := zip.OpenReader(*otaFile)
+	if err != nil {
+		logging.Exitf("Failed to open OTA zip %q: %v", *otaFile, err)
+	}
+	defer r.Close()
+
+	fr, err := verifyOTA(&r.Reader, deviceCP, lSigV, frSigV, *logOrigin, *firmwareName, *bundleName)
+	if err != nil {
+		logging.Exitf("OTA zip %q is INVALID: %v", *otaFile, err)
+	}
+	fmt.Printf("OTA zip %q is valid: revision %q for platform %q\n", *otaFile, fr.Revision, fr.PlatformID)
+}
+
+// verifyOTA checks that the firmware image in the OTA zip is committed to by the
+// release in the zip's ProofBundle, and that the bundle proves the release is
+// included in the log, for a device holding deviceCP. If deviceCP is nil, the
+// device is assumed to hold no checkpoint.
+// The verified release is returned.
+func verifyOTA(r *zip.Reader, deviceCP []byte, lSigV, frSigV note.Verifier, origin, firmwareName, bundleName string) (api.FirmwareRelease, error) {
+	var oldCP api.Checkpoint
+	if deviceCP != nil {
+		n, err := note.Open(deviceCP, note.VerifierList(lSigV))
+		if err != nil {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to verify signature on device checkpoint: %v", err)
+		}
+		if err := oldCP.Unmarshal([]byte(n.Text)); err != nil {
+			return api.FirmwareRelease{}, fmt.Errorf("failed to unmarshal device checkpoint: %v", err)
+		}
+		if oldCP.Origin != origin {
+			return api.FirmwareRelease{}, fmt.Errorf("incorrect device checkpoint origin %q, want %q", oldCP.Origin, origin)
+		}
+	}
+
+	bundleRaw, err := readFile(r, bundleName)
+	if err != nil {
+		return api.FirmwareRelease{}, err
+	}
+	pb, err := api.ParseProofBundle(bundleRaw)
+	if err != nil {
+		return api.FirmwareRelease{}, err
+	}
+	if err := pb.Validate(); err != nil {
+		return api.FirmwareRelease{}, err
+	}
+
+	f, err := r.Open(firmwareName)
+	if err != nil {
+		return api.FirmwareRelease{}, fmt.Errorf("failed to open %q in OTA zip: %v", firmwareName, err)
+	}
+	defer f.Close()
+
+	if err := verify.BundleArtifacts(pb, oldCP, lSigV, frSigV, map[string]io.Reader{firmwareName: f}, origin); err != nil {
+		return api.FirmwareRelease{}, err
+	}
+
+	// The release has been verified, so only needs to be parsed for reporting.
+	n, err := note.Open(pb.FirmwareRelease, note.VerifierList(frSigV))
+	if err != nil {
+		return api.FirmwareRelease{}, err
+	}
+	var fr api.FirmwareRelease
+	if err := json.Unmarshal([]byte(n.Text), &fr); err != nil {
+		return api.FirmwareRelease{}, fmt.Errorf("failed to unmarshal FirmwareRelease: %v", err)
+	}
+	return fr, nil
+}
+
+// readFile returns the contents of the named file in the zip.
+func readFile(r *zip.Reader, name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q in OTA zip: %v", name, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q from OTA zip: %v", name, err)
+	}
+	return b, nil
+}
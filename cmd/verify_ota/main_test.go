@@ -0,0 +1,174 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/bundle"
+	"github.com/usbarmory/armory-drive-log/testutil"
+)
+
+const bundleFile = "armory-drive.log"
+
+// otaZip returns a zip containing the given files.
+func otaZip(t *testing.T, files map[string][]byte) *zip.Reader {
+	t.Helper()
+	b := &bytes.Buffer{}
+	w := zip.NewWriter(b)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := f.Write(content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	return r
+}
+
+// gzipped returns b compressed with gzip.
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	c := &bytes.Buffer{}
+	w := gzip.NewWriter(c)
+	if _, err := w.Write(b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return c.Bytes()
+}
+
+func TestVerifyOTA(t *testing.T) {
+	l := testutil.New(t)
+	deviceCP := l.AddReleases("v1", "v2")
+
+	image := []byte("firmware image")
+	imageHash := sha256.Sum256(image)
+	release := l.SignRelease(api.FirmwareRelease{
+		Description:    "A release",
+		PlatformID:     "armory-drive",
+		Revision:       "v3",
+		ArtifactSHA256: map[string][]byte{api.FirmwareArtifactName: imageHash[:]},
+		ToolChain:      "tama1.17.1",
+	})
+	l.Add(release)
+	otherCP := testutil.New(t).AddReleases("v1")
+
+	newBundle := func(deviceSize uint64) []byte {
+		t.Helper()
+		pb, err := bundle.BuildProofBundle(context.Background(), l.Fetcher(), release, l.LogVerifier, testutil.Origin, bundle.WithDeviceCheckpointSize(deviceSize))
+		if err != nil {
+			t.Fatalf("BuildProofBundle: %v", err)
+		}
+		pbRaw, err := json.Marshal(pb)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return pbRaw
+	}
+	fullBundle, deviceBundle := newBundle(0), newBundle(2)
+	var pb api.ProofBundle
+	if err := json.Unmarshal(fullBundle, &pb); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	pb.LeafHashes = pb.LeafHashes[1:]
+	truncBundle, err := json.Marshal(pb)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var fullPB api.ProofBundle
+	if err := json.Unmarshal(fullBundle, &fullPB); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	binBundle, err := fullPB.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		files    map[string][]byte
+		deviceCP []byte
+		wantErr  bool
+	}{
+		{
+			desc:  "valid",
+			files: map[string][]byte{api.FirmwareArtifactName: image, bundleFile: fullBundle},
+		}, {
+			desc:     "valid with device checkpoint",
+			files:    map[string][]byte{api.FirmwareArtifactName: image, bundleFile: deviceBundle},
+			deviceCP: deviceCP,
+		}, {
+			desc:     "device checkpoint from another log",
+			files:    map[string][]byte{api.FirmwareArtifactName: image, bundleFile: fullBundle},
+			deviceCP: otherCP,
+			wantErr:  true,
+		}, {
+			desc:    "tampered image",
+			files:   map[string][]byte{api.FirmwareArtifactName: []byte("evil image"), bundleFile: fullBundle},
+			wantErr: true,
+		}, {
+			desc:    "missing image",
+			files:   map[string][]byte{bundleFile: fullBundle},
+			wantErr: true,
+		}, {
+			desc:    "missing bundle",
+			files:   map[string][]byte{api.FirmwareArtifactName: image},
+			wantErr: true,
+		}, {
+			desc:  "compressed bundle",
+			files: map[string][]byte{api.FirmwareArtifactName: image, bundleFile: gzipped(t, fullBundle)},
+		}, {
+			desc:  "binary bundle",
+			files: map[string][]byte{api.FirmwareArtifactName: image, bundleFile: binBundle},
+		}, {
+			desc:    "truncated bundle",
+			files:   map[string][]byte{api.FirmwareArtifactName: image, bundleFile: truncBundle},
+			wantErr: true,
+		}, {
+			desc:    "corrupt bundle",
+			files:   map[string][]byte{api.FirmwareArtifactName: image, bundleFile: []byte("{")},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			fr, err := verifyOTA(otaZip(t, test.files), test.deviceCP, l.LogVerifier, l.ReleaseVerifier, testutil.Origin, api.FirmwareArtifactName, bundleFile)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("verifyOTA: %v, wantErr %t", err, test.wantErr)
+			}
+			if err == nil && fr.Revision != "v3" {
+				t.Errorf("verifyOTA: got revision %q, want v3", fr.Revision)
+			}
+		})
+	}
+}
@@ -16,81 +16,292 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/usbarmory/armory-drive-log/api"
-	"github.com/golang/glog"
+	"github.com/usbarmory/armory-drive-log/internal/insecure"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
 	"golang.org/x/mod/sumdb/note"
 )
 
 var (
-	publicKeyFile = flag.String("public_key", "", "Path to file containing the public key used to sign the manifest. If unset, uses the contents of the environment variable.")
-	manifest      = flag.String("manifest", "", "Path to the signed manifest")
+	manifest     = flag.String("manifest", "", "Path to the signed manifest, or to the unsigned manifest if --signature is set")
+	signature    = flag.String("signature", "", "If set, path to a file containing the note signature lines for the manifest, which is then read from --manifest without any signatures")
+	threshold    = flag.Int("threshold", 1, "The number of authorised keys which must have signed the manifest")
+	expectSHA256 = flag.String("expect_sha256", "", "If set, comma separated list of name=hash pairs, each giving the expected SHA256 hash of the named artifact in hex or base64. A hash without a name is compared against the release's firmware image")
+	field        = flag.String("field", "", "If set, only the value of this dot separated path into the manifest is printed, e.g. artifact_sha256.armory-drive.imx")
+	logFormat    = flag.String("log_format", logging.FormatGlog, logging.FlagUsage)
+	skipSig      = flag.Bool(insecure.SkipSignatureFlag, false, insecure.SkipSignatureUsage)
+	skipSigAck   = flag.Bool(insecure.AcknowledgeFlag, false, insecure.AcknowledgeUsage)
 )
 
+// publicKeyFiles holds the paths to the files containing the public keys authorised
+// to sign the manifest.
+var publicKeyFiles fileList
+
+func init() {
+	flag.Var(&publicKeyFiles, "public_key", "Path to file containing a public key authorised to sign the manifest. May be repeated, or be a comma separated list of paths. If unset, uses the keys in the environment variable, one per line.")
+}
+
+// fileList is a flag.Value which accumulates file paths from repeated and/or
+// comma separated flag values.
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(v string) error {
+	*l = append(*l, strings.Split(v, ",")...)
+	return nil
+}
+
 const pubkeyEnv = "FR_PUBKEY"
 
 func main() {
-	var pubkey string
+	var pubkeys []string
 
 	flag.Parse()
+	if err := logging.Init(*logFormat); err != nil {
+		logging.Exitf("Invalid --log_format: %v", err)
+	}
 	if err := validateFlags(); err != nil {
-		glog.Exitf("Invalid flag(s):\n%s", err)
+		logging.Exitf("Invalid flag(s):\n%s", err)
+	}
+	if err := insecure.Check(*skipSig, *skipSigAck); err != nil {
+		logging.Exitf("Invalid flag(s):\n%s", err)
 	}
 
-	if len(*publicKeyFile) > 0 {
-		k, err := os.ReadFile(*publicKeyFile)
-		if err != nil {
-			glog.Exitf("failed to read public key file: %v", err)
-		}
-		pubkey = string(k)
-	} else {
-		pubkey = os.Getenv(pubkeyEnv)
-		if len(pubkey) == 0 {
-			glog.Exitf("%s environment variable not found.", pubkeyEnv)
+	// No keys are needed when signatures aren't being verified.
+	if !*skipSig {
+		if len(publicKeyFiles) > 0 {
+			for _, f := range publicKeyFiles {
+				k, err := os.ReadFile(f)
+				if err != nil {
+					logging.Exitf("failed to read public key file: %v", err)
+				}
+				pubkeys = append(pubkeys, string(k))
+			}
+		} else {
+			pubkeys = strings.Fields(os.Getenv(pubkeyEnv))
+			if len(pubkeys) == 0 {
+				logging.Exitf("%s environment variable not found.", pubkeyEnv)
+			}
 		}
 	}
 
 	msg, err := os.ReadFile(*manifest)
 	if err != nil {
-		glog.Exitf("failed to read manifest file: %v", err)
+		logging.Exitf("failed to read manifest file: %v", err)
+	}
+	if len(*signature) > 0 {
+		sig, err := os.ReadFile(*signature)
+		if err != nil {
+			logging.Exitf("failed to read signature file: %v", err)
+		}
+		if msg, err = attachSignature(msg, sig); err != nil {
+			logging.Exitf("Invalid signature file: %v", err)
+		}
 	}
 
-	glog.Info("Verifying signature...")
-	body, err := verify(msg, pubkey)
+	logging.Info("Verifying signature...")
+	var body []byte
+	var signers []string
+	if *skipSig {
+		body, signers, err = openManifest(msg, insecure.Verifiers(), *threshold)
+	} else {
+		body, signers, err = verify(msg, pubkeys, *threshold)
+	}
 	if err != nil {
-		glog.Exitf("Failed to verify signature: %v", err)
+		logging.Exitf("Failed to verify signature: %v", err)
 	}
+	logging.Infof("Signature verified by %s", strings.Join(signers, ", "))
 
 	release := &api.FirmwareRelease{}
 	if err = json.Unmarshal(body, &release); err != nil {
-		glog.Exitf("Firmware release manifest format error: %v", err)
+		logging.Exitf("Firmware release manifest format error: %v", err)
+	}
+
+	if err := release.CheckSchema(); err != nil {
+		logging.Exitf("Firmware release manifest format error: %v", err)
 	}
 
 	// TODO: perform deeper check on FirmwareRelease struct
 
+	if len(*expectSHA256) > 0 {
+		if err := checkArtifactHashes(*release, *expectSHA256); err != nil {
+			logging.Exitf("Artifact hash mismatch: %v", err)
+		}
+		logging.Info("Artifact hashes match")
+	}
+
+	if err := checkCreatedAt(*release, time.Now()); err != nil {
+		logging.Exitf("Invalid release creation time: %v", err)
+	}
+	if !release.CreatedAt.IsZero() {
+		logging.Infof("Release %q created at %s", release.Revision, release.CreatedAt.Format(time.RFC3339))
+	}
+
+	if len(*field) > 0 {
+		v, err := extractField(body, *field)
+		if err != nil {
+			logging.Exitf("Failed to extract field: %v", err)
+		}
+		fmt.Println(v)
+		return
+	}
+
 	fmt.Println(string(body))
 }
 
-// verify verifies the passed Go sumdb's note
-func verify(msg []byte, pubkey string) ([]byte, error) {
-	verifier, err := note.NewVerifier(pubkey)
+// maxClockSkew is how far in the future a release's creation time may be, to allow
+// for the clock of the machine which created it being ahead of this one.
+const maxClockSkew = 10 * time.Minute
+
+// checkCreatedAt returns an error if the release claims to have been created after
+// now, allowing for maxClockSkew. Releases which don't record when they were created
+// are accepted.
+func checkCreatedAt(release api.FirmwareRelease, now time.Time) error {
+	if release.CreatedAt.IsZero() {
+		return nil
+	}
+	if release.CreatedAt.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("release %q claims to have been created at %s, which is in the future", release.Revision, release.CreatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkArtifactHashes checks that the release commits to the expected artifact
+// hashes, given as a comma separated list of name=hash pairs. Hashes may be hex or
+// base64 encoded, and one without a name is that of the release's firmware image.
+func checkArtifactHashes(release api.FirmwareRelease, expect string) error {
+	for _, e := range strings.Split(expect, ",") {
+		name, hash := release.FirmwareArtifact(), e
+		// Base64 hashes may end in '=' padding, so a name is only split off if the
+		// entry isn't a hash by itself.
+		if _, err := api.ParseSHA256(e); err != nil {
+			if n, h, found := strings.Cut(e, "="); found {
+				name, hash = n, h
+			}
+		}
+		want, err := api.ParseSHA256(hash)
+		if err != nil {
+			return fmt.Errorf("invalid hash for %q: %v", name, err)
+		}
+		got, ok := release.ArtifactSHA256[name]
+		if !ok {
+			return fmt.Errorf("release has no artifact %q", name)
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("release commits to SHA256 %x for %q, want %x", got, name, want)
+		}
+	}
+	return nil
+}
+
+// extractField returns the value at the dot separated path into the JSON object
+// body. Strings are returned as they are, and any other values as JSON.
+//
+// As object keys may themselves contain dots (e.g. artifact names), at each level
+// the longest key which matches the start of the remaining path is followed.
+func extractField(body []byte, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "", err
+	}
+	for rest := path; rest != ""; {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("no field %q: %q is not an object", path, strings.TrimSuffix(path, rest))
+		}
+		key := ""
+		for k := range obj {
+			if (rest == k || strings.HasPrefix(rest, k+".")) && len(k) > len(key) {
+				key = k
+			}
+		}
+		if key == "" {
+			return "", fmt.Errorf("no field %q", path)
+		}
+		v = obj[key]
+		rest = strings.TrimPrefix(strings.TrimPrefix(rest, key), ".")
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialise key: %v", err)
+		return "", err
 	}
-	verifiers := note.VerifierList(verifier)
+	return string(b), nil
+}
 
+// verify verifies the passed Go sumdb's note, which must be signed by at least
+// threshold of the passed keys. The body of the note is returned along with the
+// names of the keys whose signatures were verified.
+func verify(msg []byte, pubkeys []string, threshold int) ([]byte, []string, error) {
+	vs := make([]note.Verifier, 0, len(pubkeys))
+	for _, k := range pubkeys {
+		v, err := note.NewVerifier(strings.TrimSpace(k))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to initialise key: %v", err)
+		}
+		vs = append(vs, v)
+	}
+	return openManifest(msg, note.VerifierList(vs...), threshold)
+}
+
+// sigPrefix begins each signature line of a note.
+const sigPrefix = "\u2014 "
+
+// attachSignature reassembles a signed note from its text and the signature lines
+// which were kept separately from it. As note text always ends with a newline, one
+// is added to body if it is missing.
+func attachSignature(body, sig []byte) ([]byte, error) {
+	sig = bytes.TrimLeft(sig, "\n")
+	if len(sig) == 0 {
+		return nil, errors.New("no signatures")
+	}
+	if !bytes.HasSuffix(sig, []byte("\n")) {
+		sig = append(sig, '\n')
+	}
+	for _, l := range strings.SplitAfter(string(sig), "\n") {
+		if l != "" && !strings.HasPrefix(l, sigPrefix) {
+			return nil, fmt.Errorf("malformed signature line %q", strings.TrimSuffix(l, "\n"))
+		}
+	}
+	msg := bytes.Clone(body)
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		msg = append(msg, '\n')
+	}
+	msg = append(msg, '\n')
+	return append(msg, sig...), nil
+}
+
+// openManifest opens the note, which must be signed by at least threshold of the
+// verifiers. The body of the note is returned along with the names of the keys
+// whose signatures were verified.
+func openManifest(msg []byte, verifiers note.Verifiers, threshold int) ([]byte, []string, error) {
 	n, err := note.Open(msg, verifiers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify manifest: %v", err)
+		return nil, nil, fmt.Errorf("failed to verify manifest: %v", err)
+	}
+	if len(n.Sigs) < threshold {
+		return nil, nil, fmt.Errorf("manifest is signed by %d authorised key(s), but %d are required", len(n.Sigs), threshold)
 	}
 
-	return []byte(n.Text), nil
+	signers := make([]string, 0, len(n.Sigs))
+	for _, sig := range n.Sigs {
+		signers = append(signers, fmt.Sprintf("%s+%08x", sig.Name, sig.Hash))
+	}
+	return []byte(n.Text), signers, nil
 }
 
 func validateFlags() error {
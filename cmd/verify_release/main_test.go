@@ -0,0 +1,280 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestExtractField(t *testing.T) {
+	body := []byte(`{
+  "description": "armory-drive v2021.10.08",
+  "revision": "v2021.10.08",
+  "artifact_sha256": {
+    "armory-drive.imx": "2dJ4zYAsPXUnSVBWk/56yV3myfK2UdqQ+vtMUHYekus=",
+    "armory-drive.imx.sig": "c2ln"
+  },
+  "build_args": {
+    "REV": "b90e2d9"
+  }
+}`)
+	for _, test := range []struct {
+		desc    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			desc: "top level",
+			path: "revision",
+			want: "v2021.10.08",
+		}, {
+			desc: "nested",
+			path: "build_args.REV",
+			want: "b90e2d9",
+		}, {
+			desc: "key containing dots",
+			path: "artifact_sha256.armory-drive.imx",
+			want: "2dJ4zYAsPXUnSVBWk/56yV3myfK2UdqQ+vtMUHYekus=",
+		}, {
+			desc: "longest key wins",
+			path: "artifact_sha256.armory-drive.imx.sig",
+			want: "c2ln",
+		}, {
+			desc: "object",
+			path: "build_args",
+			want: `{"REV":"b90e2d9"}`,
+		}, {
+			desc:    "missing",
+			path:    "tool_chain",
+			wantErr: true,
+		}, {
+			desc:    "not an object",
+			path:    "revision.major",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := extractField(body, test.path)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("extractField() = %v, want err %t", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("extractField() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	oldPriv, oldPub, err := note.GenerateKey(rand.Reader, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newPub, err := note.GenerateKey(rand.Reader, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(oldPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := note.Sign(&note.Note{Text: "{}\n"}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc        string
+		pubkeys     []string
+		threshold   int
+		wantSigners []string
+		wantErr     bool
+	}{
+		{
+			desc:        "any of several keys",
+			pubkeys:     []string{newPub, oldPub},
+			threshold:   1,
+			wantSigners: []string{fmt.Sprintf("old+%08x", signer.KeyHash())},
+		}, {
+			desc:      "no matching key",
+			pubkeys:   []string{newPub},
+			threshold: 1,
+			wantErr:   true,
+		}, {
+			desc:      "below threshold",
+			pubkeys:   []string{newPub, oldPub},
+			threshold: 2,
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, signers, err := verify(msg, test.pubkeys, test.threshold)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("verify() = %v, want err %t", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.wantSigners, signers); diff != "" {
+				t.Errorf("verify() signers diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestAttachSignature(t *testing.T) {
+	priv, pub, err := note.GenerateKey(rand.Reader, "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := note.NewSigner(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := note.Sign(&note.Note{Text: "{}\n"}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig, _ := strings.Cut(string(msg), "\n\n")
+
+	for _, test := range []struct {
+		desc    string
+		body    string
+		sig     string
+		wantErr bool
+	}{
+		{
+			desc: "detached",
+			body: body + "\n",
+			sig:  sig,
+		}, {
+			desc: "body missing newline",
+			body: body,
+			sig:  sig,
+		}, {
+			desc: "signature with leading blank line and no trailing newline",
+			body: body + "\n",
+			sig:  "\n" + strings.TrimSuffix(sig, "\n"),
+		}, {
+			desc:    "no signatures",
+			body:    body + "\n",
+			sig:     "\n",
+			wantErr: true,
+		}, {
+			desc:    "not a signature",
+			body:    body + "\n",
+			sig:     "{}\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := attachSignature([]byte(test.body), []byte(test.sig))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("attachSignature() = %v, want err %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if _, _, err := verify(got, []string{pub}, 1); err != nil {
+				t.Errorf("verify() of reassembled manifest: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckArtifactHashes(t *testing.T) {
+	imx := sha256.Sum256([]byte("imx"))
+	csf := sha256.Sum256([]byte("csf"))
+	release := api.FirmwareRelease{
+		ArtifactSHA256: map[string][]byte{
+			api.FirmwareArtifactName: imx[:],
+			"armory-drive.csf":       csf[:],
+		},
+	}
+	for _, test := range []struct {
+		desc    string
+		expect  string
+		wantErr bool
+	}{
+		{
+			desc:   "firmware image hex",
+			expect: hex.EncodeToString(imx[:]),
+		}, {
+			desc:   "firmware image base64",
+			expect: base64.StdEncoding.EncodeToString(imx[:]),
+		}, {
+			desc:   "named artifacts",
+			expect: "armory-drive.csf=" + hex.EncodeToString(csf[:]) + ",armory-drive.imx=" + base64.StdEncoding.EncodeToString(imx[:]),
+		}, {
+			desc:    "mismatch",
+			expect:  "armory-drive.csf=" + hex.EncodeToString(imx[:]),
+			wantErr: true,
+		}, {
+			desc:    "missing artifact",
+			expect:  "armory-drive.sig=" + hex.EncodeToString(imx[:]),
+			wantErr: true,
+		}, {
+			desc:    "invalid hash",
+			expect:  "armory-drive.imx=1234",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := checkArtifactHashes(release, test.expect)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("checkArtifactHashes() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCreatedAt(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc      string
+		createdAt time.Time
+		wantErr   bool
+	}{
+		{
+			desc: "not recorded",
+		}, {
+			desc:      "in the past",
+			createdAt: now.Add(-24 * time.Hour),
+		}, {
+			desc:      "within clock skew",
+			createdAt: now.Add(maxClockSkew),
+		}, {
+			desc:      "in the future",
+			createdAt: now.Add(maxClockSkew + time.Second),
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := checkCreatedAt(api.FirmwareRelease{Revision: "v1", CreatedAt: test.createdAt}, now)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("checkCreatedAt() = %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
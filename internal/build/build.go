@@ -0,0 +1,631 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package build reproduces the builds of firmware releases described by
+// FirmwareRelease manifests.
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"github.com/usbarmory/armory-drive-log/keys"
+)
+
+const (
+	gitOwner = "usbarmory"
+	gitRepo  = "armory-drive"
+
+	gitBin  = "/usr/bin/git"
+	makeBin = "/usr/bin/make"
+
+	// minRevLength is the shortest abbreviated commit hash accepted in a release's
+	// REV build arg, the same as git's default abbreviation.
+	minRevLength = 7
+
+	// maxOutputTail is the number of bytes at the end of a command's output which
+	// are kept, to be included in the error if it fails.
+	maxOutputTail = 8 << 10
+)
+
+const (
+	// MakeTargetArg is the key in a FirmwareRelease's BuildArgs which, if present,
+	// names the make target which builds the release.
+	MakeTargetArg = "MAKE_TARGET"
+	// CrossCompileArg is the key in a FirmwareRelease's BuildArgs which, if present,
+	// gives the cross compiler prefix used to build the release.
+	CrossCompileArg = "CROSS_COMPILE"
+
+	// DefaultMakeTarget is the make target used for releases which don't specify one.
+	DefaultMakeTarget = "imx"
+	// DefaultCrossCompile is the cross compiler prefix used for releases which don't
+	// specify one.
+	DefaultCrossCompile = "arm-none-eabi-"
+)
+
+// Builder reproduces the build of a firmware release.
+type Builder interface {
+	// Build builds the release described by r from source, and returns the
+	// SHA256 hashes of the artifacts produced, keyed by artifact name. Only the
+	// artifacts claimed by r need to be included.
+	Build(ctx context.Context, r api.FirmwareRelease) (map[string][]byte, error)
+}
+
+// ArtifactMismatchError is returned by Verify when a reproduced artifact does not
+// match the hash claimed for it by the FirmwareRelease.
+type ArtifactMismatchError struct {
+	Name string
+	Got  []byte
+	Want []byte
+}
+
+func (e ArtifactMismatchError) Error() string {
+	return fmt.Sprintf("%s hash mismatch (got %x, wanted %x)", e.Name, e.Got, e.Want)
+}
+
+// SourceMismatchError is returned by GitBuilder when the checkout of a release's
+// tag is not the commit, or doesn't have the git tree, claimed by the
+// FirmwareRelease, or, if configured WithSourceCheck, when the tarball at its
+// SourceURL doesn't have the claimed SourceSHA256.
+type SourceMismatchError struct {
+	Tag string
+	// Object is what was compared: "commit", "git tree" or "source tarball".
+	Object string
+	Got    string
+	Want   string
+}
+
+func (e SourceMismatchError) Error() string {
+	return fmt.Sprintf("%s mismatch for tag %q (got %q, wanted %q)", e.Object, e.Tag, e.Got, e.Want)
+}
+
+// UnclaimedArtifactError is returned by Verify when an artifact to be checked is
+// not claimed by the FirmwareRelease, so there is no hash to compare it against.
+// Name is empty if the release claims no artifacts at all.
+type UnclaimedArtifactError struct {
+	Name string
+}
+
+func (e UnclaimedArtifactError) Error() string {
+	if e.Name == "" {
+		return "release claims no artifacts"
+	}
+	return fmt.Sprintf("release does not claim %s", e.Name)
+}
+
+// ArtifactResult is the outcome of comparing one reproduced artifact against the
+// hash claimed for it by a FirmwareRelease.
+type ArtifactResult struct {
+	Name string
+	// Got is the hash of the reproduced artifact, or nil if the build didn't
+	// produce it.
+	Got  []byte
+	Want []byte
+}
+
+// Matches returns true if the artifact was reproduced with the claimed hash.
+func (a ArtifactResult) Matches() bool {
+	return a.Got != nil && bytes.Equal(a.Got, a.Want)
+}
+
+// Verify uses the Builder to build the release described by r, and checks that the
+// named artifacts produced match the ones claimed by r. If no names are given, all
+// of the artifacts claimed by r are checked. The name api.FirmwareArtifactName
+// selects the release's firmware image, which may be named for its platform, as
+// returned by r.FirmwareArtifact.
+//
+// If r doesn't claim one of the named artifacts, or claims none at all when no
+// names are given, an UnclaimedArtifactError is returned without building r, so
+// that a release is never reported as reproduced without anything being compared.
+//
+// A result is returned for each artifact checked. If the build succeeds but any of
+// the artifacts differ, the error returned wraps an ArtifactMismatchError for each
+// of them. Artifacts which the build didn't produce are reported as plain errors.
+func Verify(ctx context.Context, b Builder, r api.FirmwareRelease, names ...string) ([]ArtifactResult, error) {
+	if len(names) == 0 {
+		for n := range r.ArtifactSHA256 {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return nil, UnclaimedArtifactError{}
+	}
+	checked := make([]string, 0, len(names))
+	var errs []error
+	for _, n := range names {
+		if n == api.FirmwareArtifactName {
+			n = r.FirmwareArtifact()
+		}
+		if _, ok := r.ArtifactSHA256[n]; !ok {
+			errs = append(errs, UnclaimedArtifactError{Name: n})
+		}
+		checked = append(checked, n)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	built, err := b.Build(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ArtifactResult, 0, len(checked))
+	for _, n := range checked {
+		want := r.ArtifactSHA256[n]
+		res := ArtifactResult{Name: n, Got: built[n], Want: want}
+		switch {
+		case res.Got == nil:
+			errs = append(errs, fmt.Errorf("build did not produce %s", n))
+		case !res.Matches():
+			errs = append(errs, ArtifactMismatchError{Name: n, Got: res.Got, Want: want})
+		}
+		results = append(results, res)
+	}
+	return results, errors.Join(errs...)
+}
+
+// CheckEnvironment confirms that the tools needed by GitBuilder are available, and
+// returns the identifier of the toolchain which will be used to build releases.
+func CheckEnvironment(ctx context.Context) (string, error) {
+	for _, bin := range []string{gitBin, makeBin} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return "", fmt.Errorf("%s not available: %v", bin, err)
+		}
+	}
+	return tamagoToolChain(ctx)
+}
+
+// commandContext returns a command which runs the named program with the given
+// arguments in a new process group. If ctx is done before the command exits, the
+// whole group is interrupted, so that the processes started by programs such as
+// make are stopped too, and is then killed after cancelGracePeriod. If stop is not
+// nil, it is also called when ctx is done, to stop anything the command started
+// outside of its process group.
+func commandContext(ctx context.Context, stop func(), name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		if stop != nil {
+			go stop()
+		}
+		// Processes which ignore the interrupt are killed even if the command
+		// itself exits, as they may still be running in its group.
+		time.AfterFunc(cancelGracePeriod, func() {
+			killProcessGroup(cmd.Process)
+		})
+		return interruptProcessGroup(cmd.Process)
+	}
+	cmd.WaitDelay = cancelGracePeriod
+	return cmd
+}
+
+// cancelGracePeriod is how long a command is given to exit after being interrupted
+// because its context is done, before it and the processes it started are killed.
+var cancelGracePeriod = 10 * time.Second
+
+// containerSeq numbers the containers started by this process, to name them.
+var containerSeq atomic.Uint64
+
+// outputLogger is an io.Writer which logs each line of a command's output at V(2)
+// as it is written, and keeps the last maxOutputTail bytes of it.
+//
+// It is not safe for concurrent use, so the same outputLogger should be used as
+// both the Stdout and Stderr of a command, which exec.Cmd then writes to from a
+// single goroutine.
+type outputLogger struct {
+	name string
+	// line holds the start of the line currently being written.
+	line []byte
+	// buf holds the end of the output, and truncated whether any came before it.
+	buf       []byte
+	truncated bool
+}
+
+func (l *outputLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	if over := len(l.buf) - maxOutputTail; over > 0 {
+		l.buf = l.buf[:copy(l.buf, l.buf[over:])]
+		l.truncated = true
+	}
+
+	l.line = append(l.line, p...)
+	rest := l.line
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(rest[:i])
+		rest = rest[i+1:]
+	}
+	l.line = l.line[:copy(l.line, rest)]
+	// Don't let output without newlines, such as progress bars, grow without bound.
+	if len(l.line) >= maxOutputTail {
+		l.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs any partial line which has been written.
+func (l *outputLogger) flush() {
+	if len(l.line) > 0 {
+		l.log(l.line)
+		l.line = nil
+	}
+}
+
+func (l *outputLogger) log(line []byte) {
+	logging.V(2).Info("Build output", "command", l.name, "line", string(bytes.TrimRight(line, "\r")))
+}
+
+// tail returns the end of the output written, prefixed with "..." if the start of
+// it has been dropped.
+func (l *outputLogger) tail() string {
+	if l.truncated {
+		return "..." + string(l.buf)
+	}
+	return string(l.buf)
+}
+
+// run runs cmd, logging its output at V(2) under the given name as it is produced.
+// If cmd fails, the returned error includes the end of its output.
+func run(cmd *exec.Cmd, name string) error {
+	out := &outputLogger{name: name}
+	cmd.Stdout, cmd.Stderr = out, out
+	err := cmd.Run()
+	out.flush()
+	if err != nil {
+		return fmt.Errorf("%v (%s)", err, out.tail())
+	}
+	return nil
+}
+
+// tamagoToolChain returns the identifier of the tamago toolchain pointed to by the
+// TAMAGO environment variable, in the form used by FirmwareRelease.ToolChain.
+func tamagoToolChain(ctx context.Context) (string, error) {
+	// TODO: support downloading other TAMAGO compiler builds.
+	// For now, this just uses the one version pointed to by the process env.
+	tamagoBin := ""
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "TAMAGO=") {
+			tamagoBin = e[len("TAMAGO="):]
+		}
+	}
+	if len(tamagoBin) == 0 {
+		return "", fmt.Errorf("failed to find TAMAGO in env")
+	}
+	out, err := commandContext(ctx, nil, tamagoBin, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get tamago version: %v (%s)", err, out)
+	}
+	return fmt.Sprintf("tama%s", strings.TrimSpace(string(out))), nil
+}
+
+// GitBuilderOption configures a GitBuilder.
+type GitBuilderOption func(*GitBuilder)
+
+// WithMakeTarget sets the make target used to build releases which don't specify
+// one in their BuildArgs. The default is DefaultMakeTarget.
+func WithMakeTarget(target string) GitBuilderOption {
+	return func(b *GitBuilder) {
+		b.makeTarget = target
+	}
+}
+
+// WithCrossCompile sets the cross compiler prefix used to build releases which don't
+// specify one in their BuildArgs. The default is DefaultCrossCompile.
+func WithCrossCompile(prefix string) GitBuilderOption {
+	return func(b *GitBuilder) {
+		b.crossCompile = prefix
+	}
+}
+
+// WithContainer runs the clone, toolchain check and make for each release inside
+// the given container image, using runtime (e.g. docker or podman) to run it, so
+// that the build environment doesn't depend on the host. The image must provide
+// git, make and a tamago toolchain pointed to by its TAMAGO environment variable,
+// and should be pinned by digest so that every build uses the same environment.
+func WithContainer(runtime, image string) GitBuilderOption {
+	return func(b *GitBuilder) {
+		b.containerRuntime, b.containerImage = runtime, image
+	}
+}
+
+// WithSourceCheck makes the builder fetch the tarball at each release's SourceURL
+// using c, or http.DefaultClient if c is nil, and check that its SHA256 is the
+// SourceSHA256 claimed by the release before building it. GitHub does not serve
+// source tarballs byte-for-byte stably over time, so this may fail for old
+// releases whose source is unchanged, and is off by default. Releases which commit
+// to their source by git tree are always checked against the checkout instead.
+func WithSourceCheck(c *http.Client) GitBuilderOption {
+	return func(b *GitBuilder) {
+		if c == nil {
+			c = http.DefaultClient
+		}
+		b.sourceClient = c
+	}
+}
+
+// NewGitBuilder returns a GitBuilder that will delete any temporary git repositories
+// after use if cleanup is true, or leave them around for further investigation if false.
+func NewGitBuilder(cleanup bool, opts ...GitBuilderOption) *GitBuilder {
+	b := &GitBuilder{
+		cleanup:      cleanup,
+		makeTarget:   DefaultMakeTarget,
+		crossCompile: DefaultCrossCompile,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// GitBuilder checks out the source code referenced by a manifest from GitHub and
+// builds it using the local toolchain, or the one in a container image if
+// configured WithContainer.
+//
+// This has a number of expectations of the environment, such as a working
+// tamago installation, git, and other make tooling.
+type GitBuilder struct {
+	cleanup      bool
+	makeTarget   string
+	crossCompile string
+	// containerRuntime and containerImage, if set, are used to run build commands
+	// in a container rather than on the host.
+	containerRuntime string
+	containerImage   string
+	// sourceClient, if set, is used to fetch and check the source tarball of
+	// each release.
+	sourceClient *http.Client
+}
+
+// command returns a command which runs the named program with the given arguments
+// in dir, either on the host or in the builder's container. The container has dir
+// mounted at the same path, and runs as the current user so that the files it
+// creates can be cleaned up.
+//
+// If ctx is done before the command exits, it is stopped along with the processes
+// it started, as described by commandContext. A container is killed through the
+// container runtime, since it doesn't run in the command's process group, and runs
+// with an init process so that the processes in it are reaped and signalled.
+func (b *GitBuilder) command(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	if b.containerImage == "" {
+		cmd := commandContext(ctx, nil, name, args...)
+		cmd.Dir = dir
+		return cmd
+	}
+	container := fmt.Sprintf("armory-drive-build-%d-%d", os.Getpid(), containerSeq.Add(1))
+	stop := func() {
+		kctx, cancel := context.WithTimeout(context.Background(), cancelGracePeriod)
+		defer cancel()
+		if out, err := exec.CommandContext(kctx, b.containerRuntime, "kill", container).CombinedOutput(); err != nil {
+			logging.Warning("Failed to kill build container", "container", container, "error", err, "output", string(out))
+		}
+	}
+	cArgs := []string{"run", "--rm", "--init",
+		"--name", container,
+		"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"--volume", dir + ":" + dir,
+		"--workdir", dir,
+		b.containerImage, name}
+	return commandContext(ctx, stop, b.containerRuntime, append(cArgs, args...)...)
+}
+
+// CheckEnvironment confirms that the tools needed by the GitBuilder are available,
+// and returns the identifier of the toolchain which will be used to build releases.
+// If the builder uses a container, the toolchain is the one in the container image.
+func (b *GitBuilder) CheckEnvironment(ctx context.Context) (string, error) {
+	if b.containerImage == "" {
+		return CheckEnvironment(ctx)
+	}
+	if _, err := exec.LookPath(b.containerRuntime); err != nil {
+		return "", fmt.Errorf("%s not available: %v", b.containerRuntime, err)
+	}
+	dir, err := os.MkdirTemp("", "armory-verify")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	return b.toolChain(ctx, dir)
+}
+
+// toolChain returns the identifier of the toolchain used by the builder, in the
+// form used by FirmwareRelease.ToolChain. dir is mounted into the container, if
+// the builder uses one.
+func (b *GitBuilder) toolChain(ctx context.Context, dir string) (string, error) {
+	if b.containerImage == "" {
+		return tamagoToolChain(ctx)
+	}
+	out, err := b.command(ctx, dir, "/bin/sh", "-c", `"$TAMAGO" version`).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get tamago version in container %q: %v (%s)", b.containerImage, err, out)
+	}
+	return fmt.Sprintf("tama%s", strings.TrimSpace(string(out))), nil
+}
+
+// makeArgs returns the arguments to make which build the release, taking the make
+// target and cross compiler from the release's BuildArgs if it specifies them.
+func (b *GitBuilder) makeArgs(r api.FirmwareRelease) ([]string, error) {
+	target, cc := b.makeTarget, b.crossCompile
+	if t, ok := r.BuildArgs[MakeTargetArg]; ok {
+		target = t
+	}
+	if c, ok := r.BuildArgs[CrossCompileArg]; ok {
+		cc = c
+	}
+	// These come from the manifest, so make sure they can't smuggle in other
+	// arguments to make.
+	if target == "" || strings.HasPrefix(target, "-") || strings.ContainsAny(target, "= \t\n") {
+		return nil, fmt.Errorf("invalid make target %q", target)
+	}
+	if strings.ContainsAny(cc, " \t\n") {
+		return nil, fmt.Errorf("invalid cross compiler prefix %q", cc)
+	}
+	return []string{"CROSS_COMPILE=" + cc, target}, nil
+}
+
+// checkSource fetches the tarball at the release's SourceURL and checks that it
+// matches the SourceSHA256 signed in the release. Releases which commit to their
+// source by git tree instead are checked against the checkout by checkCheckout.
+func (b *GitBuilder) checkSource(ctx context.Context, r api.FirmwareRelease) error {
+	if len(r.SourceSHA256) == 0 {
+		return nil
+	}
+	if r.SourceURL == "" {
+		return errors.New("release has a SourceSHA256 but no SourceURL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.SourceURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %q: %v", r.SourceURL, err)
+	}
+	resp, err := b.sourceClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %q: %v", r.SourceURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got non-200 HTTP status when fetching %q: %s", r.SourceURL, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return fmt.Errorf("failed to read %q: %v", r.SourceURL, err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, r.SourceSHA256) {
+		return SourceMismatchError{Tag: r.Revision, Object: "source tarball", Got: fmt.Sprintf("%x", got), Want: fmt.Sprintf("%x", r.SourceSHA256)}
+	}
+	logging.V(1).Info("Source tarball verified", "url", r.SourceURL, "revision", r.Revision)
+	return nil
+}
+
+// checkCheckout checks that the repository checked out in repoRoot is the commit
+// the release claims to be built from, and, if the release commits to its source
+// by git tree, that the tree matches.
+func (b *GitBuilder) checkCheckout(ctx context.Context, repoRoot string, r api.FirmwareRelease) error {
+	out, err := b.command(ctx, repoRoot, gitBin, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD revision: %v (%s)", err, out)
+	}
+	// Releases record the commit as git abbreviates it, so compare the prefix
+	// rather than asking git for an abbreviation which may be a different length.
+	got, want := strings.TrimSpace(string(out)), r.BuildArgs["REV"]
+	if len(want) < minRevLength || !strings.HasPrefix(got, want) {
+		return SourceMismatchError{Tag: r.Revision, Object: "commit", Got: got, Want: want}
+	}
+	if r.SourceGitTree == "" {
+		return nil
+	}
+	out, err = b.command(ctx, repoRoot, gitBin, "rev-parse", "HEAD^{tree}").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD tree: %v (%s)", err, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), r.SourceGitTree; got != want {
+		return SourceMismatchError{Tag: r.Revision, Object: "git tree", Got: got, Want: want}
+	}
+	return nil
+}
+
+// Build checks out the code at the release tag, checks that it is the source the
+// release commits to, and runs the make file. If configured WithSourceCheck, the
+// release's source tarball is checked first.
+func (b *GitBuilder) Build(ctx context.Context, r api.FirmwareRelease) (map[string][]byte, error) {
+	if b.sourceClient != nil {
+		if err := b.checkSource(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create temporary directory that will be cleaned up after this method returns
+	dir, err := os.MkdirTemp("", "armory-verify")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	if b.cleanup {
+		defer os.RemoveAll(dir)
+	} else {
+		logging.Infof("Cleanup disabled: %q will not be deleted after use", dir)
+	}
+
+	logging.V(1).Infof("Cloning repo into %q", dir)
+	// Clone the repository at the release tag
+	cmd := b.command(ctx, dir, gitBin, "clone", fmt.Sprintf("https://github.com/%s/%s", gitOwner, gitRepo), "-b", r.Revision)
+	if err := run(cmd, "git clone"); err != nil {
+		return nil, fmt.Errorf("failed to clone: %v", err)
+	}
+
+	repoRoot := filepath.Join(dir, gitRepo)
+	if err := b.checkCheckout(ctx, repoRoot, r); err != nil {
+		return nil, err
+	}
+
+	tc, err := b.toolChain(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	if got, want := tc, r.ToolChain; got != want {
+		return nil, fmt.Errorf("expected toolchain %q but got %q for tag %q", want, got, r.Revision)
+	}
+
+	// Copy the public keys into place
+	otaDir := filepath.Join(repoRoot, "internal", "ota")
+	if err := os.WriteFile(filepath.Join(otaDir, "armory-drive-log.pub"), []byte(keys.ArmoryDriveLogPub), 0666); err != nil {
+		return nil, fmt.Errorf("failed to write key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(otaDir, "armory-drive.pub"), []byte(keys.ArmoryDrivePub), 0666); err != nil {
+		return nil, fmt.Errorf("failed to write key: %v", err)
+	}
+
+	args, err := b.makeArgs(r)
+	if err != nil {
+		return nil, err
+	}
+	logging.V(1).Infof("Running make %s in %s", strings.Join(args, " "), repoRoot)
+	cmd = b.command(ctx, repoRoot, makeBin, args...)
+	if err := run(cmd, "make"); err != nil {
+		return nil, fmt.Errorf("failed to make: %v", err)
+	}
+
+	// Hash each of the artifacts claimed by the release which the build produced.
+	hashes := make(map[string][]byte)
+	for name := range r.ArtifactSHA256 {
+		if filepath.Base(name) != name {
+			logging.Warning("Ignoring artifact: not a file name", "artifact", name, "revision", r.Revision)
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(repoRoot, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		h := sha256.Sum256(data)
+		hashes[name] = h[:]
+	}
+	return hashes, nil
+}
@@ -0,0 +1,392 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+)
+
+func TestMakeArgs(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		opts      []GitBuilderOption
+		buildArgs map[string]string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			desc: "defaults",
+			want: []string{"CROSS_COMPILE=arm-none-eabi-", "imx"},
+		}, {
+			desc: "flags",
+			opts: []GitBuilderOption{WithMakeTarget("imx_signed"), WithCrossCompile("arm-linux-gnueabi-")},
+			want: []string{"CROSS_COMPILE=arm-linux-gnueabi-", "imx_signed"},
+		}, {
+			desc:      "build args override flags",
+			opts:      []GitBuilderOption{WithMakeTarget("imx_signed")},
+			buildArgs: map[string]string{"REV": "b90e2d9", MakeTargetArg: "elf", CrossCompileArg: ""},
+			want:      []string{"CROSS_COMPILE=", "elf"},
+		}, {
+			desc:      "target is a flag",
+			buildArgs: map[string]string{MakeTargetArg: "--eval=foo"},
+			wantErr:   true,
+		}, {
+			desc:      "target is a variable",
+			buildArgs: map[string]string{MakeTargetArg: "SHELL=/bin/evil"},
+			wantErr:   true,
+		}, {
+			desc:      "cross compiler with spaces",
+			buildArgs: map[string]string{CrossCompileArg: "arm- imx"},
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			b := NewGitBuilder(true, test.opts...)
+			got, err := b.makeArgs(api.FirmwareRelease{BuildArgs: test.buildArgs})
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("makeArgs() = %v, want err %t", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("makeArgs() diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	tarball := []byte("source tarball")
+	h := sha256.Sum256(tarball)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.tar.gz":
+			_, _ = w.Write(tarball)
+		case "/changed.tar.gz":
+			_, _ = w.Write([]byte("different source tarball"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	b := NewGitBuilder(true, WithSourceCheck(srv.Client()))
+
+	for _, test := range []struct {
+		desc         string
+		r            api.FirmwareRelease
+		wantErr      bool
+		wantMismatch bool
+	}{
+		{
+			desc: "matches",
+			r:    api.FirmwareRelease{SourceURL: srv.URL + "/v1.tar.gz", SourceSHA256: h[:]},
+		}, {
+			desc: "git tree release",
+			r:    api.FirmwareRelease{SourceURL: srv.URL + "/missing.tar.gz", SourceGitTree: "abcdef"},
+		}, {
+			desc:         "mismatch",
+			r:            api.FirmwareRelease{SourceURL: srv.URL + "/changed.tar.gz", SourceSHA256: h[:]},
+			wantErr:      true,
+			wantMismatch: true,
+		}, {
+			desc:    "missing tarball",
+			r:       api.FirmwareRelease{SourceURL: srv.URL + "/missing.tar.gz", SourceSHA256: h[:]},
+			wantErr: true,
+		}, {
+			desc:    "no source URL",
+			r:       api.FirmwareRelease{SourceSHA256: h[:]},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := b.checkSource(context.Background(), test.r)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("checkSource: %v, wantErr %t", err, test.wantErr)
+			}
+			var mErr SourceMismatchError
+			if got := errors.As(err, &mErr); got != test.wantMismatch {
+				t.Errorf("checkSource: %v, want SourceMismatchError %t", err, test.wantMismatch)
+			} else if got && mErr.Object != "source tarball" {
+				t.Errorf("checkSource: got %s mismatch, want source tarball", mErr.Object)
+			}
+		})
+	}
+}
+
+func TestCheckCheckout(t *testing.T) {
+	if _, err := os.Stat(gitBin); err != nil {
+		t.Skipf("git not available: %v", err)
+	}
+	ctx := context.Background()
+	b := NewGitBuilder(true)
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := b.command(ctx, dir, gitBin, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v (%s)", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "main.go")
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "release")
+	commit, tree := git("rev-parse", "HEAD"), git("rev-parse", "HEAD^{tree}")
+
+	for _, test := range []struct {
+		desc         string
+		rev          string
+		tree         string
+		wantMismatch string
+	}{
+		{
+			desc: "abbreviated commit",
+			rev:  commit[:minRevLength],
+		}, {
+			desc: "full commit and tree",
+			rev:  commit,
+			tree: tree,
+		}, {
+			desc:         "wrong commit",
+			rev:          "0000000",
+			wantMismatch: "commit",
+		}, {
+			desc:         "commit too short",
+			rev:          commit[:4],
+			wantMismatch: "commit",
+		}, {
+			desc:         "no commit",
+			wantMismatch: "commit",
+		}, {
+			desc:         "wrong tree",
+			rev:          commit,
+			tree:         strings.Repeat("0", len(tree)),
+			wantMismatch: "git tree",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			r := api.FirmwareRelease{
+				Revision:      "v1",
+				BuildArgs:     map[string]string{"REV": test.rev},
+				SourceGitTree: test.tree,
+			}
+			err := b.checkCheckout(ctx, dir, r)
+			var mErr SourceMismatchError
+			if errors.As(err, &mErr) {
+				if mErr.Object != test.wantMismatch {
+					t.Errorf("checkCheckout: got %s mismatch, want %q", mErr.Object, test.wantMismatch)
+				}
+			} else if err != nil || test.wantMismatch != "" {
+				t.Errorf("checkCheckout: %v, want %s mismatch", err, test.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestCommand(t *testing.T) {
+	user := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	for _, test := range []struct {
+		desc     string
+		opts     []GitBuilderOption
+		wantArgs []string
+		wantDir  string
+	}{
+		{
+			desc:     "host",
+			wantArgs: []string{makeBin, "imx"},
+			wantDir:  "/tmp/src",
+		}, {
+			desc:     "container",
+			opts:     []GitBuilderOption{WithContainer("podman", "example.com/tamago@sha256:abcd")},
+			wantArgs: []string{"podman", "run", "--rm", "--init", "--name", "armory-drive-build", "--user", user, "--volume", "/tmp/src:/tmp/src", "--workdir", "/tmp/src", "example.com/tamago@sha256:abcd", makeBin, "imx"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			cmd := NewGitBuilder(true, test.opts...).command(context.Background(), "/tmp/src", makeBin, "imx")
+			args := slices.Clone(cmd.Args)
+			// Container names are unique to each command, so only check their prefix.
+			if i := slices.Index(args, "--name"); i >= 0 && i+1 < len(args) {
+				if !strings.HasPrefix(args[i+1], "armory-drive-build-") {
+					t.Errorf("command() got container name %q, want armory-drive-build- prefix", args[i+1])
+				}
+				args[i+1] = "armory-drive-build"
+			}
+			if diff := cmp.Diff(test.wantArgs, args); diff != "" {
+				t.Errorf("command() got unexpected args, diff: %s", diff)
+			}
+			if cmd.Dir != test.wantDir {
+				t.Errorf("command() got dir %q, want %q", cmd.Dir, test.wantDir)
+			}
+		})
+	}
+}
+
+func TestCommandContextCancelled(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skipf("sleep not available: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := NewGitBuilder(true).command(ctx, t.TempDir(), sleep, "60").Run(); err == nil {
+		t.Error("Run() succeeded after context was done, want error")
+	}
+	if d := time.Since(start); d > cancelGracePeriod {
+		t.Errorf("Run() took %v after context was done, want less than %v", d, cancelGracePeriod)
+	}
+}
+
+func TestRunOutputTail(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		script   string
+		wantErr  bool
+		wantTail string
+	}{
+		{
+			desc:   "success",
+			script: "echo built",
+		}, {
+			desc:     "failure",
+			script:   "echo building; echo broken >&2; exit 2",
+			wantErr:  true,
+			wantTail: "building\nbroken\n",
+		}, {
+			desc:     "long output truncated",
+			script:   fmt.Sprintf("head -c %d /dev/zero | tr '\\0' a; echo; echo broken; exit 1", 2*maxOutputTail),
+			wantErr:  true,
+			wantTail: "..." + strings.Repeat("a", maxOutputTail-len("\nbroken\n")) + "\nbroken\n",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := run(exec.Command("/bin/sh", "-c", test.script), "sh")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("run() = %v, want error %t", err, test.wantErr)
+			}
+			if err != nil && !strings.HasSuffix(err.Error(), "("+test.wantTail+")") {
+				t.Errorf("run() = %.100q..., want error ending with output %.100q...", err, test.wantTail)
+			}
+		})
+	}
+}
+
+func TestOutputLoggerLines(t *testing.T) {
+	l := &outputLogger{name: "make"}
+	for _, p := range []string{"first ", "line\nsecond", " line\n", strings.Repeat("x", 2*maxOutputTail)} {
+		if _, err := l.Write([]byte(p)); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+	}
+	if got := len(l.line); got != 0 {
+		t.Errorf("outputLogger kept %d bytes of an unterminated line, want it flushed", got)
+	}
+	if got := len(l.buf); got != maxOutputTail {
+		t.Errorf("outputLogger kept %d bytes of output, want %d", got, maxOutputTail)
+	}
+}
+
+// fakeBuilder is a Builder which returns fixed artifact hashes.
+type fakeBuilder map[string][]byte
+
+func (f fakeBuilder) Build(context.Context, api.FirmwareRelease) (map[string][]byte, error) {
+	return f, nil
+}
+
+func TestVerifyUnclaimedArtifact(t *testing.T) {
+	built := fakeBuilder{"armory-drive.imx": []byte("imx")}
+	for _, test := range []struct {
+		desc     string
+		claimed  map[string][]byte
+		names    []string
+		wantName string
+	}{
+		{
+			desc:     "named artifact not claimed",
+			claimed:  map[string][]byte{"armory-drive.imx": []byte("imx")},
+			names:    []string{"armory-drive.imx", "armory-drive.csf"},
+			wantName: "armory-drive.csf",
+		}, {
+			desc:     "firmware not claimed",
+			claimed:  map[string][]byte{"armory-drive.csf": []byte("csf")},
+			names:    []string{api.FirmwareArtifactName},
+			wantName: "armory-drive-mk2.imx",
+		}, {
+			desc: "nothing claimed",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			r := api.FirmwareRelease{PlatformID: "mk2", ArtifactSHA256: test.claimed}
+			_, err := Verify(context.Background(), built, r, test.names...)
+			var uErr UnclaimedArtifactError
+			if !errors.As(err, &uErr) || uErr.Name != test.wantName {
+				t.Errorf("Verify: %v, want UnclaimedArtifactError for %q", err, test.wantName)
+			}
+		})
+	}
+}
+
+func TestVerifyPlatformArtifact(t *testing.T) {
+	r := api.FirmwareRelease{
+		PlatformID: "mk2",
+		ArtifactSHA256: map[string][]byte{
+			"armory-drive-mk2.imx":       []byte("mk2"),
+			"armory-drive-usbarmory.imx": []byte("usbarmory"),
+		},
+	}
+	for _, test := range []struct {
+		desc     string
+		built    fakeBuilder
+		wantName string
+		wantErr  bool
+	}{
+		{
+			desc:     "reproduced",
+			built:    fakeBuilder{"armory-drive-mk2.imx": []byte("mk2")},
+			wantName: "armory-drive-mk2.imx",
+		}, {
+			desc:     "mismatch",
+			built:    fakeBuilder{"armory-drive-mk2.imx": []byte("evil")},
+			wantName: "armory-drive-mk2.imx",
+			wantErr:  true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			results, err := Verify(context.Background(), test.built, r, api.FirmwareArtifactName)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Verify: %v, wantErr %t", err, test.wantErr)
+			}
+			if len(results) != 1 || results[0].Name != test.wantName {
+				t.Errorf("Verify: got results %v, want one for %q", results, test.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processRunning returns true if the process with the given pid exists and is not
+// a zombie waiting to be reaped.
+func processRunning(t *testing.T, pid int) bool {
+	t.Helper()
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("Failed to read process status: %v", err)
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestCommandContextKillsProcessGroup(t *testing.T) {
+	defer func(d time.Duration) { cancelGracePeriod = d }(cancelGracePeriod)
+	cancelGracePeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A non-interactive shell runs background jobs ignoring SIGINT, so the
+	// grandchild outlives the interrupt and must be killed with the group.
+	cmd := NewGitBuilder(true).command(ctx, t.TempDir(), "/bin/sh", "-c", "sleep 60 & echo $!; wait")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe(): %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read grandchild pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("Failed to parse grandchild pid %q: %v", line, err)
+	}
+	if !processRunning(t, pid) {
+		t.Fatalf("Grandchild %d not running before cancel", pid)
+	}
+
+	cancel()
+	if err := cmd.Wait(); err == nil {
+		t.Error("Wait() succeeded after context was cancelled, want error")
+	}
+	for deadline := time.Now().Add(5 * time.Second); processRunning(t, pid); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Grandchild %d still running after context was cancelled", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package build
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing on platforms without process groups, where only
+// the command itself can be signalled.
+func setProcessGroup(*exec.Cmd) {}
+
+// interruptProcessGroup interrupts p.
+func interruptProcessGroup(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
+
+// killProcessGroup kills p.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+)
+
+// WithCache serves resources fetched from the log, other than the checkpoint,
+// from c when possible, and adds those which aren't there to it. c must have been
+// created for the same log root as the Fetcher.
+func WithCache(c *Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// Cache is a disk cache of the immutable resources of a single log.
+//
+// The serverless log layout never changes the contents at a path once written:
+// tiles which are still filling up are written under a path which includes their
+// size. Only the checkpoint is updated in place, so it is never cached.
+//
+// Resources fetched from the log are held in memory until Commit is called, which
+// should only be done once they have been verified against a checkpoint. This way
+// a corrupt or malicious response is never persisted to be served on every later
+// run, and is fetched again once it has been dropped by Discard.
+type Cache struct {
+	dir string
+
+	mu sync.Mutex
+	// pending holds the resources fetched since the last Commit or Discard,
+	// keyed by their file name in the cache.
+	pending map[string][]byte
+}
+
+// NewCache returns a cache for the log at root, creating its directory under dir
+// if necessary. The cache is split by log root, so dir may be shared between logs.
+func NewCache(dir string, root *url.URL) (*Cache, error) {
+	d := filepath.Join(dir, url.PathEscape(root.String()))
+	if err := os.MkdirAll(d, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	return &Cache{dir: d, pending: make(map[string][]byte)}, nil
+}
+
+// Commit writes the resources fetched since the last Commit or Discard to disk.
+// Failing to write to the cache is logged, but is otherwise ignored. It does
+// nothing if c is nil.
+func (c *Cache) Commit() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, b := range c.pending {
+		if err := writeCacheFile(name, b); err != nil {
+			logging.Warning("Failed to write to cache", "path", name, "error", err)
+		}
+	}
+	clear(c.pending)
+}
+
+// Discard drops the resources fetched since the last Commit or Discard, so that
+// they are fetched again if needed. It does nothing if c is nil.
+func (c *Cache) Discard() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.pending)
+}
+
+// fetcher returns a Fetcher which serves cacheable paths from the cache when
+// possible, and otherwise fetches them with f and holds them until Commit.
+// Failing to read the cache is logged, but does not fail the fetch.
+func (c *Cache) fetcher(f client.Fetcher) client.Fetcher {
+	return func(ctx context.Context, p string) ([]byte, error) {
+		name := filepath.FromSlash(p)
+		if p == layout.CheckpointPath || !filepath.IsLocal(name) {
+			return f(ctx, p)
+		}
+		name = filepath.Join(c.dir, name)
+		c.mu.Lock()
+		b, ok := c.pending[name]
+		c.mu.Unlock()
+		if ok {
+			return b, nil
+		}
+		b, err := os.ReadFile(name)
+		if err == nil {
+			return b, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			logging.Warning("Failed to read from cache", "path", p, "error", err)
+		}
+
+		b, err = f(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.pending[name] = b
+		c.mu.Unlock()
+		return b, nil
+	}
+}
+
+// writeCacheFile writes data to the named file via a temporary file, so that
+// concurrent readers never see a partially written file.
+func writeCacheFile(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Once renamed, the temporary file no longer exists and this is a no-op.
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
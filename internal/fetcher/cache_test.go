@@ -0,0 +1,108 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestFetcherCache(t *testing.T) {
+	calls := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		if r.URL.Path == "/log/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer s.Close()
+
+	dir := t.TempDir()
+	newFetcher := func(root string) (func(string) ([]byte, error), *Cache) {
+		t.Helper()
+		u, err := url.Parse(s.URL + root)
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %v", err)
+		}
+		c, err := NewCache(dir, u)
+		if err != nil {
+			t.Fatalf("NewCache: %v", err)
+		}
+		f, err := New(u, WithCache(c))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return func(p string) ([]byte, error) { return f(context.Background(), p) }, c
+	}
+	// The server responds with the path requested, so cached responses can be
+	// checked too.
+	fetch := func(f func(string) ([]byte, error), root, p string) {
+		t.Helper()
+		got, err := f(p)
+		if err != nil {
+			t.Fatalf("Fetch %q: %v", p, err)
+		}
+		if want := root + p; string(got) != want {
+			t.Errorf("Fetch %q: got %q, want %q", p, got, want)
+		}
+	}
+
+	f, c := newFetcher("/log/")
+	for i := 0; i < 2; i++ {
+		fetch(f, "/log/", "checkpoint")
+		fetch(f, "/log/", "tile/00/0000/00")
+		fetch(f, "/log/", "seq/00/00/00/00/00")
+		if _, err := f("missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Got err %v, want %v", err, os.ErrNotExist)
+		}
+	}
+	// Nothing is written to disk until it is committed.
+	other, _ := newFetcher("/log/")
+	fetch(other, "/log/", "seq/00/00/00/00/00")
+	c.Commit()
+	// A new fetcher for the same log shares the committed cache, but one for a
+	// different log does not.
+	shared, _ := newFetcher("/log/")
+	fetch(shared, "/log/", "tile/00/0000/00")
+	unshared, _ := newFetcher("/other/")
+	fetch(unshared, "/other/", "tile/00/0000/00")
+
+	// Discarded resources are fetched again.
+	fetch(f, "/log/", "tile/00/0000/01")
+	c.Discard()
+	fetch(f, "/log/", "tile/00/0000/01")
+	c.Commit()
+	fetch(f, "/log/", "tile/00/0000/01")
+
+	for p, want := range map[string]int{
+		"/log/checkpoint":         2,
+		"/log/tile/00/0000/00":    1,
+		"/log/tile/00/0000/01":    2,
+		"/log/seq/00/00/00/00/00": 2,
+		"/log/missing":            2,
+		"/other/tile/00/0000/00":  1,
+	} {
+		if got := calls[p]; got != want {
+			t.Errorf("Got %d requests for %q, want %d", got, p, want)
+		}
+	}
+}
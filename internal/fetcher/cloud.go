@@ -0,0 +1,122 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bucketObject splits a URL of the form <scheme>://<bucket>/<object> into its
+// bucket and object names.
+func bucketObject(u *url.URL) (string, string, error) {
+	if u.Host == "" {
+		return "", "", fmt.Errorf("no bucket specified in %q", u)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// newGCSGet returns a getFunc which reads objects from GCS. Unless the options
+// provide a client, one is created on first use with the ambient credentials
+// available to the process, so that commands which never read from cloud storage
+// don't need any credentials configured.
+func newGCSGet(o options) getFunc {
+	var once sync.Once
+	c, cErr := o.gcsClient, error(nil)
+	return rateLimited(o.limiter, func(ctx context.Context, u *url.URL) ([]byte, error) {
+		once.Do(func() {
+			if c == nil {
+				// The client outlives any single request, so it mustn't use ctx.
+				c, cErr = storage.NewClient(context.Background())
+			}
+		})
+		if cErr != nil {
+			return nil, fmt.Errorf("failed to create GCS client: %v", cErr)
+		}
+		return readGCS(ctx, c, u)
+	})
+}
+
+// readGCS reads the object at the given gs:// URL using c.
+func readGCS(ctx context.Context, c *storage.Client, u *url.URL) ([]byte, error) {
+	bucket, object, err := bucketObject(u)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// newS3Get returns a getFunc which reads objects from S3. Unless the options
+// provide a client, one is created on first use with the ambient credentials
+// available to the process, as for GCS.
+func newS3Get(o options) getFunc {
+	var once sync.Once
+	c, cErr := o.s3Client, error(nil)
+	return rateLimited(o.limiter, func(ctx context.Context, u *url.URL) ([]byte, error) {
+		once.Do(func() {
+			if c == nil {
+				var cfg aws.Config
+				if cfg, cErr = config.LoadDefaultConfig(context.Background()); cErr == nil {
+					c = s3.NewFromConfig(cfg)
+				}
+			}
+		})
+		if cErr != nil {
+			return nil, fmt.Errorf("failed to create S3 client: %v", cErr)
+		}
+		return readS3(ctx, c, u)
+	})
+}
+
+// readS3 reads the object at the given s3:// URL using c.
+func readS3(ctx context.Context, c *s3.Client, u *url.URL) ([]byte, error) {
+	bucket, object, err := bucketObject(u)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(object),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/option"
+)
+
+func TestBucketObject(t *testing.T) {
+	for _, test := range []struct {
+		url        string
+		wantBucket string
+		wantObject string
+		wantErr    bool
+	}{
+		{url: "gs://bucket/log/checkpoint", wantBucket: "bucket", wantObject: "log/checkpoint"},
+		{url: "s3://bucket/checkpoint", wantBucket: "bucket", wantObject: "checkpoint"},
+		{url: "gs:///log/checkpoint", wantErr: true},
+	} {
+		t.Run(test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+			bucket, object, err := bucketObject(u)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("bucketObject: %v, wantErr %t", err, test.wantErr)
+			}
+			if bucket != test.wantBucket || object != test.wantObject {
+				t.Errorf("bucketObject: got %q, %q, want %q, %q", bucket, object, test.wantBucket, test.wantObject)
+			}
+		})
+	}
+}
+
+func TestFetcherCloud(t *testing.T) {
+	// Both GCS and S3 clients can be configured to fetch objects with path-style
+	// requests for /<bucket>/<object> from this server.
+	objects := map[string]string{"/bucket/log/checkpoint": "checkpoint"}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			// S3 only reports a missing object as such with an error document.
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		_, _ = w.Write([]byte(o))
+	}))
+	defer s.Close()
+
+	gcs, err := storage.NewClient(context.Background(), option.WithEndpoint(s.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Failed to create GCS client: %v", err)
+	}
+	defer gcs.Close()
+	s3c := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(s.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	for _, scheme := range []string{"gs", "s3"} {
+		for _, test := range []struct {
+			desc     string
+			root     string
+			path     string
+			want     string
+			wantErr  bool
+			notExist bool
+		}{
+			{
+				desc: "found",
+				root: "//bucket/log/",
+				path: "checkpoint",
+				want: "checkpoint",
+			}, {
+				desc:     "not found",
+				root:     "//bucket/log/",
+				path:     "tile/0/000",
+				wantErr:  true,
+				notExist: true,
+			}, {
+				desc:    "no bucket",
+				root:    "///log/",
+				path:    "checkpoint",
+				wantErr: true,
+			},
+		} {
+			t.Run(scheme+" "+test.desc, func(t *testing.T) {
+				root, err := url.Parse(scheme + ":" + test.root)
+				if err != nil {
+					t.Fatalf("Failed to parse URL: %v", err)
+				}
+				f, err := New(root, WithGCSClient(gcs), WithS3Client(s3c))
+				if err != nil {
+					t.Fatalf("New: %v", err)
+				}
+				got, err := f(context.Background(), test.path)
+				if gotErr := err != nil; gotErr != test.wantErr {
+					t.Fatalf("Fetch: %v, wantErr %t", err, test.wantErr)
+				}
+				if notExist := errors.Is(err, os.ErrNotExist); notExist != test.notExist {
+					t.Errorf("Fetch: got %v, want os.ErrNotExist %t", err, test.notExist)
+				}
+				if string(got) != test.want {
+					t.Errorf("Fetch: got %q, want %q", got, test.want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fetcher provides the client.Fetcher implementations used by the
+// commands in this repo to read data from the log.
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/time/rate"
+)
+
+// DefaultMaxRetryAfter is how long a Fetcher is prepared to wait, by default, when
+// a server asks it to back off before retrying a request. This covers GitHub's
+// primary rate limit, which resets hourly.
+const DefaultMaxRetryAfter = time.Hour
+
+type options struct {
+	httpClient     *http.Client
+	proxy          string
+	limiter        *rate.Limiter
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration
+	cache          *Cache
+	gcsClient      *storage.Client
+	s3Client       *s3.Client
+}
+
+// Option configures the behaviour of Fetchers created by New.
+type Option func(*options)
+
+// WithRetries configures the number of times a failed HTTP request will be retried,
+// and the bounds of the exponential backoff applied between attempts.
+//
+// Only transient failures are retried: network errors, 429s, 5xx responses, and
+// 403s which the server marks as the result of rate limiting.
+// A 404 is always considered to be a definitive answer.
+func WithRetries(maxRetries int, initialBackoff, maxBackoff time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = maxRetries
+		o.initialBackoff = initialBackoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithMaxRetryAfter sets how long the Fetcher is prepared to wait when a server
+// asks it to back off before retrying a request, with Retry-After or a rate limit
+// reset time. Requests which the server asks to be delayed for longer fail
+// immediately. The default is DefaultMaxRetryAfter.
+func WithMaxRetryAfter(d time.Duration) Option {
+	return func(o *options) {
+		o.maxRetryAfter = d
+	}
+}
+
+// WithHTTPClient configures the HTTP client used to make requests to the log.
+//
+// This allows callers to configure timeouts and custom transports; by default
+// a client with conservative timeouts is used.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithGCSClient configures the client used to read logs at gs:// URLs, in place of
+// one using the ambient credentials available to the process.
+func WithGCSClient(c *storage.Client) Option {
+	return func(o *options) {
+		o.gcsClient = c
+	}
+}
+
+// WithS3Client configures the client used to read logs at s3:// URLs, in place of
+// one using the ambient credentials available to the process.
+func WithS3Client(c *s3.Client) Option {
+	return func(o *options) {
+		o.s3Client = c
+	}
+}
+
+// WithProxy sets the proxy through which HTTP(S) requests to the log are sent,
+// overriding the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables which
+// are otherwise honoured. It has no effect if WithHTTPClient is also used.
+func WithProxy(proxy string) Option {
+	return func(o *options) {
+		o.proxy = proxy
+	}
+}
+
+// WithRateLimit limits the rate at which requests are made to the log to at most
+// rps requests per second, across all callers of the Fetcher.
+// Callers waiting for permission to make a request will give up if their context
+// is cancelled.
+func WithRateLimit(rps float64) Option {
+	return func(o *options) {
+		o.limiter = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+}
+
+// HTTPClient returns an HTTP client which won't wait forever on a connection which
+// has stopped responding. This is the client used by Fetchers by default, and is
+// exported so that other HTTP requests made by the commands behave the same way.
+//
+// Requests are sent through the given proxy URL if it is non-empty, and otherwise
+// through the proxy specified by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, if any.
+func HTTPClient(proxy string) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if len(proxy) > 0 {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	t.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{
+		Transport: t,
+		Timeout:   2 * time.Minute,
+	}, nil
+}
+
+// New creates a Fetcher for the log at the given root location.
+//
+// Supported URL schemes are http, https, file, gs (Google Cloud Storage), and s3
+// (Amazon S3). The cloud storage schemes take the form <scheme>://<bucket>/<prefix>/
+// and use the ambient credentials for the respective cloud.
+//
+// Regardless of the URL scheme, resources which are not present in the log are
+// reported as os.ErrNotExist.
+func New(root *url.URL, opts ...Option) (client.Fetcher, error) {
+	newGet := getByScheme[root.Scheme]
+	if newGet == nil {
+		return nil, fmt.Errorf("unsupported URL scheme %s", root.Scheme)
+	}
+	o := options{
+		maxRetries:     3,
+		initialBackoff: time.Second,
+		maxBackoff:     30 * time.Second,
+		maxRetryAfter:  DefaultMaxRetryAfter,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.httpClient == nil {
+		c, err := HTTPClient(o.proxy)
+		if err != nil {
+			return nil, err
+		}
+		o.httpClient = c
+	}
+	get := newGet(o)
+
+	var f client.Fetcher = func(ctx context.Context, p string) ([]byte, error) {
+		u, err := root.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		return get(ctx, u)
+	}
+	if o.cache != nil {
+		f = o.cache.fetcher(f)
+	}
+	return f, nil
+}
+
+type getFunc func(context.Context, *url.URL) ([]byte, error)
+
+var getByScheme = map[string]func(options) getFunc{
+	"http":  newHTTPGet,
+	"https": newHTTPGet,
+	"file":  func(o options) getFunc { return rateLimited(o.limiter, readFile) },
+	"gs":    newGCSGet,
+	"s3":    newS3Get,
+}
+
+// rateLimited returns a getFunc which waits for permission from the limiter
+// before every call to get. If l is nil, get is returned unchanged.
+func rateLimited(l *rate.Limiter, get getFunc) getFunc {
+	if l == nil {
+		return get
+	}
+	return func(ctx context.Context, u *url.URL) ([]byte, error) {
+		if err := l.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return get(ctx, u)
+	}
+}
+
+// retryableError is returned by readHTTPOnce for failures which may succeed if
+// the request is retried.
+type retryableError struct {
+	err error
+	// after is the delay requested by the server before retrying, if any.
+	after time.Duration
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+// ErrRateLimited is returned when a server has refused a request because the
+// client has exhausted its request quota, as GitHub does with a 403 response
+// carrying X-RateLimit-Remaining: 0.
+type ErrRateLimited struct {
+	// Reset is when the server will accept requests again, or the zero time if
+	// it didn't say.
+	Reset time.Time
+}
+
+func (e ErrRateLimited) Error() string {
+	if e.Reset.IsZero() {
+		return "rate limited by server"
+	}
+	return fmt.Sprintf("rate limited by server until %v", e.Reset.Format(time.RFC3339))
+}
+
+// newHTTPGet returns a getFunc which fetches resources over HTTP(S), retrying
+// transient failures with exponential backoff. Every attempt, including each
+// retry, waits for permission from the rate limiter if one is configured.
+//
+// The checkpoint is the only resource which is fetched repeatedly, so it is
+// requested conditionally on having changed since it was last fetched. If the
+// server reports that it hasn't, the previous checkpoint is returned.
+func newHTTPGet(o options) getFunc {
+	cpCond := &conditional{}
+	return func(ctx context.Context, u *url.URL) ([]byte, error) {
+		var cond *conditional
+		if path.Base(u.Path) == layout.CheckpointPath {
+			cond = cpCond
+		}
+		readOnce := rateLimited(o.limiter, func(ctx context.Context, u *url.URL) ([]byte, error) {
+			return readHTTPOnce(ctx, o.httpClient, u, cond)
+		})
+		backoff := o.initialBackoff
+		for attempt := 0; ; attempt++ {
+			body, err := readOnce(ctx, u)
+			var rErr retryableError
+			if err == nil || !errors.As(err, &rErr) || attempt >= o.maxRetries || ctx.Err() != nil {
+				return body, err
+			}
+			d := backoff
+			if rErr.after > 0 {
+				if rErr.after > o.maxRetryAfter {
+					return nil, fmt.Errorf("server requested retry after %v: %w", rErr.after, err)
+				}
+				d = rErr.after
+			}
+			backoff *= 2
+			if backoff > o.maxBackoff {
+				backoff = o.maxBackoff
+			}
+			logging.V(1).Infof("Fetching %q failed (%v), retrying after %v", u, err, d)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(d):
+			}
+		}
+	}
+}
+
+// readHTTPOnce makes a single attempt at fetching the resource at u using c.
+// If cond is not nil, the request is made conditional on the resource having
+// changed since the response which cond last recorded.
+func readHTTPOnce(ctx context.Context, c *http.Client, u *url.URL, cond *conditional) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cond != nil {
+		cond.addHeaders(req)
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == 200:
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, retryableError{err: err}
+		}
+		if cond != nil {
+			cond.update(resp, b)
+		}
+		return b, nil
+	case resp.StatusCode == http.StatusNotModified && cond != nil:
+		return cond.notModified()
+	case resp.StatusCode == 404:
+		return nil, os.ErrNotExist
+	case resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+		reset := rateLimitReset(resp)
+		var after time.Duration
+		if !reset.IsZero() {
+			// Wait at least a second, in case our clock is a little ahead of the server's.
+			after = max(time.Until(reset), time.Second)
+		}
+		return nil, retryableError{err: ErrRateLimited{Reset: reset}, after: after}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, retryableError{
+			err:   fmt.Errorf("failed to fetch url: %s", resp.Status),
+			after: retryAfter(resp),
+		}
+	default:
+		return nil, fmt.Errorf("failed to fetch url: %s", resp.Status)
+	}
+}
+
+// conditional holds the validators from the last successful response for a
+// resource, so that it can be requested again only if it has changed.
+type conditional struct {
+	mu           sync.Mutex
+	body         []byte
+	etag         string
+	lastModified string
+}
+
+// addHeaders makes req conditional on the resource having changed since the last
+// recorded response, if there is one.
+func (c *conditional) addHeaders(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.body == nil {
+		return
+	}
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+	if c.lastModified != "" {
+		req.Header.Set("If-Modified-Since", c.lastModified)
+	}
+}
+
+// update records the body and validators of a successful response.
+func (c *conditional) update(resp *http.Response, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body = bytes.Clone(body)
+	c.etag = resp.Header.Get("ETag")
+	c.lastModified = resp.Header.Get("Last-Modified")
+}
+
+// notModified returns the body of the last recorded response, for when the server
+// reports that the resource hasn't changed since.
+func (c *conditional) notModified() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.body == nil {
+		return nil, errors.New("failed to fetch url: got 304 Not Modified for unconditional request")
+	}
+	return bytes.Clone(c.body), nil
+}
+
+// retryAfter returns the duration the server has asked us to wait before retrying
+// the request which resulted in resp, or zero if it didn't specify one.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// rateLimitReset returns the time at which the server's rate limit for the request
+// which resulted in resp will be reset, or the zero time if it didn't specify one.
+func rateLimitReset(resp *http.Response) time.Time {
+	s, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || s <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(s, 0)
+}
+
+// readFile reads the file at the path of the given URL.
+func readFile(_ context.Context, u *url.URL) ([]byte, error) {
+	b, err := os.ReadFile(u.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, os.ErrNotExist
+	}
+	return b, err
+}
@@ -0,0 +1,445 @@
+// Copyright 2021 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetcherRetryAfter(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("checkpoint"))
+	}))
+	defer s.Close()
+
+	root, err := url.Parse(s.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	f, err := New(root, WithRetries(3, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, err := f(context.Background(), "checkpoint")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if string(got) != "checkpoint" {
+		t.Errorf("Got %q, want %q", got, "checkpoint")
+	}
+	if calls != 2 {
+		t.Errorf("Got %d requests, want 2", calls)
+	}
+}
+
+func TestFetcherNotFound(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	for _, root := range []string{s.URL + "/", "file://" + t.TempDir() + "/"} {
+		t.Run(root, func(t *testing.T) {
+			u, err := url.Parse(root)
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+			f, err := New(u)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if _, err := f(context.Background(), "checkpoint"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Got err %v, want %v", err, os.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestFetcherRetries(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		failures  int
+		status    int
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			desc:      "transient 5xx",
+			failures:  2,
+			status:    http.StatusInternalServerError,
+			wantCalls: 3,
+		}, {
+			desc:      "persistent 5xx",
+			failures:  10,
+			status:    http.StatusBadGateway,
+			wantCalls: 4,
+			wantErr:   true,
+		}, {
+			desc:      "404 is not retried",
+			failures:  10,
+			status:    http.StatusNotFound,
+			wantCalls: 1,
+			wantErr:   true,
+		}, {
+			desc:      "other 4xx is not retried",
+			failures:  10,
+			status:    http.StatusForbidden,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			calls := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls <= test.failures {
+					w.WriteHeader(test.status)
+					return
+				}
+				_, _ = w.Write([]byte("checkpoint"))
+			}))
+			defer s.Close()
+
+			root, err := url.Parse(s.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+			f, err := New(root, WithRetries(3, time.Millisecond, 2*time.Millisecond))
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			_, err = f(context.Background(), "checkpoint")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+			if calls != test.wantCalls {
+				t.Errorf("Got %d requests, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFetcherRateLimited(t *testing.T) {
+	reset := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	soon := time.Now().Add(time.Second).Truncate(time.Second)
+	for _, test := range []struct {
+		desc          string
+		reset         string
+		maxRetryAfter time.Duration
+		wantCalls     int
+		wantReset     time.Time
+		wantErr       bool
+	}{
+		{
+			desc:      "no reset time",
+			wantCalls: 2,
+		}, {
+			desc:      "reset within window",
+			reset:     strconv.FormatInt(soon.Unix(), 10),
+			wantCalls: 2,
+		}, {
+			desc:      "reset too far away",
+			reset:     strconv.FormatInt(reset.Unix(), 10),
+			wantCalls: 1,
+			wantReset: reset,
+			wantErr:   true,
+		}, {
+			desc:          "reset beyond configured window",
+			reset:         strconv.FormatInt(reset.Unix(), 10),
+			maxRetryAfter: time.Minute,
+			wantCalls:     1,
+			wantReset:     reset,
+			wantErr:       true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			calls := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("X-RateLimit-Remaining", "0")
+					if test.reset != "" {
+						w.Header().Set("X-RateLimit-Reset", test.reset)
+					}
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				_, _ = w.Write([]byte("checkpoint"))
+			}))
+			defer s.Close()
+
+			root, err := url.Parse(s.URL + "/")
+			if err != nil {
+				t.Fatalf("Failed to parse URL: %v", err)
+			}
+			opts := []Option{WithRetries(3, time.Millisecond, time.Millisecond)}
+			if test.maxRetryAfter > 0 {
+				opts = append(opts, WithMaxRetryAfter(test.maxRetryAfter))
+			}
+			f, err := New(root, opts...)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			_, err = f(context.Background(), "checkpoint")
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("wantErr: %v, but got: %v", test.wantErr, err)
+			}
+			if calls != test.wantCalls {
+				t.Errorf("Got %d requests, want %d", calls, test.wantCalls)
+			}
+			if !test.wantErr {
+				return
+			}
+			var rErr ErrRateLimited
+			if !errors.As(err, &rErr) {
+				t.Fatalf("Got err %v, want ErrRateLimited", err)
+			}
+			if !rErr.Reset.Equal(test.wantReset) {
+				t.Errorf("Got reset %v, want %v", rErr.Reset, test.wantReset)
+			}
+		})
+	}
+}
+
+func TestFetcherHTTPClient(t *testing.T) {
+	block := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer s.Close()
+	defer close(block)
+
+	root, err := url.Parse(s.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	c := &http.Client{Timeout: 10 * time.Millisecond}
+	f, err := New(root, WithHTTPClient(c), WithRetries(0, 0, 0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := f(context.Background(), "checkpoint"); err == nil {
+		t.Fatal("Fetch from unresponsive server succeeded, want timeout")
+	}
+}
+
+func TestFetcherProxy(t *testing.T) {
+	var gotURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.String()
+		_, _ = w.Write([]byte("checkpoint"))
+	}))
+	defer proxy.Close()
+
+	// The log's host doesn't exist, so the request can only succeed via the proxy.
+	root, err := url.Parse("http://log.invalid/log/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	f, err := New(root, WithProxy(proxy.URL), WithRetries(0, 0, 0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, err := f(context.Background(), "checkpoint")
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if string(got) != "checkpoint" {
+		t.Errorf("Got %q, want %q", got, "checkpoint")
+	}
+	if want := "http://log.invalid/log/checkpoint"; gotURL != want {
+		t.Errorf("Proxy got request for %q, want %q", gotURL, want)
+	}
+
+	if _, err := New(root, WithProxy("not a proxy")); err == nil {
+		t.Error("New with invalid proxy succeeded, want error")
+	}
+}
+
+func TestFetcherRateLimit(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte("leaf"))
+	}))
+	defer s.Close()
+
+	root, err := url.Parse(s.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	const rps = 50
+	f, err := New(root, WithRateLimit(rps))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := f(context.Background(), "leaf"); err != nil {
+					t.Errorf("Fetch failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// The first request is allowed immediately, the rest must wait their turn.
+	n := atomic.LoadInt32(&calls)
+	if min := time.Duration(n-1) * time.Second / rps; elapsed < min {
+		t.Errorf("%d requests took %v, want at least %v", n, elapsed, min)
+	}
+}
+
+func TestFetcherRateLimitRetries(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 5 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("leaf"))
+	}))
+	defer s.Close()
+
+	root, err := url.Parse(s.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	const rps = 50
+	f, err := New(root, WithRateLimit(rps), WithRetries(5, 0, 0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := f(context.Background(), "leaf"); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	// Retries are requests too, so they must each wait their turn.
+	n := atomic.LoadInt32(&calls)
+	if n != 5 {
+		t.Errorf("Got %d requests, want 5", n)
+	}
+	if min := time.Duration(n-1) * time.Second / rps; elapsed < min {
+		t.Errorf("%d requests took %v, want at least %v", n, elapsed, min)
+	}
+}
+
+func TestFetcherRateLimitCancelled(t *testing.T) {
+	root, err := url.Parse("file://" + t.TempDir() + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	f, err := New(root, WithRateLimit(0.001))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Use up the only token.
+	_, _ = f(context.Background(), "checkpoint")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f(ctx, "checkpoint"); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Got err %v, want error from cancelled wait", err)
+	}
+}
+
+func TestFetcherConditionalCheckpoint(t *testing.T) {
+	cp, etag := "checkpoint 1", `"1"`
+	var notModified, leafConditional int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inm := r.Header.Get("If-None-Match")
+		if r.URL.Path != "/checkpoint" {
+			if inm != "" {
+				leafConditional++
+			}
+			w.Header().Set("ETag", `"leaf"`)
+			_, _ = w.Write([]byte("leaf"))
+			return
+		}
+		if inm == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(cp))
+	}))
+	defer s.Close()
+
+	root, err := url.Parse(s.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	f, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	fetch := func(p, want string) {
+		t.Helper()
+		got, err := f(context.Background(), p)
+		if err != nil {
+			t.Fatalf("Fetch %q: %v", p, err)
+		}
+		if string(got) != want {
+			t.Errorf("Fetch %q: got %q, want %q", p, got, want)
+		}
+	}
+
+	fetch("checkpoint", "checkpoint 1")
+	fetch("checkpoint", "checkpoint 1")
+	fetch("checkpoint", "checkpoint 1")
+	if notModified != 2 {
+		t.Errorf("Got %d Not Modified responses, want 2", notModified)
+	}
+
+	cp, etag = "checkpoint 2", `"2"`
+	fetch("checkpoint", "checkpoint 2")
+	fetch("checkpoint", "checkpoint 2")
+	if notModified != 3 {
+		t.Errorf("Got %d Not Modified responses, want 3", notModified)
+	}
+
+	// Only the checkpoint is fetched conditionally.
+	fetch("leaf", "leaf")
+	fetch("leaf", "leaf")
+	if leafConditional != 0 {
+		t.Errorf("Got %d conditional requests for leaf, want 0", leafConditional)
+	}
+}
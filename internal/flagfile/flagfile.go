@@ -0,0 +1,107 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flagfile sets command line flags from a YAML or JSON configuration file,
+// so that deployments with many flags can be described declaratively.
+package flagfile
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FlagName is the conventional name of the flag which names the configuration file.
+const FlagName = "config"
+
+// FlagUsage is the usage string for the flag which names the configuration file.
+const FlagUsage = "If set, path to a YAML or JSON file whose top level keys are flag names, without the leading dashes, and whose values set those flags. Flags given on the command line override the file"
+
+// Load reads the named file, and sets the flags in fs from it as described on Apply.
+func Load(fs *flag.FlagSet, name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := Apply(fs, b); err != nil {
+		return fmt.Errorf("invalid config file %q: %v", name, err)
+	}
+	return nil
+}
+
+// Apply sets the flags in fs from b, which is a YAML or JSON object whose keys are
+// flag names. Flags which have already been set, such as on the command line, are
+// left unchanged so that they take precedence over the file. A list value sets
+// the flag to its elements joined by commas.
+//
+// It is an error for the object to name a flag which doesn't exist, or FlagName
+// itself, as config files can't include one another.
+func Apply(fs *flag.FlagSet, b []byte) error {
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("failed to parse: %v", err)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// Apply the values in a stable order, so that errors are reproducible.
+	names := make([]string, 0, len(values))
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if n == FlagName || fs.Lookup(n) == nil {
+			return fmt.Errorf("unknown flag %q", n)
+		}
+		if set[n] {
+			continue
+		}
+		v, err := flagValue(values[n])
+		if err != nil {
+			return fmt.Errorf("flag %q: %v", n, err)
+		}
+		if err := fs.Set(n, v); err != nil {
+			return fmt.Errorf("flag %q: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// flagValue returns the string form of a value parsed from the config file, as it
+// would be given on the command line.
+func flagValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+	case map[string]any:
+		return "", fmt.Errorf("objects are not supported")
+	case []any:
+		elems := make([]string, 0, len(v))
+		for _, e := range v {
+			s, err := flagValue(e)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, s)
+		}
+		return strings.Join(elems, ","), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
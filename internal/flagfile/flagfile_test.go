@@ -0,0 +1,138 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flagfile
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testFlags holds the values of the flags in a FlagSet created by newFlagSet.
+type testFlags struct {
+	URL       string
+	Interval  time.Duration
+	Once      bool
+	Jitter    float64
+	Retries   int
+	Artifacts string
+}
+
+func newFlagSet() (*flag.FlagSet, *testFlags) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := &testFlags{}
+	fs.StringVar(&f.URL, "log_url", "https://default/", "")
+	fs.DurationVar(&f.Interval, "poll_interval", time.Minute, "")
+	fs.BoolVar(&f.Once, "once", false, "")
+	fs.Float64Var(&f.Jitter, "poll_jitter", 0, "")
+	fs.IntVar(&f.Retries, "fetch_retries", 5, "")
+	fs.StringVar(&f.Artifacts, "verify_artifacts", "armory-drive.imx", "")
+	fs.String(FlagName, "", FlagUsage)
+	return fs, f
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		args    []string
+		config  string
+		want    testFlags
+		wantErr bool
+	}{
+		{
+			desc: "YAML",
+			config: `
+log_url: https://example.com/log/
+poll_interval: 30s
+once: true
+poll_jitter: 0.1
+fetch_retries: 3
+verify_artifacts: [armory-drive.imx, armory-drive.csf]
+`,
+			want: testFlags{URL: "https://example.com/log/", Interval: 30 * time.Second, Once: true, Jitter: 0.1, Retries: 3, Artifacts: "armory-drive.imx,armory-drive.csf"},
+		}, {
+			desc:   "JSON",
+			config: `{"log_url": "https://example.com/log/", "once": true, "fetch_retries": 3}`,
+			want:   testFlags{URL: "https://example.com/log/", Interval: time.Minute, Once: true, Retries: 3, Artifacts: "armory-drive.imx"},
+		}, {
+			desc:   "command line overrides file",
+			args:   []string{"--log_url=https://flag/", "--once=false"},
+			config: "log_url: https://example.com/log/\nonce: true\n",
+			want:   testFlags{URL: "https://flag/", Interval: time.Minute, Retries: 5, Artifacts: "armory-drive.imx"},
+		}, {
+			desc:   "empty",
+			config: "",
+			want:   testFlags{URL: "https://default/", Interval: time.Minute, Retries: 5, Artifacts: "armory-drive.imx"},
+		}, {
+			desc:    "unknown flag",
+			config:  "log_uri: https://example.com/log/\n",
+			wantErr: true,
+		}, {
+			desc:    "nested config",
+			config:  "config: other.yaml\n",
+			wantErr: true,
+		}, {
+			desc:    "invalid value",
+			config:  "poll_interval: soon\n",
+			wantErr: true,
+		}, {
+			desc:    "object value",
+			config:  "log_url: {host: example.com}\n",
+			wantErr: true,
+		}, {
+			desc:    "not an object",
+			config:  "- log_url\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			fs, got := newFlagSet()
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			err := Apply(fs, []byte(test.config))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Apply: %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(test.want, *got); diff != "" {
+				t.Errorf("Apply: got unexpected flags, diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "monitor.yaml")
+	if err := os.WriteFile(name, []byte("once: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, got := newFlagSet()
+	if err := Load(fs, name); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !got.Once {
+		t.Error("Load: --once not set")
+	}
+	if err := Load(fs, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Load of missing file: got no error")
+	}
+}
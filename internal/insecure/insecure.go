@@ -0,0 +1,77 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package insecure allows the signatures on releases to be ignored, which is only
+// ever useful when developing against a test log whose release signing key is not
+// to hand. It must never be used to check real releases.
+package insecure
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/usbarmory/armory-drive-log/internal/logging"
+	"golang.org/x/mod/sumdb/note"
+)
+
+const (
+	// SkipSignatureFlag is the name of the flag which enables skipping release
+	// signature verification.
+	SkipSignatureFlag = "insecure_skip_signature"
+	// SkipSignatureUsage is the usage string for SkipSignatureFlag.
+	SkipSignatureUsage = "DEVELOPMENT ONLY: accept releases signed by any key, even with an invalid signature. Requires --" + AcknowledgeFlag
+	// AcknowledgeFlag is the name of the flag which must also be set for
+	// SkipSignatureFlag to take effect.
+	AcknowledgeFlag = "i_understand_this_is_insecure"
+	// AcknowledgeUsage is the usage string for AcknowledgeFlag.
+	AcknowledgeUsage = "Must be set to use --" + SkipSignatureFlag
+)
+
+// Check returns an error if skipSignature is set without acknowledged. If both
+// are set, a warning is logged.
+func Check(skipSignature, acknowledged bool) error {
+	if !skipSignature {
+		return nil
+	}
+	if !acknowledged {
+		return fmt.Errorf("--%s disables release signature verification, so also requires --%s", SkipSignatureFlag, AcknowledgeFlag)
+	}
+	logging.Warningf("INSECURE: --%s is set, release signatures are NOT being verified. Never use this with a real log.", SkipSignatureFlag)
+	return nil
+}
+
+// Verifiers returns note verifiers which accept any signature from any key.
+func Verifiers() note.Verifiers {
+	return anyKey{}
+}
+
+// anyKey is a note.Verifiers which returns a verifier for every key.
+type anyKey struct{}
+
+func (anyKey) Verifier(name string, hash uint32) (note.Verifier, error) {
+	if name == "" {
+		return nil, errors.New("empty key name")
+	}
+	return anySig{name: name, hash: hash}, nil
+}
+
+// anySig is a note.Verifier which accepts every signature.
+type anySig struct {
+	name string
+	hash uint32
+}
+
+func (v anySig) Name() string            { return v.name }
+func (v anySig) KeyHash() uint32         { return v.hash }
+func (v anySig) Verify(_, _ []byte) bool { return true }
@@ -0,0 +1,68 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package insecure
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestCheck(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		skip, ack bool
+		wantErr   bool
+	}{
+		{desc: "disabled"},
+		{desc: "acknowledged only", ack: true},
+		{desc: "skip without acknowledgement", skip: true, wantErr: true},
+		{desc: "skip acknowledged", skip: true, ack: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if err := Check(test.skip, test.ack); (err != nil) != test.wantErr {
+				t.Errorf("Check(%t, %t) = %v, wantErr %t", test.skip, test.ack, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifiers(t *testing.T) {
+	skey, _, err := note.GenerateKey(rand.Reader, "unknown-key")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	msg, err := note.Sign(&note.Note{Text: "release\n"}, s)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	n, err := note.Open(msg, Verifiers())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got, want := len(n.Sigs), 1; got != want {
+		t.Errorf("Got %d signatures, want %d", got, want)
+	}
+	// A note must still carry a signature to be opened.
+	if _, err := note.Open([]byte("release\n\n"), Verifiers()); err == nil {
+		t.Error("Open of unsigned note: got no error")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging lets the tools log either through glog, or as JSON objects via
+// log/slog for consumption by log aggregation pipelines.
+//
+// The logging functions take a message followed by alternating keys and values,
+// as for slog. With glog, the pairs are appended to the message as key=value.
+// Printf style variants are provided for messages without structured context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// FormatGlog logs through glog, honouring its flags. This is the default.
+	FormatGlog = "glog"
+	// FormatJSON logs one JSON object per line to stderr.
+	FormatJSON = "json"
+)
+
+// FlagUsage is the usage string for the --log_format flag registered by the tools.
+const FlagUsage = "Log format, either glog or json. The json format writes one JSON object per line to stderr, with structured fields"
+
+// logger is used to log when the format is FormatJSON, and is nil otherwise.
+var logger *slog.Logger
+
+// exit is called after logging by Exit and Exitf in FormatJSON mode.
+var exit = os.Exit
+
+// Init sets the log format, which must be one of FormatGlog or FormatJSON.
+// It should be called once, after flags have been parsed.
+func Init(format string) error {
+	return initWriter(format, os.Stderr)
+}
+
+func initWriter(format string, w io.Writer) error {
+	switch format {
+	case FormatGlog, "":
+		logger = nil
+	case FormatJSON:
+		// Verbose logs are emitted at debug level, subject to glog's -v flag.
+		logger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	default:
+		return fmt.Errorf("unknown log format %q, want %q or %q", format, FormatGlog, FormatJSON)
+	}
+	return nil
+}
+
+// Info logs msg with the given key/value pairs at info level.
+func Info(msg string, args ...any) {
+	output(slog.LevelInfo, msg, args)
+}
+
+// Infof logs a formatted message at info level.
+func Infof(format string, args ...any) {
+	output(slog.LevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+// Warning logs msg with the given key/value pairs at warning level.
+func Warning(msg string, args ...any) {
+	output(slog.LevelWarn, msg, args)
+}
+
+// Warningf logs a formatted message at warning level.
+func Warningf(format string, args ...any) {
+	output(slog.LevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+// Error logs msg with the given key/value pairs at error level.
+func Error(msg string, args ...any) {
+	output(slog.LevelError, msg, args)
+}
+
+// Errorf logs a formatted message at error level.
+func Errorf(format string, args ...any) {
+	output(slog.LevelError, fmt.Sprintf(format, args...), nil)
+}
+
+// Exit logs msg with the given key/value pairs at error level, and then exits
+// with status 1.
+func Exit(msg string, args ...any) {
+	output(levelExit, msg, args)
+}
+
+// Exitf logs a formatted message at error level, and then exits with status 1.
+func Exitf(format string, args ...any) {
+	output(levelExit, fmt.Sprintf(format, args...), nil)
+}
+
+// Verbose is returned by V, and logs only if verbose logging at the requested
+// level is enabled.
+type Verbose bool
+
+// V reports whether verbose logging at the given level is enabled by glog's -v
+// and -vmodule flags.
+func V(level glog.Level) Verbose {
+	return Verbose(glog.VDepth(1, level))
+}
+
+// Info logs msg with the given key/value pairs if v is enabled. Verbose logs are
+// emitted at debug level in FormatJSON mode.
+func (v Verbose) Info(msg string, args ...any) {
+	if v {
+		output(slog.LevelDebug, msg, args)
+	}
+}
+
+// Infof logs a formatted message if v is enabled.
+func (v Verbose) Infof(format string, args ...any) {
+	if v {
+		output(slog.LevelDebug, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+// levelExit is the level passed to output by Exit and Exitf. It is logged as an
+// error.
+const levelExit = slog.LevelError + 1
+
+// output logs msg and args at the given level. It must be called directly by the
+// exported logging functions, so that glog attributes the log to their caller.
+func output(level slog.Level, msg string, args []any) {
+	if logger != nil {
+		l := level
+		if l == levelExit {
+			l = slog.LevelError
+		}
+		logger.Log(context.Background(), l, msg, args...)
+		if level == levelExit {
+			exit(1)
+		}
+		return
+	}
+	const depth = 2
+	t := text(msg, args)
+	switch level {
+	case slog.LevelDebug, slog.LevelInfo:
+		glog.InfoDepth(depth, t)
+	case slog.LevelWarn:
+		glog.WarningDepth(depth, t)
+	case slog.LevelError:
+		glog.ErrorDepth(depth, t)
+	case levelExit:
+		glog.ExitDepth(depth, t)
+	}
+}
+
+// text formats msg and the key/value pairs in args for glog.
+func text(msg string, args []any) string {
+	if len(args) == 0 {
+		return msg
+	}
+	b := &strings.Builder{}
+	b.WriteString(msg)
+	r := slog.NewRecord(time.Time{}, slog.LevelInfo, "", 0)
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(b, " %s=%s", a.Key, value(a.Value))
+		return true
+	})
+	return b.String()
+}
+
+// value formats v for glog: strings are quoted if needed, and byte slices are
+// hex encoded.
+func value(v slog.Value) string {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		s := v.String()
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			return fmt.Sprintf("%q", s)
+		}
+		return s
+	case slog.KindAny:
+		if b, ok := v.Any().([]byte); ok {
+			return fmt.Sprintf("%x", b)
+		}
+	}
+	return v.String()
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInit(t *testing.T) {
+	defer func() { logger = nil }()
+	for _, test := range []struct {
+		format   string
+		wantJSON bool
+		wantErr  bool
+	}{
+		{format: ""},
+		{format: FormatGlog},
+		{format: FormatJSON, wantJSON: true},
+		{format: "text", wantErr: true},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			err := Init(test.format)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Init(%q): %v, wantErr %t", test.format, err, test.wantErr)
+			}
+			if err == nil && (logger != nil) != test.wantJSON {
+				t.Errorf("Init(%q): got JSON logger %t, want %t", test.format, logger != nil, test.wantJSON)
+			}
+		})
+	}
+}
+
+func TestText(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		msg  string
+		args []any
+		want string
+	}{
+		{
+			desc: "no args",
+			msg:  "Verified log",
+			want: "Verified log",
+		}, {
+			desc: "fields",
+			msg:  "Verified log",
+			args: []any{"tree_size", 42, "revision", "v1.0.0"},
+			want: "Verified log tree_size=42 revision=v1.0.0",
+		}, {
+			desc: "quoted string",
+			msg:  "Failed",
+			args: []any{"error", errors.New("bad thing").Error(), "platform", ""},
+			want: `Failed error="bad thing" platform=""`,
+		}, {
+			desc: "hash",
+			msg:  "Leaf",
+			args: []any{"sha256", []byte{0xde, 0xad}},
+			want: "Leaf sha256=dead",
+		}, {
+			desc: "missing key",
+			msg:  "Leaf",
+			args: []any{42},
+			want: "Leaf !BADKEY=42",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := text(test.msg, test.args); got != test.want {
+				t.Errorf("text: got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	oldExit := exit
+	defer func() { logger, exit = nil, oldExit }()
+	b := &bytes.Buffer{}
+	if err := initWriter(FormatJSON, b); err != nil {
+		t.Fatalf("initWriter: %v", err)
+	}
+	exitCode := -1
+	exit = func(code int) { exitCode = code }
+
+	Info("Found leaf", "index", 3, "revision", "v1.0.0")
+	Warningf("Skipping leaf %d", 4)
+	V(0).Info("Polling", "tree_size", 5)
+	Exit("Failed", "error", "bad")
+
+	var got []map[string]any
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		delete(m, "time")
+		got = append(got, m)
+	}
+	want := []map[string]any{
+		{"level": "INFO", "msg": "Found leaf", "index": 3.0, "revision": "v1.0.0"},
+		{"level": "WARN", "msg": "Skipping leaf 4"},
+		{"level": "DEBUG", "msg": "Polling", "tree_size": 5.0},
+		{"level": "ERROR", "msg": "Failed", "error": "bad"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Got unexpected logs, diff: %s", diff)
+	}
+	if exitCode != 1 {
+		t.Errorf("Exit: got exit code %d, want 1", exitCode)
+	}
+}
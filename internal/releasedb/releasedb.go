@@ -0,0 +1,192 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package releasedb stores the releases verified by the monitor in a local
+// database, so that they can be queried without replaying the log.
+package releasedb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// leavesBucket maps big-endian leaf indices to JSON encoded Records.
+	leavesBucket = []byte("leaves")
+	// revisionsBucket maps release revisions to JSON encoded lists of leaf indices.
+	revisionsBucket = []byte("revisions")
+)
+
+// lockTimeout is how long to wait for another process to release its lock on the
+// database before giving up.
+const lockTimeout = 10 * time.Second
+
+// Record describes a leaf which has been checked by the monitor.
+type Record struct {
+	// Index is the position of the leaf in the log.
+	Index uint64 `json:"index"`
+	// LeafHash is the leaf hash committed to by the log.
+	LeafHash []byte `json:"leaf_hash"`
+	// Release is the FirmwareRelease contained in the leaf.
+	Release api.FirmwareRelease `json:"release"`
+	// Verified is true if the release passed all of the checks made by the monitor,
+	// and false if its build could not be reproduced.
+	Verified bool `json:"verified"`
+}
+
+// DB is a database of Records.
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens the database at path, creating it if it does not exist.
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{leavesBucket, revisionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise %q: %v", path, err)
+	}
+	return &DB{db: db}, nil
+}
+
+// OpenReadOnly opens the existing database at path for reading. The database
+// can't be opened while a process has it open with Open.
+func OpenReadOnly(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0444, &bolt.Options{Timeout: lockTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %v", path, err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{leavesBucket, revisionsBucket} {
+			if tx.Bucket(b) == nil {
+				return fmt.Errorf("missing bucket %q", b)
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read %q: %v", path, err)
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Put stores r, replacing any existing Record for the same index. A Record whose
+// revision is empty, or too long to be a key, is stored but can't be found with
+// ByRevision.
+func (d *DB) Put(r Record) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %v", err)
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(leavesBucket).Put(indexKey(r.Index), v); err != nil {
+			return err
+		}
+		if !validRevisionKey(r.Release.Revision) {
+			return nil
+		}
+		revs := tx.Bucket(revisionsBucket)
+		var indices []uint64
+		if raw := revs.Get([]byte(r.Release.Revision)); raw != nil {
+			if err := json.Unmarshal(raw, &indices); err != nil {
+				return fmt.Errorf("corrupt index for revision %q: %v", r.Release.Revision, err)
+			}
+		}
+		for _, i := range indices {
+			if i == r.Index {
+				return nil
+			}
+		}
+		raw, err := json.Marshal(append(indices, r.Index))
+		if err != nil {
+			return err
+		}
+		return revs.Put([]byte(r.Release.Revision), raw)
+	})
+}
+
+// Get returns the Record for the leaf at index i, and whether one was found.
+func (d *DB) Get(i uint64) (Record, bool, error) {
+	var r Record
+	var found bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(leavesBucket).Get(indexKey(i))
+		if raw == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(raw, &r)
+	})
+	return r, found, err
+}
+
+// ByRevision returns the Records for all leaves containing a release with the
+// given revision, in the order in which they were stored.
+func (d *DB) ByRevision(rev string) ([]Record, error) {
+	if !validRevisionKey(rev) {
+		return nil, nil
+	}
+	var rs []Record
+	err := d.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(revisionsBucket).Get([]byte(rev))
+		if raw == nil {
+			return nil
+		}
+		var indices []uint64
+		if err := json.Unmarshal(raw, &indices); err != nil {
+			return fmt.Errorf("corrupt index for revision %q: %v", rev, err)
+		}
+		leaves := tx.Bucket(leavesBucket)
+		for _, i := range indices {
+			var r Record
+			if err := json.Unmarshal(leaves.Get(indexKey(i)), &r); err != nil {
+				return fmt.Errorf("corrupt record for leaf %d: %v", i, err)
+			}
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// indexKey returns the key under which the Record for leaf i is stored, which sorts
+// in the same order as the leaves.
+func indexKey(i uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, i)
+}
+
+// validRevisionKey returns true if rev can be used as a key in the revisions bucket.
+func validRevisionKey(rev string) bool {
+	return len(rev) > 0 && len(rev) <= bolt.MaxKeySize
+}
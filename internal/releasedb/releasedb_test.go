@@ -0,0 +1,126 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package releasedb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/usbarmory/armory-drive-log/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "releases.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	records := []Record{
+		{Index: 0, LeafHash: []byte("zero"), Release: api.FirmwareRelease{Revision: "v2021.09.22"}, Verified: true},
+		{Index: 1, LeafHash: []byte("one"), Release: api.FirmwareRelease{Revision: "v2021.10.08"}, Verified: false},
+		{Index: 2, LeafHash: []byte("two"), Release: api.FirmwareRelease{Revision: "v2021.09.22", PlatformID: "other"}, Verified: true},
+	}
+	for _, r := range records {
+		if err := db.Put(r); err != nil {
+			t.Fatalf("Put(%d): %v", r.Index, err)
+		}
+	}
+	// Storing a record again must not duplicate it in the revision index.
+	if err := db.Put(records[0]); err != nil {
+		t.Fatalf("Put(%d): %v", records[0].Index, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Reopen to check that the records were persisted.
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+
+	got, found, err := db.Get(1)
+	if err != nil || !found {
+		t.Fatalf("Get(1) = %v, %v", found, err)
+	}
+	if diff := cmp.Diff(records[1], got); diff != "" {
+		t.Errorf("Get(1) diff: %s", diff)
+	}
+	if _, found, err := db.Get(3); err != nil || found {
+		t.Errorf("Get(3) = %v, %v, want not found", found, err)
+	}
+
+	byRev, err := db.ByRevision("v2021.09.22")
+	if err != nil {
+		t.Fatalf("ByRevision: %v", err)
+	}
+	if diff := cmp.Diff([]Record{records[0], records[2]}, byRev); diff != "" {
+		t.Errorf("ByRevision diff: %s", diff)
+	}
+	if byRev, err := db.ByRevision("v2000.01.01"); err != nil || len(byRev) != 0 {
+		t.Errorf("ByRevision(unknown) = %v, %v, want none", byRev, err)
+	}
+}
+
+func TestDBRevisionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "releases.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	records := []Record{
+		{Index: 0, Release: api.FirmwareRelease{Revision: ""}},
+		{Index: 1, Release: api.FirmwareRelease{Revision: strings.Repeat("v", bolt.MaxKeySize+1)}},
+	}
+	for _, r := range records {
+		if err := db.Put(r); err != nil {
+			t.Fatalf("Put(%d): %v", r.Index, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	defer db.Close()
+	for _, r := range records {
+		got, found, err := db.Get(r.Index)
+		if err != nil || !found {
+			t.Fatalf("Get(%d) = %v, %v", r.Index, found, err)
+		}
+		if diff := cmp.Diff(r, got); diff != "" {
+			t.Errorf("Get(%d) diff: %s", r.Index, diff)
+		}
+		if byRev, err := db.ByRevision(r.Release.Revision); err != nil || len(byRev) != 0 {
+			t.Errorf("ByRevision(%d) = %v, %v, want none", r.Index, byRev, err)
+		}
+	}
+	if err := db.Put(Record{Index: 2}); err == nil {
+		t.Error("Put on read-only database succeeded, want error")
+	}
+}
+
+func TestOpenReadOnlyMissing(t *testing.T) {
+	if _, err := OpenReadOnly(filepath.Join(t.TempDir(), "releases.db")); err == nil {
+		t.Error("OpenReadOnly of missing database succeeded, want error")
+	}
+}
@@ -15,7 +15,13 @@
 // Package keys exposes the public verification keys needed to verify log data.
 package keys
 
-import _ "embed"
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+
+	"golang.org/x/mod/sumdb/note"
+)
 
 var (
 	//go:embed armory-drive-log.pub
@@ -23,3 +29,24 @@ var (
 	//go:embed armory-drive.pub
 	ArmoryDrivePub string
 )
+
+// Verifiers returns note verifiers constructed from each of the public keys in
+// this package, keyed by the name of the variable holding the key.
+// An error is returned if any of the keys fail to parse.
+func Verifiers() (map[string]note.Verifier, error) {
+	keys := map[string]string{
+		"ArmoryDriveLogPub": ArmoryDriveLogPub,
+		"ArmoryDrivePub":    ArmoryDrivePub,
+	}
+	r := make(map[string]note.Verifier, len(keys))
+	var errs []error
+	for name, k := range keys {
+		v, err := note.NewVerifier(k)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		r[name] = v
+	}
+	return r, errors.Join(errs...)
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"testing"
+)
+
+func TestVerifiers(t *testing.T) {
+	vs, err := Verifiers()
+	if err != nil {
+		t.Fatalf("Verifiers: %v", err)
+	}
+	for _, name := range []string{"ArmoryDriveLogPub", "ArmoryDrivePub"} {
+		if vs[name] == nil {
+			t.Errorf("No verifier for %s", name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"context"
+	"os"
+
+	"github.com/transparency-dev/serverless-log/client"
+)
+
+// MapFetcher returns a fetcher which serves the contents of m, keyed by path
+// relative to the log root, e.g. "checkpoint" or "tile/0/000". As with the
+// fetchers used against real logs, paths which are not present are reported as
+// os.ErrNotExist.
+//
+// The map is read on every fetch, so tests may change its contents between
+// fetches, for example to simulate the log growing.
+func MapFetcher(m map[string][]byte) client.Fetcher {
+	return func(ctx context.Context, p string) ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b, ok := m[p]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return b, nil
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides test doubles for the log, so that code built on this
+// module, including the steps of creating, logging, bundling and verifying a
+// release, can be tested without making HTTP requests.
+package testutil
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/transparency-dev/serverless-log/client"
+	"github.com/transparency-dev/serverless-log/pkg/log"
+	"github.com/transparency-dev/serverless-log/testonly"
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive-log/api/verify"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Origin is the origin line of the checkpoints issued by test logs.
+const Origin = "Test Log"
+
+// Log is an in-memory log, with freshly generated keys for signing its checkpoints
+// and the releases added to it.
+type Log struct {
+	// LogSigner signs the log's checkpoints, and LogVerifier verifies them.
+	LogSigner   note.Signer
+	LogVerifier note.Verifier
+	// LogKey is the verifier key for LogVerifier.
+	LogKey string
+
+	// ReleaseSigner signs the releases added with AddReleases, and ReleaseVerifier
+	// verifies them. ReleaseSigner may be replaced to simulate rotating the key.
+	ReleaseSigner   note.Signer
+	ReleaseVerifier note.Verifier
+	// ReleaseKey is the verifier key for ReleaseVerifier.
+	ReleaseKey string
+
+	t       testing.TB
+	storage *testonly.MemStorage
+	size    uint64
+	cpRaw   []byte
+}
+
+// New returns an empty log.
+func New(t testing.TB) *Log {
+	t.Helper()
+	l := &Log{t: t, storage: testonly.NewMemStorage()}
+	l.LogSigner, l.LogVerifier, l.LogKey = GenerateKey(t, "log")
+	l.ReleaseSigner, l.ReleaseVerifier, l.ReleaseKey = GenerateKey(t, "release")
+	return l
+}
+
+// GenerateKey returns a new note signer and its verifier, along with the verifier
+// key which can be passed to note.NewVerifier.
+func GenerateKey(t testing.TB, name string) (note.Signer, note.Verifier, string) {
+	t.Helper()
+	priv, pub, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(priv)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	v, err := note.NewVerifier(pub)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return s, v, pub
+}
+
+// SignRelease returns the release's canonical JSON signed by ReleaseSigner, as
+// created by the create_release tool.
+func (l *Log) SignRelease(fr api.FirmwareRelease) []byte {
+	l.t.Helper()
+	frRaw, err := fr.CanonicalJSON()
+	if err != nil {
+		l.t.Fatalf("CanonicalJSON: %v", err)
+	}
+	n, err := note.Sign(&note.Note{Text: string(frRaw) + "\n"}, l.ReleaseSigner)
+	if err != nil {
+		l.t.Fatalf("Sign: %v", err)
+	}
+	return n
+}
+
+// AddReleases adds signed releases with the given revisions to the log, and
+// returns the signed checkpoint which commits to them.
+func (l *Log) AddReleases(revisions ...string) []byte {
+	l.t.Helper()
+	leaves := make([][]byte, 0, len(revisions))
+	for _, rev := range revisions {
+		leaves = append(leaves, l.SignRelease(api.FirmwareRelease{Revision: rev}))
+	}
+	return l.Add(leaves...)
+}
+
+// Add sequences the leaves, integrates them into the log, and returns the new
+// signed checkpoint.
+func (l *Log) Add(leaves ...[]byte) []byte {
+	l.t.Helper()
+	ctx := context.Background()
+	h := verify.Hasher()
+	for _, leaf := range leaves {
+		if _, err := l.storage.Sequence(ctx, h.HashLeaf(leaf), leaf); err != nil {
+			l.t.Fatalf("Sequence: %v", err)
+		}
+	}
+	cp, err := log.Integrate(ctx, l.size, l.storage, h)
+	if err != nil {
+		l.t.Fatalf("Integrate: %v", err)
+	}
+	cp.Origin = Origin
+	cpRaw, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, l.LogSigner)
+	if err != nil {
+		l.t.Fatalf("Sign: %v", err)
+	}
+	if err := l.storage.WriteCheckpoint(ctx, cpRaw); err != nil {
+		l.t.Fatalf("WriteCheckpoint: %v", err)
+	}
+	l.size, l.cpRaw = cp.Size, cpRaw
+	return cpRaw
+}
+
+// Checkpoint returns the log's latest signed checkpoint.
+func (l *Log) Checkpoint() []byte {
+	return l.cpRaw
+}
+
+// Fetcher returns a fetcher which reads from the log.
+func (l *Log) Fetcher() client.Fetcher {
+	return l.storage.Fetcher()
+}
+
+// StateTracker returns a state tracker for the log which trusts its latest
+// checkpoint.
+func (l *Log) StateTracker() client.LogStateTracker {
+	l.t.Helper()
+	f := l.Fetcher()
+	st, err := client.NewLogStateTracker(context.Background(), f, verify.Hasher(), nil, l.LogVerifier, Origin, client.UnilateralConsensus(f))
+	if err != nil {
+		l.t.Fatalf("NewLogStateTracker: %v", err)
+	}
+	return st
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Project Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"github.com/transparency-dev/serverless-log/client"
+)
+
+func TestMapFetcher(t *testing.T) {
+	m := map[string][]byte{"checkpoint": []byte("first")}
+	f := MapFetcher(m)
+	ctx := context.Background()
+
+	if got, err := f(ctx, "checkpoint"); err != nil || string(got) != "first" {
+		t.Errorf("Fetch: got (%q, %v), want first", got, err)
+	}
+	m["checkpoint"] = []byte("second")
+	if got, err := f(ctx, "checkpoint"); err != nil || string(got) != "second" {
+		t.Errorf("Fetch after update: got (%q, %v), want second", got, err)
+	}
+	if _, err := f(ctx, "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Fetch missing: got %v, want %v", err, os.ErrNotExist)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := f(cctx, "checkpoint"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Fetch with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLog(t *testing.T) {
+	l := New(t)
+	cp := l.AddReleases("v1", "v2")
+	if !bytes.Equal(cp, l.Checkpoint()) {
+		t.Errorf("AddReleases returned %q, but Checkpoint is %q", cp, l.Checkpoint())
+	}
+
+	// A fetcher built from the log's contents behaves like the log's own fetcher.
+	ctx := context.Background()
+	m := map[string][]byte{layout.CheckpointPath: cp}
+	for i := uint64(0); i < 2; i++ {
+		leaf, err := client.GetLeaf(ctx, l.Fetcher(), i)
+		if err != nil {
+			t.Fatalf("GetLeaf(%d): %v", i, err)
+		}
+		dir, file := layout.SeqPath("", i)
+		m[dir+"/"+file] = leaf
+	}
+	st := l.StateTracker()
+	if got, want := st.LatestConsistent.Size, uint64(2); got != want {
+		t.Errorf("Got checkpoint size %d, want %d", got, want)
+	}
+	for i := uint64(0); i < 2; i++ {
+		got, err := client.GetLeaf(ctx, MapFetcher(m), i)
+		if err != nil {
+			t.Fatalf("GetLeaf(%d) from map: %v", i, err)
+		}
+		want, _ := client.GetLeaf(ctx, l.Fetcher(), i)
+		if !bytes.Equal(got, want) {
+			t.Errorf("Leaf %d differs between fetchers", i)
+		}
+	}
+}